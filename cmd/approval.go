@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/go-johnnyhe/shadow/internal/client"
+	"github.com/go-johnnyhe/shadow/internal/ui"
+)
+
+type approvalCommand struct {
+	action string
+	id     int
+	all    bool
+}
+
+// parseApprovalCommand reads one review command. Terminal input looks like
+// "approve 3", "reject all", "allow 2" or "list"; in JSON mode each line is
+// an object such as {"command":"approve","proposal_id":3},
+// {"command":"reject","all":true} or {"command":"deny","run_id":2}.
+func parseApprovalCommand(line string, jsonMode bool) (approvalCommand, error) {
+	var command approvalCommand
+	if jsonMode {
+		var request struct {
+			Command    string `json:"command"`
+			ProposalID int    `json:"proposal_id"`
+			RunID      int    `json:"run_id"`
+			All        bool   `json:"all"`
+		}
+		if err := json.Unmarshal([]byte(line), &request); err != nil {
+			return approvalCommand{}, fmt.Errorf("invalid command: %w", err)
+		}
+		command = approvalCommand{action: request.Command, id: request.ProposalID, all: request.All}
+		if request.Command == "allow" || request.Command == "deny" {
+			command.id = request.RunID
+		}
+	} else {
+		fields := strings.Fields(strings.ToLower(line))
+		if len(fields) == 0 || len(fields) > 2 {
+			return approvalCommand{}, fmt.Errorf("usage: approve <id|all>, reject <id|all>, allow <id|all>, deny <id|all> or list")
+		}
+		command.action = fields[0]
+		if len(fields) == 2 {
+			if fields[1] == "all" {
+				command.all = true
+			} else {
+				id, err := strconv.Atoi(fields[1])
+				if err != nil {
+					return approvalCommand{}, fmt.Errorf("invalid number %q", fields[1])
+				}
+				command.id = id
+			}
+		}
+	}
+
+	switch command.action {
+	case "list":
+		return command, nil
+	case "approve", "reject":
+		if !command.all && command.id <= 0 {
+			return approvalCommand{}, fmt.Errorf("%s needs a proposal number or all", command.action)
+		}
+		return command, nil
+	case "allow", "deny":
+		if !command.all && command.id <= 0 {
+			return approvalCommand{}, fmt.Errorf("%s needs a task run number or all", command.action)
+		}
+		return command, nil
+	default:
+		return approvalCommand{}, fmt.Errorf("unknown command %q", command.action)
+	}
+}
+
+// runApprovalCommands reads review commands for the host until input ends.
+func runApprovalCommands(ctx context.Context, in io.Reader, hostClient <-chan *client.Client, jsonMode bool) {
+	var c *client.Client
+	select {
+	case <-ctx.Done():
+		return
+	case c = <-hostClient:
+	}
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		command, err := parseApprovalCommand(line, jsonMode)
+		if err != nil {
+			reportApproval(jsonMode, EventWarning, err.Error(), 0)
+			continue
+		}
+		runApprovalCommand(c, command, jsonMode)
+	}
+}
+
+func runApprovalCommand(c *client.Client, command approvalCommand, jsonMode bool) {
+	switch command.action {
+	case "list":
+		proposals := c.Proposals()
+		runs := c.TaskRuns()
+		if len(proposals) == 0 && len(runs) == 0 {
+			reportApproval(jsonMode, EventProposalResolved, "No pending proposals", 0)
+			return
+		}
+		onProposal := jsonOnProposal(jsonMode)
+		for _, proposal := range proposals {
+			if onProposal != nil {
+				onProposal(proposal)
+			} else {
+				fmt.Printf("  #%d %s %s\n", proposal.ID, proposal.Path, ui.Dim("from peer "+proposal.PeerID))
+			}
+		}
+		onTaskRun := jsonOnTaskRun(jsonMode)
+		for _, run := range runs {
+			if onTaskRun != nil {
+				onTaskRun(run)
+			} else {
+				fmt.Printf("  run %d %s %s\n", run.ID, run.Task, ui.Dim("from "+run.Peer.Label()))
+			}
+		}
+		return
+	case "allow", "deny":
+		runTaskCommand(c, command, jsonMode)
+		return
+	}
+
+	approve := command.action == "approve"
+	verb := "Rejected"
+	if approve {
+		verb = "Approved"
+	}
+	if command.all {
+		count, err := c.ResolveAllProposals(approve)
+		if err != nil {
+			reportApproval(jsonMode, EventWarning, err.Error(), 0)
+			return
+		}
+		reportApproval(jsonMode, EventProposalResolved, fmt.Sprintf("%s %d proposals", verb, count), 0)
+		return
+	}
+	if err := c.ResolveProposal(command.id, approve); err != nil {
+		reportApproval(jsonMode, EventWarning, err.Error(), command.id)
+		return
+	}
+	reportApproval(jsonMode, EventProposalResolved, fmt.Sprintf("%s #%d", verb, command.id), command.id)
+}
+
+func runTaskCommand(c *client.Client, command approvalCommand, jsonMode bool) {
+	allow := command.action == "allow"
+	verb := "Denied"
+	if allow {
+		verb = "Allowed"
+	}
+	ids := []int{command.id}
+	if command.all {
+		ids = ids[:0]
+		for _, run := range c.TaskRuns() {
+			ids = append(ids, run.ID)
+		}
+	}
+	for _, id := range ids {
+		if err := c.ResolveTaskRun(id, allow); err != nil {
+			reportTaskCommand(jsonMode, EventWarning, err.Error(), id)
+			continue
+		}
+		if !command.all {
+			reportTaskCommand(jsonMode, EventTask, fmt.Sprintf("%s run %d", verb, id), id)
+		}
+	}
+	if command.all {
+		reportTaskCommand(jsonMode, EventTask, fmt.Sprintf("%s %d task runs", verb, len(ids)), 0)
+	}
+}
+
+func reportTaskCommand(jsonMode bool, event, message string, runID int) {
+	if jsonMode {
+		emitJSON(JSONEvent{Event: event, Message: message, RunID: runID})
+		return
+	}
+	reportApproval(false, event, message, 0)
+}
+
+func reportApproval(jsonMode bool, event, message string, proposalID int) {
+	if jsonMode {
+		emitJSON(JSONEvent{Event: event, Message: message, ProposalID: proposalID})
+		return
+	}
+	if event == EventWarning {
+		fmt.Println(ui.Warn(message))
+		return
+	}
+	fmt.Println(ui.Dim(message))
+}
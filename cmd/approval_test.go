@@ -0,0 +1,42 @@
+package cmd
+
+import "testing"
+
+func TestParseApprovalCommand(t *testing.T) {
+	tests := []struct {
+		line     string
+		jsonMode bool
+		want     approvalCommand
+		wantErr  bool
+	}{
+		{line: "approve 3", want: approvalCommand{action: "approve", id: 3}},
+		{line: "Reject ALL", want: approvalCommand{action: "reject", all: true}},
+		{line: "list", want: approvalCommand{action: "list"}},
+		{line: `{"command":"approve","proposal_id":7}`, jsonMode: true, want: approvalCommand{action: "approve", id: 7}},
+		{line: `{"command":"reject","all":true}`, jsonMode: true, want: approvalCommand{action: "reject", all: true}},
+		{line: "allow 2", want: approvalCommand{action: "allow", id: 2}},
+		{line: "deny all", want: approvalCommand{action: "deny", all: true}},
+		{line: `{"command":"deny","run_id":4}`, jsonMode: true, want: approvalCommand{action: "deny", id: 4}},
+		{line: `{"command":"allow","proposal_id":4}`, jsonMode: true, wantErr: true},
+		{line: "approve", wantErr: true},
+		{line: "approve x", wantErr: true},
+		{line: "merge 2", wantErr: true},
+		{line: "approve 2", jsonMode: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseApprovalCommand(tt.line, tt.jsonMode)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseApprovalCommand(%q) succeeded, want error", tt.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseApprovalCommand(%q) error: %v", tt.line, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseApprovalCommand(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
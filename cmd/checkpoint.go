@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/checkpoint"
+	"github.com/go-johnnyhe/shadow/internal/ui"
+)
+
+const defaultCheckpointInterval = 10 * time.Minute
+
+// checkpointLoop commits the shared files to the checkpoint branch on an
+// interval and once more when the session ends.
+type checkpointLoop struct {
+	repo     *checkpoint.Repo
+	jsonMode bool
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+func startCheckpoints(repo *checkpoint.Repo, interval time.Duration, jsonMode bool) *checkpointLoop {
+	loop := &checkpointLoop{
+		repo:     repo,
+		jsonMode: jsonMode,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(loop.done)
+		if interval <= 0 {
+			<-loop.stop
+			return
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-loop.stop:
+				return
+			case now := <-ticker.C:
+				loop.commit("shadow checkpoint " + now.Format("2006-01-02 15:04"))
+			}
+		}
+	}()
+	return loop
+}
+
+// Stop ends the loop and takes the final checkpoint.
+func (l *checkpointLoop) Stop() {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() {
+		close(l.stop)
+		<-l.done
+		l.commit("shadow checkpoint at session end " + time.Now().Format("2006-01-02 15:04"))
+		l.repo.Close()
+	})
+}
+
+func (l *checkpointLoop) commit(message string) {
+	commit, err := l.repo.Commit(message)
+	if err != nil {
+		if l.jsonMode {
+			emitJSON(JSONEvent{Event: EventWarning, Message: "checkpoint failed: " + err.Error()})
+		} else {
+			fmt.Println(ui.Warn("checkpoint failed: " + err.Error()))
+		}
+		return
+	}
+	if commit == "" {
+		return
+	}
+	text := fmt.Sprintf("checkpoint %s on %s", commit[:min(len(commit), 7)], l.repo.Branch())
+	if l.jsonMode {
+		emitJSON(JSONEvent{Event: EventCheckpoint, Message: text, Commit: commit})
+	} else {
+		fmt.Printf("  %s\n", ui.Dim(text))
+	}
+}
@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-johnnyhe/shadow/internal/client"
+	"github.com/go-johnnyhe/shadow/internal/control"
+)
+
+// openControl starts the local control interface editor plugins connect to.
+// Failing to open it only disables editor integration, so it returns nil
+// instead of an error.
+func openControl(root string, jsonMode bool) *control.Server {
+	server, err := control.Listen(root)
+	if err != nil {
+		log.Printf("editor integration disabled: %v", err)
+		return nil
+	}
+	if jsonMode {
+		info := server.Info()
+		emitJSON(JSONEvent{
+			Event:        EventControlReady,
+			Message:      fmt.Sprintf("Editor integration listening on 127.0.0.1:%d", info.Port),
+			ControlPort:  info.Port,
+			ControlToken: info.Token,
+		})
+	}
+	return server
+}
+
+func closeControl(server *control.Server) {
+	if server != nil {
+		_ = server.Close()
+	}
+}
+
+// serveControl feeds messages from editor plugins into the session client.
+func serveControl(server *control.Server, c *client.Client, root string) {
+	if server == nil {
+		return
+	}
+	server.HandleStream(control.AttachTerminal, terminalStream(c))
+	server.HandleStream(control.AttachTask, taskStream(c))
+	server.HandleStream(control.AttachPatch, patchStream(c))
+	go server.Serve(func(message control.Message) error {
+		switch message.Type {
+		case control.TypeCursor:
+			cursor := client.Cursor{Line: message.Line, Column: message.Column}
+			if message.File != "" {
+				relPath, ok := controlRelPath(root, message.File)
+				if !ok {
+					// Files outside the share are not visible to peers.
+					return c.UpdatePresence(client.Cursor{})
+				}
+				cursor.Path = relPath
+			}
+			if message.Selection != nil {
+				cursor.Selection = &client.Selection{
+					Start: client.Position(message.Selection.Start),
+					End:   client.Position(message.Selection.End),
+				}
+			}
+			return c.UpdatePresence(cursor)
+		case control.TypeChat:
+			return c.Say(message.Text)
+		case control.TypeFocus:
+			relPath, ok := controlRelPath(root, message.File)
+			if !ok {
+				return fmt.Errorf("%s is outside the shared directory", message.File)
+			}
+			return c.Focus(relPath, message.Line)
+		default:
+			return fmt.Errorf("unsupported message type %q", message.Type)
+		}
+	})
+}
+
+// controlPresence returns an OnPresence callback that forwards peer cursors to
+// editor plugins, or nil when the control interface is not running.
+func controlPresence(server *control.Server, root string) func(client.PeerCursor) {
+	if server == nil {
+		return nil
+	}
+	return func(update client.PeerCursor) {
+		message := control.Message{
+			Type:     control.TypeCursor,
+			PeerID:   update.Peer.ID,
+			PeerName: update.Peer.Label(),
+			Line:     update.Cursor.Line,
+			Column:   update.Cursor.Column,
+		}
+		if update.Cursor.Path != "" {
+			message.File = filepath.Join(root, filepath.FromSlash(update.Cursor.Path))
+		}
+		if selection := update.Cursor.Selection; selection != nil {
+			message.Selection = &control.Selection{
+				Start: control.Position(selection.Start),
+				End:   control.Position(selection.End),
+			}
+		}
+		server.Publish(message)
+	}
+}
+
+// controlRelPath converts an editor's absolute file path into a session path.
+func controlRelPath(root, file string) (string, bool) {
+	if !filepath.IsAbs(file) {
+		return "", false
+	}
+	rel, err := filepath.Rel(root, filepath.Clean(file))
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
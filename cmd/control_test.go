@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestControlRelPath(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "project")
+	tests := []struct {
+		file string
+		want string
+		ok   bool
+	}{
+		{filepath.Join(root, "src", "main.go"), "src/main.go", true},
+		{filepath.Join(root, "src", "..", "go.mod"), "go.mod", true},
+		{root, "", false},
+		{filepath.Join(root, "..", "other", "main.go"), "", false},
+		{filepath.Join(root+"-sibling", "main.go"), "", false},
+		{"relative/main.go", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := controlRelPath(root, tt.file)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("controlRelPath(%q) = %q, %v; want %q, %v", tt.file, got, ok, tt.want, tt.ok)
+		}
+	}
+}
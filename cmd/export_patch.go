@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-johnnyhe/shadow/internal/client"
+	"github.com/go-johnnyhe/shadow/internal/control"
+	"github.com/go-johnnyhe/shadow/internal/ui"
+	"github.com/spf13/cobra"
+)
+
+var exportPatchOutput string
+
+var exportPatchCmd = &cobra.Command{
+	Use:   "export-patch",
+	Short: "Write everything changed during the running session as a patch",
+	Long: `Write a unified diff of every change made to the shared files since the
+session started, from a terminal inside the shared directory. New, deleted
+and binary files are included, and the patch applies with git apply. The
+session must have been started or joined with --export-patch.
+
+Example:
+  shadow export-patch -o pairing.patch
+  git apply pairing.patch`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		info, err := control.Find(cwd)
+		if err != nil {
+			return err
+		}
+		stream, err := control.Attach(info, control.Message{Attach: control.AttachPatch})
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+
+		// Collect a patch for a file first so a file inside the shared
+		// directory does not end up in its own patch.
+		var buffered bytes.Buffer
+		out := io.Writer(os.Stdout)
+		if exportPatchOutput != "" {
+			out = &buffered
+		}
+		for {
+			message, err := stream.Receive()
+			if err != nil {
+				return fmt.Errorf("the session ended before the patch was written")
+			}
+			switch message.Type {
+			case control.TypeOutput:
+				if _, err := out.Write(message.Data); err != nil {
+					return err
+				}
+			case control.TypeError:
+				return errors.New(message.Error)
+			case control.TypeExit:
+				if exportPatchOutput != "" {
+					if err := os.WriteFile(exportPatchOutput, buffered.Bytes(), 0o644); err != nil {
+						return fmt.Errorf("failed to write %s: %w", exportPatchOutput, err)
+					}
+					fmt.Fprintln(os.Stderr, ui.Dim(fmt.Sprintf("wrote %s with %s", exportPatchOutput, changedFiles(message.Files))))
+				}
+				return nil
+			}
+		}
+	},
+}
+
+// patchStream serves `shadow export-patch`.
+func patchStream(c *client.Client) control.StreamHandler {
+	return func(hello control.Message, stream *control.Stream) {
+		out := bufio.NewWriterSize(streamWriter{stream}, 32*1024)
+		count, err := c.SessionPatch(out)
+		if err == nil {
+			err = out.Flush()
+		}
+		if errors.Is(err, client.ErrPatchNotKept) {
+			err = fmt.Errorf("this session keeps no patch; start or join it with --export-patch <file>")
+		}
+		if err != nil {
+			_ = stream.Send(control.Message{Type: control.TypeError, Error: err.Error()})
+			return
+		}
+		_ = stream.Send(control.Message{Type: control.TypeExit, Files: count})
+	}
+}
+
+// exportPatchOnExit writes the session's patch to path as the session ends.
+func exportPatchOnExit(c *client.Client, path string, jsonMode bool) {
+	if c == nil || path == "" {
+		return
+	}
+	count, err := writePatchFile(c, path)
+	if err != nil {
+		if jsonMode {
+			emitJSON(JSONEvent{Event: EventWarning, Message: "patch export failed: " + err.Error()})
+		} else {
+			fmt.Println(ui.Warn("patch export failed: " + err.Error()))
+		}
+		return
+	}
+	message := fmt.Sprintf("wrote %s with %s", path, changedFiles(count))
+	if jsonMode {
+		emitJSON(JSONEvent{Event: EventPatchExported, Message: message, RelPath: path, FileCount: count})
+	} else {
+		fmt.Printf("  %s\n", ui.Dim(message))
+	}
+}
+
+func writePatchFile(c *client.Client, path string) (int, error) {
+	var patch bytes.Buffer
+	count, err := c.SessionPatch(&patch)
+	if err != nil {
+		return 0, err
+	}
+	return count, os.WriteFile(path, patch.Bytes(), 0o644)
+}
+
+func changedFiles(count int) string {
+	if count == 1 {
+		return "1 changed file"
+	}
+	return fmt.Sprintf("%d changed files", count)
+}
+
+func init() {
+	rootCmd.AddCommand(exportPatchCmd)
+	exportPatchCmd.Flags().StringVarP(&exportPatchOutput, "output", "o", "", "Write the patch to this file instead of stdout")
+}
@@ -0,0 +1,239 @@
+-- Shadow cursor presence: share your cursor with session peers and show theirs.
+-- Talks to the running shadow process through its local control interface.
+local uv = vim.uv or vim.loop
+local ns = vim.api.nvim_create_namespace("shadow_presence")
+local presence_group = vim.api.nvim_create_augroup("shadow_presence", { clear = true })
+
+vim.api.nvim_set_hl(0, "ShadowCursor", { default = true, reverse = true })
+vim.api.nvim_set_hl(0, "ShadowSelection", { default = true, link = "Visual" })
+vim.api.nvim_set_hl(0, "ShadowPeerName", { default = true, link = "Comment" })
+
+local sessions_dir = (vim.env.SHADOW_HOME and vim.env.SHADOW_HOME ~= "" and vim.env.SHADOW_HOME
+  or (uv.os_homedir() .. "/.shadow")) .. "/sessions"
+
+local conn = nil
+local ready = false
+local session = nil
+local buffered = ""
+local latest = {} -- peer_id -> last cursor message
+local marks = {} -- peer_id -> { buf = n, ids = { ... } }
+local send_timer = nil
+
+local function to_utf16(line, byte_col)
+  local ok, idx = pcall(vim.str_utfindex, line, "utf-16", byte_col)
+  if ok and type(idx) == "number" then return idx end
+  local ok_old, _, idx16 = pcall(vim.str_utfindex, line, byte_col)
+  if ok_old and idx16 then return idx16 end
+  return byte_col
+end
+
+local function from_utf16(line, col)
+  local ok, idx = pcall(vim.str_byteindex, line, "utf-16", col)
+  if ok and type(idx) == "number" then return idx end
+  local ok_old, idx_old = pcall(vim.str_byteindex, line, col, true)
+  if ok_old and idx_old then return idx_old end
+  return math.min(col, #line)
+end
+
+local function within(root, file)
+  return file == root or file:sub(1, #root + 1) == root .. "/"
+end
+
+-- find_session returns the newest running session sharing file.
+local function find_session(file)
+  local best = nil
+  for _, path in ipairs(vim.fn.glob(sessions_dir .. "/*.json", true, true)) do
+    local ok, info = pcall(function() return vim.json.decode(table.concat(vim.fn.readfile(path), "\n")) end)
+    if ok and type(info) == "table" and info.root and within(info.root, file) then
+      if not best or #info.root > #best.root then best = info end
+    end
+  end
+  return best
+end
+
+local function send(message)
+  if conn and ready then conn:write(vim.json.encode(message) .. "\n") end
+end
+
+local function clear_peer(peer_id)
+  local mark = marks[peer_id]
+  if mark and vim.api.nvim_buf_is_valid(mark.buf) then
+    for _, id in ipairs(mark.ids) do pcall(vim.api.nvim_buf_del_extmark, mark.buf, ns, id) end
+  end
+  marks[peer_id] = nil
+end
+
+local function clear_all()
+  for peer_id in pairs(marks) do clear_peer(peer_id) end
+end
+
+local function buf_line(buf, row)
+  return vim.api.nvim_buf_get_lines(buf, row, row + 1, false)[1]
+end
+
+local function show_cursor(message)
+  clear_peer(message.peer_id)
+  if not message.file or message.file == "" then return end
+  local buf = vim.fn.bufnr(message.file)
+  if buf == -1 or not vim.api.nvim_buf_is_loaded(buf) then return end
+  local row = message.line or 0
+  local line = buf_line(buf, row)
+  if not line then return end
+  local col = from_utf16(line, message.column or 0)
+  local ids = {}
+  local sel = message.selection
+  if sel then
+    local start_line = buf_line(buf, sel.start.line)
+    local end_line = buf_line(buf, sel["end"].line)
+    if start_line and end_line then
+      table.insert(ids, vim.api.nvim_buf_set_extmark(buf, ns, sel.start.line, from_utf16(start_line, sel.start.column), {
+        end_row = sel["end"].line,
+        end_col = from_utf16(end_line, sel["end"].column),
+        hl_group = "ShadowSelection",
+        strict = false,
+      }))
+    end
+  end
+  table.insert(ids, vim.api.nvim_buf_set_extmark(buf, ns, row, col, {
+    end_col = math.min(col + 1, #line),
+    hl_group = "ShadowCursor",
+    virt_text = { { " " .. (message.peer_name or ("peer " .. message.peer_id)), "ShadowPeerName" } },
+    virt_text_pos = "eol",
+    strict = false,
+  }))
+  marks[message.peer_id] = { buf = buf, ids = ids }
+end
+
+local function on_line(line)
+  local ok, message = pcall(vim.json.decode, line)
+  if ok and type(message) == "table" and message.type == "cursor" and message.peer_id then
+    latest[message.peer_id] = (message.file and message.file ~= "") and message or nil
+    pcall(show_cursor, message)
+  end
+end
+
+local function disconnect()
+  if conn then
+    conn:close()
+    conn = nil
+  end
+  ready = false
+  session = nil
+  buffered = ""
+  latest = {}
+  clear_all()
+end
+
+local current_cursor
+
+local function connect(info)
+  local tcp = uv.new_tcp()
+  conn = tcp
+  session = info
+  local function lost()
+    vim.schedule(function()
+      if conn == tcp then disconnect() end
+    end)
+  end
+  tcp:connect("127.0.0.1", info.port, function(err)
+    if err then
+      lost()
+      return
+    end
+    tcp:write(vim.json.encode({ type = "hello", token = info.token }) .. "\n")
+    vim.schedule(function()
+      if conn ~= tcp then return end
+      ready = true
+      local message = current_cursor()
+      if message then send(message) end
+    end)
+    tcp:read_start(function(read_err, chunk)
+      if read_err or not chunk then
+        lost()
+        return
+      end
+      buffered = buffered .. chunk
+      local lines = {}
+      while true do
+        local nl = buffered:find("\n", 1, true)
+        if not nl then break end
+        table.insert(lines, buffered:sub(1, nl - 1))
+        buffered = buffered:sub(nl + 1)
+      end
+      vim.schedule(function()
+        for _, l in ipairs(lines) do on_line(l) end
+      end)
+    end)
+  end)
+end
+
+current_cursor = function()
+  local file = vim.api.nvim_buf_get_name(0)
+  if file == "" or vim.bo.buftype ~= "" then return nil end
+  file = vim.fn.fnamemodify(file, ":p")
+  local pos = vim.api.nvim_win_get_cursor(0)
+  local row = pos[1] - 1
+  local line = vim.api.nvim_get_current_line()
+  local message = { type = "cursor", file = file, line = row, column = to_utf16(line, math.min(pos[2], #line)) }
+  local mode = vim.fn.mode()
+  if mode == "v" or mode == "V" or mode == "\22" then
+    local a, b = vim.fn.getpos("v"), vim.fn.getpos(".")
+    if a[2] > b[2] or (a[2] == b[2] and a[3] > b[3]) then a, b = b, a end
+    local a_line, b_line = buf_line(0, a[2] - 1) or "", buf_line(0, b[2] - 1) or ""
+    message.selection = {
+      start = { line = a[2] - 1, column = to_utf16(a_line, math.min(a[3] - 1, #a_line)) },
+      ["end"] = { line = b[2] - 1, column = to_utf16(b_line, math.min(b[3], #b_line)) },
+    }
+  end
+  return message
+end
+
+local function share_cursor()
+  local message = current_cursor()
+  if not message then return end
+  if not session or not within(session.root, message.file) then
+    local info = find_session(message.file)
+    if info and (not session or session.pid ~= info.pid) then
+      disconnect()
+      connect(info)
+    end
+  end
+  -- Files outside the share are sent too, so peers stop showing this cursor.
+  send(message)
+end
+
+vim.api.nvim_create_autocmd({ "CursorMoved", "CursorMovedI", "BufEnter", "ModeChanged" }, {
+  group = presence_group,
+  callback = function()
+    if send_timer then return end
+    send_timer = vim.defer_fn(function()
+      send_timer = nil
+      share_cursor()
+    end, 50)
+  end,
+  desc = "Share the cursor with shadow session peers",
+})
+
+vim.api.nvim_create_autocmd("BufWinEnter", {
+  group = presence_group,
+  callback = function()
+    for _, message in pairs(latest) do pcall(show_cursor, message) end
+  end,
+  desc = "Show shadow peers' cursors in newly opened buffers",
+})
+
+vim.api.nvim_create_autocmd("VimLeavePre", {
+  group = presence_group,
+  callback = disconnect,
+})
+
+vim.api.nvim_create_user_command("ShadowFocus", function()
+  local message = current_cursor()
+  if not message then return end
+  share_cursor()
+  if not ready then
+    vim.notify("shadow: no running session shares this file", vim.log.levels.WARN)
+    return
+  end
+  send({ type = "focus", file = message.file, line = message.line })
+end, { desc = "Point shadow session peers at the cursor line" })
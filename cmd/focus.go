@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-johnnyhe/shadow/internal/client"
+	"github.com/go-johnnyhe/shadow/internal/control"
+	"github.com/go-johnnyhe/shadow/internal/opener"
+	"github.com/go-johnnyhe/shadow/internal/ui"
+	"github.com/spf13/cobra"
+)
+
+var focusCmd = &cobra.Command{
+	Use:   "focus <path>[:line]",
+	Short: "Ask everyone in the running session to look at a file and line",
+	Long: `Broadcast a location to the session running in this directory. Peers see
+where you are pointing, and peers started with --follow jump there in their
+editor.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, line, err := parseFocusTarget(args[0])
+		if err != nil {
+			return err
+		}
+		file, err = filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		info, err := control.Find(filepath.Dir(file))
+		if err != nil {
+			return err
+		}
+		return control.Call(info, control.Message{Type: control.TypeFocus, File: file, Line: line - 1})
+	},
+}
+
+// parseFocusTarget splits "path:line" into the path and a one-based line.
+// A path without a line points at line 1.
+func parseFocusTarget(target string) (string, int, error) {
+	if i := strings.LastIndex(target, ":"); i > 0 {
+		if line, err := strconv.Atoi(target[i+1:]); err == nil {
+			if line < 1 {
+				return "", 0, fmt.Errorf("line must be 1 or more")
+			}
+			return target[:i], line, nil
+		}
+	}
+	return target, 1, nil
+}
+
+// followEditor resolves the editor --follow opens locations in, or nil when
+// not following.
+func followEditor(follow bool, command string) (*opener.Editor, error) {
+	if !follow {
+		if command != "" {
+			return nil, fmt.Errorf("--follow-editor needs --follow")
+		}
+		return nil, nil
+	}
+	editor, err := opener.Preferred(command)
+	if err != nil {
+		return nil, fmt.Errorf("--follow: %w; pick one with --follow-editor", err)
+	}
+	return &editor, nil
+}
+
+// focusHandler returns the OnFocus callback. Without an editor, focus
+// requests are only reported, as JSON events or by the client itself.
+func focusHandler(jsonMode bool, editor *opener.Editor, root string) func(client.PeerFocus) {
+	report := jsonOnFocus(jsonMode)
+	if editor == nil {
+		return report
+	}
+	return func(focus client.PeerFocus) {
+		file := filepath.Join(root, filepath.FromSlash(focus.Path))
+		var err error
+		if _, statErr := os.Stat(file); statErr != nil {
+			err = fmt.Errorf("%s has not synced yet", focus.Path)
+		} else {
+			err = opener.OpenAt(*editor, file, focus.Line+1)
+		}
+
+		if report != nil {
+			report(focus)
+			if err != nil {
+				emitJSON(JSONEvent{Event: EventWarning, RelPath: focus.Path, Message: "Could not follow: " + err.Error()})
+			}
+			return
+		}
+		location := fmt.Sprintf("%s:%d", focus.Path, focus.Line+1)
+		if err != nil {
+			log.Printf("could not follow %s to %s: %v", focus.Peer.Label(), location, err)
+			return
+		}
+		fmt.Printf("%s %s %s\n", ui.Accent("◆"), focus.Peer.Label()+ui.Dim(" → "), location+ui.Dim(" in "+editor.Name))
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(focusCmd)
+}
@@ -0,0 +1,24 @@
+package cmd
+
+import "testing"
+
+func TestParseFocusTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		file   string
+		line   int
+	}{
+		{"handler.go:80", "handler.go", 80},
+		{"handler.go", "handler.go", 1},
+		{"C:/src/handler.go", "C:/src/handler.go", 1},
+	}
+	for _, test := range tests {
+		file, line, err := parseFocusTarget(test.target)
+		if err != nil || file != test.file || line != test.line {
+			t.Errorf("%s: got %s:%d (%v), want %s:%d", test.target, file, line, err, test.file, test.line)
+		}
+	}
+	if _, _, err := parseFocusTarget("handler.go:0"); err == nil {
+		t.Error("accepted line 0")
+	}
+}
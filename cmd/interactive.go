@@ -108,12 +108,19 @@ func runInteractiveWizard() error {
 		return err
 	}
 
+	profile, err := localProfile("")
+	if err != nil {
+		return err
+	}
+
 	switch action {
 	case interactiveActionStart:
 		return runStart(StartOptions{
 			Path:            ".",
 			Port:            startPort,
 			ReadOnlyJoiners: readOnlyJoiners,
+			RepairInterval:  startRepairInterval,
+			Profile:         profile,
 		})
 	case interactiveActionJoin:
 		sessionURL = strings.TrimSpace(sessionURL)
@@ -125,7 +132,9 @@ func runInteractiveWizard() error {
 			return fmt.Errorf("session URL cannot be empty")
 		}
 		return runJoin(JoinOptions{
-			SessionURL: sessionURL,
+			SessionURL:     sessionURL,
+			RepairInterval: joinRepairInterval,
+			Profile:        profile,
 		})
 	default:
 		return fmt.Errorf("unknown action: %s", action)
@@ -5,6 +5,7 @@ package cmd
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/go-johnnyhe/shadow/internal/ui"
 	"github.com/spf13/cobra"
@@ -13,9 +14,17 @@ import (
 var joinKey string
 var joinJSON bool
 var joinPathFlag string
+var joinRepairInterval time.Duration
+var joinMaxUploadRate string
+var joinStandbyHost bool
+var joinName string
+var joinFollow bool
+var joinFollowEditor string
+var joinExportPatch string
+var joinDiscover bool
 
 var joinCmd = &cobra.Command{
-	Use:   "join <session-url>",
+	Use:   "join <session-url> | --discover",
 	Short: "Join an existing collaborative coding session",
 	Long: `Join a collaborative coding session by connecting to the provided URL.
 
@@ -26,14 +35,27 @@ This will:
 Example:
   shadow join 'https://abc123.trycloudflare.com#<e2e-key>'
 
-The session URL comes from whoever ran 'shadow start'.`,
+The session URL comes from whoever ran 'shadow start'. On the same network
+as a session started with --lan, --discover lists the sessions nearby to
+pick from; their E2E key still comes from the host, with --key or when
+asked:
+  shadow join --discover --key <e2e-key>`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if joinJSON {
 			cmd.SilenceErrors = true
 			cmd.SilenceUsage = true
 		}
 
-		if len(args) != 1 {
+		if joinDiscover && len(args) != 0 {
+			err := fmt.Errorf("--discover finds the session URL; do not pass one")
+			if joinJSON {
+				emitJSONError(err.Error())
+				return err
+			}
+			fmt.Printf("Error: %v\n", err)
+			return nil
+		}
+		if !joinDiscover && len(args) != 1 {
 			err := fmt.Errorf("expected exactly one session URL")
 			if joinJSON {
 				emitJSONError(err.Error())
@@ -44,15 +66,70 @@ The session URL comes from whoever ran 'shadow start'.`,
 			return nil
 		}
 
+		maxUploadRate, err := parseUploadRate(joinMaxUploadRate)
+		if err != nil {
+			if joinJSON {
+				emitJSONError(err.Error())
+				return err
+			}
+			fmt.Printf("Error: %v\n", err)
+			return nil
+		}
+
+		profile, err := localProfile(joinName)
+		if err != nil {
+			if joinJSON {
+				emitJSONError(err.Error())
+				return err
+			}
+			fmt.Printf("Error: %v\n", err)
+			return nil
+		}
+
+		follow, err := followEditor(joinFollow, joinFollowEditor)
+		if err != nil {
+			if joinJSON {
+				emitJSONError(err.Error())
+				return err
+			}
+			fmt.Printf("Error: %v\n", err)
+			return nil
+		}
+
 		if !joinJSON {
 			fmt.Printf("\n  %s\n", ui.Dim("◗ shadow"))
 		}
 
-		err := runJoin(JoinOptions{
-			SessionURL: args[0],
-			E2EKey:     joinKey,
-			Path:       joinPathFlag,
-			JSONMode:   joinJSON,
+		var sessionURL string
+		if joinDiscover {
+			sessionURL, err = discoverSession(joinKey, joinJSON)
+			if err != nil {
+				if joinJSON {
+					emitJSONError(err.Error())
+					return err
+				}
+				fmt.Printf("Error: %v\n", err)
+				return nil
+			}
+			// In JSON mode --discover only lists the sessions.
+			if sessionURL == "" {
+				return nil
+			}
+		} else {
+			sessionURL = args[0]
+		}
+
+		err = runJoin(JoinOptions{
+			SessionURL:     sessionURL,
+			E2EKey:         joinKey,
+			Path:           joinPathFlag,
+			JSONMode:       joinJSON,
+			RepairInterval: joinRepairInterval,
+			MaxUploadRate:  maxUploadRate,
+			StandbyHost:    joinStandbyHost,
+			Profile:        profile,
+			Follow:         follow,
+			ExportPatch:    joinExportPatch,
 		})
 		if err != nil {
 			if joinJSON {
@@ -68,6 +145,14 @@ The session URL comes from whoever ran 'shadow start'.`,
 func init() {
 	rootCmd.AddCommand(joinCmd)
 	joinCmd.Flags().StringVar(&joinKey, "key", "", "E2E share key (optional if included in URL fragment)")
+	joinCmd.Flags().BoolVar(&joinDiscover, "discover", false, "Find sessions started with --lan on your network and pick one to join")
+	joinCmd.Flags().StringVar(&joinName, "name", "", "Name shown to other peers (default your login name)")
+	joinCmd.Flags().BoolVar(&joinFollow, "follow", false, "Open the file and line a peer focuses on in your editor")
+	joinCmd.Flags().StringVar(&joinExportPatch, "export-patch", "", "When the session ends, write everything changed since you joined to this patch file")
+	joinCmd.Flags().StringVar(&joinFollowEditor, "follow-editor", "", "Editor command --follow uses, e.g. code, nvim, subl or idea (default detected)")
 	joinCmd.Flags().StringVar(&joinPathFlag, "path", "", "Directory to sync into (alternative to current directory)")
 	joinCmd.Flags().BoolVar(&joinJSON, "json", false, "Emit structured JSON events to stdout")
+	joinCmd.Flags().DurationVar(&joinRepairInterval, "repair-interval", defaultRepairInterval, "How often to reconcile local files with the session (0 disables)")
+	joinCmd.Flags().BoolVar(&joinStandbyHost, "standby-host", false, "Take over as host, serving your copy of the files, if the host does not come back (the host must start with --allow-standby)")
+	joinCmd.Flags().StringVar(&joinMaxUploadRate, "max-upload-rate", "", "Cap outbound sync traffic, e.g. 512KB or 2MB per second (default unlimited)")
 }
@@ -2,38 +2,101 @@ package cmd
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"time"
 
+	"github.com/go-johnnyhe/shadow/internal/client"
 	"github.com/go-johnnyhe/shadow/internal/tunnel"
 )
 
 // Event name constants — single source of truth for the JSON protocol.
 const (
-	EventStarting         = "starting"
-	EventTunnelReady      = "tunnel_ready"
-	EventConnected        = "connected"
-	EventSnapshotComplete = "snapshot_complete"
-	EventStopped          = "stopped"
-	EventFileSent         = "file_sent"
-	EventFileReceived     = "file_received"
-	EventReadOnly         = "read_only"
-	EventWarning          = "warning"
-	EventError            = "error"
-	EventDisconnected     = "disconnected"
-	EventDownloadingDep   = "downloading_dependency"
-	EventDependencyReady  = "dependency_ready"
+	EventStarting          = "starting"
+	EventTunnelReady       = "tunnel_ready"
+	EventConnected         = "connected"
+	EventSnapshotComplete  = "snapshot_complete"
+	EventStopped           = "stopped"
+	EventFileSent          = "file_sent"
+	EventFileReceived      = "file_received"
+	EventReadOnly          = "read_only"
+	EventWarning           = "warning"
+	EventError             = "error"
+	EventDisconnected      = "disconnected"
+	EventRepair            = "repair"
+	EventOutbound          = "outbound"
+	EventBootstrapProgress = "bootstrap_progress"
+	EventProposal          = "proposal"
+	EventProposalResolved  = "proposal_resolved"
+	EventApprovalRequired  = "approval_required"
+	EventPolicyViolation   = "policy_violation"
+	EventReconnecting      = "reconnecting"
+	EventReconnected       = "reconnected"
+	EventHostAway          = "host_away"
+	EventHostReturned      = "host_returned"
+	EventPromoted          = "promoted"
+	EventRoster            = "roster"
+	EventPeerJoined        = "peer_joined"
+	EventPeerLeft          = "peer_left"
+	EventControlReady      = "control_ready"
+	EventChat              = "chat"
+	EventFocus             = "focus"
+	EventTerminal          = "terminal"
+	EventForward           = "forward"
+	EventTask              = "task"
+	EventPatchExported     = "patch_exported"
+	EventCheckpoint        = "checkpoint"
+	EventDownloadingDep    = "downloading_dependency"
+	EventDependencyReady   = "dependency_ready"
+	EventDiscovered        = "discovered"
 )
 
 // JSONEvent represents a structured event emitted in --json mode.
 type JSONEvent struct {
-	Event       string `json:"event"`
-	Message     string `json:"message"`
-	JoinURL     string `json:"join_url,omitempty"`
-	JoinCommand string `json:"join_command,omitempty"`
-	FileCount   int    `json:"file_count,omitempty"`
-	RelPath     string `json:"rel_path,omitempty"`
-	Timestamp   string `json:"timestamp"`
+	Event       string     `json:"event"`
+	Message     string     `json:"message"`
+	JoinURL     string     `json:"join_url,omitempty"`
+	JoinCommand string     `json:"join_command,omitempty"`
+	FileCount   int        `json:"file_count,omitempty"`
+	RelPath     string     `json:"rel_path,omitempty"`
+	FilesDone   int        `json:"files_done,omitempty"`
+	FilesTotal  int        `json:"files_total,omitempty"`
+	BytesDone   int64      `json:"bytes_done,omitempty"`
+	BytesTotal  int64      `json:"bytes_total,omitempty"`
+	ETASeconds  int64      `json:"eta_seconds,omitempty"`
+	Done        bool       `json:"done,omitempty"`
+	ProposalID  int        `json:"proposal_id,omitempty"`
+	PeerID      string     `json:"peer_id,omitempty"`
+	PeerName    string     `json:"peer_name,omitempty"`
+	Peers       []JSONPeer `json:"peers,omitempty"`
+	// Line is the zero-based line of a focus event.
+	Line int `json:"line,omitempty"`
+	// Self marks a chat message this process sent.
+	Self bool `json:"self,omitempty"`
+	// RunID, Task and State describe a task run; ExitCode is set once it
+	// finishes.
+	RunID    int    `json:"run_id,omitempty"`
+	Task     string `json:"task,omitempty"`
+	State    string `json:"state,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	// Commit is the object name of a checkpoint.
+	Commit string `json:"commit,omitempty"`
+	// Address is where a discovered session answered, as host:port.
+	Address string `json:"address,omitempty"`
+	// ControlPort and ControlToken let the process that spawned shadow
+	// connect to its editor control interface.
+	ControlPort  int    `json:"control_port,omitempty"`
+	ControlToken string `json:"control_token,omitempty"`
+	Timestamp    string `json:"timestamp"`
+}
+
+// JSONPeer is one entry of a roster event.
+type JSONPeer struct {
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Editor  string `json:"editor,omitempty"`
+	Version string `json:"version,omitempty"`
+	Host    bool   `json:"host,omitempty"`
 }
 
 func emitJSON(evt JSONEvent) {
@@ -61,6 +124,162 @@ func jsonOnEvent(jsonMode bool) func(string, string, string) {
 	}
 }
 
+// jsonOnBootstrapProgress returns an OnBootstrapProgress callback that emits
+// bootstrap_progress events, or nil if jsonMode is false.
+func jsonOnBootstrapProgress(jsonMode bool) func(client.BootstrapProgress) {
+	if !jsonMode {
+		return nil
+	}
+	return func(progress client.BootstrapProgress) {
+		message := fmt.Sprintf("%d/%d files", progress.FilesDone, progress.FilesTotal)
+		if progress.Done {
+			message = fmt.Sprintf("Synced %d files", progress.FilesDone)
+		}
+		emitJSON(JSONEvent{
+			Event:      EventBootstrapProgress,
+			Message:    message,
+			FilesDone:  progress.FilesDone,
+			FilesTotal: progress.FilesTotal,
+			BytesDone:  progress.BytesDone,
+			BytesTotal: progress.BytesTotal,
+			ETASeconds: int64(progress.ETA.Round(time.Second) / time.Second),
+			Done:       progress.Done,
+		})
+	}
+}
+
+// jsonOnProposal returns an OnProposal callback that emits proposal events,
+// or nil if jsonMode is false.
+func jsonOnProposal(jsonMode bool) func(client.Proposal) {
+	if !jsonMode {
+		return nil
+	}
+	return func(proposal client.Proposal) {
+		action := "edit"
+		if proposal.Delete {
+			action = "delete"
+		}
+		emitJSON(JSONEvent{
+			Event:      EventProposal,
+			Message:    fmt.Sprintf("Peer %s wants to %s %s", proposal.PeerID, action, proposal.Path),
+			RelPath:    proposal.Path,
+			ProposalID: proposal.ID,
+			PeerID:     proposal.PeerID,
+		})
+	}
+}
+
+// jsonOnRoster returns an OnRoster callback that emits roster events, or nil
+// if jsonMode is false.
+func jsonOnRoster(jsonMode bool) func([]client.PeerInfo) {
+	if !jsonMode {
+		return nil
+	}
+	return func(peers []client.PeerInfo) {
+		roster := make([]JSONPeer, 0, len(peers))
+		for _, peer := range peers {
+			roster = append(roster, JSONPeer{
+				ID:      peer.ID,
+				Name:    peer.Name,
+				Editor:  peer.Editor,
+				Version: peer.Version,
+				Host:    peer.Host,
+			})
+		}
+		message := fmt.Sprintf("%d peers connected", len(roster))
+		if len(roster) == 1 {
+			message = "1 peer connected"
+		}
+		emitJSON(JSONEvent{Event: EventRoster, Message: message, Peers: roster})
+	}
+}
+
+// jsonOnFileReceived returns an OnFileReceived callback that emits
+// file_received events naming the peer behind the change, or nil if jsonMode
+// is false.
+func jsonOnFileReceived(jsonMode bool) func(client.FileReceived) {
+	if !jsonMode {
+		return nil
+	}
+	return func(file client.FileReceived) {
+		emitJSON(JSONEvent{
+			Event:    EventFileReceived,
+			Message:  file.Path,
+			RelPath:  file.Path,
+			PeerID:   file.Peer.ID,
+			PeerName: file.Peer.Name,
+		})
+	}
+}
+
+// jsonOnChat returns an OnChat callback that emits chat events, or nil if
+// jsonMode is false.
+func jsonOnChat(jsonMode bool) func(client.ChatMessage) {
+	if !jsonMode {
+		return nil
+	}
+	return func(message client.ChatMessage) {
+		emitJSON(JSONEvent{
+			Event:    EventChat,
+			Message:  message.Text,
+			PeerID:   message.Peer.ID,
+			PeerName: message.Peer.Name,
+			Self:     message.Self,
+		})
+	}
+}
+
+// jsonOnFocus returns an OnFocus callback that emits focus events, or nil if
+// jsonMode is false.
+func jsonOnFocus(jsonMode bool) func(client.PeerFocus) {
+	if !jsonMode {
+		return nil
+	}
+	return func(focus client.PeerFocus) {
+		emitJSON(JSONEvent{
+			Event:    EventFocus,
+			Message:  fmt.Sprintf("%s is looking at %s:%d", focus.Peer.Label(), focus.Path, focus.Line+1),
+			RelPath:  focus.Path,
+			Line:     focus.Line,
+			PeerID:   focus.Peer.ID,
+			PeerName: focus.Peer.Name,
+		})
+	}
+}
+
+// jsonOnTaskRun returns an OnTaskRun callback that emits task events, or nil
+// if jsonMode is false.
+func jsonOnTaskRun(jsonMode bool) func(client.TaskRun) {
+	if !jsonMode {
+		return nil
+	}
+	return func(run client.TaskRun) {
+		event := JSONEvent{
+			Event:    EventTask,
+			Message:  fmt.Sprintf("%s asked to run %s", run.Peer.Label(), run.Task),
+			RunID:    run.ID,
+			Task:     run.Task,
+			State:    run.State,
+			PeerID:   run.Peer.ID,
+			PeerName: run.Peer.Name,
+		}
+		switch run.State {
+		case client.TaskRunning:
+			event.Message = fmt.Sprintf("%s is running %s", run.Peer.Label(), run.Task)
+		case client.TaskDenied:
+			event.Message = fmt.Sprintf("denied %s for %s", run.Task, run.Peer.Label())
+		case client.TaskFinished:
+			code := run.ExitCode
+			event.ExitCode = &code
+			event.Message = fmt.Sprintf("%s finished with exit code %d", run.Task, code)
+			if run.Err != nil {
+				event.Message = run.Err.Error()
+			}
+		}
+		emitJSON(event)
+	}
+}
+
 func tunnelStatusReporter(jsonMode bool) tunnel.StatusReporter {
 	if !jsonMode {
 		return nil
@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/mdns"
+	"github.com/go-johnnyhe/shadow/internal/ui"
+)
+
+const (
+	// lanServiceType is the DNS-SD service type --lan sessions advertise.
+	lanServiceType = "_shadow._tcp"
+	// discoverTimeout is how long join --discover listens for sessions.
+	discoverTimeout = 2 * time.Second
+)
+
+// lanJoinToken derives a --lan session's join token from its E2E key and
+// the binding lanTokenBinding picks, so a joiner who found the session with
+// --discover needs only the key. The token cannot be turned back into the
+// key, and it only opens the session whose certificate the joiner checked:
+// a machine answering in another session's name gets a token bound to its
+// own certificate, which the real session refuses.
+func lanJoinToken(key, binding string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("shadow lan join token\x00" + binding))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// lanTokenBinding is what a --lan join token is bound to: the pin of a
+// self-signed certificate, or else the host name a certificate from an
+// authority is checked against.
+func lanTokenBinding(pin, host string) string {
+	if pin != "" {
+		return "pin:" + pin
+	}
+	return "host:" + host
+}
+
+// advertiseSession announces a --lan session served at sessionURL over mDNS.
+// The advertisement is public to the network: it names the session and its
+// host and carries the certificate pin, or the TLS host name when the
+// certificate is not self-signed, but never the key or the token.
+func advertiseSession(sessionURL, name, user, pin string) (*mdns.Responder, error) {
+	parsed, err := url.Parse(sessionURL)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(parsed.Port())
+	if err != nil {
+		return nil, fmt.Errorf("session URL %q has no port", sessionURL)
+	}
+	text := map[string]string{"name": name, "user": user}
+	if pin != "" {
+		text["pin"] = pin
+	} else {
+		text["host"] = parsed.Hostname()
+	}
+	return mdns.Advertise(mdns.Service{Type: lanServiceType, Port: port, Text: text})
+}
+
+// discoveredSessionURL builds the join URL for a session found on the
+// network. The advertisement is not authenticated, so the token is bound to
+// the certificate the joiner will check; a session answering in another's
+// name gets a token that opens only itself, and the E2E key stays here.
+func discoveredSessionURL(entry mdns.Entry, key string) (string, error) {
+	host, pin := entry.Addr.String(), entry.Text["pin"]
+	if pin == "" {
+		// A certificate from an authority is checked against its name.
+		host = entry.Text["host"]
+		if host == "" {
+			return "", fmt.Errorf("session %s does not say how to reach it", entry.Instance)
+		}
+	}
+	base := url.URL{Scheme: "https", Host: net.JoinHostPort(host, strconv.Itoa(entry.Port))}
+	return appendSessionCredentials(base.String(), lanJoinToken(key, lanTokenBinding(pin, host)), key, pin)
+}
+
+// discoverSession finds --lan sessions on the local network, asks which to
+// join and, without --key, for its E2E key, and returns the join URL. In JSON
+// mode it lists the sessions as discovered events instead, with join URLs
+// when key is set, and returns "".
+func discoverSession(key string, jsonMode bool) (string, error) {
+	if !jsonMode {
+		fmt.Printf("  %s\n", ui.Dim("looking for sessions on this network..."))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), discoverTimeout)
+	defer cancel()
+	entries, err := mdns.Browse(ctx, lanServiceType)
+	if err != nil {
+		return "", fmt.Errorf("failed to look for sessions: %w", err)
+	}
+
+	if jsonMode {
+		for _, entry := range entries {
+			event := JSONEvent{
+				Event:    EventDiscovered,
+				Message:  entry.Text["name"],
+				PeerName: entry.Text["user"],
+				Address:  net.JoinHostPort(entry.Addr.String(), strconv.Itoa(entry.Port)),
+			}
+			if key != "" {
+				if joinURL, err := discoveredSessionURL(entry, key); err == nil {
+					event.JoinURL = joinURL
+				}
+			}
+			emitJSON(event)
+		}
+		return "", nil
+	}
+	if len(entries) == 0 {
+		return "", fmt.Errorf("no sessions found on this network; the host needs shadow start --lan")
+	}
+
+	for i, entry := range entries {
+		fmt.Printf("  %s  %s  %s\n", ui.Accent(strconv.Itoa(i+1)), entry.Text["name"],
+			ui.Dim(fmt.Sprintf("%s · %s", entry.Text["user"], net.JoinHostPort(entry.Addr.String(), strconv.Itoa(entry.Port)))))
+	}
+	input := bufio.NewScanner(os.Stdin)
+	picked := entries[0]
+	if len(entries) > 1 {
+		fmt.Printf("  %s ", ui.Accent(">"))
+		if !input.Scan() {
+			return "", fmt.Errorf("no session picked")
+		}
+		choice, err := strconv.Atoi(strings.TrimSpace(input.Text()))
+		if err != nil || choice < 1 || choice > len(entries) {
+			return "", fmt.Errorf("pick a session from 1 to %d", len(entries))
+		}
+		picked = entries[choice-1]
+	}
+
+	key = strings.TrimSpace(key)
+	if key == "" {
+		fmt.Printf("  %s ", ui.Dim("E2E key from the host:"))
+		if !input.Scan() {
+			return "", fmt.Errorf("missing E2E key (pass --key)")
+		}
+		key = strings.TrimSpace(input.Text())
+		if key == "" {
+			return "", fmt.Errorf("missing E2E key (pass --key)")
+		}
+	}
+	return discoveredSessionURL(picked, key)
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"net"
+	"testing"
+
+	"github.com/go-johnnyhe/shadow/internal/mdns"
+)
+
+func TestDiscoveredSessionURLCarriesDerivedToken(t *testing.T) {
+	token := lanJoinToken("e2e-key", lanTokenBinding("pin", ""))
+	if token == "" || token == lanJoinToken("other-key", lanTokenBinding("pin", "")) || token == "e2e-key" {
+		t.Fatalf("lanJoinToken(e2e-key) = %q", token)
+	}
+	// A session answering with its own certificate gets a token that does
+	// not open one pinned to another.
+	if token == lanJoinToken("e2e-key", lanTokenBinding("spoofed-pin", "")) {
+		t.Fatal("join token does not depend on the certificate pin")
+	}
+
+	entry := mdns.Entry{
+		Instance: "shadow-abc123",
+		Addr:     net.IPv4(192, 168, 1, 20),
+		Port:     8443,
+		Text:     map[string]string{"name": "project", "user": "alice", "pin": "pin", "host": "ignored.example"},
+	}
+	joinURL, err := discoveredSessionURL(entry, "e2e-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsURL, key, joinToken, pin, err := normalizeSessionWSURL(joinURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wsURL != "wss://192.168.1.20:8443/ws" || key != "e2e-key" || joinToken != token || pin != "pin" {
+		t.Fatalf("discovered session = %s key %q token %q pin %q", wsURL, key, joinToken, pin)
+	}
+
+	// Without a pin the certificate is checked against the advertised name.
+	entry.Text = map[string]string{"host": "dev.example.com"}
+	joinURL, err = discoveredSessionURL(entry, "e2e-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsURL, _, joinToken, _, _ = normalizeSessionWSURL(joinURL)
+	if wsURL != "wss://dev.example.com:8443/ws" || joinToken != lanJoinToken("e2e-key", lanTokenBinding("", "dev.example.com")) {
+		t.Fatalf("discovered session without pin = %s token %q", wsURL, joinToken)
+	}
+
+	entry.Text = nil
+	if _, err := discoveredSessionURL(entry, "e2e-key"); err == nil {
+		t.Fatal("built a URL for a session with neither pin nor host")
+	}
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/server"
+	"gopkg.in/yaml.v3"
+)
+
+// sessionLimits are the relay limits a host sets in the session config's
+// limits section or with start flags. Zero leaves the relay's default.
+type sessionLimits struct {
+	MaxPeers          int           `yaml:"max_peers"`
+	MaxSyncingPeers   int           `yaml:"max_syncing_peers"`
+	MaxQueuedMessages int           `yaml:"max_queued_messages"`
+	MaxQueuedBytes    byteSize      `yaml:"max_queued_bytes"`
+	MaxMessageSize    byteSize      `yaml:"max_message_size"`
+	SyncTimeout       time.Duration `yaml:"sync_timeout"`
+}
+
+// byteSize is a size written like "64MB" in the session config.
+type byteSize int64
+
+func (b *byteSize) UnmarshalYAML(node *yaml.Node) error {
+	var value string
+	if err := node.Decode(&value); err != nil {
+		return err
+	}
+	size, err := parseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(size)
+	return nil
+}
+
+// parseSessionLimits builds limits from start flags, with sizes written like
+// "64MB".
+func parseSessionLimits(maxPeers, maxSyncingPeers, maxQueuedMessages int, maxQueuedBytes, maxMessageSize string, syncTimeout time.Duration) (sessionLimits, error) {
+	queuedBytes, err := parseByteSize(maxQueuedBytes)
+	if err != nil {
+		return sessionLimits{}, fmt.Errorf("--max-queued-bytes: %w", err)
+	}
+	messageSize, err := parseByteSize(maxMessageSize)
+	if err != nil {
+		return sessionLimits{}, fmt.Errorf("--max-message-size: %w", err)
+	}
+	return sessionLimits{
+		MaxPeers:          maxPeers,
+		MaxSyncingPeers:   maxSyncingPeers,
+		MaxQueuedMessages: maxQueuedMessages,
+		MaxQueuedBytes:    byteSize(queuedBytes),
+		MaxMessageSize:    byteSize(messageSize),
+		SyncTimeout:       syncTimeout,
+	}, nil
+}
+
+// override returns l with every limit set in flags replacing it.
+func (l sessionLimits) override(flags sessionLimits) sessionLimits {
+	if flags.MaxPeers != 0 {
+		l.MaxPeers = flags.MaxPeers
+	}
+	if flags.MaxSyncingPeers != 0 {
+		l.MaxSyncingPeers = flags.MaxSyncingPeers
+	}
+	if flags.MaxQueuedMessages != 0 {
+		l.MaxQueuedMessages = flags.MaxQueuedMessages
+	}
+	if flags.MaxQueuedBytes != 0 {
+		l.MaxQueuedBytes = flags.MaxQueuedBytes
+	}
+	if flags.MaxMessageSize != 0 {
+		l.MaxMessageSize = flags.MaxMessageSize
+	}
+	if flags.SyncTimeout != 0 {
+		l.SyncTimeout = flags.SyncTimeout
+	}
+	return l
+}
+
+// apply sets the limits on a relay session config.
+func (l sessionLimits) apply(config server.SessionConfig) server.SessionConfig {
+	config.MaxPeers = l.MaxPeers
+	config.MaxSyncingPeers = l.MaxSyncingPeers
+	config.MaxQueuedMessages = l.MaxQueuedMessages
+	config.MaxQueuedBytes = int(l.MaxQueuedBytes)
+	config.MaxMessageBytes = int(l.MaxMessageSize)
+	config.SyncTimeout = l.SyncTimeout
+	return config
+}
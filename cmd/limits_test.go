@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/server"
+)
+
+func TestSessionLimitsFromConfigAndFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.yaml")
+	if err := os.WriteFile(path, []byte("limits:\n  max_peers: 20\n  max_queued_bytes: 128MB\n  sync_timeout: 5m\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadSessionConfig(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Limits.MaxPeers != 20 || config.Limits.MaxQueuedBytes != 128<<20 || config.Limits.SyncTimeout != 5*time.Minute {
+		t.Fatalf("limits = %+v", config.Limits)
+	}
+
+	flags, err := parseSessionLimits(16, 4, 0, "", "8MB", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := config.Limits.override(flags).apply(server.SessionConfig{})
+	if relay.MaxPeers != 16 || relay.MaxSyncingPeers != 4 || relay.MaxQueuedBytes != 128<<20 || relay.MaxMessageBytes != 8<<20 || relay.SyncTimeout != 5*time.Minute {
+		t.Fatalf("relay config = %+v", relay)
+	}
+	if err := relay.Validate(); err != nil {
+		t.Fatalf("valid limits rejected: %v", err)
+	}
+
+	if _, err := parseSessionLimits(0, 0, 0, "lots", "", 0); err == nil {
+		t.Fatal("accepted an invalid --max-queued-bytes")
+	}
+	if err := os.WriteFile(path, []byte("limits:\n  max_message_size: huge\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSessionConfig(path, true); err == nil {
+		t.Fatal("accepted an invalid max_message_size")
+	}
+}
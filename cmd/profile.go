@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-johnnyhe/shadow/internal/client"
+)
+
+const maxDisplayNameBytes = 64
+
+// localProfile builds the profile this client shares with the session. An
+// empty name falls back to the login name.
+func localProfile(name string) (client.Profile, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = defaultDisplayName()
+	} else if strings.IndexFunc(name, unicode.IsControl) >= 0 || len(name) > maxDisplayNameBytes {
+		return client.Profile{}, fmt.Errorf("--name must be at most %d bytes without control characters", maxDisplayNameBytes)
+	}
+	return client.Profile{
+		Name:    truncateLabel(name),
+		Editor:  truncateLabel(detectEditor()),
+		Version: truncateLabel(Version),
+	}, nil
+}
+
+func defaultDisplayName() string {
+	if current, err := user.Current(); err == nil && current.Username != "" {
+		// Windows reports DOMAIN\user.
+		if _, name, ok := strings.Cut(current.Username, `\`); ok {
+			return name
+		}
+		return current.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return "anonymous"
+}
+
+// detectEditor names the tool driving this client. Editor integrations set
+// SHADOW_EDITOR when they spawn shadow.
+func detectEditor() string {
+	if editor := strings.TrimSpace(os.Getenv("SHADOW_EDITOR")); editor != "" {
+		return editor
+	}
+	if program := strings.TrimSpace(os.Getenv("TERM_PROGRAM")); program != "" {
+		return program
+	}
+	return "terminal"
+}
+
+func truncateLabel(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, value)
+	for len(value) > maxDisplayNameBytes {
+		_, size := utf8.DecodeLastRuneInString(value)
+		value = value[:len(value)-size]
+	}
+	return value
+}
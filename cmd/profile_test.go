@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLocalProfile(t *testing.T) {
+	t.Setenv("SHADOW_EDITOR", "vscode")
+	profile, err := localProfile("  alice ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Name != "alice" || profile.Editor != "vscode" || profile.Version != Version {
+		t.Fatalf("got %+v", profile)
+	}
+
+	if _, err := localProfile("bad\x1bname"); err == nil {
+		t.Fatal("accepted a name with control characters")
+	}
+	if _, err := localProfile(strings.Repeat("a", maxDisplayNameBytes+1)); err == nil {
+		t.Fatal("accepted an overlong name")
+	}
+
+	t.Setenv("SHADOW_EDITOR", strings.Repeat("é", maxDisplayNameBytes))
+	profile, err = localProfile("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Name == "" || len(profile.Editor) > maxDisplayNameBytes || !strings.HasPrefix(profile.Editor, "é") {
+		t.Fatalf("got %+v, want a default name and a truncated editor", profile)
+	}
+}
@@ -0,0 +1,328 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/e2e"
+	"github.com/go-johnnyhe/shadow/internal/ui"
+	"github.com/go-johnnyhe/shadow/server"
+	"github.com/spf13/cobra"
+)
+
+// relayAdminTokenEnv supplies the relay's admin token without putting it on
+// the command line.
+const relayAdminTokenEnv = "SHADOW_RELAY_TOKEN"
+
+var relayListen string
+var relayAdminToken string
+var relayMaxSessions int
+var relayIdleTimeout time.Duration
+var relayMetricsListen string
+var relayTLSCert string
+var relayTLSKey string
+var relaySessionMaxPeers int
+var relaySessionMaxSyncingPeers int
+var relaySessionMaxQueuedMessages int
+var relaySessionMaxQueuedBytes string
+var relaySessionMaxMessageSize string
+var relaySessionMaxSyncTimeout time.Duration
+var relaySessionMaxHostGrace time.Duration
+var relaySessionMaxSnapshotSize string
+var relayNoSnapshotCache bool
+
+var relayCmd = &cobra.Command{
+	Use:   "relay",
+	Short: "Run a long-lived relay that hosts many sessions",
+	Long: `Run a standalone relay for a team. Each session gets its own URL path and
+host and join tokens, created with an authenticated call:
+
+  curl -X POST -H "Authorization: Bearer <admin-token>" https://<relay>/sessions
+
+Hosts and joiners connect to the returned path. Only the session's host
+token can end it early with DELETE /sessions/<id>. Like the relay built into
+shadow start, it only sees encrypted traffic: file contents and names stay
+end-to-end encrypted with a key the relay never learns.
+
+The admin token comes from --admin-token or $` + relayAdminTokenEnv + `, and is
+generated and printed if neither is set.
+
+Tokens travel in request headers, so the relay serves TLS with --tls-cert and
+--tls-key. Without them it only listens on a loopback address, for a TLS
+proxy on the same machine.
+
+Example:
+  shadow relay --listen :8443 --tls-cert relay.crt --tls-key relay.key`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		caps, err := relaySessionCaps(relaySessionMaxPeers, relaySessionMaxSyncingPeers, relaySessionMaxQueuedMessages,
+			relaySessionMaxQueuedBytes, relaySessionMaxMessageSize, relaySessionMaxSnapshotSize, relaySessionMaxSyncTimeout, relaySessionMaxHostGrace)
+		if err != nil {
+			return err
+		}
+		return runRelay(relayListen, relayAdminToken, relayTLSCert, relayTLSKey, relayMetricsListen, server.HubConfig{
+			MaxSessions:     relayMaxSessions,
+			IdleTimeout:     relayIdleTimeout,
+			SessionCaps:     caps,
+			NoSnapshotCache: relayNoSnapshotCache,
+		})
+	},
+}
+
+func runRelay(listen, adminToken, certFile, keyFile, metricsListen string, config server.HubConfig) error {
+	var served *sessionTLS
+	if certFile != "" || keyFile != "" {
+		certificate, err := loadSessionTLS(certFile, keyFile, nil)
+		if err != nil {
+			return err
+		}
+		served = &certificate
+	} else if !loopbackListen(listen) {
+		return fmt.Errorf("refusing to serve tokens over plain HTTP on %s; pass --tls-cert and --tls-key, or listen on 127.0.0.1 behind a TLS proxy", listen)
+	}
+
+	adminToken = strings.TrimSpace(adminToken)
+	if adminToken == "" {
+		adminToken = strings.TrimSpace(os.Getenv(relayAdminTokenEnv))
+	}
+	generated := false
+	if adminToken == "" {
+		token, err := e2e.GenerateShareKey()
+		if err != nil {
+			return fmt.Errorf("failed to generate admin token: %w", err)
+		}
+		adminToken = token
+		generated = true
+	}
+	config.AdminToken = adminToken
+	hub, err := server.NewHub(config)
+	if err != nil {
+		return err
+	}
+	defer hub.Close()
+
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", listen, err)
+	}
+	scheme := "http"
+	if served != nil {
+		listener = tls.NewListener(listener, served.Config)
+		scheme = "https"
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	metricsAddr := ""
+	stopMetrics := func() {}
+	if metricsListen != "" {
+		metricsAddr, stopMetrics, err = serveMetrics(metricsListen, hub.ServeMetrics)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		defer stopMetrics()
+	}
+
+	srv := &http.Server{Handler: hub}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(listener)
+	}()
+
+	fmt.Printf("\n  %s %s\n\n", ui.Accent("◗ shadow relay"), ui.Dim("— listening on "+listener.Addr().String()))
+	if generated {
+		fmt.Printf("  %s\n  %s\n\n", ui.Dim("admin token (set "+relayAdminTokenEnv+" to keep one across restarts):"), ui.Bold(adminToken))
+	}
+	fmt.Printf("  %s\n", ui.Dim("hosts start sessions with: shadow start --relay "+scheme+"://<this-host>"+relayPort(listener.Addr())+" --relay-token <admin token>"))
+	if metricsAddr != "" {
+		fmt.Printf("  %s\n", ui.Dim("metrics at http://"+metricsAddr+"/metrics"))
+	}
+	fmt.Printf("  %s\n", ui.Accent("ctrl+c to stop"))
+
+	select {
+	case <-ctx.Done():
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("relay failed: %w", err)
+		}
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	hub.Close()
+	_ = srv.Shutdown(shutdownCtx)
+	fmt.Printf("\n  %s\n", ui.Dim("relay stopped"))
+	return nil
+}
+
+// relaySessionCaps builds the hub's session caps from relay flags, with
+// sizes written like "64MB".
+func relaySessionCaps(maxPeers, maxSyncingPeers, maxQueuedMessages int, maxQueuedBytes, maxMessageSize, maxSnapshotSize string, maxSyncTimeout, maxHostGrace time.Duration) (server.SessionConfig, error) {
+	queuedBytes, err := parseByteSize(maxQueuedBytes)
+	if err != nil {
+		return server.SessionConfig{}, fmt.Errorf("--session-max-queued-bytes: %w", err)
+	}
+	messageSize, err := parseByteSize(maxMessageSize)
+	if err != nil {
+		return server.SessionConfig{}, fmt.Errorf("--session-max-message-size: %w", err)
+	}
+	snapshotSize, err := parseByteSize(maxSnapshotSize)
+	if err != nil {
+		return server.SessionConfig{}, fmt.Errorf("--session-max-snapshot-size: %w", err)
+	}
+	return server.SessionConfig{
+		MaxPeers:          maxPeers,
+		MaxSyncingPeers:   maxSyncingPeers,
+		MaxQueuedMessages: maxQueuedMessages,
+		MaxQueuedBytes:    int(queuedBytes),
+		MaxMessageBytes:   int(messageSize),
+		MaxSnapshotBytes:  int(snapshotSize),
+		SyncTimeout:       maxSyncTimeout,
+		HostGracePeriod:   maxHostGrace,
+	}, nil
+}
+
+// loopbackListen reports whether listen only accepts connections from this
+// machine.
+func loopbackListen(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// serveMetrics serves handler at /metrics on a listener of its own at
+// listen, so metrics never share the session or relay address. It returns
+// the address it listens on and a function that stops it.
+func serveMetrics(listen string, handler http.HandlerFunc) (string, func(), error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to listen for metrics on %s: %w", listen, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", handler)
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(listener)
+	return listener.Addr().String(), func() { srv.Close() }, nil
+}
+
+// relayPort is the ":port" suffix for addr.
+func relayPort(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return fmt.Sprintf(":%d", tcp.Port)
+	}
+	return ""
+}
+
+func init() {
+	rootCmd.AddCommand(relayCmd)
+	relayCmd.Flags().StringVar(&relayListen, "listen", ":8443", "Address to listen on")
+	relayCmd.Flags().StringVar(&relayAdminToken, "admin-token", "", "Token that authorizes creating sessions (default $"+relayAdminTokenEnv+", or generated)")
+	relayCmd.Flags().StringVar(&relayTLSCert, "tls-cert", "", "Certificate file to serve the relay over TLS with; required unless --listen is a loopback address")
+	relayCmd.Flags().StringVar(&relayTLSKey, "tls-key", "", "Private key file for --tls-cert")
+	relayCmd.Flags().IntVar(&relayMaxSessions, "max-sessions", 100, "Most sessions the relay holds at once")
+	relayCmd.Flags().DurationVar(&relayIdleTimeout, "idle-timeout", 10*time.Minute, "Remove a session once it has had no peers for this long")
+	relayCmd.Flags().IntVar(&relaySessionMaxPeers, "session-max-peers", 0, "Cap on the peers each session may allow, host included; sessions asking for more are refused")
+	relayCmd.Flags().IntVar(&relaySessionMaxSyncingPeers, "session-max-syncing-peers", 0, "Cap on the joiners each session may sync at once")
+	relayCmd.Flags().IntVar(&relaySessionMaxQueuedMessages, "session-max-queued-messages", 0, "Cap on the messages each session may hold for a slow peer")
+	relayCmd.Flags().StringVar(&relaySessionMaxQueuedBytes, "session-max-queued-bytes", "", "Cap on the bytes each session may hold for a slow peer, e.g. 32MB")
+	relayCmd.Flags().StringVar(&relaySessionMaxMessageSize, "session-max-message-size", "", "Cap on the largest message each session may accept, e.g. 8MB")
+	relayCmd.Flags().StringVar(&relaySessionMaxSnapshotSize, "session-max-snapshot-size", "", "Cap on the snapshot each --snapshot-cache session keeps in memory, e.g. 64MB (default 256MB)")
+	relayCmd.Flags().BoolVar(&relayNoSnapshotCache, "no-snapshot-cache", false, "Refuse sessions that ask to keep a snapshot on the relay")
+	relayCmd.Flags().DurationVar(&relaySessionMaxSyncTimeout, "session-max-sync-timeout", 0, "Cap on each session's sync timeout")
+	relayCmd.Flags().DurationVar(&relaySessionMaxHostGrace, "session-max-host-grace", 0, "Cap on each session's host grace period (default 1h)")
+	relayCmd.Flags().StringVar(&relayMetricsListen, "metrics-listen", "", "Serve Prometheus metrics at /metrics on this separate address, without authentication, e.g. 127.0.0.1:9090")
+}
+
+// relaySession is a session created on a remote relay.
+type relaySession struct {
+	server.CreatedSession
+	// sessionURL is what joiners connect to, before credentials are added.
+	sessionURL string
+	// hostURL is the WebSocket URL the host connects to.
+	hostURL string
+}
+
+// createRelaySession registers a session on the relay at relayURL.
+func createRelaySession(relayURL, adminToken string, request server.CreateSessionRequest) (relaySession, error) {
+	base, err := url.Parse(strings.TrimSpace(relayURL))
+	if err != nil || base.Host == "" {
+		return relaySession{}, fmt.Errorf("invalid relay URL %q", relayURL)
+	}
+	switch base.Scheme {
+	case "http", "https":
+	case "ws":
+		base.Scheme = "http"
+	case "wss":
+		base.Scheme = "https"
+	default:
+		return relaySession{}, fmt.Errorf("invalid relay URL %q: use http or https", relayURL)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	base.RawQuery, base.Fragment = "", ""
+
+	adminToken = strings.TrimSpace(adminToken)
+	if adminToken == "" {
+		adminToken = strings.TrimSpace(os.Getenv(relayAdminTokenEnv))
+	}
+	if adminToken == "" {
+		return relaySession{}, fmt.Errorf("--relay needs the relay's admin token; pass --relay-token or set $%s", relayAdminTokenEnv)
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return relaySession{}, err
+	}
+	httpRequest, err := http.NewRequest("POST", base.String()+"/sessions", bytes.NewReader(body))
+	if err != nil {
+		return relaySession{}, err
+	}
+	httpRequest.Header.Set("Authorization", "Bearer "+adminToken)
+	httpRequest.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 15 * time.Second}
+	response, err := client.Do(httpRequest)
+	if err != nil {
+		return relaySession{}, fmt.Errorf("failed to reach relay: %w", err)
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusCreated:
+	case http.StatusUnauthorized:
+		return relaySession{}, fmt.Errorf("relay rejected the admin token")
+	default:
+		detail, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return relaySession{}, fmt.Errorf("relay refused the session: %s %s", response.Status, strings.TrimSpace(string(detail)))
+	}
+
+	var created server.CreatedSession
+	if err := json.NewDecoder(response.Body).Decode(&created); err != nil || created.Path == "" || created.HostToken == "" || created.JoinToken == "" {
+		return relaySession{}, fmt.Errorf("relay sent an invalid session")
+	}
+	hostURL := *base
+	hostURL.Scheme = "ws"
+	if base.Scheme == "https" {
+		hostURL.Scheme = "wss"
+	}
+	hostURL.Path = base.Path + created.Path
+	sessionURL := *base
+	sessionURL.Path = base.Path + strings.TrimSuffix(created.Path, "/ws")
+	return relaySession{CreatedSession: created, sessionURL: sessionURL.String(), hostURL: hostURL.String()}, nil
+}
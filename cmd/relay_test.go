@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/server"
+)
+
+func TestCreateRelaySessionBuildsJoinAndHostURLs(t *testing.T) {
+	hub, err := server.NewHub(server.HubConfig{AdminToken: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	relay := httptest.NewServer(hub)
+	defer relay.Close()
+
+	if _, err := createRelaySession(relay.URL, "wrong", server.CreateSessionRequest{}); err == nil {
+		t.Fatal("created a session with a bad admin token")
+	}
+	t.Setenv(relayAdminTokenEnv, "")
+	if _, err := createRelaySession(relay.URL, "", server.CreateSessionRequest{}); err == nil {
+		t.Fatal("created a session without an admin token")
+	}
+
+	t.Setenv(relayAdminTokenEnv, "admin")
+	session, err := createRelaySession(relay.URL+"/", "", server.CreateSessionRequest{HostGraceSeconds: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantHost := "ws" + strings.TrimPrefix(relay.URL, "http") + "/s/" + session.ID + "/ws"
+	if session.hostURL != wantHost {
+		t.Fatalf("host URL = %q, want %q", session.hostURL, wantHost)
+	}
+
+	joinURL, err := appendSessionCredentials(session.sessionURL, session.JoinToken, "e2e-key", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsURL, key, token, _, err := normalizeSessionWSURL(joinURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wsURL != wantHost || key != "e2e-key" || token != session.JoinToken {
+		t.Fatalf("join URL %q resolves to %q key=%q token=%q", joinURL, wsURL, key, token)
+	}
+
+	host, _, err := dialSessionWebSocket(session.hostURL, session.HostToken, "", nil)
+	if err != nil {
+		t.Fatalf("host could not connect: %v", err)
+	}
+	host.Close()
+}
+
+func TestRelayRefusesPlainHTTPBeyondLoopback(t *testing.T) {
+	for listen, want := range map[string]bool{
+		"127.0.0.1:8443": true,
+		"[::1]:8443":     true,
+		"localhost:8443": true,
+		":8443":          false,
+		"0.0.0.0:8443":   false,
+		"10.0.0.5:8443":  false,
+	} {
+		if got := loopbackListen(listen); got != want {
+			t.Fatalf("loopbackListen(%q) = %v, want %v", listen, got, want)
+		}
+	}
+	if err := runRelay(":0", "admin", "", "", "", server.HubConfig{}); err == nil || !strings.Contains(err.Error(), "--tls-cert") {
+		t.Fatalf("runRelay on all interfaces without TLS = %v", err)
+	}
+}
+
+func TestMetricsAreServedOnTheirOwnListener(t *testing.T) {
+	addr, stop, err := serveMetrics("127.0.0.1:0", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "shadow_relay_sessions 0")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	response, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || !strings.Contains(string(body), "shadow_relay_sessions 0") {
+		t.Fatalf("metrics listener returned %d: %s", response.StatusCode, body)
+	}
+}
+
+func TestRelaySessionCapsParseSizes(t *testing.T) {
+	caps, err := relaySessionCaps(4, 1, 0, "32MB", "8MB", "64MB", time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.MaxPeers != 4 || caps.MaxSyncingPeers != 1 || caps.MaxQueuedBytes != 32*1024*1024 || caps.MaxMessageBytes != 8*1024*1024 || caps.MaxSnapshotBytes != 64*1024*1024 || caps.SyncTimeout != time.Minute {
+		t.Fatalf("caps = %+v", caps)
+	}
+	if _, err := relaySessionCaps(0, 0, 0, "lots", "", "", 0, 0); err == nil || !strings.Contains(err.Error(), "--session-max-queued-bytes") {
+		t.Fatalf("bad size error = %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/record"
+	"github.com/go-johnnyhe/shadow/internal/ui"
+	"github.com/spf13/cobra"
+)
+
+var replayInto string
+var replayKey string
+var replaySpeed string
+var replayAt time.Duration
+
+var replayCmd = &cobra.Command{
+	Use:   "replay <recording>",
+	Short: "Rebuild a recorded session's files step by step",
+	Long: `Rebuild the files of a session recorded with shadow start --record into an
+empty directory. Changes are replayed at the pace they happened, or faster
+with --speed. With --at, the files are rebuilt as they were at that point in
+the session and replay stops there.
+
+The recording is encrypted with the session key, which the host passes with
+--key.
+
+Example:
+  shadow replay interview.shadowrec --key <key> --into ./replay --speed 4x
+  shadow replay interview.shadowrec --key <key> --into ./replay --at 12m30s`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if strings.TrimSpace(replayKey) == "" {
+			return fmt.Errorf("--key is required to decrypt the recording")
+		}
+		speed, err := parseReplaySpeed(replaySpeed)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to open recording: %w", err)
+		}
+		defer file.Close()
+		reader, err := record.NewReader(file, replayKey)
+		if err != nil {
+			return err
+		}
+		if err := prepareReplayDir(replayInto); err != nil {
+			return err
+		}
+		options := replayOptions{speed: speed, until: replayAt, stopAt: cmd.Flags().Changed("at")}
+		return replayRecording(reader, replayInto, options, os.Stdout)
+	},
+}
+
+type replayOptions struct {
+	// speed divides the time between changes.
+	speed float64
+	// until ends the replay at this point in the session when stopAt is set.
+	until  time.Duration
+	stopAt bool
+}
+
+// parseReplaySpeed reads a speed such as "4x", "0.5x" or "4".
+func parseReplaySpeed(value string) (float64, error) {
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(value)), "x"), 64)
+	if err != nil || speed <= 0 {
+		return 0, fmt.Errorf("invalid speed %q; use a multiplier such as 4x", value)
+	}
+	return speed, nil
+}
+
+// prepareReplayDir creates dir, which must not already hold files.
+func prepareReplayDir(dir string) error {
+	if dir == "" {
+		return fmt.Errorf("--into is required")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%s is not empty; replay into a new directory", dir)
+	}
+	return nil
+}
+
+// replayRecording applies the recording's entries to root, pausing between
+// operations as options ask.
+func replayRecording(reader *record.Reader, root string, options replayOptions, out io.Writer) error {
+	snapshotFiles := 0
+	operations := 0
+	restored := false
+	announceRestored := func() {
+		if !restored {
+			restored = true
+			fmt.Fprintln(out, ui.Dim(fmt.Sprintf("restored %d files as the session started", snapshotFiles)))
+		}
+	}
+	var last time.Duration
+	for {
+		entry, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if options.stopAt && entry.At > options.until {
+			break
+		}
+		if !entry.Snapshot {
+			announceRestored()
+		}
+		if !entry.Snapshot && !options.stopAt && entry.At > last {
+			time.Sleep(time.Duration(float64(entry.At-last) / options.speed))
+		}
+		if err := applyReplayEntry(root, entry); err != nil {
+			return err
+		}
+		if entry.Snapshot {
+			if !entry.Dir {
+				snapshotFiles++
+			}
+			continue
+		}
+		last = entry.At
+		operations++
+		if !options.stopAt {
+			fmt.Fprintln(out, describeReplayEntry(entry))
+		}
+	}
+	announceRestored()
+	summary := fmt.Sprintf("replayed %d changes", operations)
+	if options.stopAt {
+		summary += " up to " + formatReplayTime(options.until)
+	}
+	fmt.Fprintln(out, ui.Accent(summary+" into "+root))
+	return nil
+}
+
+func applyReplayEntry(root string, entry record.Entry) error {
+	relPath := filepath.FromSlash(entry.Path)
+	if !filepath.IsLocal(relPath) {
+		return fmt.Errorf("recording has an unsafe path %q", entry.Path)
+	}
+	target := filepath.Join(root, relPath)
+	switch {
+	case entry.Delete:
+		if err := os.RemoveAll(target); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", entry.Path, err)
+		}
+	case entry.Dir:
+		if err := os.MkdirAll(target, 0o755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", entry.Path, err)
+		}
+	default:
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", entry.Path, err)
+		}
+		if err := os.WriteFile(target, entry.Content, 0o644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", entry.Path, err)
+		}
+	}
+	return nil
+}
+
+func describeReplayEntry(entry record.Entry) string {
+	who := entry.PeerName
+	if who == "" {
+		who = "peer " + entry.PeerID
+	}
+	verb := "changed"
+	if entry.Delete {
+		verb = "deleted"
+	}
+	return fmt.Sprintf("%s %s %s %s", ui.Dim(formatReplayTime(entry.At)), who, ui.Dim(verb), entry.Path)
+}
+
+// formatReplayTime formats a point in the session as m:ss.
+func formatReplayTime(at time.Duration) string {
+	at = at.Truncate(time.Second)
+	return fmt.Sprintf("%d:%02d", int(at.Minutes()), int(at.Seconds())%60)
+}
+
+func init() {
+	rootCmd.AddCommand(replayCmd)
+	replayCmd.Flags().StringVar(&replayInto, "into", "", "Empty directory to rebuild the files in")
+	replayCmd.Flags().StringVar(&replayKey, "key", "", "Session key the recording was made with")
+	replayCmd.Flags().StringVar(&replaySpeed, "speed", "1x", "Replay faster or slower, e.g. 4x or 0.5x")
+	replayCmd.Flags().DurationVar(&replayAt, "at", 0, "Rebuild the files as they were at this point, e.g. 12m30s")
+}
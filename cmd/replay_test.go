@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/record"
+)
+
+func TestParseReplaySpeed(t *testing.T) {
+	for value, want := range map[string]float64{"4x": 4, "0.5x": 0.5, "2": 2, "1X": 1} {
+		if got, err := parseReplaySpeed(value); err != nil || got != want {
+			t.Errorf("parseReplaySpeed(%q) = %v, %v; want %v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "fast", "0x", "-2x"} {
+		if _, err := parseReplaySpeed(value); err == nil {
+			t.Errorf("parseReplaySpeed(%q) succeeded", value)
+		}
+	}
+}
+
+func TestReplayStopsAtPointInTime(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "session.shadowrec")
+	w, err := record.Create(path, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.RecordSnapshot("notes.txt", []byte("v1"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.RecordOperation(1, "2", "bob", "notes.txt", []byte("v2"), false); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := w.RecordOperation(2, "2", "bob", "notes.txt", nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	replay := func(options replayOptions) string {
+		t.Helper()
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		reader, err := record.NewReader(file, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		into := filepath.Join(t.TempDir(), "replay")
+		if err := prepareReplayDir(into); err != nil {
+			t.Fatal(err)
+		}
+		if err := replayRecording(reader, into, options, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		return into
+	}
+
+	into := replay(replayOptions{speed: 1, until: 25 * time.Millisecond, stopAt: true})
+	if got, _ := os.ReadFile(filepath.Join(into, "notes.txt")); string(got) != "v2" {
+		t.Fatalf("notes.txt at 25ms = %q, want v2", got)
+	}
+	into = replay(replayOptions{speed: 100})
+	if _, err := os.Stat(filepath.Join(into, "notes.txt")); !os.IsNotExist(err) {
+		t.Fatalf("notes.txt survived its deletion: %v", err)
+	}
+	if err := prepareReplayDir(dir); err == nil {
+		t.Fatal("replayed into a directory that is not empty")
+	}
+}
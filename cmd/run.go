@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/go-johnnyhe/shadow/internal/control"
+	"github.com/spf13/cobra"
+)
+
+var runCmd = &cobra.Command{
+	Use:   "run [task]",
+	Short: "Run one of the host's tasks in the running session",
+	Long: `Run a task the host defined in the session config, such as "test", from a
+terminal inside the shared directory. The task runs on the host's machine and
+its output and exit code come back here. Without a task, list the tasks.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		info, err := control.Find(cwd)
+		if err != nil {
+			return err
+		}
+		hello := control.Message{Attach: control.AttachTask}
+		if len(args) == 1 {
+			hello.Text = args[0]
+		}
+		stream, err := control.Attach(info, hello)
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+
+		for {
+			message, err := stream.Receive()
+			if err != nil {
+				return fmt.Errorf("the session ended before the task finished")
+			}
+			switch message.Type {
+			case control.TypeTasks:
+				if len(message.Tasks) == 0 {
+					return fmt.Errorf("this session has no tasks; the host defines them in %s", defaultSessionConfig)
+				}
+				for _, task := range message.Tasks {
+					fmt.Println(task)
+				}
+				return nil
+			case control.TypeOutput:
+				_, _ = os.Stdout.Write(message.Data)
+			case control.TypeError:
+				return errors.New(message.Error)
+			case control.TypeExit:
+				if message.Error != "" {
+					return errors.New(message.Error)
+				}
+				if message.ExitCode != nil && *message.ExitCode != 0 {
+					stream.Close()
+					os.Exit(*message.ExitCode)
+				}
+				return nil
+			}
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(runCmd)
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/go-johnnyhe/shadow/internal/control"
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+	"github.com/spf13/cobra"
+)
+
+var sayCmd = &cobra.Command{
+	Use:   "say <message>",
+	Short: "Send a chat message to everyone in the running session",
+	Long: `Send an end-to-end encrypted chat message to the session running in this
+directory. Use "-" to read the message from stdin, for example to share a
+stack trace: go test ./... 2>&1 | shadow say -`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		text := strings.Join(args, " ")
+		if text == "-" {
+			data, err := io.ReadAll(io.LimitReader(os.Stdin, maxChatInputBytes))
+			if err != nil {
+				return fmt.Errorf("failed to read message: %w", err)
+			}
+			text = string(data)
+		}
+		text = strings.TrimSpace(text)
+		if len(text) > protocol.MaxChatBytes {
+			return fmt.Errorf("message is longer than %d bytes", protocol.MaxChatBytes)
+		}
+		dir, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		info, err := control.Find(dir)
+		if err != nil {
+			return err
+		}
+		return control.Call(info, control.Message{Type: control.TypeChat, Text: text})
+	},
+}
+
+// maxChatInputBytes stops "shadow say -" from buffering an unbounded stream;
+// the session rejects anything over the chat size limit anyway.
+const maxChatInputBytes = 1 << 20
+
+func init() {
+	rootCmd.AddCommand(sayCmd)
+}
@@ -3,11 +3,14 @@ package cmd
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"fmt"
+	"github.com/go-johnnyhe/shadow/internal/checkpoint"
 	"github.com/go-johnnyhe/shadow/internal/client"
 	"github.com/go-johnnyhe/shadow/internal/e2e"
 	"github.com/go-johnnyhe/shadow/internal/opener"
 	"github.com/go-johnnyhe/shadow/internal/protocol"
+	"github.com/go-johnnyhe/shadow/internal/record"
 	"github.com/go-johnnyhe/shadow/internal/tunnel"
 	"github.com/go-johnnyhe/shadow/internal/ui"
 	"github.com/go-johnnyhe/shadow/server"
@@ -18,26 +21,88 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
 )
 
+const (
+	defaultRepairInterval = 5 * time.Minute
+	defaultHostGrace      = 2 * time.Minute
+)
+
 type StartOptions struct {
-	Path            string
-	Port            int
-	E2EKey          string
-	ReadOnlyJoiners bool
-	Force           bool
-	JSONMode        bool
+	Path               string
+	Port               int
+	E2EKey             string
+	ReadOnlyJoiners    bool
+	ApproveJoinerEdits bool
+	WritePolicy        *client.WritePolicy
+	Force              bool
+	JSONMode           bool
+	RepairInterval     time.Duration
+	MaxUploadRate      int64
+	HostGrace          time.Duration
+	AllowStandby       bool
+	Profile            client.Profile
+	// Follow opens the locations peers focus on in this editor.
+	Follow *opener.Editor
+	// ShareTerminal runs a shell the session streams to joiners, who may
+	// type into it when TerminalInput is set.
+	ShareTerminal bool
+	TerminalInput bool
+	// Forward lists localhost ports joiners can reach through the session.
+	Forward []int
+	// ConfigPath names the session config; empty reads defaultSessionConfig
+	// from the shared directory if it exists.
+	ConfigPath   string
+	ConfirmTasks bool
+	// Record names a file to keep an encrypted recording of the session in.
+	Record string
+	// ExportPatch names a file to write the session's changes to on exit.
+	ExportPatch string
+	// CheckpointBranch names a git branch the shared files are committed to
+	// every CheckpointInterval and when the session ends.
+	CheckpointBranch   string
+	CheckpointInterval time.Duration
+	// Relay hosts the session on a shadow relay at this URL instead of a
+	// local server and tunnel. RelayToken is its admin token.
+	Relay      string
+	RelayToken string
+	// MetricsListen serves the built-in relay's Prometheus metrics at
+	// /metrics on this address, apart from the session URL.
+	MetricsListen string
+	// Limits overrides the relay limits in the session config.
+	Limits sessionLimits
+	// SnapshotCache keeps an encrypted snapshot on the relay that new joiners
+	// sync from instead of the host.
+	SnapshotCache bool
+	// TLS serves the session directly over TLS at TLSHost instead of through
+	// a tunnel, with TLSCert and TLSKey or a self-signed certificate whose
+	// pin goes in the join URL.
+	TLS     bool
+	TLSCert string
+	TLSKey  string
+	TLSHost string
+	// LAN serves the session over TLS on the local network and advertises
+	// it over mDNS for join --discover. Its join token is derived from the
+	// E2E key.
+	LAN bool
 }
 
 type JoinOptions struct {
-	SessionURL string
-	E2EKey     string
-	Path       string
-	JSONMode   bool
+	SessionURL     string
+	E2EKey         string
+	Path           string
+	JSONMode       bool
+	RepairInterval time.Duration
+	MaxUploadRate  int64
+	StandbyHost    bool
+	Profile        client.Profile
+	Follow         *opener.Editor
+	ExportPatch    string
 }
 
 func runStart(opts StartOptions) error {
@@ -52,14 +117,6 @@ func runStart(opts StartOptions) error {
 		}
 		opts.E2EKey = generatedKey
 	}
-	hostToken, err := e2e.GenerateShareKey()
-	if err != nil {
-		return fmt.Errorf("failed to generate host token: %w", err)
-	}
-	joinToken, err := e2e.GenerateShareKey()
-	if err != nil {
-		return fmt.Errorf("failed to generate join token: %w", err)
-	}
 
 	if opts.JSONMode {
 		emitJSON(JSONEvent{Event: EventStarting, Message: "Starting session"})
@@ -98,6 +155,34 @@ func runStart(opts StartOptions) error {
 	if err := validateShareBaseDir(shareBaseDir); err != nil {
 		return err
 	}
+	configPath := opts.ConfigPath
+	if configPath == "" {
+		configPath = filepath.Join(shareBaseDir, defaultSessionConfig)
+	}
+	config, err := loadSessionConfig(configPath, opts.ConfigPath != "")
+	if err != nil {
+		return err
+	}
+	confirmTasks := (opts.ConfirmTasks || config.ConfirmTasks) && len(config.Tasks) > 0
+	limits := config.Limits.override(opts.Limits)
+	if err := limits.apply(server.SessionConfig{}).Validate(); err != nil {
+		return fmt.Errorf("invalid session limits: %w", err)
+	}
+	var checkpoints *checkpoint.Repo
+	if opts.CheckpointBranch != "" {
+		checkpoints, err = checkpoint.Open(absSharePath, opts.CheckpointBranch)
+		if err != nil {
+			return fmt.Errorf("--checkpoint-branch: %w", err)
+		}
+	}
+	var recorder *record.Writer
+	if opts.Record != "" {
+		recorder, err = record.Create(opts.Record, opts.E2EKey)
+		if err != nil {
+			return err
+		}
+		defer recorder.Close()
+	}
 	if shareSingleFile == "" {
 		outboundIgnore := client.NewOutboundIgnore(shareBaseDir)
 		estimate, err := estimateShareSnapshot(shareBaseDir, outboundIgnore)
@@ -116,73 +201,92 @@ func runStart(opts StartOptions) error {
 		}
 	}
 
-	actualPort, listener, err := findAvailablePort(opts.Port)
-	if err != nil {
-		return fmt.Errorf("failed to find available port: %w", err)
-	}
-	if actualPort != opts.Port {
-		if opts.JSONMode {
-			emitJSON(JSONEvent{Event: EventWarning, Message: fmt.Sprintf("Port %d in use, using %d", opts.Port, actualPort)})
-		} else {
-			fmt.Printf("Port %d was in use, using port %d instead\n", opts.Port, actualPort)
-		}
-	}
-
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	mux := http.NewServeMux()
-	relay := server.NewRelay(server.SessionConfig{
-		ReadOnlyJoiners: opts.ReadOnlyJoiners,
-		HostToken:       hostToken,
-		JoinToken:       joinToken,
-	})
-	mux.Handle("/ws", relay)
-	srv := &http.Server{Handler: mux}
-	go func() {
-		if serveErr := srv.Serve(listener); serveErr != http.ErrServerClosed {
-			if opts.JSONMode {
-				emitJSONError(fmt.Sprintf("Server failed: %v", serveErr))
-			} else {
-				fmt.Printf("Server failed: %v\n", serveErr)
-			}
-			os.Exit(1)
+	reviewJoinerEdits := opts.ApproveJoinerEdits && !opts.ReadOnlyJoiners
+	// With a write policy, joiner edits go to the host first so a
+	// disallowed one never reaches the other joiners.
+	routeJoinerEdits := reviewJoinerEdits || (opts.WritePolicy != nil && !opts.ReadOnlyJoiners)
+	var sessionURL, hostURL, hostToken, joinToken, hostPin, joinPin string
+	shutdownRelay := func() {}
+	if opts.Relay != "" {
+		remote, err := createRelaySession(opts.Relay, opts.RelayToken, server.CreateSessionRequest{
+			ReadOnlyJoiners:    opts.ReadOnlyJoiners,
+			ApproveJoinerEdits: routeJoinerEdits,
+			HostGraceSeconds:   int(opts.HostGrace / time.Second),
+			AllowStandby:       opts.AllowStandby,
+			MaxPeers:           limits.MaxPeers,
+			MaxSyncingPeers:    limits.MaxSyncingPeers,
+			MaxQueuedMessages:  limits.MaxQueuedMessages,
+			MaxQueuedBytes:     int(limits.MaxQueuedBytes),
+			MaxMessageBytes:    int(limits.MaxMessageSize),
+			SyncTimeoutSeconds: int(limits.SyncTimeout / time.Second),
+			SnapshotCache:      opts.SnapshotCache,
+		})
+		if err != nil {
+			return err
 		}
-	}()
-
-	time.Sleep(1 * time.Second)
-
-	// Spinner — skip in JSON mode.
-	spinDone := make(chan struct{})
-	spinExited := make(chan struct{})
-	if opts.JSONMode {
-		close(spinExited)
+		sessionURL, hostURL = remote.sessionURL, remote.hostURL
+		hostToken, joinToken = remote.HostToken, remote.JoinToken
 	} else {
-		go func() {
-			defer close(spinExited)
-			frames := []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
-			i := 0
-			for {
-				select {
-				case <-spinDone:
-					fmt.Printf("\r\033[K")
-					return
-				default:
-					fmt.Printf("\r  %s %s", frames[i%len(frames)], ui.Dim("casting shadow..."))
-					i++
-					time.Sleep(80 * time.Millisecond)
+		hostToken, err = e2e.GenerateShareKey()
+		if err != nil {
+			return fmt.Errorf("failed to generate host token: %w", err)
+		}
+		var served *sessionTLS
+		if opts.TLS {
+			if opts.TLSHost == "" && opts.TLSCert == "" {
+				opts.TLSHost = lanHost()
+			}
+			certificate, err := loadSessionTLS(opts.TLSCert, opts.TLSKey, []string{opts.TLSHost})
+			if err != nil {
+				return err
+			}
+			opts.TLSHost, err = certificate.servedHost(opts.TLSHost)
+			if err != nil {
+				return err
+			}
+			served = &certificate
+			hostPin = certificate.Pin
+			if certificate.SelfSigned {
+				joinPin = certificate.Pin
+			}
+		}
+		if opts.LAN {
+			joinToken = lanJoinToken(opts.E2EKey, lanTokenBinding(joinPin, opts.TLSHost))
+		} else {
+			joinToken, err = e2e.GenerateShareKey()
+			if err != nil {
+				return fmt.Errorf("failed to generate join token: %w", err)
+			}
+		}
+		sessionURL, hostURL, shutdownRelay, err = serveLocalRelay(ctx, opts, served, limits.apply(server.SessionConfig{
+			ReadOnlyJoiners:    opts.ReadOnlyJoiners,
+			ApproveJoinerEdits: routeJoinerEdits,
+			HostToken:          hostToken,
+			JoinToken:          joinToken,
+			HostGracePeriod:    opts.HostGrace,
+			AllowStandby:       opts.AllowStandby,
+			SnapshotCache:      opts.SnapshotCache,
+		}))
+		if err != nil {
+			return err
+		}
+		if opts.LAN {
+			responder, err := advertiseSession(sessionURL, filepath.Base(absSharePath), opts.Profile.Name, joinPin)
+			if err != nil {
+				if opts.JSONMode {
+					emitJSON(JSONEvent{Event: EventWarning, Message: fmt.Sprintf("Could not advertise the session on the network: %v", err)})
+				} else {
+					fmt.Printf("  %s\n", ui.Warn(fmt.Sprintf("could not advertise the session on the network: %v", err)))
 				}
+			} else {
+				defer responder.Close()
 			}
-		}()
-	}
-
-	tunnelURL, err := tunnel.StartCloudflaredTunnel(ctx, actualPort, tunnelStatusReporter(opts.JSONMode))
-	close(spinDone)
-	<-spinExited
-	if err != nil {
-		return fmt.Errorf("failed to create tunnel: %w (server is running locally on localhost:%d)", err, actualPort)
+		}
 	}
-	shareJoinURL, err := appendSessionCredentials(tunnelURL, joinToken, opts.E2EKey)
+	shareJoinURL, err := appendSessionCredentials(sessionURL, joinToken, opts.E2EKey, joinPin)
 	if err != nil {
 		return err
 	}
@@ -208,22 +312,50 @@ func runStart(opts StartOptions) error {
 			fmt.Printf("  %s", ui.Bold("✓ copied to clipboard"))
 		}
 		fmt.Print("\n\n")
+		if opts.LAN {
+			fmt.Printf("  %s\n\n", ui.Dim("or, on this network: shadow join --discover --key "+opts.E2EKey))
+		}
 		footer := "encrypted end-to-end · ctrl+c to stop"
 		if opts.ReadOnlyJoiners {
 			footer += " · joiners are read-only"
+		} else if reviewJoinerEdits {
+			footer += " · joiner edits need approval"
 		}
 		fmt.Printf("  %s\n", ui.Accent(footer))
+		if len(config.Tasks) > 0 {
+			fmt.Printf("  %s\n", ui.Dim("tasks: "+strings.Join(config.taskNames(), ", ")+" · joiners run them with shadow run <task>"))
+		}
+		if recorder != nil {
+			fmt.Printf("  %s\n", ui.Dim(fmt.Sprintf("recording to %s · replay with: shadow replay %s --key %s --into <dir>", opts.Record, opts.Record, opts.E2EKey)))
+		}
+		if checkpoints != nil {
+			when := "when the session ends"
+			if opts.CheckpointInterval > 0 {
+				when = "every " + formatDuration(opts.CheckpointInterval)
+			}
+			fmt.Printf("  %s\n", ui.Dim(fmt.Sprintf("checkpoints to %s %s · restore with: git checkout %s -- <path>", checkpoints.Branch(), when, checkpoints.Branch())))
+		}
+	}
+
+	var checkpointer *checkpointLoop
+	if checkpoints != nil {
+		checkpointer = startCheckpoints(checkpoints, opts.CheckpointInterval, opts.JSONMode)
+		defer checkpointer.Stop()
 	}
 
 	clientOnEvent := jsonOnEvent(opts.JSONMode)
+	controlServer := openControl(shareBaseDir, opts.JSONMode)
+	defer closeControl(controlServer)
 
 	var sessionFileCount atomic.Int64
 	var connectionLost atomic.Bool
 	sessionStart := time.Now()
+	hostClient := make(chan *client.Client, 1)
+	var sessionClient atomic.Pointer[client.Client]
 
-	go func(runCtx context.Context, port int) {
+	go func(runCtx context.Context) {
 		time.Sleep(500 * time.Millisecond)
-		conn, _, dialErr := dialSessionWebSocket(fmt.Sprintf("ws://localhost:%d/ws", port), hostToken)
+		conn, _, dialErr := dialSessionWebSocket(hostURL, hostToken, hostPin, nil)
 		if dialErr != nil {
 			if opts.JSONMode {
 				emitJSONError(fmt.Sprintf("Local connection failed: %v", dialErr))
@@ -236,13 +368,44 @@ func runStart(opts StartOptions) error {
 		}
 		defer conn.Close()
 
-		c, clientErr := client.NewClient(conn, client.Options{
-			IsHost:     true,
-			E2EKey:     opts.E2EKey,
-			BaseDir:    shareBaseDir,
-			SingleFile: shareSingleFile,
-			OnEvent:    clientOnEvent,
-		})
+		hostOptions := client.Options{
+			IsHost:              true,
+			E2EKey:              opts.E2EKey,
+			BaseDir:             shareBaseDir,
+			SingleFile:          shareSingleFile,
+			RepairInterval:      opts.RepairInterval,
+			MaxUploadRate:       opts.MaxUploadRate,
+			OnEvent:             clientOnEvent,
+			ApproveJoinerEdits:  routeJoinerEdits,
+			ApproveAllowedEdits: !reviewJoinerEdits,
+			OnProposal:          jsonOnProposal(opts.JSONMode),
+			WritePolicy:         opts.WritePolicy,
+			ReconnectWindow:     opts.HostGrace,
+			Profile:             opts.Profile,
+			OnRoster:            jsonOnRoster(opts.JSONMode),
+			OnFileReceived:      jsonOnFileReceived(opts.JSONMode),
+			OnPresence:          controlPresence(controlServer, shareBaseDir),
+			OnChat:              jsonOnChat(opts.JSONMode),
+			OnFocus:             focusHandler(opts.JSONMode, opts.Follow, shareBaseDir),
+			ForwardPorts:        opts.Forward,
+			Tasks:               config.taskNames(),
+			RunTask:             taskRunner(shareBaseDir, config.Tasks),
+			ConfirmTasks:        confirmTasks,
+			OnTaskRun:           jsonOnTaskRun(opts.JSONMode),
+			ExportPatch:         opts.ExportPatch != "",
+		}
+		if recorder != nil {
+			hostOptions.Recorder = recorder
+		}
+		if opts.HostGrace > 0 {
+			hostOptions.Redial = func(resumeSequence uint64) (*websocket.Conn, error) {
+				header := http.Header{}
+				header.Set(protocol.ResumeHeader, strconv.FormatUint(resumeSequence, 10))
+				conn, _, err := dialSessionWebSocket(hostURL, hostToken, hostPin, header)
+				return conn, err
+			}
+		}
+		c, clientErr := client.NewClient(conn, hostOptions)
 		if clientErr != nil {
 			if opts.JSONMode {
 				emitJSONError(fmt.Sprintf("E2E init failed: %v", clientErr))
@@ -254,6 +417,21 @@ func runStart(opts StartOptions) error {
 			return
 		}
 		c.Start(runCtx)
+		sessionClient.Store(c)
+		serveControl(controlServer, c, shareBaseDir)
+		if opts.ShareTerminal {
+			stopTerminal, terminalErr := shareTerminal(c, shareBaseDir, opts.TerminalInput)
+			if terminalErr != nil {
+				if opts.JSONMode {
+					emitJSON(JSONEvent{Event: EventWarning, Message: terminalErr.Error()})
+				} else {
+					fmt.Println("Warning:", terminalErr)
+				}
+			} else {
+				defer stopTerminal()
+			}
+		}
+		hostClient <- c
 		count, snapshotErr := c.SendInitialSnapshot()
 		if snapshotErr != nil {
 			if opts.JSONMode {
@@ -277,16 +455,29 @@ func runStart(opts StartOptions) error {
 				stop()
 			}
 		}
-	}(ctx, actualPort)
+	}(ctx)
 
 	if !opts.JSONMode && isInteractiveSession() {
 		promptOpenIn(absSharePath)
 		fmt.Println()
 	}
+	if reviewJoinerEdits || confirmTasks {
+		if !opts.JSONMode {
+			if reviewJoinerEdits {
+				fmt.Printf("  %s\n", ui.Dim("review joiner edits with: approve <n|all>, reject <n|all>, list"))
+			}
+			if confirmTasks {
+				fmt.Printf("  %s\n", ui.Dim("confirm task runs with: allow <n|all>, deny <n|all>, list"))
+			}
+		}
+		go runApprovalCommands(ctx, os.Stdin, hostClient, opts.JSONMode)
+	}
 
 	<-ctx.Done()
-	srv.Shutdown(context.Background())
+	shutdownRelay()
 	time.Sleep(100 * time.Millisecond)
+	exportPatchOnExit(sessionClient.Load(), opts.ExportPatch, opts.JSONMode)
+	checkpointer.Stop()
 	if connectionLost.Load() {
 		return nil
 	}
@@ -313,7 +504,7 @@ func runJoin(opts JoinOptions) error {
 		return fmt.Errorf("join path must be a directory")
 	}
 
-	wsURL, keyFromURL, joinToken, err := normalizeSessionWSURL(opts.SessionURL)
+	wsURL, keyFromURL, joinToken, pin, err := normalizeSessionWSURL(opts.SessionURL)
 	if err != nil {
 		return err
 	}
@@ -335,11 +526,18 @@ func runJoin(opts JoinOptions) error {
 	if !opts.JSONMode {
 		fmt.Printf("\n  %s", ui.Dim("connecting..."))
 	}
-	conn, _, err := dialSessionWebSocket(wsURL, joinToken)
+	joinHeader := http.Header{}
+	if opts.StandbyHost {
+		joinHeader.Set(protocol.StandbyHeader, "1")
+	}
+	conn, response, err := dialSessionWebSocket(wsURL, joinToken, pin, joinHeader)
 	if err != nil {
 		if !opts.JSONMode {
 			fmt.Println()
 		}
+		if opts.StandbyHost && response != nil && response.StatusCode == http.StatusForbidden {
+			return fmt.Errorf("this session does not accept standby hosts; join without --standby-host, or ask the host to start with --allow-standby")
+		}
 		return fmt.Errorf("error making connection: %w", err)
 	}
 	defer conn.Close()
@@ -351,22 +549,35 @@ func runJoin(opts JoinOptions) error {
 	}
 
 	clientOnEvent := jsonOnEvent(opts.JSONMode)
+	absJoinDir, _ := filepath.Abs(joinBaseDir)
+	if absJoinDir == "" {
+		absJoinDir = joinBaseDir
+	}
+	controlServer := openControl(absJoinDir, opts.JSONMode)
+	defer closeControl(controlServer)
 
 	c, err := client.NewClient(conn, client.Options{
-		E2EKey:  joinKey,
-		BaseDir: joinBaseDir,
-		OnEvent: clientOnEvent,
+		E2EKey:              joinKey,
+		BaseDir:             joinBaseDir,
+		RepairInterval:      opts.RepairInterval,
+		MaxUploadRate:       opts.MaxUploadRate,
+		OnEvent:             clientOnEvent,
+		OnBootstrapProgress: jsonOnBootstrapProgress(opts.JSONMode),
+		Profile:             opts.Profile,
+		OnRoster:            jsonOnRoster(opts.JSONMode),
+		OnFileReceived:      jsonOnFileReceived(opts.JSONMode),
+		OnPresence:          controlPresence(controlServer, absJoinDir),
+		OnChat:              jsonOnChat(opts.JSONMode),
+		OnFocus:             focusHandler(opts.JSONMode, opts.Follow, absJoinDir),
+		ExportPatch:         opts.ExportPatch != "",
 	})
 	if err != nil {
 		return fmt.Errorf("error initializing E2E client: %w", err)
 	}
-	absJoinDir, _ := filepath.Abs(joinBaseDir)
-	if absJoinDir == "" {
-		absJoinDir = joinBaseDir
-	}
 
 	sessionStart := time.Now()
 	c.Start(ctx)
+	serveControl(controlServer, c, absJoinDir)
 
 	if !opts.JSONMode && isInteractiveSession() {
 		promptOpenIn(absJoinDir)
@@ -380,6 +591,7 @@ func runJoin(opts JoinOptions) error {
 	case <-c.Done():
 		disconnected = ctx.Err() == nil
 	}
+	exportPatchOnExit(c, opts.ExportPatch, opts.JSONMode)
 	if disconnected {
 		return nil
 	}
@@ -392,29 +604,123 @@ func runJoin(opts JoinOptions) error {
 	return nil
 }
 
-func normalizeSessionWSURL(rawURL string) (string, string, string, error) {
+// serveLocalRelay runs the session's relay on a local port behind a
+// cloudflared tunnel, or serves it directly over TLS at opts.TLSHost when
+// served is set. It returns the public session URL, the URL the host connects
+// to and a function that stops the server.
+func serveLocalRelay(ctx context.Context, opts StartOptions, served *sessionTLS, config server.SessionConfig) (string, string, func(), error) {
+	actualPort, listener, err := findAvailablePort(opts.Port)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to find available port: %w", err)
+	}
+	if actualPort != opts.Port {
+		if opts.JSONMode {
+			emitJSON(JSONEvent{Event: EventWarning, Message: fmt.Sprintf("Port %d in use, using %d", opts.Port, actualPort)})
+		} else {
+			fmt.Printf("Port %d was in use, using port %d instead\n", opts.Port, actualPort)
+		}
+	}
+
+	mux := http.NewServeMux()
+	relay := server.NewRelay(config)
+	mux.Handle("/ws", relay)
+	srv := &http.Server{Handler: mux}
+	if served != nil {
+		listener = tls.NewListener(listener, served.Config)
+	}
+	go func() {
+		if serveErr := srv.Serve(listener); serveErr != http.ErrServerClosed {
+			if opts.JSONMode {
+				emitJSONError(fmt.Sprintf("Server failed: %v", serveErr))
+			} else {
+				fmt.Printf("Server failed: %v\n", serveErr)
+			}
+			os.Exit(1)
+		}
+	}()
+
+	shutdown := func() { srv.Shutdown(context.Background()) }
+	if opts.MetricsListen != "" {
+		metricsAddr, stopMetrics, err := serveMetrics(opts.MetricsListen, relay.ServeMetrics)
+		if err != nil {
+			shutdown()
+			return "", "", nil, err
+		}
+		shutdown = func() {
+			stopMetrics()
+			srv.Shutdown(context.Background())
+		}
+		if !opts.JSONMode {
+			fmt.Printf("  %s\n", ui.Dim("metrics at http://"+metricsAddr+"/metrics"))
+		}
+	}
+	if served != nil {
+		sessionURL := url.URL{Scheme: "https", Host: net.JoinHostPort(opts.TLSHost, strconv.Itoa(actualPort))}
+		return sessionURL.String(), fmt.Sprintf("wss://localhost:%d/ws", actualPort), shutdown, nil
+	}
+
+	time.Sleep(1 * time.Second)
+
+	// Spinner — skip in JSON mode.
+	spinDone := make(chan struct{})
+	spinExited := make(chan struct{})
+	if opts.JSONMode {
+		close(spinExited)
+	} else {
+		go func() {
+			defer close(spinExited)
+			frames := []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+			i := 0
+			for {
+				select {
+				case <-spinDone:
+					fmt.Printf("\r\033[K")
+					return
+				default:
+					fmt.Printf("\r  %s %s", frames[i%len(frames)], ui.Dim("casting shadow..."))
+					i++
+					time.Sleep(80 * time.Millisecond)
+				}
+			}
+		}()
+	}
+
+	tunnelURL, err := tunnel.StartCloudflaredTunnel(ctx, actualPort, tunnelStatusReporter(opts.JSONMode))
+	close(spinDone)
+	<-spinExited
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to create tunnel: %w (server is running locally on localhost:%d)", err, actualPort)
+	}
+	return tunnelURL, fmt.Sprintf("ws://localhost:%d/ws", actualPort), shutdown, nil
+}
+
+// normalizeSessionWSURL splits a join URL into the WebSocket URL and the
+// credentials in its fragment. Pin is the fingerprint of a self-signed
+// certificate the session is served with, if any.
+func normalizeSessionWSURL(rawURL string) (string, string, string, string, error) {
 	trimmed := strings.TrimSpace(rawURL)
 	if trimmed == "" {
-		return "", "", "", fmt.Errorf("session URL is required")
+		return "", "", "", "", fmt.Errorf("session URL is required")
 	}
 
 	parsed, err := url.Parse(trimmed)
 	if err != nil {
-		return "", "", "", fmt.Errorf("invalid session URL: %w", err)
+		return "", "", "", "", fmt.Errorf("invalid session URL: %w", err)
 	}
 	if parsed.Scheme == "" || parsed.Host == "" {
-		return "", "", "", fmt.Errorf("invalid session URL: expected full URL with scheme and host")
+		return "", "", "", "", fmt.Errorf("invalid session URL: expected full URL with scheme and host")
 	}
 
 	fragmentValues, err := url.ParseQuery(parsed.Fragment)
 	if err != nil {
-		return "", "", "", fmt.Errorf("invalid session credentials")
+		return "", "", "", "", fmt.Errorf("invalid session credentials")
 	}
 	keyFromURL := strings.TrimSpace(fragmentValues.Get("key"))
 	joinToken := strings.TrimSpace(fragmentValues.Get("token"))
+	pin := strings.TrimSpace(fragmentValues.Get("pin"))
 	parsed.Fragment = ""
 	if joinToken == "" {
-		return "", "", "", fmt.Errorf("session URL is missing an access token")
+		return "", "", "", "", fmt.Errorf("session URL is missing an access token")
 	}
 
 	switch parsed.Scheme {
@@ -424,7 +730,10 @@ func normalizeSessionWSURL(rawURL string) (string, string, string, error) {
 		parsed.Scheme = "ws"
 	case "wss", "ws":
 	default:
-		return "", "", "", fmt.Errorf("unsupported URL scheme %q", parsed.Scheme)
+		return "", "", "", "", fmt.Errorf("unsupported URL scheme %q", parsed.Scheme)
+	}
+	if pin != "" && parsed.Scheme != "wss" {
+		return "", "", "", "", fmt.Errorf("session URL pins a certificate but does not use https")
 	}
 
 	if parsed.Path == "" || parsed.Path == "/" {
@@ -433,10 +742,12 @@ func normalizeSessionWSURL(rawURL string) (string, string, string, error) {
 		parsed.Path = strings.TrimSuffix(parsed.Path, "/") + "/ws"
 	}
 
-	return parsed.String(), keyFromURL, joinToken, nil
+	return parsed.String(), keyFromURL, joinToken, pin, nil
 }
 
-func appendSessionCredentials(rawURL, token, fragment string) (string, error) {
+// appendSessionCredentials puts the E2E key, the join token and an optional
+// certificate pin in the URL fragment, which is never sent to the server.
+func appendSessionCredentials(rawURL, token, fragment, pin string) (string, error) {
 	parsed, err := url.Parse(rawURL)
 	if err != nil {
 		return "", fmt.Errorf("failed to build share URL with E2E key: %w", err)
@@ -444,14 +755,28 @@ func appendSessionCredentials(rawURL, token, fragment string) (string, error) {
 	credentials := url.Values{}
 	credentials.Set("key", fragment)
 	credentials.Set("token", token)
+	if pin != "" {
+		credentials.Set("pin", pin)
+	}
 	parsed.Fragment = credentials.Encode()
 	return parsed.String(), nil
 }
 
-func dialSessionWebSocket(wsURL, token string) (*websocket.Conn, *http.Response, error) {
+// dialSessionWebSocket connects to a session. With a pin, the server must
+// present exactly that certificate, and the system roots are not consulted.
+func dialSessionWebSocket(wsURL, token, pin string, headers http.Header) (*websocket.Conn, *http.Response, error) {
 	dialer := *websocket.DefaultDialer
 	dialer.Subprotocols = []string{protocol.WebSocketSubprotocol}
-	headers := http.Header{}
+	if pin != "" {
+		tlsConfig, err := pinnedTLSConfig(pin)
+		if err != nil {
+			return nil, nil, err
+		}
+		dialer.TLSClientConfig = tlsConfig
+	}
+	if headers == nil {
+		headers = http.Header{}
+	}
 	headers.Set("Authorization", "Bearer "+token)
 	conn, response, err := dialer.Dial(wsURL, headers)
 	if err != nil {
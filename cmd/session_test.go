@@ -4,10 +4,11 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestSessionCredentialsStayInURLFragment(t *testing.T) {
-	shareURL, err := appendSessionCredentials("https://example.trycloudflare.com", "join-secret", "e2e-secret")
+	shareURL, err := appendSessionCredentials("https://example.trycloudflare.com", "join-secret", "e2e-secret", "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -22,7 +23,7 @@ func TestSessionCredentialsStayInURLFragment(t *testing.T) {
 		t.Fatalf("credentials are not in fragment: %q", parsed.Fragment)
 	}
 
-	wsURL, key, token, err := normalizeSessionWSURL(shareURL)
+	wsURL, key, token, _, err := normalizeSessionWSURL(shareURL)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -35,7 +36,23 @@ func TestSessionCredentialsStayInURLFragment(t *testing.T) {
 }
 
 func TestNormalizeSessionURLRequiresAccessToken(t *testing.T) {
-	if _, _, _, err := normalizeSessionWSURL("https://example.test#key=only-a-key"); err == nil {
+	if _, _, _, _, err := normalizeSessionWSURL("https://example.test#key=only-a-key"); err == nil {
 		t.Fatal("session URL without access token was accepted")
 	}
 }
+
+func TestAllowStandbyNeedsTrustedJoiners(t *testing.T) {
+	if err := checkAllowStandby(true, false, false, false, time.Minute); err != nil {
+		t.Fatalf("--allow-standby refused in an open session: %v", err)
+	}
+	for name, err := range map[string]error{
+		"read-only":     checkAllowStandby(true, true, false, false, time.Minute),
+		"approve edits": checkAllowStandby(true, false, true, false, time.Minute),
+		"write policy":  checkAllowStandby(true, false, false, true, time.Minute),
+		"no host grace": checkAllowStandby(true, false, false, false, 0),
+	} {
+		if err == nil {
+			t.Fatalf("--allow-standby accepted with %s", name)
+		}
+	}
+}
@@ -2,17 +2,55 @@ package cmd
 
 import (
 	"fmt"
+	"time"
 
+	"github.com/go-johnnyhe/shadow/internal/protocol"
 	"github.com/go-johnnyhe/shadow/internal/ui"
 	"github.com/spf13/cobra"
 )
 
 var startPort int
 var startReadOnlyJoiners bool
+var startApproveJoinerEdits bool
 var startKey string
 var startPathFlag string
 var startForce bool
 var startJSON bool
+var startRepairInterval time.Duration
+var startMaxUploadRate string
+var startHostGrace time.Duration
+var startAllowStandby bool
+var startWriteAllow []string
+var startWriteDeny []string
+var startPeerWriteAllow []string
+var startPeerWriteDeny []string
+var startName string
+var startFollow bool
+var startFollowEditor string
+var startShareTerminal bool
+var startTerminalInput bool
+var startForward []int
+var startConfig string
+var startConfirmTasks bool
+var startRecord string
+var startExportPatch string
+var startCheckpointBranch string
+var startCheckpointInterval time.Duration
+var startRelay string
+var startRelayToken string
+var startMetricsListen string
+var startMaxPeers int
+var startMaxSyncingPeers int
+var startMaxQueuedMessages int
+var startMaxQueuedBytes string
+var startMaxMessageSize string
+var startSyncTimeout time.Duration
+var startSnapshotCache bool
+var startTLS bool
+var startTLSCert string
+var startTLSKey string
+var startTLSHost string
+var startLAN bool
 
 // startCmd represents the start command
 var startCmd = &cobra.Command{
@@ -51,17 +89,153 @@ Perfect for mock interviews, pair programming, and collaborative debugging.`,
 			return nil
 		}
 
+		maxUploadRate, err := parseUploadRate(startMaxUploadRate)
+		if err != nil {
+			if startJSON {
+				emitJSONError(err.Error())
+				return err
+			}
+			fmt.Printf("Error: %v\n", err)
+			return nil
+		}
+
+		limits, err := parseSessionLimits(startMaxPeers, startMaxSyncingPeers, startMaxQueuedMessages, startMaxQueuedBytes, startMaxMessageSize, startSyncTimeout)
+		if err != nil {
+			if startJSON {
+				emitJSONError(err.Error())
+				return err
+			}
+			fmt.Printf("Error: %v\n", err)
+			return nil
+		}
+
+		writePolicy, err := buildWritePolicy(startWriteAllow, startWriteDeny, startPeerWriteAllow, startPeerWriteDeny)
+		if err != nil {
+			if startJSON {
+				emitJSONError(err.Error())
+				return err
+			}
+			fmt.Printf("Error: %v\n", err)
+			return nil
+		}
+
+		if err := checkAllowStandby(startAllowStandby, startReadOnlyJoiners, startApproveJoinerEdits, writePolicy != nil, startHostGrace); err != nil {
+			if startJSON {
+				emitJSONError(err.Error())
+				return err
+			}
+			fmt.Printf("Error: %v\n", err)
+			return nil
+		}
+
+		profile, err := localProfile(startName)
+		if err != nil {
+			if startJSON {
+				emitJSONError(err.Error())
+				return err
+			}
+			fmt.Printf("Error: %v\n", err)
+			return nil
+		}
+
+		follow, err := followEditor(startFollow, startFollowEditor)
+		if err != nil {
+			if startJSON {
+				emitJSONError(err.Error())
+				return err
+			}
+			fmt.Printf("Error: %v\n", err)
+			return nil
+		}
+
+		if err := validateForwardPorts(startForward); err != nil {
+			if startJSON {
+				emitJSONError(err.Error())
+				return err
+			}
+			fmt.Printf("Error: %v\n", err)
+			return nil
+		}
+
+		if startTerminalInput && !startShareTerminal {
+			err := fmt.Errorf("--terminal-input needs --share-terminal")
+			if startJSON {
+				emitJSONError(err.Error())
+				return err
+			}
+			fmt.Printf("Error: %v\n", err)
+			return nil
+		}
+
+		if startMetricsListen != "" && startRelay != "" {
+			err := fmt.Errorf("--metrics-listen serves the built-in relay; run shadow relay --metrics-listen on the relay instead")
+			if startJSON {
+				emitJSONError(err.Error())
+				return err
+			}
+			fmt.Printf("Error: %v\n", err)
+			return nil
+		}
+
+		if startLAN && startRelay != "" {
+			err := fmt.Errorf("--lan serves the session from this machine and cannot be combined with --relay")
+			if startJSON {
+				emitJSONError(err.Error())
+				return err
+			}
+			fmt.Printf("Error: %v\n", err)
+			return nil
+		}
+
+		useTLS := startLAN || startTLS || startTLSCert != "" || startTLSKey != ""
+		if useTLS && startRelay != "" {
+			err := fmt.Errorf("--tls serves the session from this machine; use an https --relay URL instead")
+			if startJSON {
+				emitJSONError(err.Error())
+				return err
+			}
+			fmt.Printf("Error: %v\n", err)
+			return nil
+		}
+
 		if !startJSON {
 			fmt.Printf("\n  %s\n", ui.Dim("◗ shadow"))
 		}
 
 		err = runStart(StartOptions{
-			Path:            targetPath,
-			Port:            startPort,
-			E2EKey:          startKey,
-			ReadOnlyJoiners: startReadOnlyJoiners,
-			Force:           startForce,
-			JSONMode:        startJSON,
+			Path:               targetPath,
+			Port:               startPort,
+			E2EKey:             startKey,
+			ReadOnlyJoiners:    startReadOnlyJoiners,
+			ApproveJoinerEdits: startApproveJoinerEdits,
+			WritePolicy:        writePolicy,
+			Force:              startForce,
+			JSONMode:           startJSON,
+			RepairInterval:     startRepairInterval,
+			MaxUploadRate:      maxUploadRate,
+			HostGrace:          startHostGrace,
+			AllowStandby:       startAllowStandby,
+			Profile:            profile,
+			Follow:             follow,
+			ShareTerminal:      startShareTerminal,
+			TerminalInput:      startTerminalInput,
+			Forward:            startForward,
+			ConfigPath:         startConfig,
+			ConfirmTasks:       startConfirmTasks,
+			Record:             startRecord,
+			ExportPatch:        startExportPatch,
+			CheckpointBranch:   startCheckpointBranch,
+			CheckpointInterval: startCheckpointInterval,
+			Relay:              startRelay,
+			RelayToken:         startRelayToken,
+			MetricsListen:      startMetricsListen,
+			Limits:             limits,
+			SnapshotCache:      startSnapshotCache,
+			TLS:                useTLS,
+			TLSCert:            startTLSCert,
+			TLSKey:             startTLSKey,
+			TLSHost:            startTLSHost,
+			LAN:                startLAN,
 		})
 		if err != nil {
 			if startJSON {
@@ -93,12 +267,82 @@ func resolveStartPath(args []string, pathFlag string) (string, error) {
 	return ".", nil
 }
 
+// validateForwardPorts checks the ports given to --forward.
+func validateForwardPorts(ports []int) error {
+	seen := make(map[int]bool, len(ports))
+	for _, port := range ports {
+		if !protocol.ValidPort(port) {
+			return fmt.Errorf("--forward: invalid port %d", port)
+		}
+		if seen[port] {
+			return fmt.Errorf("--forward: port %d given twice", port)
+		}
+		seen[port] = true
+	}
+	return nil
+}
+
+// checkAllowStandby refuses --allow-standby in sessions that do not trust
+// joiners with their own edits, since a promoted joiner would serve its
+// copy of the files unchecked.
+func checkAllowStandby(allow, readOnly, approve, writePolicy bool, grace time.Duration) error {
+	switch {
+	case !allow:
+		return nil
+	case readOnly:
+		return fmt.Errorf("--allow-standby cannot be used with --read-only-joiners")
+	case approve:
+		return fmt.Errorf("--allow-standby cannot be used with --approve-joiner-edits")
+	case writePolicy:
+		return fmt.Errorf("--allow-standby cannot be used with --write-allow, --write-deny or their per-peer forms")
+	case grace <= 0:
+		return fmt.Errorf("--allow-standby needs a --host-grace above 0")
+	}
+	return nil
+}
+
 func init() {
 	rootCmd.AddCommand(startCmd)
 	startCmd.Flags().IntVarP(&startPort, "port", "p", 8080, "Port to run the server on (will auto-increment if in use)")
 	startCmd.Flags().BoolVar(&startReadOnlyJoiners, "read-only-joiners", false, "Allow joiners to view updates without uploading local edits")
+	startCmd.Flags().BoolVar(&startApproveJoinerEdits, "approve-joiner-edits", false, "Queue joiner edits for you to approve or reject before they sync")
+	startCmd.Flags().StringArrayVar(&startWriteAllow, "write-allow", nil, "Only let joiners change matching paths, e.g. src/ (repeatable)")
+	startCmd.Flags().StringArrayVar(&startWriteDeny, "write-deny", nil, "Never let joiners change matching paths, e.g. go.mod (repeatable)")
+	startCmd.Flags().StringArrayVar(&startPeerWriteAllow, "peer-write-allow", nil, "Narrow --write-allow for the peer joining as <name>, given as <name>=<pattern> (repeatable)")
+	startCmd.Flags().StringArrayVar(&startPeerWriteDeny, "peer-write-deny", nil, "Add to --write-deny for the peer joining as <name>, given as <name>=<pattern> (repeatable)")
+	startCmd.Flags().StringVar(&startName, "name", "", "Name shown to other peers (default your login name)")
+	startCmd.Flags().BoolVar(&startFollow, "follow", false, "Open the file and line a peer focuses on in your editor")
+	startCmd.Flags().StringVar(&startFollowEditor, "follow-editor", "", "Editor command --follow uses, e.g. code, nvim, subl or idea (default detected)")
+	startCmd.Flags().BoolVar(&startShareTerminal, "share-terminal", false, "Share a shell running in the shared directory; peers watch it with shadow terminal")
+	startCmd.Flags().BoolVar(&startTerminalInput, "terminal-input", false, "Let joiners type into the shared terminal")
+	startCmd.Flags().IntSliceVar(&startForward, "forward", nil, "Let joiners reach this localhost port through the session, e.g. 3000 (repeatable)")
+	startCmd.Flags().StringVar(&startConfig, "config", "", "Session config with the tasks joiners can run (default "+defaultSessionConfig+" in the shared directory)")
+	startCmd.Flags().BoolVar(&startConfirmTasks, "confirm-tasks", false, "Ask you to allow each task run a joiner starts")
+	startCmd.Flags().StringVar(&startRecord, "record", "", "Keep an encrypted recording of every file change in this file, e.g. session.shadowrec (see shadow replay)")
+	startCmd.Flags().StringVar(&startExportPatch, "export-patch", "", "When the session ends, write everything changed during it to this patch file (see shadow export-patch)")
+	startCmd.Flags().StringVar(&startCheckpointBranch, "checkpoint-branch", "", "Commit the shared files to this git branch during the session, e.g. shadow/session-2026-10-19, without touching your branch or index")
+	startCmd.Flags().DurationVar(&startCheckpointInterval, "checkpoint-interval", defaultCheckpointInterval, "How often to commit to --checkpoint-branch; it is also committed when the session ends (0 only then)")
+	startCmd.Flags().StringVar(&startRelay, "relay", "", "Host the session on a shadow relay at this URL instead of a local server and cloudflared tunnel")
+	startCmd.Flags().StringVar(&startRelayToken, "relay-token", "", "Admin token of the --relay (default $"+relayAdminTokenEnv+")")
+	startCmd.Flags().StringVar(&startMetricsListen, "metrics-listen", "", "Serve relay metrics in the Prometheus format at /metrics on this address, apart from the session URL, e.g. 127.0.0.1:9090")
+	startCmd.Flags().BoolVar(&startTLS, "tls", false, "Serve the session over TLS from this machine instead of a cloudflared tunnel, with a self-signed certificate pinned in the join URL")
+	startCmd.Flags().StringVar(&startTLSCert, "tls-cert", "", "Certificate file to serve the session over TLS with, instead of a self-signed one (implies --tls)")
+	startCmd.Flags().StringVar(&startTLSKey, "tls-key", "", "Private key file for --tls-cert")
+	startCmd.Flags().BoolVar(&startLAN, "lan", false, "Serve the session on the local network instead of a cloudflared tunnel and advertise it for shadow join --discover (implies --tls)")
+	startCmd.Flags().StringVar(&startTLSHost, "tls-host", "", "Host name or address joiners reach this machine at with --tls; must match --tls-cert (default your LAN address, or the certificate's first DNS name)")
 	startCmd.Flags().StringVar(&startKey, "key", "", "E2E share key (auto-generated if empty)")
 	startCmd.Flags().StringVar(&startPathFlag, "path", "", "Path to share (alternative to positional argument)")
 	startCmd.Flags().BoolVar(&startForce, "force", false, "Bypass large-directory warning and continue")
 	startCmd.Flags().BoolVar(&startJSON, "json", false, "Emit structured JSON events to stdout")
+	startCmd.Flags().DurationVar(&startRepairInterval, "repair-interval", defaultRepairInterval, "How often to reconcile files with joiners (0 disables)")
+	startCmd.Flags().DurationVar(&startHostGrace, "host-grace", defaultHostGrace, "How long joiners wait for you to reconnect before a standby joiner takes over or the session ends (0 ends it at once)")
+	startCmd.Flags().BoolVar(&startAllowStandby, "allow-standby", false, "Let joiners started with --standby-host take over as host if you do not come back within --host-grace")
+	startCmd.Flags().IntVar(&startMaxPeers, "max-peers", 0, "Most peers in the session, you included (default 8, or the session config's)")
+	startCmd.Flags().IntVar(&startMaxSyncingPeers, "max-syncing-peers", 0, "Most joiners receiving the shared files at once (default 2)")
+	startCmd.Flags().IntVar(&startMaxQueuedMessages, "max-queued-messages", 0, "Messages the relay holds for a slow peer before dropping it (default 4096)")
+	startCmd.Flags().StringVar(&startMaxQueuedBytes, "max-queued-bytes", "", "Bytes the relay holds for a slow peer before dropping it, e.g. 128MB (default 64MB)")
+	startCmd.Flags().StringVar(&startMaxMessageSize, "max-message-size", "", "Largest message the relay accepts, up to 20MB; larger files are not synced (default 20MB)")
+	startCmd.Flags().DurationVar(&startSyncTimeout, "sync-timeout", 0, "How long a joiner may take to receive the shared files (default 2m)")
+	startCmd.Flags().BoolVar(&startSnapshotCache, "snapshot-cache", false, "Keep an encrypted snapshot on the relay so new joiners sync from it instead of from you; useful with many spectators")
+	startCmd.Flags().StringVar(&startMaxUploadRate, "max-upload-rate", "", "Cap outbound sync traffic, e.g. 512KB or 2MB per second (default unlimited)")
 }
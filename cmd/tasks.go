@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/client"
+	"github.com/go-johnnyhe/shadow/internal/control"
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultSessionConfig is read from the shared directory when --config is
+// not given. .shadow is never synced, so joiners cannot change the commands
+// the host runs.
+const defaultSessionConfig = ".shadow/session.yaml"
+
+const (
+	maxSessionTasks = 64
+	// taskWaitDelay bounds how long a cancelled task's children may keep its
+	// output open.
+	taskWaitDelay = 2 * time.Second
+)
+
+// sessionConfig is the host's session config file.
+type sessionConfig struct {
+	// Tasks maps task names to shell commands run in the shared directory.
+	Tasks map[string]string `yaml:"tasks"`
+	// ConfirmTasks makes the host allow each run a joiner asks for.
+	ConfirmTasks bool `yaml:"confirm_tasks"`
+	// Limits tunes the relay for this session; start flags override it.
+	Limits sessionLimits `yaml:"limits"`
+}
+
+// loadSessionConfig reads a session config. A missing file is only an error
+// when the user named it.
+func loadSessionConfig(path string, required bool) (sessionConfig, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return sessionConfig{}, nil
+	}
+	if err != nil {
+		return sessionConfig{}, fmt.Errorf("failed to read session config: %w", err)
+	}
+	var config sessionConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return sessionConfig{}, fmt.Errorf("invalid session config %s: %w", path, err)
+	}
+	if len(config.Tasks) > maxSessionTasks {
+		return sessionConfig{}, fmt.Errorf("invalid session config %s: more than %d tasks", path, maxSessionTasks)
+	}
+	for name, command := range config.Tasks {
+		if !protocol.ValidTaskName(name) {
+			return sessionConfig{}, fmt.Errorf("invalid session config %s: task name %q must be short and without spaces", path, name)
+		}
+		if strings.TrimSpace(command) == "" {
+			return sessionConfig{}, fmt.Errorf("invalid session config %s: task %q has no command", path, name)
+		}
+	}
+	return config, nil
+}
+
+func (c sessionConfig) taskNames() []string {
+	names := make([]string, 0, len(c.Tasks))
+	for name := range c.Tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// taskRunner runs tasks from the session config with the system shell in
+// root.
+func taskRunner(root string, tasks map[string]string) client.TaskRunner {
+	if len(tasks) == 0 {
+		return nil
+	}
+	return func(ctx context.Context, name string, out io.Writer) (int, error) {
+		command, ok := tasks[name]
+		if !ok {
+			return 0, fmt.Errorf("no task named %q", name)
+		}
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		if runtime.GOOS == "windows" {
+			cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+		}
+		cmd.Dir = root
+		cmd.Stdout = out
+		cmd.Stderr = out
+		cmd.WaitDelay = taskWaitDelay
+		err := cmd.Run()
+		var exitErr *exec.ExitError
+		switch {
+		case ctx.Err() != nil:
+			return -1, fmt.Errorf("%s was cancelled", name)
+		case errors.As(err, &exitErr):
+			return exitErr.ExitCode(), nil
+		case err != nil:
+			return -1, fmt.Errorf("failed to run %s: %w", name, err)
+		}
+		return 0, nil
+	}
+}
+
+// taskStream serves `shadow run` and other tools attached to run a task.
+func taskStream(c *client.Client) control.StreamHandler {
+	return func(hello control.Message, stream *control.Stream) {
+		if hello.Text == "" {
+			_ = stream.Send(control.Message{Type: control.TypeTasks, Tasks: c.Tasks()})
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			// The tool going away cancels the run.
+			for {
+				if _, err := stream.Receive(); err != nil {
+					cancel()
+					return
+				}
+			}
+		}()
+		code, err := c.RunTask(ctx, hello.Text, streamWriter{stream})
+		exit := control.Message{Type: control.TypeExit, ExitCode: &code}
+		if err != nil {
+			exit.Error = err.Error()
+		}
+		_ = stream.Send(exit)
+	}
+}
+
+// streamWriter sends what is written to it as output messages.
+type streamWriter struct {
+	stream *control.Stream
+}
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	if err := w.stream.Send(control.Message{Type: control.TypeOutput, Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestLoadSessionConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "session.yaml")
+
+	config, err := loadSessionConfig(path, false)
+	if err != nil || len(config.Tasks) != 0 {
+		t.Fatalf("missing optional config = %+v, %v", config, err)
+	}
+	if _, err := loadSessionConfig(path, true); err == nil {
+		t.Fatal("missing --config file was accepted")
+	}
+
+	if err := os.WriteFile(path, []byte("tasks:\n  test: go test ./...\n  lint: go vet ./...\nconfirm_tasks: true\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, err = loadSessionConfig(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.ConfirmTasks || config.Tasks["test"] != "go test ./..." {
+		t.Fatalf("config = %+v", config)
+	}
+	if got := config.taskNames(); !reflect.DeepEqual(got, []string{"lint", "test"}) {
+		t.Fatalf("taskNames() = %v", got)
+	}
+
+	for _, invalid := range []string{
+		"tasks:\n  run tests: go test ./...\n",
+		"tasks:\n  test: \"  \"\n",
+		"task:\n  test: go test ./...\n",
+	} {
+		if err := os.WriteFile(path, []byte(invalid), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadSessionConfig(path, true); err == nil {
+			t.Errorf("accepted invalid config %q", invalid)
+		}
+	}
+}
+
+func TestTaskRunnerReportsExitCode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	dir := t.TempDir()
+	run := taskRunner(dir, map[string]string{"check": "pwd; echo oops >&2; exit 4"})
+
+	var out bytes.Buffer
+	code, err := run(context.Background(), "check", &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 4 {
+		t.Fatalf("exit code = %d, want 4", code)
+	}
+	resolved, _ := filepath.EvalSymlinks(dir)
+	if got := out.String(); !strings.Contains(got, "oops") || !strings.Contains(got, filepath.Base(resolved)) {
+		t.Fatalf("output = %q, want the shared directory and stderr", got)
+	}
+	if _, err := run(context.Background(), "deploy", &out); err == nil {
+		t.Fatal("ran a task that is not in the config")
+	}
+}
@@ -0,0 +1,244 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/x/term"
+	"github.com/go-johnnyhe/shadow/internal/client"
+	"github.com/go-johnnyhe/shadow/internal/control"
+	"github.com/go-johnnyhe/shadow/internal/pty"
+	"github.com/go-johnnyhe/shadow/internal/ui"
+	"github.com/spf13/cobra"
+)
+
+const (
+	defaultTerminalCols = 120
+	defaultTerminalRows = 32
+	// detachKey is Ctrl-], as in telnet.
+	detachKey      = 0x1d
+	interruptKey   = 0x03
+	resizeInterval = 500 * time.Millisecond
+)
+
+var terminalCmd = &cobra.Command{
+	Use:   "terminal",
+	Short: "Attach to the terminal shared in the running session",
+	Long: `Show the terminal the host shares with --share-terminal, from another
+terminal inside the shared directory. Typing reaches the shell when you are the
+host or the host started with --terminal-input; otherwise the view is
+read-only. Press Ctrl-] to detach.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		info, err := control.Find(cwd)
+		if err != nil {
+			return err
+		}
+		return attachTerminal(info)
+	},
+}
+
+func attachTerminal(info control.Info) error {
+	hello := control.Message{Attach: control.AttachTerminal}
+	if cols, rows, err := term.GetSize(os.Stdout.Fd()); err == nil {
+		hello.Cols, hello.Rows = cols, rows
+	}
+	stream, err := control.Attach(info, hello)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	first, err := stream.Receive()
+	if err != nil {
+		return fmt.Errorf("session %d closed the connection", info.PID)
+	}
+	if first.Type == control.TypeError {
+		return errors.New(first.Error)
+	}
+	if first.Closed {
+		if len(first.Data) == 0 {
+			return fmt.Errorf("this session has no shared terminal; the host can share one with --share-terminal")
+		}
+		return fmt.Errorf("the shared terminal has exited")
+	}
+
+	seen := len(first.Data) > 0
+	var writable atomic.Bool
+	writable.Store(first.Writable)
+	mode := "read-only"
+	if first.Writable {
+		mode = "you can type"
+	}
+	fmt.Fprintf(os.Stderr, "%s\r\n", ui.Dim("attached to the shared terminal ("+mode+") · ctrl+] to detach"))
+
+	stdin := os.Stdin.Fd()
+	if term.IsTerminal(stdin) {
+		state, err := term.MakeRaw(stdin)
+		if err != nil {
+			return fmt.Errorf("failed to set up the terminal: %w", err)
+		}
+		defer term.Restore(stdin, state)
+	}
+	_, _ = os.Stdout.Write(first.Data)
+
+	var detached atomic.Bool
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				data := buf[:n]
+				stop := bytes.IndexByte(data, detachKey)
+				if stop < 0 && !writable.Load() {
+					stop = bytes.IndexByte(data, interruptKey)
+				}
+				if stop >= 0 {
+					data = data[:stop]
+				}
+				if len(data) > 0 && writable.Load() {
+					_ = stream.Send(control.Message{Type: control.TypeInput, Data: append([]byte(nil), data...)})
+				}
+				if stop >= 0 {
+					detached.Store(true)
+					_ = stream.Close()
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		cols, rows := hello.Cols, hello.Rows
+		for range time.Tick(resizeInterval) {
+			newCols, newRows, err := term.GetSize(os.Stdout.Fd())
+			if err != nil || (newCols == cols && newRows == rows) {
+				continue
+			}
+			cols, rows = newCols, newRows
+			if stream.Send(control.Message{Type: control.TypeResize, Cols: cols, Rows: rows}) != nil {
+				return
+			}
+		}
+	}()
+
+	lastError := "the session ended"
+	for {
+		message, err := stream.Receive()
+		if err != nil {
+			if detached.Load() {
+				fmt.Fprintf(os.Stderr, "\r\n%s\r\n", ui.Dim("detached"))
+				return nil
+			}
+			return errors.New(lastError)
+		}
+		switch message.Type {
+		case control.TypeOutput:
+			if message.Reset {
+				_, _ = os.Stdout.WriteString("\x1b[H\x1b[2J")
+			}
+			_, _ = os.Stdout.Write(message.Data)
+			writable.Store(message.Writable)
+			seen = seen || len(message.Data) > 0
+			if message.Closed && !seen {
+				return fmt.Errorf("this session has no shared terminal; the host can share one with --share-terminal")
+			}
+			if message.Closed {
+				fmt.Fprintf(os.Stderr, "\r\n%s\r\n", ui.Dim("the shared terminal has exited"))
+				return nil
+			}
+		case control.TypeError:
+			lastError = message.Error
+			fmt.Fprintf(os.Stderr, "\r\n%s\r\n", ui.Dim(message.Error))
+		}
+	}
+}
+
+// shareTerminal starts the user's shell in the shared directory and streams
+// it to the session. The returned func stops the shell.
+func shareTerminal(c *client.Client, root string, allowInput bool) (func(), error) {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	cmd := exec.Command(shell)
+	cmd.Dir = root
+	cmd.Env = append(os.Environ(), "SHADOW_SHARED_TERMINAL=1")
+	if os.Getenv("TERM") == "" {
+		cmd.Env = append(cmd.Env, "TERM=xterm-256color")
+	}
+	terminal, err := pty.Start(cmd, defaultTerminalCols, defaultTerminalRows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start the shared terminal: %w", err)
+	}
+	go cmd.Wait()
+	c.ShareTerminal(terminal, allowInput, func(cols, rows int) error {
+		return pty.Resize(terminal, cols, rows)
+	})
+	return func() {
+		_ = terminal.Close()
+		_ = cmd.Process.Kill()
+	}, nil
+}
+
+// terminalStream serves `shadow terminal` viewers attached through the
+// control interface.
+func terminalStream(c *client.Client) control.StreamHandler {
+	return func(hello control.Message, stream *control.Stream) {
+		watch := c.WatchTerminal()
+		defer watch.Close()
+		first := control.Message{Type: control.TypeOutput, Data: watch.History, Writable: watch.Writable, Closed: watch.Closed}
+		if stream.Send(first) != nil || watch.Closed {
+			return
+		}
+		_ = c.ResizeTerminal(hello.Cols, hello.Rows)
+
+		go func() {
+			defer watch.Close()
+			for {
+				message, err := stream.Receive()
+				if err != nil {
+					return
+				}
+				switch message.Type {
+				case control.TypeInput:
+					err = c.TerminalWrite(message.Data)
+				case control.TypeResize:
+					err = c.ResizeTerminal(message.Cols, message.Rows)
+				}
+				if err != nil {
+					_ = stream.Send(control.Message{Type: control.TypeError, Error: err.Error()})
+				}
+			}
+		}()
+
+		for update := range watch.Updates {
+			message := control.Message{
+				Type:     control.TypeOutput,
+				Data:     update.Data,
+				Reset:    update.Reset,
+				Writable: update.Writable,
+				Closed:   update.Closed,
+			}
+			if stream.Send(message) != nil || update.Closed {
+				return
+			}
+		}
+		_ = stream.Send(control.Message{Type: control.TypeError, Error: "fell too far behind the shared terminal; attach again to catch up"})
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(terminalCmd)
+}
@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// selfSignedValidity is how long a generated session certificate is valid.
+// Joiners check its pin rather than its dates, but other TLS clients may not.
+const selfSignedValidity = 30 * 24 * time.Hour
+
+// sessionTLS is the certificate a session's relay serves directly. Pin is the
+// certificate's fingerprint; SelfSigned sessions put it in the join URL so
+// joiners can trust the certificate without a certificate authority.
+type sessionTLS struct {
+	Config     *tls.Config
+	Pin        string
+	SelfSigned bool
+}
+
+// loadSessionTLS loads the certificate in certFile and keyFile, or generates a
+// self-signed one for hosts when both are empty.
+func loadSessionTLS(certFile, keyFile string, hosts []string) (sessionTLS, error) {
+	if (certFile == "") != (keyFile == "") {
+		return sessionTLS{}, fmt.Errorf("--tls-cert and --tls-key must be used together")
+	}
+	var cert tls.Certificate
+	selfSigned := certFile == ""
+	if selfSigned {
+		generated, err := selfSignedCertificate(hosts)
+		if err != nil {
+			return sessionTLS{}, fmt.Errorf("failed to generate TLS certificate: %w", err)
+		}
+		cert = generated
+	} else {
+		loaded, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return sessionTLS{}, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		cert = loaded
+	}
+	return sessionTLS{
+		Config:     &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12},
+		Pin:        certificatePin(cert.Certificate[0]),
+		SelfSigned: selfSigned,
+	}, nil
+}
+
+// servedHost returns the name joiners reach the session at. A self-signed
+// certificate is pinned, so host is used as given. A certificate from an
+// authority must be valid for host, which defaults to its first DNS name,
+// or joiners would fail to verify it.
+func (t sessionTLS) servedHost(host string) (string, error) {
+	if t.SelfSigned {
+		return host, nil
+	}
+	leaf := t.Config.Certificates[0].Leaf
+	if leaf == nil {
+		parsed, err := x509.ParseCertificate(t.Config.Certificates[0].Certificate[0])
+		if err != nil {
+			return "", fmt.Errorf("failed to read TLS certificate: %w", err)
+		}
+		leaf = parsed
+	}
+	if host == "" {
+		for _, name := range leaf.DNSNames {
+			if !strings.HasPrefix(name, "*.") {
+				return name, nil
+			}
+		}
+		return "", fmt.Errorf("the --tls-cert certificate names no single host; pass --tls-host with the name joiners reach it at")
+	}
+	if err := leaf.VerifyHostname(host); err != nil {
+		return "", fmt.Errorf("--tls-host %s is not a name the --tls-cert certificate is valid for", host)
+	}
+	return host, nil
+}
+
+// selfSignedCertificate makes a certificate for hosts, which may be names or
+// IP addresses, and for localhost.
+func selfSignedCertificate(hosts []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "shadow session"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range append(hosts, "localhost", "127.0.0.1", "::1", hostname) {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// certificatePin is the SHA-256 fingerprint of a DER certificate, as carried
+// in a join URL.
+func certificatePin(der []byte) string {
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// pinnedTLSConfig trusts exactly the certificate with the given pin, instead
+// of the system roots.
+func pinnedTLSConfig(pin string) (*tls.Config, error) {
+	want, err := base64.RawURLEncoding.DecodeString(pin)
+	if err != nil || len(want) != sha256.Size {
+		return nil, fmt.Errorf("invalid certificate pin in session URL")
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// The handshake still proves the server holds the certificate's key;
+		// VerifyConnection replaces the chain and name checks with the pin.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("session server sent no certificate")
+			}
+			sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+			if !bytes.Equal(sum[:], want) {
+				return fmt.Errorf("session server's certificate does not match the pin in the session URL")
+			}
+			return nil
+		},
+	}, nil
+}
+
+// lanHost is this machine's address on the local network, for join URLs of
+// sessions served directly. It falls back to the hostname.
+func lanHost() string {
+	interfaces, err := net.Interfaces()
+	if err == nil {
+		for _, iface := range interfaces {
+			if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+				continue
+			}
+			addrs, err := iface.Addrs()
+			if err != nil {
+				continue
+			}
+			for _, addr := range addrs {
+				if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && ipNet.IP.IsPrivate() {
+					return ipNet.IP.String()
+				}
+			}
+		}
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+	return "localhost"
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-johnnyhe/shadow/server"
+)
+
+func TestPinnedSelfSignedSessionTLS(t *testing.T) {
+	if _, err := loadSessionTLS("cert.pem", "", nil); err == nil {
+		t.Fatal("accepted --tls-cert without --tls-key")
+	}
+	certificate, err := loadSessionTLS("", "", []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !certificate.SelfSigned || certificate.Pin == "" {
+		t.Fatalf("generated certificate = %+v", certificate)
+	}
+	other, err := loadSessionTLS("", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay := httptest.NewUnstartedServer(server.NewRelay(server.SessionConfig{HostToken: "host-token", JoinToken: "join-token"}))
+	relay.TLS = certificate.Config
+	relay.StartTLS()
+	defer relay.Close()
+
+	joinURL, err := appendSessionCredentials(relay.URL, "join-token", "e2e-key", certificate.Pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsURL, _, _, pin, err := normalizeSessionWSURL(joinURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pin != certificate.Pin || !strings.HasPrefix(wsURL, "wss://") {
+		t.Fatalf("join URL %q resolves to %q pin=%q", joinURL, wsURL, pin)
+	}
+	if _, _, _, _, err := normalizeSessionWSURL("http://example.test#token=t&pin=" + certificate.Pin); err == nil {
+		t.Fatal("accepted a pin on a plain HTTP session URL")
+	}
+
+	host, _, err := dialSessionWebSocket(wsURL, "host-token", pin, nil)
+	if err != nil {
+		t.Fatalf("host could not connect with the pin: %v", err)
+	}
+	host.Close()
+	if _, _, err := dialSessionWebSocket(wsURL, "host-token", other.Pin, nil); err == nil {
+		t.Fatal("connected to a server whose certificate does not match the pin")
+	}
+	if _, _, err := dialSessionWebSocket(wsURL, "host-token", "", nil); err == nil {
+		t.Fatal("trusted a self-signed certificate without a pin")
+	}
+}
+
+func TestServedHostMatchesAuthorityCertificate(t *testing.T) {
+	cert, err := selfSignedCertificate([]string{"dev.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued := sessionTLS{Config: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	if host, err := issued.servedHost(""); err != nil || host != "dev.example.com" {
+		t.Fatalf("default host = %q, %v; want the certificate's first DNS name", host, err)
+	}
+	if host, err := issued.servedHost("dev.example.com"); err != nil || host != "dev.example.com" {
+		t.Fatalf("servedHost(dev.example.com) = %q, %v", host, err)
+	}
+	if _, err := issued.servedHost("192.168.1.20"); err == nil {
+		t.Fatal("accepted a host the certificate is not valid for")
+	}
+
+	issued.SelfSigned = true
+	if host, err := issued.servedHost("192.168.1.20"); err != nil || host != "192.168.1.20" {
+		t.Fatalf("self-signed servedHost = %q, %v; want the host as given", host, err)
+	}
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseUploadRate parses values like "512KB", "2MB/s" or "0" into bytes per
+// second. Units are binary (1KB = 1024 bytes); zero or empty means unlimited.
+func parseUploadRate(value string) (int64, error) {
+	rate, err := parseByteSize(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "/S"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid upload rate %q (examples: 512KB, 2MB)", value)
+	}
+	if rate > 0 && rate < 1024 {
+		return 0, fmt.Errorf("upload rate %q is below the 1KB/s minimum", value)
+	}
+	return rate, nil
+}
+
+// parseByteSize parses values like "512KB", "20MB" or "4096" into bytes.
+// Units are binary (1KB = 1024 bytes); empty means zero.
+func parseByteSize(value string) (int64, error) {
+	trimmed := strings.ToUpper(strings.TrimSpace(value))
+	if trimmed == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		scale  int64
+	}{
+		{"GB", 1024 * 1024 * 1024},
+		{"MB", 1024 * 1024},
+		{"KB", 1024},
+		{"G", 1024 * 1024 * 1024},
+		{"M", 1024 * 1024},
+		{"K", 1024},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(trimmed, unit.suffix) {
+			trimmed = strings.TrimSpace(strings.TrimSuffix(trimmed, unit.suffix))
+			multiplier = unit.scale
+			break
+		}
+	}
+
+	amount, err := strconv.ParseFloat(trimmed, 64)
+	if err != nil || amount < 0 {
+		return 0, fmt.Errorf("invalid size %q (examples: 512KB, 20MB)", value)
+	}
+	return int64(amount * float64(multiplier)), nil
+}
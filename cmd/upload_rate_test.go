@@ -0,0 +1,28 @@
+package cmd
+
+import "testing"
+
+func TestParseUploadRate(t *testing.T) {
+	for input, want := range map[string]int64{
+		"":        0,
+		"0":       0,
+		"512KB":   512 * 1024,
+		"2MB/s":   2 * 1024 * 1024,
+		"1.5m":    1536 * 1024,
+		"4096":    4096,
+		" 64 kb ": 64 * 1024,
+	} {
+		got, err := parseUploadRate(input)
+		if err != nil {
+			t.Fatalf("parseUploadRate(%q) returned error: %v", input, err)
+		}
+		if got != want {
+			t.Fatalf("parseUploadRate(%q) = %d, want %d", input, got, want)
+		}
+	}
+	for _, input := range []string{"fast", "-1MB", "10B"} {
+		if _, err := parseUploadRate(input); err == nil {
+			t.Fatalf("parseUploadRate(%q) accepted an invalid rate", input)
+		}
+	}
+}
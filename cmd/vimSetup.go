@@ -17,6 +17,11 @@ import (
 //go:embed extras/autoread.vim
 var pluginBody []byte
 
+// presenceLua is appended to the Neovim script to share and show cursors.
+//
+//go:embed extras/presence.lua
+var presenceLua string
+
 const luaSnippet = `-- ~/.config/nvim/after/plugin/shadow.lua
 vim.opt.autoread = true
 vim.opt.updatetime = 100
@@ -112,7 +117,7 @@ var vimSetupCmd = &cobra.Command{
 		if cfg, err := nvimConfigDir(); err == nil {
 			dst := filepath.Join(cfg, "after", "plugin", "shadow.lua")
 
-			if fileExists(dst) {
+			if fileExists(dst) && !nvimScriptOutdated(dst) {
 				if !strings.Contains(strings.Join(alreadyConfigured, ","), "Neovim") {
 					alreadyConfigured = append(alreadyConfigured, "Neovim")
 				}
@@ -205,7 +210,18 @@ func installNvimScriptAfterPlugin(cfg string) error {
 	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
 		return err
 	}
-	return os.WriteFile(dst, []byte(luaSnippet), 0o644)
+	return os.WriteFile(dst, []byte(nvimScript()), 0o644)
+}
+
+func nvimScript() string {
+	return luaSnippet + "\n\n" + presenceLua
+}
+
+// nvimScriptOutdated reports whether an installed shadow.lua was written by an
+// older shadow and should be rewritten.
+func nvimScriptOutdated(dst string) bool {
+	body, err := os.ReadFile(dst)
+	return err == nil && string(body) != nvimScript()
 }
 
 func vimSiteDir() string {
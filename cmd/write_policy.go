@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-johnnyhe/shadow/internal/client"
+)
+
+// buildWritePolicy turns the --write-* flags into a host write policy. Peer
+// rules are given as "<name>=<pattern>" and further restrict the joiner rules
+// for the peer that joins with that name. It returns nil when no rules are set.
+func buildWritePolicy(allow, deny, peerAllow, peerDeny []string) (*client.WritePolicy, error) {
+	if len(allow) == 0 && len(deny) == 0 && len(peerAllow) == 0 && len(peerDeny) == 0 {
+		return nil, nil
+	}
+	for _, pattern := range append(append([]string(nil), allow...), deny...) {
+		if err := client.ValidateWritePattern(pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	policy := &client.WritePolicy{
+		Joiners: client.WriteRules{Allow: allow, Deny: deny},
+		Peers:   make(map[string]client.WriteRules),
+	}
+	for _, entry := range peerAllow {
+		name, pattern, err := parsePeerWriteRule(entry)
+		if err != nil {
+			return nil, err
+		}
+		rules := policy.Peers[name]
+		rules.Allow = append(rules.Allow, pattern)
+		policy.Peers[name] = rules
+	}
+	for _, entry := range peerDeny {
+		name, pattern, err := parsePeerWriteRule(entry)
+		if err != nil {
+			return nil, err
+		}
+		rules := policy.Peers[name]
+		rules.Deny = append(rules.Deny, pattern)
+		policy.Peers[name] = rules
+	}
+	return policy, nil
+}
+
+func parsePeerWriteRule(entry string) (string, string, error) {
+	name, pattern, ok := strings.Cut(entry, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("invalid peer rule %q (expected <name>=<pattern>)", entry)
+	}
+	if err := client.ValidateWritePattern(pattern); err != nil {
+		return "", "", err
+	}
+	return truncateLabel(name), pattern, nil
+}
@@ -0,0 +1,38 @@
+package cmd
+
+import "testing"
+
+func TestBuildWritePolicy(t *testing.T) {
+	policy, err := buildWritePolicy(nil, nil, nil, nil)
+	if err != nil || policy != nil {
+		t.Fatalf("empty flags built a policy: %+v, %v", policy, err)
+	}
+
+	policy, err = buildWritePolicy(
+		[]string{"src/", "tests/"},
+		[]string{"go.mod", ".github/"},
+		[]string{"alice=src/", "alice=docs/"},
+		[]string{"alice=src/private/"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !policy.Allows("bob", "src/main.go") || policy.Allows("bob", "go.mod") || policy.Allows("bob", "docs/a.md") {
+		t.Fatal("joiner rules were not applied")
+	}
+	if !policy.Allows("alice", "src/main.go") || policy.Allows("alice", "src/private/b.go") || policy.Allows("alice", "tests/a_test.go") {
+		t.Fatal("peer rules did not narrow the joiner rules")
+	}
+	if policy.Allows("alice", "docs/a.md") {
+		t.Fatal("peer rules widened the joiner rules")
+	}
+
+	for _, flags := range [][]string{{"/abs"}, {"a/**/b"}, {"[x"}} {
+		if _, err := buildWritePolicy(flags, nil, nil, nil); err == nil {
+			t.Fatalf("accepted invalid pattern %q", flags[0])
+		}
+	}
+	if _, err := buildWritePolicy(nil, nil, []string{"docs/"}, nil); err == nil {
+		t.Fatal("accepted a peer rule without a name")
+	}
+}
@@ -0,0 +1,176 @@
+// Package checkpoint commits a git working tree to a side branch without
+// touching the checked-out branch, the index or the files. It stages into
+// its own index file and writes the commit with git's plumbing commands.
+package checkpoint
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// fallbackName and fallbackEmail sign checkpoints in repositories with no
+// user configured.
+const (
+	fallbackName  = "shadow"
+	fallbackEmail = "shadow@localhost"
+)
+
+// Repo checkpoints part of a git working tree to one branch.
+type Repo struct {
+	root      string
+	pathspec  string
+	ref       string
+	indexFile string
+	env       []string
+}
+
+// Open prepares checkpoints of path, a file or directory inside a git
+// working tree, to branch. Files outside path are taken from HEAD, so each
+// checkpoint is HEAD plus the shared files as they are on disk.
+func Open(path, branch string) (*Repo, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	dir := absPath
+	if info, err := os.Stat(absPath); err == nil && !info.IsDir() {
+		dir = filepath.Dir(absPath)
+	}
+	root, err := git(dir, nil, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, fmt.Errorf("%s is not inside a git repository", path)
+	}
+	root = filepath.FromSlash(root)
+	if _, err := git(root, nil, "check-ref-format", "--branch", branch); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint branch %q", branch)
+	}
+	ref := "refs/heads/" + branch
+	if current, err := git(root, nil, "symbolic-ref", "-q", "HEAD"); err == nil && current == ref {
+		return nil, fmt.Errorf("%s is the branch you have checked out; pick another checkpoint branch", branch)
+	}
+	indexFile, err := git(root, nil, "rev-parse", "--path-format=absolute", "--git-path", "shadow-checkpoint-index")
+	if err != nil {
+		return nil, err
+	}
+
+	pathspec, err := relativePathspec(root, absPath)
+	if err != nil {
+		return nil, err
+	}
+	repo := &Repo{
+		root:      root,
+		pathspec:  pathspec,
+		ref:       ref,
+		indexFile: filepath.FromSlash(indexFile),
+	}
+	repo.env = append(repo.env, "GIT_INDEX_FILE="+repo.indexFile)
+	if _, err := git(root, nil, "var", "GIT_COMMITTER_IDENT"); err != nil {
+		repo.env = append(repo.env,
+			"GIT_AUTHOR_NAME="+fallbackName, "GIT_AUTHOR_EMAIL="+fallbackEmail,
+			"GIT_COMMITTER_NAME="+fallbackName, "GIT_COMMITTER_EMAIL="+fallbackEmail)
+	}
+	return repo, nil
+}
+
+// relativePathspec names target relative to the repository root as a
+// literal pathspec.
+func relativePathspec(root, target string) (string, error) {
+	// Compare resolved paths; the root git reports has its symlinks
+	// resolved.
+	if resolved, err := filepath.EvalSymlinks(target); err == nil {
+		target = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	rel, err := filepath.Rel(root, target)
+	if err != nil || !filepath.IsLocal(rel) && rel != "." {
+		return "", fmt.Errorf("%s is outside the git repository at %s", target, root)
+	}
+	return ":(literal)" + filepath.ToSlash(rel), nil
+}
+
+// Branch is the checkpoint branch name.
+func (r *Repo) Branch() string {
+	return strings.TrimPrefix(r.ref, "refs/heads/")
+}
+
+// Commit records the shared files on the checkpoint branch and returns the
+// new commit. It returns "" when nothing changed since the last checkpoint.
+// The first checkpoint's parent is HEAD, so the branch reads as work on top
+// of it.
+func (r *Repo) Commit(message string) (string, error) {
+	existing, _ := git(r.root, nil, "rev-parse", "-q", "--verify", r.ref+"^{commit}")
+	head, headErr := git(r.root, nil, "rev-parse", "-q", "--verify", "HEAD^{commit}")
+	parent := existing
+	if parent == "" && headErr == nil {
+		parent = head
+	}
+
+	// Start from HEAD so files outside the share keep their committed
+	// content, then stage the share as it is on disk.
+	if headErr == nil {
+		if _, err := git(r.root, r.env, "read-tree", "HEAD"); err != nil {
+			return "", err
+		}
+	} else if _, err := git(r.root, r.env, "read-tree", "--empty"); err != nil {
+		return "", err
+	}
+	if _, err := git(r.root, r.env, "add", "--all", "--", r.pathspec, ":(exclude,glob)**/*.shadowrec"); err != nil {
+		return "", err
+	}
+	tree, err := git(r.root, r.env, "write-tree")
+	if err != nil {
+		return "", err
+	}
+	if parent != "" {
+		if parentTree, err := git(r.root, nil, "rev-parse", parent+"^{tree}"); err == nil && parentTree == tree {
+			return "", nil
+		}
+	}
+
+	args := []string{"commit-tree", tree, "-m", message}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	commit, err := git(r.root, r.env, args...)
+	if err != nil {
+		return "", err
+	}
+	// Only move the branch if it is still where we read it, so a
+	// checkpoint made elsewhere in the meantime is not dropped. An empty
+	// old value means the branch must not exist yet.
+	if _, err := git(r.root, nil, "update-ref", "-m", "shadow checkpoint", r.ref, commit, existing); err != nil {
+		return "", err
+	}
+	return commit, nil
+}
+
+// Close removes the checkpoint index.
+func (r *Repo) Close() {
+	_ = os.Remove(r.indexFile)
+}
+
+// git runs a git command in dir and returns its trimmed output.
+func git(dir string, env []string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(), env...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			if detail := strings.TrimSpace(stderr.String()); detail != "" {
+				return "", fmt.Errorf("git %s: %s", args[0], detail)
+			}
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
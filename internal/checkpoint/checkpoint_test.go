@@ -0,0 +1,124 @@
+package checkpoint
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckpointLeavesBranchAndIndexAlone(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	root := t.TempDir()
+	run := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", root}, args...)...)
+		cmd.Env = append(os.Environ(), "GIT_CONFIG_GLOBAL=/dev/null",
+			"GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com",
+			"GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	write := func(name, content string) {
+		t.Helper()
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run("init", "-q", "-b", "main")
+	write("README", "readme\n")
+	write("app/main.go", "package main\n")
+	write(".gitignore", "*.log\n")
+	run("add", "-A")
+	run("commit", "-q", "-m", "initial")
+	head := run("rev-parse", "HEAD")
+
+	// Share only app/, with a staged change and untracked files around it.
+	write("README", "edited outside the share\n")
+	write("app/main.go", "package main\n\nfunc main() {}\n")
+	write("app/new.go", "package main\n")
+	write("app/debug.log", "ignored\n")
+	write("app/session.shadowrec", "recording\n")
+	run("add", "README")
+	statusBefore := run("status", "--porcelain")
+
+	if _, err := Open(filepath.Join(root, "app"), "main"); err == nil {
+		t.Fatal("allowed checkpoints to the checked-out branch")
+	}
+	repo, err := Open(filepath.Join(root, "app"), "shadow/session-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	first, err := repo.Commit("checkpoint 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == "" {
+		t.Fatal("no checkpoint for changed files")
+	}
+	if got := run("rev-parse", "shadow/session-1"); got != first {
+		t.Fatalf("branch = %s, want %s", got, first)
+	}
+	if got := run("rev-parse", first+"^"); got != head {
+		t.Fatalf("first checkpoint parent = %s, want HEAD %s", got, head)
+	}
+	if got := run("ls-tree", "-r", "--name-only", first); got != ".gitignore\nREADME\napp/main.go\napp/new.go" {
+		t.Fatalf("checkpoint files =\n%s", got)
+	}
+	if got := run("show", first+":README"); got != "readme" {
+		t.Fatalf("README outside the share = %q, want HEAD's content", got)
+	}
+	if got := run("show", first+":app/main.go"); !strings.Contains(got, "func main") {
+		t.Fatalf("app/main.go = %q, want the working copy", got)
+	}
+
+	if got := run("rev-parse", "HEAD"); got != head {
+		t.Fatal("checkpoint moved HEAD")
+	}
+	if got := run("symbolic-ref", "HEAD"); got != "refs/heads/main" {
+		t.Fatalf("HEAD = %s, want main", got)
+	}
+	if got := run("status", "--porcelain"); got != statusBefore {
+		t.Fatalf("status changed:\n%s\nwant:\n%s", got, statusBefore)
+	}
+
+	if again, err := repo.Commit("checkpoint 2"); err != nil || again != "" {
+		t.Fatalf("unchanged checkpoint = %q, %v; want none", again, err)
+	}
+
+	if err := os.Remove(filepath.Join(root, "app", "new.go")); err != nil {
+		t.Fatal(err)
+	}
+	second, err := repo.Commit("checkpoint 3")
+	if err != nil || second == "" {
+		t.Fatalf("second checkpoint = %q, %v", second, err)
+	}
+	if got := run("rev-parse", second+"^"); got != first {
+		t.Fatalf("second checkpoint parent = %s, want %s", got, first)
+	}
+	if got := run("ls-tree", "-r", "--name-only", second, "app"); got != "app/main.go" {
+		t.Fatalf("deleted file still in checkpoint:\n%s", got)
+	}
+}
+
+func TestOpenOutsideRepository(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	if _, err := Open(t.TempDir(), "shadow/session"); err == nil {
+		t.Fatal("opened checkpoints outside a git repository")
+	}
+}
@@ -0,0 +1,198 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+	"github.com/go-johnnyhe/shadow/internal/ui"
+)
+
+const maxQueuedProposals = 256
+
+// Proposal is a joiner operation waiting for the host's decision.
+type Proposal struct {
+	ID       int
+	PeerID   string
+	Path     string
+	Delete   bool
+	Size     int
+	Received time.Time
+}
+
+type queuedProposal struct {
+	Proposal
+	operationID string
+	// payload is the joiner's encrypted operation, broadcast unchanged on
+	// approval so the joiner's pending echo still matches.
+	payload string
+}
+
+// queueProposal validates a joiner operation that the relay routed to the
+// host for approval and adds it to the review queue.
+func (c *Client) queueProposal(peerID, encryptedPayload string, decrypted []byte) error {
+	if !c.approveJoinerEdits {
+		return fmt.Errorf("unexpected proposal")
+	}
+	operation, err := protocol.DecodeSyncOperation(decrypted)
+	if err != nil {
+		return err
+	}
+	relPath, err := normalizeIncomingPath(operation.Path)
+	if err != nil || relPath != operation.Path || c.shouldIgnoreInboundRel(relPath) {
+		return fmt.Errorf("invalid proposal path")
+	}
+	if singleFileRel := c.singleFileScope(); singleFileRel != "" && relPath != singleFileRel {
+		return fmt.Errorf("proposal is outside file scope")
+	}
+	if !c.allowsPeerWrite(peerID, relPath, operation.Delete) {
+		c.notifyPolicyViolation(relPath, fmt.Sprintf("blocked peer %s from changing %s", peerID, relPath))
+		return c.sendProposalResult(peerID, operation.ID, relPath, false)
+	}
+	if c.approveAllowedEdits {
+		return c.resolveProposal(queuedProposal{
+			Proposal:    Proposal{PeerID: peerID, Path: relPath},
+			operationID: operation.ID,
+			payload:     encryptedPayload,
+		}, true)
+	}
+
+	c.proposalsMu.Lock()
+	if len(c.proposals) >= maxQueuedProposals {
+		c.proposalsMu.Unlock()
+		return c.sendProposalResult(peerID, operation.ID, relPath, false)
+	}
+	c.nextProposal++
+	proposal := queuedProposal{
+		Proposal: Proposal{
+			ID:       c.nextProposal,
+			PeerID:   peerID,
+			Path:     relPath,
+			Delete:   operation.Delete,
+			Size:     len(operation.Content),
+			Received: time.Now(),
+		},
+		operationID: operation.ID,
+		payload:     encryptedPayload,
+	}
+	c.proposals = append(c.proposals, proposal)
+	c.proposalsMu.Unlock()
+
+	c.notifyProposal(proposal.Proposal)
+	return nil
+}
+
+// Proposals lists joiner operations waiting for approval, oldest first.
+func (c *Client) Proposals() []Proposal {
+	c.proposalsMu.Lock()
+	defer c.proposalsMu.Unlock()
+	proposals := make([]Proposal, 0, len(c.proposals))
+	for _, proposal := range c.proposals {
+		proposals = append(proposals, proposal.Proposal)
+	}
+	return proposals
+}
+
+// ResolveProposal approves or rejects one queued proposal. Approved
+// operations are broadcast to the session as host operations.
+func (c *Client) ResolveProposal(id int, approve bool) error {
+	c.proposalsMu.Lock()
+	index := -1
+	for i := range c.proposals {
+		if c.proposals[i].ID == id {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		c.proposalsMu.Unlock()
+		return fmt.Errorf("no pending proposal #%d", id)
+	}
+	proposal := c.proposals[index]
+	c.proposals = append(c.proposals[:index], c.proposals[index+1:]...)
+	c.proposalsMu.Unlock()
+	return c.resolveProposal(proposal, approve)
+}
+
+// ResolveAllProposals approves or rejects every queued proposal in the order
+// they arrived and reports how many were resolved.
+func (c *Client) ResolveAllProposals(approve bool) (int, error) {
+	c.proposalsMu.Lock()
+	proposals := c.proposals
+	c.proposals = nil
+	c.proposalsMu.Unlock()
+	for i, proposal := range proposals {
+		if err := c.resolveProposal(proposal, approve); err != nil {
+			return i, err
+		}
+	}
+	return len(proposals), nil
+}
+
+func (c *Client) resolveProposal(proposal queuedProposal, approve bool) error {
+	if approve {
+		if err := c.outbound.enqueue(priorityInteractive, proposal.Path, protocol.EncodeEncrypted(proposal.payload)); err != nil {
+			return err
+		}
+	}
+	return c.sendProposalResult(proposal.PeerID, proposal.operationID, proposal.Path, approve)
+}
+
+func (c *Client) sendProposalResult(peerID, operationID, relPath string, approved bool) error {
+	plaintext, err := protocol.EncodeProposalResult(operationID, relPath, approved)
+	if err != nil {
+		return err
+	}
+	return c.writeEncrypted(priorityInteractive, relPath, plaintext, func(payload string) []byte {
+		return protocol.EncodeDirectEncrypted(peerID, payload)
+	})
+}
+
+// applyProposalResult handles the host's decision on one of this joiner's
+// operations. A rejected path is repaired from the host, which preserves the
+// local bytes as a conflict copy.
+func (c *Client) applyProposalResult(result protocol.ProposalResult) {
+	if result.Approved {
+		return
+	}
+	relPath, err := normalizeIncomingPath(result.Path)
+	if err != nil || relPath != result.Path {
+		return
+	}
+	c.removePending(relPath, result.OperationID)
+	c.notifyWarning(fmt.Sprintf("host rejected your change to %s", relPath))
+
+	plaintext, err := protocol.EncodeRepairRequest(map[string]string{relPath: c.committedPathState(relPath)})
+	if err == nil {
+		err = c.writeEncrypted(priorityBulk, "", plaintext, protocol.EncodeHostEncrypted)
+	}
+	if err != nil {
+		log.Printf("failed to request repair of %s: %v", relPath, err)
+	}
+}
+
+func (c *Client) notifyProposal(proposal Proposal) {
+	if c.onProposal != nil {
+		c.onProposal(proposal)
+		return
+	}
+	action := "edit"
+	if proposal.Delete {
+		action = "delete"
+	}
+	if c.onEvent != nil {
+		c.onEvent("proposal", proposal.Path, fmt.Sprintf("#%d peer %s wants to %s %s", proposal.ID, proposal.PeerID, action, proposal.Path))
+		return
+	}
+	fmt.Printf("%s #%d peer %s wants to %s %s %s\n", ui.Accent("?"), proposal.ID, proposal.PeerID, action, proposal.Path,
+		ui.Dim(fmt.Sprintf("· approve %d / reject %d", proposal.ID, proposal.ID)))
+}
+
+func (c *Client) notifyApprovalMode() {
+	if c.onEvent != nil {
+		c.onEvent("approval_required", "", "Edits need host approval")
+		return
+	}
+	fmt.Println(ui.Bold("review mode · your edits are sent to the host for approval"))
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+)
+
+func TestApprovedProposalIsBroadcastUnchanged(t *testing.T) {
+	client := testApplyClient(t, t.TempDir())
+	client.isHost.Store(true)
+	client.approveJoinerEdits = true
+	client.outbound = newOutboundScheduler(nil, 0)
+	var queued []Proposal
+	client.onProposal = func(proposal Proposal) {
+		queued = append(queued, proposal)
+	}
+
+	operation := protocol.SyncOperation{
+		ID:          "joiner-1",
+		Path:        "main.go",
+		BaseState:   missingState,
+		DesiredHash: fileHash([]byte("package main")),
+		Content:     []byte("package main"),
+	}
+	payload := encryptedOperation(t, client.codec, operation)
+	if err := client.handlePeerMessage("4", payload); err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 1 || queued[0].PeerID != "4" || queued[0].Path != "main.go" {
+		t.Fatalf("unexpected proposals: %+v", queued)
+	}
+	if err := client.ResolveProposal(queued[0].ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.Proposals()) != 0 {
+		t.Fatal("approved proposal is still queued")
+	}
+
+	client.outbound.mu.Lock()
+	frames := append([]outboundFrame(nil), client.outbound.interactive...)
+	client.outbound.mu.Unlock()
+	if len(frames) != 2 {
+		t.Fatalf("queued %d frames, want broadcast and result", len(frames))
+	}
+	if string(frames[0].data) != string(protocol.EncodeEncrypted(payload)) {
+		t.Fatal("approved operation was not broadcast unchanged")
+	}
+	peerID, resultPayload, ok := protocol.ParseDirectEncrypted(frames[1].data)
+	if !ok || peerID != "4" {
+		t.Fatalf("result was not sent to the proposer: %q", frames[1].data)
+	}
+	plaintext, err := client.codec.Decrypt(resultPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, isResult, err := protocol.DecodeProposalResult(plaintext)
+	if err != nil || !isResult || !result.Approved || result.OperationID != "joiner-1" {
+		t.Fatalf("unexpected proposal result: %+v, %v", result, err)
+	}
+
+	if err := client.ResolveProposal(queued[0].ID, false); err == nil {
+		t.Fatal("resolved the same proposal twice")
+	}
+}
+
+func TestProposalsAreRejectedWithoutApprovalMode(t *testing.T) {
+	client := testApplyClient(t, t.TempDir())
+	client.isHost.Store(true)
+	operation := protocol.SyncOperation{
+		ID:          "joiner-1",
+		Path:        "main.go",
+		BaseState:   missingState,
+		DesiredHash: fileHash([]byte("x")),
+		Content:     []byte("x"),
+	}
+	if err := client.handlePeerMessage("4", encryptedOperation(t, client.codec, operation)); err == nil {
+		t.Fatal("proposal accepted outside approval mode")
+	}
+}
+
+func TestRejectedProposalClearsPendingAndRequestsRepair(t *testing.T) {
+	client := testApplyClient(t, t.TempDir())
+	client.outbound = newOutboundScheduler(nil, 0)
+	client.onEvent = func(string, string, string) {}
+	client.lastHash.Store("main.go", missingState)
+	client.addPending("main.go", pendingOperation{id: "me-1", desiredState: fileHash([]byte("draft"))})
+
+	client.applyProposalResult(protocol.ProposalResult{OperationID: "me-1", Path: "main.go"})
+
+	if state := client.latestPathState("main.go"); state != missingState {
+		t.Fatalf("latest state = %q, want committed state", state)
+	}
+	client.outbound.mu.Lock()
+	frames := append([]outboundFrame(nil), client.outbound.bulk...)
+	client.outbound.mu.Unlock()
+	if len(frames) != 1 || !strings.HasPrefix(string(frames[0].data), protocol.HostEncryptedChannel+"|") {
+		t.Fatalf("repair request was not sent to the host: %d frames", len(frames))
+	}
+	payload, _ := protocol.ParseHostEncrypted(frames[0].data)
+	plaintext, err := client.codec.Decrypt(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, isRepair, err := protocol.DecodeRepairRequest(plaintext)
+	if err != nil || !isRepair || request.States["main.go"] != missingState {
+		t.Fatalf("unexpected repair request: %+v, %v", request, err)
+	}
+}
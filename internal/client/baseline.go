@@ -0,0 +1,131 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-johnnyhe/shadow/internal/patch"
+)
+
+// ErrPatchNotKept is returned by SessionPatch when the client was not
+// started with Options.ExportPatch.
+var ErrPatchNotKept = errors.New("the session is not keeping its starting files for a patch")
+
+// baselineFile is a file as it was when the session started.
+type baselineFile struct {
+	content []byte
+	mode    os.FileMode
+}
+
+// captureBaseline remembers the shared tree so SessionPatch can show what
+// changed since. The host captures it on start and joiners once they have
+// synced, and only with Options.ExportPatch. It is kept in memory for the
+// whole session.
+func (c *Client) captureBaseline() {
+	if !c.exportPatch {
+		return
+	}
+	c.baselineMu.Lock()
+	captured := c.baseline != nil
+	c.baselineMu.Unlock()
+	if captured {
+		return
+	}
+	files, err := c.readTree()
+	if err != nil {
+		c.notifyWarning("cannot export a patch for this session: " + err.Error())
+		return
+	}
+	c.baselineMu.Lock()
+	if c.baseline == nil {
+		c.baseline = files
+	}
+	c.baselineMu.Unlock()
+}
+
+// readTree reads every file that would be synced.
+func (c *Client) readTree() (map[string]baselineFile, error) {
+	paths, directories, err := c.snapshotManifest()
+	if err != nil {
+		return nil, err
+	}
+	if singleFileRel := c.singleFileScope(); singleFileRel != "" {
+		paths, directories = []string{singleFileRel}, nil
+	}
+	isDirectory := make(map[string]bool, len(directories))
+	for _, dir := range directories {
+		isDirectory[dir] = true
+	}
+	files := make(map[string]baselineFile, len(paths))
+	for _, relPath := range paths {
+		if isDirectory[relPath] {
+			continue
+		}
+		filePath := filepath.Join(c.baseDir, filepath.FromSlash(relPath))
+		info, err := os.Stat(filePath)
+		if err != nil || !info.Mode().IsRegular() || info.Size() > maxSyncedFileBytes {
+			continue
+		}
+		content, err := os.ReadFile(filePath)
+		if err != nil {
+			continue
+		}
+		files[relPath] = baselineFile{content: content, mode: info.Mode().Perm()}
+	}
+	return files, nil
+}
+
+// SessionPatch writes everything changed in the shared tree since the
+// session started as a patch `git apply` accepts, and returns how many files
+// it covers.
+func (c *Client) SessionPatch(w io.Writer) (int, error) {
+	if !c.exportPatch {
+		return 0, ErrPatchNotKept
+	}
+	c.baselineMu.Lock()
+	baseline := c.baseline
+	c.baselineMu.Unlock()
+	if baseline == nil {
+		return 0, fmt.Errorf("the session has not finished syncing yet")
+	}
+	current, err := c.readTree()
+	if err != nil {
+		return 0, err
+	}
+
+	paths := make([]string, 0, len(current))
+	for relPath := range current {
+		paths = append(paths, relPath)
+	}
+	for relPath := range baseline {
+		if _, ok := current[relPath]; !ok {
+			paths = append(paths, relPath)
+		}
+	}
+	sort.Strings(paths)
+
+	var files []patch.File
+	for _, relPath := range paths {
+		before, existed := baseline[relPath]
+		after, exists := current[relPath]
+		sameMode := (before.mode&0o111 != 0) == (after.mode&0o111 != 0)
+		if existed && exists && sameMode && bytes.Equal(before.content, after.content) {
+			continue
+		}
+		files = append(files, patch.File{
+			Path:    relPath,
+			Old:     before.content,
+			New:     after.content,
+			OldMode: before.mode,
+			NewMode: after.mode,
+			Created: !existed,
+			Deleted: !exists,
+		})
+	}
+	return len(files), patch.Write(w, files)
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSessionPatchCoversChangesSinceStart(t *testing.T) {
+	baseDir := t.TempDir()
+	write := func(relPath, content string) {
+		t.Helper()
+		path := filepath.Join(baseDir, filepath.FromSlash(relPath))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("main.go", "package main\n")
+	write("old.txt", "remove me\n")
+	write("same.txt", "unchanged\n")
+	write(".shadow/session.yaml", "tasks: {}\n")
+
+	client := testApplyClient(t, baseDir)
+	client.onEvent = func(string, string, string) {}
+	client.exportPatch = true
+	if _, err := client.SessionPatch(&bytes.Buffer{}); err == nil {
+		t.Fatal("exported a patch before the baseline was captured")
+	}
+	client.captureBaseline()
+
+	write("main.go", "package main\n\nfunc main() {}\n")
+	write("src/new.go", "package src\n")
+	write(".shadow/session.yaml", "tasks:\n  test: go test\n")
+	if err := os.Remove(filepath.Join(baseDir, "old.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	count, err := client.SessionPatch(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch := out.String()
+	if count != 3 {
+		t.Fatalf("patch covers %d files, want 3:\n%s", count, patch)
+	}
+	for _, want := range []string{
+		"diff --git a/main.go b/main.go\n",
+		"+func main() {}\n",
+		"diff --git a/old.txt b/old.txt\ndeleted file mode 100644\n",
+		"diff --git a/src/new.go b/src/new.go\nnew file mode 100644\n",
+	} {
+		if !strings.Contains(patch, want) {
+			t.Errorf("patch is missing %q:\n%s", want, patch)
+		}
+	}
+	if strings.Contains(patch, "same.txt") || strings.Contains(patch, ".shadow") {
+		t.Errorf("patch includes unchanged or ignored files:\n%s", patch)
+	}
+}
+
+func TestBaselineIsKeptOnlyForExport(t *testing.T) {
+	baseDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(baseDir, "main.go"), []byte("package main\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	client := testApplyClient(t, baseDir)
+	client.captureBaseline()
+	client.baselineMu.Lock()
+	baseline := client.baseline
+	client.baselineMu.Unlock()
+	if baseline != nil {
+		t.Fatalf("kept %d starting files without ExportPatch", len(baseline))
+	}
+	if _, err := client.SessionPatch(&bytes.Buffer{}); !errors.Is(err, ErrPatchNotKept) {
+		t.Fatalf("SessionPatch without ExportPatch = %v, want ErrPatchNotKept", err)
+	}
+}
@@ -0,0 +1,231 @@
+package client
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+)
+
+const (
+	maxBlobCacheBytes = 64 * 1024 * 1024
+	// minBlobRefBytes keeps small edits inline, where a reference saves little.
+	minBlobRefBytes   = 4 * 1024
+	maxHeldOperations = 4096
+)
+
+// blobCache is a bounded LRU of recently seen file contents keyed by hash.
+// Blobs seen on the ordered stream are marked shared: every ready peer has
+// received them, so they can be sent by reference.
+type blobCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	size     int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type blobEntry struct {
+	hash    string
+	content []byte
+	shared  bool
+}
+
+func newBlobCache(maxBytes int) *blobCache {
+	return &blobCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (b *blobCache) add(hash string, content []byte, shared bool) {
+	if len(content) > b.maxBytes {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if element, ok := b.entries[hash]; ok {
+		element.Value.(*blobEntry).shared = element.Value.(*blobEntry).shared || shared
+		b.order.MoveToFront(element)
+		return
+	}
+	b.entries[hash] = b.order.PushFront(&blobEntry{hash: hash, content: content, shared: shared})
+	b.size += len(content)
+	for b.size > b.maxBytes {
+		oldest := b.order.Back()
+		entry := oldest.Value.(*blobEntry)
+		b.order.Remove(oldest)
+		delete(b.entries, entry.hash)
+		b.size -= len(entry.content)
+	}
+}
+
+func (b *blobCache) get(hash string) ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	element, ok := b.entries[hash]
+	if !ok {
+		return nil, false
+	}
+	b.order.MoveToFront(element)
+	return element.Value.(*blobEntry).content, true
+}
+
+func (b *blobCache) isShared(hash string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	element, ok := b.entries[hash]
+	return ok && element.Value.(*blobEntry).shared
+}
+
+// missingBlobError reports an ordered operation whose referenced content is
+// not available locally.
+type missingBlobError struct {
+	hash string
+	path string
+}
+
+func (e *missingBlobError) Error() string {
+	return fmt.Sprintf("missing content %s for %s", e.hash, e.path)
+}
+
+type heldOperation struct {
+	sequence uint64
+	origin   string
+	payload  string
+}
+
+// resolveContent returns the bytes for hash from the cache, or from the file
+// at relPath if it still holds them.
+func (c *Client) resolveContent(hash, relPath string) ([]byte, bool) {
+	if content, ok := c.blobs.get(hash); ok {
+		return content, true
+	}
+	absPath := filepath.Join(c.baseDir, filepath.FromSlash(relPath))
+	info, err := os.Lstat(absPath)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > c.maxFileBytes() {
+		return nil, false
+	}
+	content, err := os.ReadFile(absPath)
+	if err != nil || fileHash(content) != hash {
+		return nil, false
+	}
+	return content, true
+}
+
+// receiveOrdered applies ordered operations in sequence. While a referenced
+// blob is being fetched, later operations are held back so order is kept.
+func (c *Client) receiveOrdered(sequence uint64, originID, encryptedPayload string) error {
+	expected := c.lastSequence.Load() + uint64(len(c.held)) + 1
+	if sequence != expected {
+		return fmt.Errorf("invalid operation sequence: got %d after %d", sequence, expected-1)
+	}
+	if len(c.held) >= maxHeldOperations {
+		return fmt.Errorf("too many operations waiting for content")
+	}
+	c.held = append(c.held, heldOperation{sequence: sequence, origin: originID, payload: encryptedPayload})
+	if len(c.held) > 1 {
+		return nil
+	}
+	return c.drainHeld()
+}
+
+func (c *Client) drainHeld() error {
+	for len(c.held) > 0 {
+		next := c.held[0]
+		err := c.applyOrderedOperation(next.sequence, next.origin, next.payload)
+		var missing *missingBlobError
+		if errors.As(err, &missing) {
+			if c.isHost.Load() {
+				// Nobody else can be asked, so reassert the host's copy.
+				c.skipHeldOperation(missing, true)
+				continue
+			}
+			return c.requestBlob(missing)
+		}
+		if err != nil {
+			return err
+		}
+		c.held = c.held[1:]
+	}
+	return nil
+}
+
+func (c *Client) requestBlob(missing *missingBlobError) error {
+	plaintext, err := protocol.EncodeBlobRequest(missing.hash, missing.path)
+	if err != nil {
+		return err
+	}
+	return c.writeEncrypted(priorityInteractive, "", plaintext, protocol.EncodeHostEncrypted)
+}
+
+// skipHeldOperation drops the first held operation without applying it and
+// asks for the path to be brought back in line with the host.
+func (c *Client) skipHeldOperation(missing *missingBlobError, isHost bool) {
+	c.outboundMu.Lock()
+	c.lastSequence.Store(c.held[0].sequence)
+	c.held = c.held[1:]
+	committed := c.committedPathState(missing.path)
+	if isHost {
+		c.repairPathUnlocked(missing.path, committed)
+	}
+	c.outboundMu.Unlock()
+
+	if !isHost {
+		plaintext, err := protocol.EncodeRepairRequest(map[string]string{missing.path: committed})
+		if err == nil {
+			err = c.writeEncrypted(priorityBulk, "", plaintext, protocol.EncodeHostEncrypted)
+		}
+		if err != nil {
+			log.Printf("failed to request repair of %s: %v", missing.path, err)
+		}
+	}
+	c.notifyWarning(fmt.Sprintf("content for %s was unavailable; resyncing from host", missing.path))
+}
+
+// applyBlobResponse stores content the host sent for a held operation and
+// resumes the ordered stream, or skips the operation if the host lacked it.
+func (c *Client) applyBlobResponse(response protocol.BlobResponse) error {
+	if len(c.held) == 0 {
+		return nil
+	}
+	if response.Missing {
+		decryptedHeld, err := c.codec.Decrypt(c.held[0].payload)
+		if err != nil {
+			return fmt.Errorf("decrypt: %w", err)
+		}
+		operation, err := protocol.DecodeSyncOperation(decryptedHeld)
+		if err != nil || !operation.ContentRef || operation.DesiredHash != response.Hash {
+			return nil
+		}
+		c.skipHeldOperation(&missingBlobError{hash: response.Hash, path: operation.Path}, false)
+	} else {
+		if fileHash(response.Content) != response.Hash {
+			return fmt.Errorf("blob hash mismatch")
+		}
+		c.blobs.add(response.Hash, response.Content, true)
+	}
+	return c.drainHeld()
+}
+
+// serveBlob answers a peer's request for referenced content.
+func (c *Client) serveBlob(peerID string, request protocol.BlobRequest) error {
+	relPath, err := normalizeIncomingPath(request.Path)
+	if err != nil || relPath != request.Path || c.shouldIgnoreInboundRel(relPath) {
+		return fmt.Errorf("invalid blob path")
+	}
+	content, ok := c.resolveContent(request.Hash, relPath)
+	plaintext, err := protocol.EncodeBlobResponse(request.Hash, content, !ok)
+	if err != nil {
+		return err
+	}
+	return c.writeEncrypted(priorityInteractive, "", plaintext, func(payload string) []byte {
+		return protocol.EncodeDirectEncrypted(peerID, payload)
+	})
+}
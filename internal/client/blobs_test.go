@@ -0,0 +1,136 @@
+package client
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+)
+
+func TestBlobCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newBlobCache(10)
+	cache.add("a", []byte("aaaa"), true)
+	cache.add("b", []byte("bbbb"), false)
+	if _, ok := cache.get("a"); !ok {
+		t.Fatal("blob a missing before eviction")
+	}
+	cache.add("c", []byte("cccc"), false)
+
+	if _, ok := cache.get("b"); ok {
+		t.Fatal("least recently used blob was kept")
+	}
+	if !cache.isShared("a") {
+		t.Fatal("recently used shared blob was evicted")
+	}
+	if cache.isShared("c") {
+		t.Fatal("unshared blob reported as shared")
+	}
+}
+
+func TestContentRefWaitsForBlobFromHost(t *testing.T) {
+	baseDir := t.TempDir()
+	client := testApplyClient(t, baseDir)
+	client.outbound = newOutboundScheduler(nil, 0)
+	client.syncReady.Store(true)
+
+	content := []byte(strings.Repeat("shared content ", 512))
+	reference := protocol.SyncOperation{
+		ID:          "op-1",
+		Path:        "big.txt",
+		BaseState:   missingState,
+		DesiredHash: fileHash(content),
+		ContentRef:  true,
+	}
+	small := protocol.SyncOperation{
+		ID:          "op-2",
+		Path:        "small.txt",
+		BaseState:   missingState,
+		DesiredHash: fileHash([]byte("next")),
+		Content:     []byte("next"),
+	}
+	if err := client.receiveOrdered(1, "2", encryptedOperation(t, client.codec, reference)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.receiveOrdered(2, "2", encryptedOperation(t, client.codec, small)); err != nil {
+		t.Fatal(err)
+	}
+	if client.lastSequence.Load() != 0 || len(client.held) != 2 {
+		t.Fatalf("operations were applied before the blob arrived: sequence %d, held %d", client.lastSequence.Load(), len(client.held))
+	}
+
+	client.outbound.mu.Lock()
+	if len(client.outbound.interactive) != 1 {
+		client.outbound.mu.Unlock()
+		t.Fatalf("queued %d blob requests, want 1", len(client.outbound.interactive))
+	}
+	payload, ok := protocol.ParseHostEncrypted(client.outbound.interactive[0].data)
+	client.outbound.mu.Unlock()
+	if !ok {
+		t.Fatal("blob request was not sent to the host")
+	}
+	plaintext, err := client.codec.Decrypt(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, isRequest, err := protocol.DecodeBlobRequest(plaintext)
+	if err != nil || !isRequest || request.Hash != reference.DesiredHash || request.Path != "big.txt" {
+		t.Fatalf("unexpected blob request: %+v, %v", request, err)
+	}
+
+	response, err := protocol.EncodeBlobResponse(reference.DesiredHash, content, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedResponse, err := client.codec.Encrypt(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.handleHostMessage(encryptedResponse); err != nil {
+		t.Fatal(err)
+	}
+	if client.lastSequence.Load() != 2 || len(client.held) != 0 {
+		t.Fatalf("held operations were not applied: sequence %d, held %d", client.lastSequence.Load(), len(client.held))
+	}
+	got, err := os.ReadFile(filepath.Join(baseDir, "big.txt"))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("referenced content was not written: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, "small.txt")); err != nil {
+		t.Fatalf("later operation was not applied: %v", err)
+	}
+}
+
+func TestSendFileReferencesSharedBlob(t *testing.T) {
+	baseDir := t.TempDir()
+	client := testApplyClient(t, baseDir)
+	client.outbound = newOutboundScheduler(nil, 0)
+	client.syncReady.Store(true)
+
+	content := []byte(strings.Repeat("x", minBlobRefBytes))
+	filePath := filepath.Join(baseDir, "copy.txt")
+	if err := os.WriteFile(filePath, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	client.blobs.add(fileHash(content), content, true)
+	if !client.sendFileUnlocked(filePath, true, false, nil) {
+		t.Fatal("file was not sent")
+	}
+
+	client.outbound.mu.Lock()
+	frame := client.outbound.interactive[0].data
+	client.outbound.mu.Unlock()
+	plaintext, err := client.codec.Decrypt(strings.TrimPrefix(string(frame), protocol.EncryptedChannel+"|"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	operation, err := protocol.DecodeSyncOperation(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !operation.ContentRef || len(operation.Content) != 0 {
+		t.Fatalf("shared content was sent inline: ref=%v, %d bytes", operation.ContentRef, len(operation.Content))
+	}
+}
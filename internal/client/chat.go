@@ -0,0 +1,110 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+	"github.com/go-johnnyhe/shadow/internal/ui"
+)
+
+// maxChatHistory is how many chat messages a client remembers. History lives
+// only in memory and ends with the session.
+const maxChatHistory = 200
+
+// ChatMessage is one message in the session chat. Self marks messages this
+// client sent; Peer is zero for those.
+type ChatMessage struct {
+	Peer PeerInfo
+	Self bool
+	Text string
+	Time time.Time
+}
+
+// From names the author of the message.
+func (m ChatMessage) From() string {
+	if m.Self {
+		return "you"
+	}
+	return m.Peer.Label()
+}
+
+// Say sends a chat message to every other peer.
+func (c *Client) Say(text string) error {
+	text = sanitizeChat(text)
+	if text == "" {
+		return fmt.Errorf("message is empty")
+	}
+	if len(text) > protocol.MaxChatBytes {
+		return fmt.Errorf("message is longer than %d bytes", protocol.MaxChatBytes)
+	}
+	plaintext, err := protocol.EncodeChat(protocol.Chat{Text: text})
+	if err != nil {
+		return err
+	}
+	if err := c.writeEncrypted(priorityInteractive, "", plaintext, protocol.EncodeBroadcastEncrypted); err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+	c.recordChat(ChatMessage{Self: true, Text: text, Time: time.Now()})
+	return nil
+}
+
+// ChatHistory returns the messages exchanged since the session started,
+// oldest first.
+func (c *Client) ChatHistory() []ChatMessage {
+	c.chatMu.Lock()
+	defer c.chatMu.Unlock()
+	return append([]ChatMessage(nil), c.chat...)
+}
+
+// applyChat records a message another peer sent.
+func (c *Client) applyChat(peerID string, chat protocol.Chat) {
+	text := sanitizeChat(chat.Text)
+	if text == "" {
+		return
+	}
+	c.recordChat(ChatMessage{Peer: c.peerInfo(peerID), Text: text, Time: time.Now()})
+}
+
+func (c *Client) recordChat(message ChatMessage) {
+	c.chatMu.Lock()
+	c.chat = append(c.chat, message)
+	if len(c.chat) > maxChatHistory {
+		c.chat = append([]ChatMessage(nil), c.chat[len(c.chat)-maxChatHistory:]...)
+	}
+	c.chatMu.Unlock()
+	c.notifyChat(message)
+}
+
+// sanitizeChat keeps line breaks and tabs, so pasted stack traces survive,
+// but strips other control characters that could drive the terminal.
+func sanitizeChat(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return -1
+		}
+		return r
+	}, text))
+}
+
+func (c *Client) notifyChat(message ChatMessage) {
+	if c.onChat != nil {
+		c.onChat(message)
+		return
+	}
+	if c.onEvent != nil {
+		c.onEvent("chat", "", message.From()+": "+message.Text)
+		return
+	}
+	lines := strings.Split(message.Text, "\n")
+	fmt.Printf("%s %s %s\n", ui.Accent("»"), ui.Bold(message.From()+":"), lines[0])
+	for _, line := range lines[1:] {
+		fmt.Println("  " + line)
+	}
+}
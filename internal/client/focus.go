@@ -0,0 +1,61 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+	"github.com/go-johnnyhe/shadow/internal/ui"
+)
+
+// PeerFocus is a request from another peer to look at Path. Line is
+// zero-based.
+type PeerFocus struct {
+	Peer PeerInfo
+	Path string
+	Line int
+}
+
+// Focus asks the other peers to look at a shared path. Peers following this
+// session open it in their editor.
+func (c *Client) Focus(relPath string, line int) error {
+	relPath, err := normalizeIncomingPath(relPath)
+	if err != nil {
+		return fmt.Errorf("invalid focus path: %w", err)
+	}
+	if !c.sharesPath(relPath) {
+		return fmt.Errorf("%s is not shared", relPath)
+	}
+	if line < 0 {
+		return fmt.Errorf("invalid line %d", line+1)
+	}
+	plaintext, err := protocol.EncodeFocus(protocol.Focus{Path: relPath, Line: line})
+	if err != nil {
+		return err
+	}
+	if err := c.writeEncrypted(priorityInteractive, "", plaintext, protocol.EncodeBroadcastEncrypted); err != nil {
+		return fmt.Errorf("failed to send focus: %w", err)
+	}
+	return nil
+}
+
+// applyFocus handles a focus request from another peer.
+func (c *Client) applyFocus(peerID string, focus protocol.Focus) {
+	relPath, err := normalizeIncomingPath(focus.Path)
+	if err != nil || relPath != focus.Path || !c.sharesPath(relPath) {
+		return
+	}
+	c.notifyFocus(PeerFocus{Peer: c.peerInfo(peerID), Path: relPath, Line: focus.Line})
+}
+
+func (c *Client) notifyFocus(focus PeerFocus) {
+	location := fmt.Sprintf("%s:%d", focus.Path, focus.Line+1)
+	if c.onFocus != nil {
+		c.onFocus(focus)
+		return
+	}
+	if c.onEvent != nil {
+		c.onEvent("focus", focus.Path, focus.Peer.Label()+" is looking at "+location)
+		return
+	}
+	fmt.Printf("%s %s %s\n", ui.Accent("◆"), focus.Peer.Label()+ui.Dim(" is looking at"), location)
+}
@@ -0,0 +1,38 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+)
+
+func TestFocusIsSentAndReported(t *testing.T) {
+	client := testApplyClient(t, t.TempDir())
+	client.outbound = newOutboundScheduler(nil, 0)
+	client.roster = map[string]*PeerInfo{"2": {ID: "2", Name: "bob"}}
+	var focused []PeerFocus
+	client.onFocus = func(focus PeerFocus) { focused = append(focused, focus) }
+
+	if err := client.Focus("../outside.go", 0); err == nil {
+		t.Fatal("focused a path outside the share")
+	}
+	if err := client.Focus("src/handler.go", 79); err != nil {
+		t.Fatal(err)
+	}
+	frame, _ := client.outbound.next()
+	encrypted, ok := protocol.ParseBroadcastEncrypted(frame.data)
+	if !ok {
+		t.Fatalf("focus was not broadcast: %q", frame.data)
+	}
+	if err := client.handlePeerBroadcast("2", encrypted); err != nil {
+		t.Fatal(err)
+	}
+	client.applyFocus("2", protocol.Focus{Path: "../escape.go"})
+
+	if len(focused) != 1 {
+		t.Fatalf("got %d focus requests, want only the valid one", len(focused))
+	}
+	if focus := focused[0]; focus.Peer.Name != "bob" || focus.Path != "src/handler.go" || focus.Line != 79 {
+		t.Fatalf("got %+v", focus)
+	}
+}
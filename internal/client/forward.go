@@ -0,0 +1,422 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+	"github.com/go-johnnyhe/shadow/internal/ui"
+)
+
+const (
+	// tunnelWindow is how many bytes one side of a forwarded connection may
+	// send before the other acknowledges writing them out. It keeps a fast
+	// sender from queueing unbounded data in the session.
+	tunnelWindow      = 256 * 1024
+	maxTunnelsPerPeer = 64
+	tunnelDialTimeout = 5 * time.Second
+	tunnelReadyWait   = 30 * time.Second
+)
+
+// ForwardedPort is a host port a joiner reaches at Local.
+type ForwardedPort struct {
+	Port  int
+	Local string
+}
+
+// tunnelKey names a forwarded connection. On the host, peer is the joiner
+// that opened it; joiners leave it empty.
+type tunnelKey struct {
+	peer string
+	id   uint64
+}
+
+// tunnel copies one forwarded TCP connection to and from the other side of
+// the session.
+type tunnel struct {
+	key    tunnelKey
+	send   func(protocol.Tunnel) error
+	remove func()
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	conn         net.Conn
+	unacked      int
+	pending      [][]byte
+	pendingBytes int
+	remoteClosed bool
+	readDone     bool
+	writeDone    bool
+	aborted      bool
+}
+
+// announceForwards tells every peer which ports the host forwards. It runs
+// on start and whenever a peer joins.
+func (c *Client) announceForwards() {
+	if !c.isHost.Load() || len(c.forwardPorts) == 0 {
+		return
+	}
+	plaintext, err := protocol.EncodeForwards(c.forwardPorts)
+	if err == nil {
+		err = c.writeEncrypted(priorityInteractive, "", plaintext, protocol.EncodeBroadcastEncrypted)
+	}
+	if err != nil && !c.stopping.Load() {
+		log.Printf("failed to announce forwarded ports: %v", err)
+	}
+}
+
+// applyForwards opens a local listener for each port the host forwards.
+func (c *Client) applyForwards(forwards protocol.Forwards) {
+	for _, port := range forwards.Ports {
+		c.forwardMu.Lock()
+		_, listening := c.forwardListeners[port]
+		c.forwardMu.Unlock()
+		if listening || c.stopping.Load() {
+			continue
+		}
+		// Prefer the host's port number so URLs match; fall back to any free port.
+		listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err != nil {
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+		}
+		if err != nil {
+			log.Printf("failed to forward host port %d: %v", port, err)
+			continue
+		}
+		c.forwardMu.Lock()
+		if c.forwardListeners == nil {
+			c.forwardListeners = make(map[int]net.Listener)
+		}
+		c.forwardListeners[port] = listener
+		c.forwardMu.Unlock()
+		go c.acceptForwarded(port, listener)
+		c.notifyForward(ForwardedPort{Port: port, Local: listener.Addr().String()})
+	}
+}
+
+// ForwardedPorts lists the host ports this joiner forwards and where.
+func (c *Client) ForwardedPorts() []ForwardedPort {
+	c.forwardMu.Lock()
+	defer c.forwardMu.Unlock()
+	ports := make([]ForwardedPort, 0, len(c.forwardListeners))
+	for port, listener := range c.forwardListeners {
+		ports = append(ports, ForwardedPort{Port: port, Local: listener.Addr().String()})
+	}
+	return ports
+}
+
+func (c *Client) acceptForwarded(port int, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go c.openTunnel(port, conn)
+	}
+}
+
+// openTunnel forwards a local connection to the host's port. Joiners cannot
+// message the host until they have synced, so early connections wait.
+func (c *Client) openTunnel(port int, conn net.Conn) {
+	select {
+	case <-c.readyCh:
+	case <-c.doneCh:
+		_ = conn.Close()
+		return
+	case <-time.After(tunnelReadyWait):
+		_ = conn.Close()
+		return
+	}
+	key := tunnelKey{id: c.nextTunnel.Add(1)}
+	t := c.newTunnel(key, func(message protocol.Tunnel) error {
+		plaintext, err := protocol.EncodeTunnel(message)
+		if err != nil {
+			return err
+		}
+		return c.writeEncrypted(priorityInteractive, "", plaintext, protocol.EncodeHostEncrypted)
+	})
+	c.forwardMu.Lock()
+	if c.tunnels == nil {
+		c.tunnels = make(map[tunnelKey]*tunnel)
+	}
+	c.tunnels[key] = t
+	c.forwardMu.Unlock()
+	if err := t.send(protocol.Tunnel{Stream: key.id, Port: port}); err != nil {
+		_ = conn.Close()
+		t.remove()
+		return
+	}
+	t.start(conn)
+}
+
+// handleTunnel handles a tunnel message from peerID, or from the host when
+// this client is a joiner.
+func (c *Client) handleTunnel(peerID string, message protocol.Tunnel) error {
+	key := tunnelKey{peer: peerID, id: message.Stream}
+	c.forwardMu.Lock()
+	t, ok := c.tunnels[key]
+	if ok || message.Port == 0 || !c.isHost.Load() {
+		c.forwardMu.Unlock()
+		if ok {
+			t.receive(message)
+		}
+		return nil
+	}
+
+	send := func(reply protocol.Tunnel) error {
+		plaintext, err := protocol.EncodeTunnel(reply)
+		if err != nil {
+			return err
+		}
+		return c.writeEncrypted(priorityInteractive, "", plaintext, func(payload string) []byte {
+			return protocol.EncodeDirectEncrypted(peerID, payload)
+		})
+	}
+	refuse := func(err error) error {
+		_ = send(protocol.Tunnel{Stream: message.Stream, Close: true, Error: err.Error()})
+		return err
+	}
+	if !c.forwardsPort(message.Port) {
+		c.forwardMu.Unlock()
+		return refuse(fmt.Errorf("port %d is not forwarded", message.Port))
+	}
+	open := 0
+	for other := range c.tunnels {
+		if other.peer == peerID {
+			open++
+		}
+	}
+	if open >= maxTunnelsPerPeer {
+		c.forwardMu.Unlock()
+		return refuse(fmt.Errorf("too many forwarded connections"))
+	}
+	if c.tunnels == nil {
+		c.tunnels = make(map[tunnelKey]*tunnel)
+	}
+	t = c.newTunnel(key, send)
+	c.tunnels[key] = t
+	c.forwardMu.Unlock()
+
+	go func() {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(message.Port)), tunnelDialTimeout)
+		if err != nil {
+			t.abort(fmt.Sprintf("nothing is listening on host port %d", message.Port))
+			return
+		}
+		t.start(conn)
+	}()
+	return nil
+}
+
+func (c *Client) forwardsPort(port int) bool {
+	for _, forwarded := range c.forwardPorts {
+		if forwarded == port {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) newTunnel(key tunnelKey, send func(protocol.Tunnel) error) *tunnel {
+	t := &tunnel{key: key, send: send}
+	t.cond = sync.NewCond(&t.mu)
+	t.remove = func() {
+		c.forwardMu.Lock()
+		if c.tunnels[key] == t {
+			delete(c.tunnels, key)
+		}
+		c.forwardMu.Unlock()
+	}
+	return t
+}
+
+// closeTunnels drops the forwarded connections that match, without telling
+// the other side. It is used once the other side is gone.
+func (c *Client) closeTunnels(match func(tunnelKey) bool) {
+	c.forwardMu.Lock()
+	var closing []*tunnel
+	for key, t := range c.tunnels {
+		if match(key) {
+			closing = append(closing, t)
+		}
+	}
+	c.forwardMu.Unlock()
+	for _, t := range closing {
+		t.close()
+	}
+}
+
+// stopForwarding closes every listener and forwarded connection.
+func (c *Client) stopForwarding() {
+	c.forwardMu.Lock()
+	listeners := c.forwardListeners
+	c.forwardListeners = nil
+	c.forwardMu.Unlock()
+	for _, listener := range listeners {
+		_ = listener.Close()
+	}
+	c.closeTunnels(func(tunnelKey) bool { return true })
+}
+
+func (c *Client) notifyForward(port ForwardedPort) {
+	msg := fmt.Sprintf("host port %d is forwarded to %s", port.Port, port.Local)
+	if c.onEvent != nil {
+		c.onEvent("forward", "", msg)
+		return
+	}
+	fmt.Printf("%s %s\n", ui.Accent("⇄"), ui.Dim("host port "+strconv.Itoa(port.Port)+" → ")+"http://"+port.Local)
+}
+
+// start begins copying once the local end of the connection exists. Data
+// that arrived before then is written out first.
+func (t *tunnel) start(conn net.Conn) {
+	t.mu.Lock()
+	if t.aborted {
+		t.mu.Unlock()
+		_ = conn.Close()
+		return
+	}
+	t.conn = conn
+	t.mu.Unlock()
+	go t.writeLoop()
+	go t.readLoop()
+}
+
+// receive applies a message from the other side.
+func (t *tunnel) receive(message protocol.Tunnel) {
+	t.mu.Lock()
+	if len(message.Data) > 0 {
+		if t.pendingBytes+len(message.Data) > tunnelWindow {
+			t.mu.Unlock()
+			t.abort("sent past the flow control window")
+			return
+		}
+		t.pending = append(t.pending, message.Data)
+		t.pendingBytes += len(message.Data)
+	}
+	t.unacked = max(t.unacked-message.Ack, 0)
+	if message.Close {
+		t.remoteClosed = true
+	}
+	t.cond.Broadcast()
+	t.mu.Unlock()
+	if message.Close && message.Error != "" {
+		// The other end failed; there is nothing left to flush.
+		t.close()
+	}
+}
+
+// readLoop sends what the local end writes, keeping within the window.
+func (t *tunnel) readLoop() {
+	buf := make([]byte, protocol.MaxTunnelBytes)
+	for {
+		n, err := t.conn.Read(buf)
+		if n > 0 {
+			t.mu.Lock()
+			for !t.aborted && t.unacked > 0 && t.unacked+n > tunnelWindow {
+				t.cond.Wait()
+			}
+			aborted := t.aborted
+			t.unacked += n
+			t.mu.Unlock()
+			if aborted {
+				return
+			}
+			if t.send(protocol.Tunnel{Stream: t.key.id, Data: append([]byte(nil), buf[:n]...)}) != nil {
+				t.close()
+				return
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			_ = t.send(protocol.Tunnel{Stream: t.key.id, Close: true})
+			t.finishSide(&t.readDone)
+			return
+		}
+		if err != nil {
+			t.abort("connection reset")
+			return
+		}
+	}
+}
+
+// writeLoop writes what the other side sent to the local end and
+// acknowledges it.
+func (t *tunnel) writeLoop() {
+	for {
+		t.mu.Lock()
+		for !t.aborted && len(t.pending) == 0 && !t.remoteClosed {
+			t.cond.Wait()
+		}
+		if t.aborted {
+			t.mu.Unlock()
+			return
+		}
+		if len(t.pending) == 0 {
+			t.mu.Unlock()
+			if tcp, ok := t.conn.(*net.TCPConn); ok {
+				_ = tcp.CloseWrite()
+			}
+			t.finishSide(&t.writeDone)
+			return
+		}
+		data := t.pending[0]
+		t.pending[0] = nil
+		t.pending = t.pending[1:]
+		t.pendingBytes -= len(data)
+		t.mu.Unlock()
+
+		if _, err := t.conn.Write(data); err != nil {
+			t.abort("connection reset")
+			return
+		}
+		if t.send(protocol.Tunnel{Stream: t.key.id, Ack: len(data)}) != nil {
+			t.close()
+			return
+		}
+	}
+}
+
+// finishSide records that one direction is done and closes the connection
+// once both are.
+func (t *tunnel) finishSide(done *bool) {
+	t.mu.Lock()
+	*done = true
+	finished := t.readDone && t.writeDone
+	t.mu.Unlock()
+	if finished {
+		t.close()
+	}
+}
+
+// abort closes the connection and tells the other side why.
+func (t *tunnel) abort(reason string) {
+	t.mu.Lock()
+	notify := !t.aborted && !(t.remoteClosed && t.readDone)
+	t.mu.Unlock()
+	if notify {
+		_ = t.send(protocol.Tunnel{Stream: t.key.id, Close: true, Error: reason})
+	}
+	t.close()
+}
+
+func (t *tunnel) close() {
+	t.mu.Lock()
+	if t.aborted {
+		t.mu.Unlock()
+		return
+	}
+	t.aborted = true
+	conn := t.conn
+	t.cond.Broadcast()
+	t.mu.Unlock()
+	if conn != nil {
+		_ = conn.Close()
+	}
+	t.remove()
+}
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/ui"
+	"github.com/go-johnnyhe/shadow/internal/wsutil"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	minReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay = 5 * time.Second
+)
+
+func (c *Client) currentConn() (*wsutil.Peer, <-chan struct{}) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.conn, c.connChanged
+}
+
+func (c *Client) swapConn(conn *wsutil.Peer) {
+	c.connMu.Lock()
+	c.conn = conn
+	close(c.connChanged)
+	c.connChanged = make(chan struct{})
+	c.connMu.Unlock()
+}
+
+func (c *Client) closeConn() {
+	conn, _ := c.currentConn()
+	_ = conn.Close()
+}
+
+// writeFrame writes one frame to the relay. When the connection can be
+// redialed, a failed write waits for the new connection and is retried there.
+func (c *Client) writeFrame(data []byte) error {
+	for {
+		conn, changed := c.currentConn()
+		err := conn.Write(websocket.TextMessage, data)
+		if err == nil || c.redial == nil || c.stopping.Load() {
+			return err
+		}
+		_ = conn.Close()
+		select {
+		case <-changed:
+		case <-c.doneCh:
+			return err
+		}
+	}
+}
+
+// reconnect redials the relay after the host's connection drops. The relay
+// replays the ordered operations sent in between, so the stream picks up
+// where it stopped. It runs on the read loop.
+func (c *Client) reconnect() bool {
+	c.notifyHandoff("reconnecting", "connection lost · reconnecting")
+	deadline := time.Now().Add(c.reconnectWindow)
+	delay := minReconnectDelay
+	for !c.stopping.Load() && time.Now().Before(deadline) {
+		conn, err := c.redial(c.lastSequence.Load() + uint64(len(c.held)))
+		if err == nil {
+			conn.SetReadLimit(maxIncomingMessageBytes)
+			c.swapConn(wsutil.NewPeer(conn))
+			c.resetRoster()
+			c.notifyHandoff("reconnected", "reconnected")
+			c.notifyRoster()
+			c.announceProfile()
+			go c.recoverAfterReconnect()
+			return true
+		}
+		time.Sleep(delay)
+		delay = min(delay*2, maxReconnectDelay)
+	}
+	if !c.stopping.Load() {
+		c.notifyDisconnected()
+	}
+	return false
+}
+
+// recoverAfterReconnect resends local changes whose operations may have been
+// lost with the old connection. Operations the relay sequenced are echoed
+// back in the replay; anything still unacknowledged after that is resent.
+// A state digest then lets joiners repair whatever else drifted meanwhile.
+func (c *Client) recoverAfterReconnect() {
+	c.waitForPendingAcks(digestSettleTimeout)
+	c.pendingMu.Lock()
+	c.pending = make(map[string][]pendingOperation)
+	c.pendingMu.Unlock()
+	c.reconcileLocal()
+	if err := c.broadcastStateDigest(); err != nil {
+		log.Printf("failed to send state digest: %v", err)
+	}
+}
+
+// promote makes this joiner the session host after the relay hands the
+// session over. It runs on the read loop.
+func (c *Client) promote() {
+	if c.isHost.Swap(true) {
+		return
+	}
+	c.readOnlyJoinerMode.Store(false)
+	// Forwarded ports pointed at the old host's machine.
+	c.stopForwarding()
+	go c.processSnapshotRequests()
+	c.notifyHandoff("promoted", "the host left · you are now hosting this session")
+	if len(c.held) > 0 {
+		// A blob requested from the old host will not arrive.
+		if err := c.drainHeld(); err != nil {
+			log.Printf("failed to resume held operations: %v", err)
+		}
+	}
+	// Joiners may have drifted from the old host; bring them in line with
+	// this one without waiting for the next repair round.
+	go c.runRepairRound()
+}
+
+// hostPresenceChanged runs on the read loop when the relay reports that the
+// host left or came back.
+func (c *Client) hostPresenceChanged(present bool) {
+	if c.isHost.Load() {
+		return
+	}
+	if !present {
+		c.closeTunnels(func(tunnelKey) bool { return true })
+		c.notifyHandoff("host_away", "host disconnected · waiting for them to return")
+		return
+	}
+	c.notifyHandoff("host_returned", "host is back")
+	if len(c.held) > 0 {
+		// Ask again for a blob the previous connection may have lost.
+		if err := c.drainHeld(); err != nil {
+			log.Printf("failed to resume held operations: %v", err)
+		}
+	}
+}
+
+func (c *Client) notifyHandoff(eventType, msg string) {
+	if c.onEvent != nil {
+		c.onEvent(eventType, "", msg)
+		return
+	}
+	switch eventType {
+	case "reconnecting", "host_away":
+		fmt.Println(ui.Warn(msg))
+	case "promoted":
+		fmt.Println(ui.Bold(msg))
+	default:
+		fmt.Println(ui.Dim(msg))
+	}
+}
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+)
+
+func TestPromotedJoinerResendsContentTheOldHostOwed(t *testing.T) {
+	client := testApplyClient(t, t.TempDir())
+	client.outbound = newOutboundScheduler(nil, 0)
+	client.onEvent = func(string, string, string) {}
+	client.snapshotRequests = make(chan string, 1)
+	client.doneCh = make(chan struct{})
+	defer close(client.doneCh)
+	client.syncReady.Store(true)
+	client.readOnlyJoinerMode.Store(true)
+
+	reference := protocol.SyncOperation{
+		ID:          "op-1",
+		Path:        "big.txt",
+		BaseState:   missingState,
+		DesiredHash: fileHash([]byte(strings.Repeat("x", minBlobRefBytes))),
+		ContentRef:  true,
+	}
+	if err := client.receiveOrdered(1, "1", encryptedOperation(t, client.codec, reference)); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.held) != 1 {
+		t.Fatalf("held %d operations, want 1", len(client.held))
+	}
+
+	client.promote()
+
+	if !client.isHost.Load() || client.readOnlyJoinerMode.Load() {
+		t.Fatal("promoted joiner is not a writable host")
+	}
+	if len(client.held) != 0 || client.lastSequence.Load() != 1 {
+		t.Fatalf("held operation was not skipped: held %d, sequence %d", len(client.held), client.lastSequence.Load())
+	}
+}
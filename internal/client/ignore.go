@@ -24,9 +24,9 @@ var hardcodedIgnore = regexp.MustCompile(`(?i)` +
 	`|(?:^|[\\/])\.(?:bash_history|zsh_history|sh_history|python_history|node_repl_history|lesshst|wget-hsts)(?:\.LOCK)?$` +
 	`|(?:^|[\\/])\.(?:bashrc|zshrc|profile|bash_profile|zprofile|bash_logout|zlogout)$` +
 	`|(?:^|[\\/])\.zcompdump` +
-	// PostgreSQL temp, macOS, vim swap, temp files
+	// PostgreSQL temp, macOS, vim swap, temp files, session recordings
 	`|(?:^|[\\/])\.s\.pgsql\.\d+$` +
-	`|\.ds_store$|\.sw[a-p0-9]$|\.swp$|\.swo$|~$|\.bak$|\.tmp$`)
+	`|\.shadowrec$|\.ds_store$|\.sw[a-p0-9]$|\.swp$|\.swo$|~$|\.bak$|\.tmp$`)
 
 type OutboundIgnore struct {
 	git *gitIgnoreMatcher
@@ -0,0 +1,239 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxQueuedBulkBytes     = 16 * 1024 * 1024
+	outboundReportInterval = 2 * time.Second
+)
+
+type sendPriority uint8
+
+const (
+	// priorityInteractive is used for single edits picked up by the watcher.
+	priorityInteractive sendPriority = iota
+	// priorityBulk is used for snapshots, bootstraps and repairs.
+	priorityBulk
+)
+
+type outboundFrame struct {
+	data []byte
+	path string
+}
+
+// outboundScheduler owns the socket write side. Interactive frames are sent
+// before bulk frames unless they touch a path that already has bulk traffic
+// queued, which keeps operations for one path in the order they were created.
+type outboundScheduler struct {
+	mu          sync.Mutex
+	cond        *sync.Cond
+	interactive []outboundFrame
+	bulk        []outboundFrame
+	bulkBytes   int
+	closed      bool
+	err         error
+	limiter     *rateLimiter
+	write       func([]byte) error
+	sentBytes   int64
+}
+
+func newOutboundScheduler(write func([]byte) error, bytesPerSecond int64) *outboundScheduler {
+	scheduler := &outboundScheduler{
+		write:   write,
+		limiter: newRateLimiter(bytesPerSecond),
+	}
+	scheduler.cond = sync.NewCond(&scheduler.mu)
+	return scheduler
+}
+
+func (s *outboundScheduler) enqueue(priority sendPriority, relPath string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		if s.err != nil {
+			return s.err
+		}
+		return fmt.Errorf("connection closed")
+	}
+	frame := outboundFrame{data: data, path: relPath}
+	if priority == priorityInteractive && !s.bulkTouchesLocked(relPath) {
+		s.interactive = append(s.interactive, frame)
+	} else {
+		s.bulk = append(s.bulk, frame)
+		s.bulkBytes += len(data)
+	}
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *outboundScheduler) bulkTouchesLocked(relPath string) bool {
+	if relPath == "" {
+		return false
+	}
+	for _, frame := range s.bulk {
+		if frame.path == "" {
+			continue
+		}
+		if frame.path == relPath || strings.HasPrefix(frame.path, relPath+"/") || strings.HasPrefix(relPath, frame.path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForBulkCapacity blocks bulk producers while the bulk lane is full so a
+// large snapshot does not have to be held in memory all at once.
+func (s *outboundScheduler) waitForBulkCapacity() {
+	s.mu.Lock()
+	for !s.closed && s.bulkBytes > maxQueuedBulkBytes {
+		s.cond.Wait()
+	}
+	s.mu.Unlock()
+}
+
+func (s *outboundScheduler) next() (outboundFrame, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if s.closed {
+			return outboundFrame{}, false
+		}
+		if len(s.interactive) > 0 {
+			frame := s.interactive[0]
+			s.interactive[0] = outboundFrame{}
+			s.interactive = s.interactive[1:]
+			return frame, true
+		}
+		if len(s.bulk) > 0 {
+			frame := s.bulk[0]
+			s.bulk[0] = outboundFrame{}
+			s.bulk = s.bulk[1:]
+			s.bulkBytes -= len(frame.data)
+			s.cond.Broadcast()
+			return frame, true
+		}
+		s.cond.Wait()
+	}
+}
+
+func (s *outboundScheduler) run(onError func(error)) {
+	for {
+		frame, ok := s.next()
+		if !ok {
+			return
+		}
+		s.limiter.wait(len(frame.data))
+		if err := s.write(frame.data); err != nil {
+			s.close(err)
+			onError(err)
+			return
+		}
+		s.mu.Lock()
+		s.sentBytes += int64(len(frame.data))
+		s.mu.Unlock()
+	}
+}
+
+func (s *outboundScheduler) close(err error) {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		s.err = err
+		s.interactive = nil
+		s.bulk = nil
+		s.bulkBytes = 0
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// stats reports queued frames, queued bytes and total bytes written.
+func (s *outboundScheduler) stats() (int, int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queuedBytes := s.bulkBytes
+	for _, frame := range s.interactive {
+		queuedBytes += len(frame.data)
+	}
+	return len(s.interactive) + len(s.bulk), queuedBytes, s.sentBytes
+}
+
+// rateLimiter is a byte-based token bucket. Frames larger than the bucket are
+// allowed through and paid back before the next frame is written.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	rate := float64(bytesPerSecond)
+	burst := rate / 4
+	if burst < 16*1024 {
+		burst = 16 * 1024
+	}
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens < 0 {
+		delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+		time.Sleep(delay)
+		l.tokens = 0
+		l.last = time.Now()
+	}
+	l.tokens -= float64(n)
+}
+
+// reportOutbound emits queue depth and throughput while there is traffic.
+func (c *Client) reportOutbound() {
+	if c.onEvent == nil {
+		return
+	}
+	ticker := time.NewTicker(outboundReportInterval)
+	defer ticker.Stop()
+	_, _, lastSent := c.outbound.stats()
+	for {
+		select {
+		case <-c.doneCh:
+			return
+		case <-ticker.C:
+			frames, queuedBytes, sent := c.outbound.stats()
+			if frames == 0 && sent == lastSent {
+				continue
+			}
+			throughput := float64(sent-lastSent) / outboundReportInterval.Seconds()
+			lastSent = sent
+			c.onEvent("outbound", "", fmt.Sprintf("%d queued (%s) · %s/s", frames, formatBytes(float64(queuedBytes)), formatBytes(throughput)))
+		}
+	}
+}
+
+func formatBytes(n float64) string {
+	switch {
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", n/(1024*1024))
+	case n >= 1024:
+		return fmt.Sprintf("%.1f KB", n/1024)
+	default:
+		return fmt.Sprintf("%.0f B", n)
+	}
+}
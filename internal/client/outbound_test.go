@@ -0,0 +1,47 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutboundSchedulerPrioritisesInteractiveFrames(t *testing.T) {
+	scheduler := newOutboundScheduler(nil, 0)
+	for _, frame := range []struct {
+		priority sendPriority
+		path     string
+		data     string
+	}{
+		{priorityBulk, "a.txt", "bulk-a"},
+		{priorityBulk, "dir/b.txt", "bulk-b"},
+		{priorityInteractive, "c.txt", "edit-c"},
+		{priorityInteractive, "a.txt", "edit-a"},
+		{priorityInteractive, "dir", "delete-dir"},
+	} {
+		if err := scheduler.enqueue(frame.priority, frame.path, []byte(frame.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"edit-c", "bulk-a", "bulk-b", "edit-a", "delete-dir"}
+	for _, expected := range want {
+		frame, ok := scheduler.next()
+		if !ok {
+			t.Fatal("scheduler closed early")
+		}
+		if string(frame.data) != expected {
+			t.Fatalf("next frame = %q, want %q", frame.data, expected)
+		}
+	}
+}
+
+func TestRateLimiterPacesLargeFrames(t *testing.T) {
+	limiter := newRateLimiter(64 * 1024)
+	started := time.Now()
+	limiter.wait(16 * 1024)
+	limiter.wait(32 * 1024)
+	limiter.wait(1)
+	if elapsed := time.Since(started); elapsed < 400*time.Millisecond {
+		t.Fatalf("48KB at 64KB/s finished in %s", elapsed)
+	}
+}
@@ -0,0 +1,210 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+	"github.com/go-johnnyhe/shadow/internal/ui"
+)
+
+// WriteRules limits which paths a joiner may change. Patterns containing a
+// slash are matched from the shared root; other patterns match any path
+// component. A trailing slash or "/**" matches everything under a directory.
+type WriteRules struct {
+	// Allow lists the paths that may be written. Empty allows every path.
+	Allow []string
+	// Deny lists paths that may never be written, even if allowed.
+	Deny []string
+}
+
+// WritePolicy is enforced by the host on operations from joiners.
+type WritePolicy struct {
+	Joiners WriteRules
+	// Peers further restricts the joiner rules for peers by the name they
+	// join with. Names are chosen by each joiner and not authenticated, so
+	// these rules can only take access away, never grant more.
+	Peers map[string]WriteRules
+}
+
+// Allows reports whether the peer named peerName may write relPath. The path
+// must pass the joiner rules and, if peerName has its own, those as well.
+func (p *WritePolicy) Allows(peerName, relPath string) bool {
+	if p == nil {
+		return true
+	}
+	if !p.Joiners.allows(relPath) {
+		return false
+	}
+	if override, ok := p.Peers[peerName]; ok && peerName != "" {
+		return override.allows(relPath)
+	}
+	return true
+}
+
+func (r WriteRules) allows(relPath string) bool {
+	for _, pattern := range r.Deny {
+		if matchWritePattern(pattern, relPath) {
+			return false
+		}
+	}
+	if len(r.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range r.Allow {
+		if matchWritePattern(pattern, relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateWritePattern reports whether pattern is usable in WriteRules.
+func ValidateWritePattern(pattern string) error {
+	if pattern == "*" || pattern == "**" {
+		return nil
+	}
+	trimmed := strings.TrimSuffix(strings.TrimSuffix(pattern, "/**"), "/")
+	if trimmed == "" || strings.HasPrefix(trimmed, "/") || strings.Contains(trimmed, "**") {
+		return fmt.Errorf("invalid write pattern %q", pattern)
+	}
+	if _, err := path.Match(trimmed, ""); err != nil {
+		return fmt.Errorf("invalid write pattern %q: %w", pattern, err)
+	}
+	return nil
+}
+
+func matchWritePattern(pattern, relPath string) bool {
+	if pattern == "**" || pattern == "*" {
+		return true
+	}
+	dirOnly := strings.HasSuffix(pattern, "/") || strings.HasSuffix(pattern, "/**")
+	pattern = strings.TrimSuffix(strings.TrimSuffix(pattern, "/**"), "/")
+	components := strings.Split(relPath, "/")
+
+	if strings.Contains(pattern, "/") {
+		for end := 1; end <= len(components); end++ {
+			if dirOnly && end == len(components) {
+				break
+			}
+			if matched, _ := path.Match(pattern, strings.Join(components[:end], "/")); matched {
+				return true
+			}
+		}
+		return false
+	}
+	for index, component := range components {
+		if dirOnly && index == len(components)-1 {
+			break
+		}
+		if matched, _ := path.Match(pattern, component); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsPeerWrite reports whether an operation from originID may change
+// relPath. A delete also covers every committed path beneath it.
+func (c *Client) allowsPeerWrite(originID, relPath string, deletion bool) bool {
+	if !c.isHost.Load() || c.writePolicy == nil || originID == "" || originID == c.selfID() {
+		return true
+	}
+	peerName := c.policyName(originID)
+	if !c.writePolicy.Allows(peerName, relPath) {
+		return false
+	}
+	if !deletion {
+		return true
+	}
+	allowed := true
+	c.lastHash.Range(func(key, _ any) bool {
+		committedPath, ok := key.(string)
+		if ok && strings.HasPrefix(committedPath, relPath+"/") && !c.writePolicy.Allows(peerName, committedPath) {
+			allowed = false
+		}
+		return allowed
+	})
+	return allowed
+}
+
+// policyName is the name peer rules match originID by. It is empty, so only
+// the joiner rules apply, until the peer's profile arrives.
+func (c *Client) policyName(originID string) string {
+	c.rosterMu.Lock()
+	defer c.rosterMu.Unlock()
+	if peer, ok := c.roster[originID]; ok {
+		return peer.Name
+	}
+	return ""
+}
+
+// revertPeerWriteLocked undoes a disallowed joiner operation that is already
+// in the ordered stream. Sessions with a write policy route joiner edits to
+// the host, so this only happens if the relay did not. The joiner is told
+// first so it can keep its bytes, then the host's copy of the path is resent
+// to every peer. A Delete goes out only for a path the host never had.
+func (c *Client) revertPeerWriteLocked(originID string, operation protocol.SyncOperation, relPath string) {
+	hostHadPath := isContentState(c.committedPathState(relPath))
+	var descendants []string
+	if operation.Delete {
+		c.lastHash.Range(func(key, _ any) bool {
+			if committedPath, ok := key.(string); ok && strings.HasPrefix(committedPath, relPath+"/") {
+				descendants = append(descendants, committedPath)
+			}
+			return true
+		})
+		c.dropPathHashes(relPath)
+	}
+	c.lastHash.Store(relPath, operation.DesiredHash)
+	plaintext, err := protocol.EncodeWriteRejected(operation.ID, relPath)
+	if err == nil {
+		err = c.writeEncrypted(priorityInteractive, relPath, plaintext, func(payload string) []byte {
+			return protocol.EncodeDirectEncrypted(originID, payload)
+		})
+	}
+	if err != nil {
+		c.notifyWarning(fmt.Sprintf("failed to notify peer %s about %s: %v", originID, relPath, err))
+	}
+	c.resendPathUnlocked(relPath, operation.DesiredHash, !hostHadPath)
+	for _, descendant := range descendants {
+		c.resendPathUnlocked(descendant, missingState, false)
+	}
+	c.notifyPolicyViolation(relPath, fmt.Sprintf("blocked peer %s from changing %s", originID, relPath))
+}
+
+// keepRejectedCopy saves this peer's bytes for a path the host refused before
+// the host's revert overwrites them.
+func (c *Client) keepRejectedCopy(rejected protocol.WriteRejected) {
+	relPath, err := normalizeIncomingPath(rejected.Path)
+	if err != nil || relPath != rejected.Path {
+		return
+	}
+	message := fmt.Sprintf("host does not allow you to change %s", relPath)
+	content, err := os.ReadFile(filepath.Join(c.baseDir, filepath.FromSlash(relPath)))
+	if err == nil {
+		copyRel := path.Join(conflictDirectory, relPath+"."+rejected.OperationID)
+		destination, destErr := secureIncomingDestination(c.baseDir, copyRel)
+		if destErr == nil {
+			destErr = os.MkdirAll(filepath.Dir(destination), 0o700)
+		}
+		if destErr == nil {
+			destErr = atomicWriteFile(destination, content, 0o600)
+		}
+		if destErr == nil {
+			message += "; kept your copy at " + copyRel
+		}
+	}
+	c.notifyPolicyViolation(relPath, message)
+}
+
+func (c *Client) notifyPolicyViolation(relPath, msg string) {
+	if c.onEvent != nil {
+		c.onEvent("policy_violation", relPath, msg)
+		return
+	}
+	fmt.Println(ui.Warn("⊘ " + msg))
+}
@@ -0,0 +1,233 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+)
+
+func TestWritePolicyAllows(t *testing.T) {
+	policy := &WritePolicy{
+		Joiners: WriteRules{
+			Allow: []string{"src/", "tests/**"},
+			Deny:  []string{"go.mod", "Makefile", ".github/", "*.key"},
+		},
+		Peers: map[string]WriteRules{
+			"carol": {Allow: []string{"src/*.go", "docs/*.md"}},
+		},
+	}
+	for relPath, want := range map[string]bool{
+		"src/main.go":          true,
+		"src/pkg/util.go":      true,
+		"tests/a_test.go":      true,
+		"src":                  false,
+		"go.mod":               false,
+		"src/go.mod":           false,
+		"Makefile":             false,
+		".github/ci.yml":       false,
+		"src/secrets/prod.key": false,
+		"README.md":            false,
+	} {
+		if got := policy.Allows("bob", relPath); got != want {
+			t.Fatalf("Allows(bob, %q) = %v, want %v", relPath, got, want)
+		}
+	}
+	if !policy.Allows("carol", "src/main.go") || policy.Allows("carol", "src/pkg/util.go") || policy.Allows("carol", "tests/a_test.go") {
+		t.Fatal("peer override did not narrow the joiner rules")
+	}
+	if policy.Allows("carol", "docs/guide.md") {
+		t.Fatal("peer override widened the joiner rules")
+	}
+	var none *WritePolicy
+	if !none.Allows("bob", "go.mod") {
+		t.Fatal("nil policy rejected a write")
+	}
+}
+
+func TestHostRevertsDisallowedJoinerWrite(t *testing.T) {
+	baseDir := t.TempDir()
+	client := testApplyClient(t, baseDir)
+	client.isHost.Store(true)
+	client.selfPeerID.Store("1")
+	client.outbound = newOutboundScheduler(nil, 0)
+	client.onEvent = func(string, string, string) {}
+	client.writePolicy = &WritePolicy{Joiners: WriteRules{Deny: []string{"go.mod"}}}
+
+	original := []byte("module example\n")
+	if err := os.WriteFile(filepath.Join(baseDir, "go.mod"), original, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	client.lastHash.Store("go.mod", fileHash(original))
+
+	changed := []byte("module hijacked\n")
+	operation := protocol.SyncOperation{
+		ID:          "joiner-1",
+		Path:        "go.mod",
+		BaseState:   fileHash(original),
+		DesiredHash: fileHash(changed),
+		Content:     changed,
+	}
+	if err := client.applyOrderedOperation(1, "2", encryptedOperation(t, client.codec, operation)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(baseDir, "go.mod")); string(got) != string(original) {
+		t.Fatalf("disallowed write was applied: %q", got)
+	}
+
+	client.outbound.mu.Lock()
+	notices := append([]outboundFrame(nil), client.outbound.interactive...)
+	resends := append([]outboundFrame(nil), client.outbound.bulk...)
+	client.outbound.mu.Unlock()
+	if len(notices) != 1 || len(resends) != 1 {
+		t.Fatalf("queued %d notices and %d resends, want 1 each", len(notices), len(resends))
+	}
+	peerID, payload, ok := protocol.ParseDirectEncrypted(notices[0].data)
+	if !ok || peerID != "2" {
+		t.Fatalf("rejection was not sent to the writer: %q", notices[0].data)
+	}
+	plaintext, err := client.codec.Decrypt(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected, isRejected, err := protocol.DecodeWriteRejected(plaintext)
+	if err != nil || !isRejected || rejected.OperationID != "joiner-1" || rejected.Path != "go.mod" {
+		t.Fatalf("unexpected rejection: %+v, %v", rejected, err)
+	}
+
+	plaintext, err = client.codec.Decrypt(strings.TrimPrefix(string(resends[0].data), protocol.EncryptedChannel+"|"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	revert, err := protocol.DecodeSyncOperation(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revert.BaseState != operation.DesiredHash || revert.DesiredHash != fileHash(original) {
+		t.Fatalf("revert has base %q and desired %q", revert.BaseState, revert.DesiredHash)
+	}
+}
+
+func TestRevertSendsOnlySharedCommittedState(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	baseDir := t.TempDir()
+	if err := runGit(baseDir, "init"); err != nil {
+		t.Fatalf("git init failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(baseDir, ".gitignore"), []byte(".env\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(baseDir, ".env"), []byte("SECRET=1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	client := testApplyClient(t, baseDir)
+	client.isHost.Store(true)
+	client.selfPeerID.Store("1")
+	client.outbound = newOutboundScheduler(nil, 0)
+	client.onEvent = func(string, string, string) {}
+	client.writePolicy = &WritePolicy{Joiners: WriteRules{Deny: []string{".env", "notes.txt"}}}
+	// notes.txt is committed but its removal has not been sent yet.
+	client.lastHash.Store("notes.txt", fileHash([]byte("notes\n")))
+
+	for i, relPath := range []string{".env", "notes.txt"} {
+		changed := []byte("changed by joiner\n")
+		operation := protocol.SyncOperation{
+			ID:          fmt.Sprintf("joiner-%d", i+1),
+			Path:        relPath,
+			BaseState:   client.committedPathState(relPath),
+			DesiredHash: fileHash(changed),
+			Content:     changed,
+		}
+		if err := client.applyOrderedOperation(uint64(i+1), "2", encryptedOperation(t, client.codec, operation)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client.outbound.mu.Lock()
+	notices, resends := len(client.outbound.interactive), len(client.outbound.bulk)
+	client.outbound.mu.Unlock()
+	if notices != 2 || resends != 0 {
+		t.Fatalf("queued %d notices and %d resends, want 2 notices and no resends", notices, resends)
+	}
+}
+
+func TestPolicyRoutedProposalsAreResolvedAtOnce(t *testing.T) {
+	client := testApplyClient(t, t.TempDir())
+	client.isHost.Store(true)
+	client.selfPeerID.Store("1")
+	client.approveJoinerEdits = true
+	client.approveAllowedEdits = true
+	client.outbound = newOutboundScheduler(nil, 0)
+	client.onEvent = func(string, string, string) {}
+	client.roster = map[string]*PeerInfo{
+		"2": {ID: "2", Name: "alice"},
+		"3": {ID: "3", Name: "bob"},
+	}
+	client.writePolicy = &WritePolicy{
+		Joiners: WriteRules{Allow: []string{"src/", "docs/"}},
+		Peers:   map[string]WriteRules{"alice": {Allow: []string{"src/"}}},
+	}
+	propose := func(peerID, relPath string) (bool, bool) {
+		t.Helper()
+		operation := protocol.SyncOperation{ID: "op-" + peerID, Path: relPath, BaseState: missingState, DesiredHash: fileHash([]byte("x")), Content: []byte("x")}
+		payload := encryptedOperation(t, client.codec, operation)
+		if err := client.handlePeerMessage(peerID, payload); err != nil {
+			t.Fatal(err)
+		}
+		client.outbound.mu.Lock()
+		frames := client.outbound.interactive
+		client.outbound.interactive = nil
+		client.outbound.mu.Unlock()
+		broadcast := len(frames) > 0 && string(frames[0].data) == string(protocol.EncodeEncrypted(payload))
+		_, resultPayload, _ := protocol.ParseDirectEncrypted(frames[len(frames)-1].data)
+		plaintext, _ := client.codec.Decrypt(resultPayload)
+		result, _, _ := protocol.DecodeProposalResult(plaintext)
+		return broadcast, result.Approved
+	}
+
+	if broadcast, approved := propose("3", "docs/a.md"); !broadcast || !approved {
+		t.Fatal("bob's allowed edit was not applied at once")
+	}
+	if broadcast, approved := propose("2", "docs/a.md"); broadcast || approved {
+		t.Fatal("alice's disallowed edit was broadcast")
+	}
+	if len(client.Proposals()) != 0 {
+		t.Fatal("policy-routed proposals were queued for review")
+	}
+
+	// Peer rules only narrow, so a second peer claiming the name gets
+	// them too.
+	client.roster["3"].Name = "alice"
+	if broadcast, _ := propose("3", "docs/a.md"); broadcast {
+		t.Fatal("peer rules skipped a peer sharing the name")
+	}
+}
+
+func TestJoinerKeepsRejectedCopy(t *testing.T) {
+	baseDir := t.TempDir()
+	client := testApplyClient(t, baseDir)
+	var events []string
+	client.onEvent = func(eventType, relPath, message string) {
+		events = append(events, eventType)
+	}
+	draft := []byte("my edit")
+	if err := os.WriteFile(filepath.Join(baseDir, "go.mod"), draft, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	client.keepRejectedCopy(protocol.WriteRejected{OperationID: "op-7", Path: "go.mod"})
+
+	got, err := os.ReadFile(filepath.Join(baseDir, conflictDirectory, "go.mod.op-7"))
+	if err != nil || string(got) != string(draft) {
+		t.Fatalf("rejected bytes were not kept: %q, %v", got, err)
+	}
+	if len(events) != 1 || events[0] != "policy_violation" {
+		t.Fatalf("unexpected events: %v", events)
+	}
+}
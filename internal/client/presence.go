@@ -0,0 +1,176 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+)
+
+// presenceInterval is the most often a cursor update is broadcast. Updates in
+// between are coalesced so only the latest position is sent.
+const presenceInterval = 100 * time.Millisecond
+
+// Position is a zero-based line and column. Columns count UTF-16 code units.
+type Position struct {
+	Line   int
+	Column int
+}
+
+type Selection struct {
+	Start Position
+	End   Position
+}
+
+// Cursor is where a user is looking. Path is relative to the shared directory
+// and empty when no shared file is focused.
+type Cursor struct {
+	Path      string
+	Line      int
+	Column    int
+	Selection *Selection
+}
+
+// PeerCursor is a cursor update from another peer. An empty Cursor.Path
+// clears the peer's cursor.
+type PeerCursor struct {
+	Peer   PeerInfo
+	Cursor Cursor
+}
+
+// presenceThrottle is guarded by presenceMu.
+type presenceThrottle struct {
+	latest   Cursor
+	sent     Cursor
+	hasSent  bool
+	lastSend time.Time
+	timer    *time.Timer
+}
+
+// UpdatePresence shares this user's cursor with the other peers. Calls are
+// throttled; the latest cursor is always sent eventually.
+func (c *Client) UpdatePresence(cursor Cursor) error {
+	if cursor.Path != "" {
+		relPath, err := normalizeIncomingPath(cursor.Path)
+		if err != nil {
+			return fmt.Errorf("invalid cursor path: %w", err)
+		}
+		cursor.Path = relPath
+		if !c.sharesPath(relPath) {
+			cursor = Cursor{}
+		}
+	}
+	if !validCursor(cursor) {
+		return fmt.Errorf("invalid cursor position")
+	}
+
+	c.presenceMu.Lock()
+	defer c.presenceMu.Unlock()
+	c.presence.latest = cursor
+	if c.presence.timer != nil {
+		return nil
+	}
+	if wait := presenceInterval - time.Since(c.presence.lastSend); wait > 0 {
+		c.presence.timer = time.AfterFunc(wait, c.flushPresence)
+		return nil
+	}
+	c.sendPresenceLocked()
+	return nil
+}
+
+func (c *Client) flushPresence() {
+	c.presenceMu.Lock()
+	defer c.presenceMu.Unlock()
+	c.presence.timer = nil
+	c.sendPresenceLocked()
+}
+
+func (c *Client) sendPresenceLocked() {
+	cursor := c.presence.latest
+	if c.presence.hasSent && sameCursor(cursor, c.presence.sent) {
+		return
+	}
+	c.presence.sent = cursor
+	c.presence.hasSent = true
+	c.presence.lastSend = time.Now()
+
+	message := protocol.Presence{Path: cursor.Path, Line: cursor.Line, Column: cursor.Column}
+	if cursor.Selection != nil {
+		message.Selection = &protocol.Selection{
+			Start: protocol.Position(cursor.Selection.Start),
+			End:   protocol.Position(cursor.Selection.End),
+		}
+	}
+	plaintext, err := protocol.EncodePresence(message)
+	if err == nil {
+		err = c.writeEncrypted(priorityInteractive, "", plaintext, protocol.EncodeBroadcastEncrypted)
+	}
+	if err != nil && !c.stopping.Load() {
+		log.Printf("failed to send cursor: %v", err)
+	}
+}
+
+// applyPresence records a cursor update from another peer.
+func (c *Client) applyPresence(peerID string, presence protocol.Presence) {
+	cursor := Cursor{Path: presence.Path, Line: presence.Line, Column: presence.Column}
+	if presence.Selection != nil {
+		cursor.Selection = &Selection{
+			Start: Position(presence.Selection.Start),
+			End:   Position(presence.Selection.End),
+		}
+	}
+	if cursor.Path != "" {
+		relPath, err := normalizeIncomingPath(cursor.Path)
+		if err != nil || relPath != cursor.Path || !c.sharesPath(relPath) {
+			return
+		}
+	}
+
+	c.rosterMu.Lock()
+	if cursor.Path == "" {
+		delete(c.cursors, peerID)
+	} else {
+		c.cursors[peerID] = cursor
+	}
+	c.rosterMu.Unlock()
+	c.notifyPresence(PeerCursor{Peer: c.peerInfo(peerID), Cursor: cursor})
+}
+
+// clearPresenceLocked forgets a departed peer's cursor. It reports whether
+// the peer had one. The caller holds rosterMu.
+func (c *Client) clearPresenceLocked(peerID string) bool {
+	_, ok := c.cursors[peerID]
+	delete(c.cursors, peerID)
+	return ok
+}
+
+func (c *Client) sharesPath(relPath string) bool {
+	if c.shouldIgnoreInboundRel(relPath) {
+		return false
+	}
+	singleFileRel := c.singleFileScope()
+	return singleFileRel == "" || relPath == singleFileRel
+}
+
+func (c *Client) notifyPresence(cursor PeerCursor) {
+	if c.onPresence != nil {
+		c.onPresence(cursor)
+	}
+}
+
+func validCursor(cursor Cursor) bool {
+	valid := cursor.Line >= 0 && cursor.Column >= 0
+	if cursor.Selection != nil {
+		valid = valid && cursor.Selection.Start.Line >= 0 && cursor.Selection.Start.Column >= 0 &&
+			cursor.Selection.End.Line >= 0 && cursor.Selection.End.Column >= 0
+	}
+	return valid
+}
+
+func sameCursor(a, b Cursor) bool {
+	if a.Path != b.Path || a.Line != b.Line || a.Column != b.Column || (a.Selection == nil) != (b.Selection == nil) {
+		return false
+	}
+	return a.Selection == nil || *a.Selection == *b.Selection
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+)
+
+func sentPresence(t *testing.T, client *Client, frame outboundFrame) protocol.Presence {
+	t.Helper()
+	encrypted, ok := protocol.ParseBroadcastEncrypted(frame.data)
+	if !ok {
+		t.Fatalf("presence was not broadcast: %q", frame.data)
+	}
+	decrypted, err := client.codec.Decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	presence, isPresence, err := protocol.DecodePresence(decrypted)
+	if err != nil || !isPresence {
+		t.Fatalf("sent %s (%v), want presence", decrypted, err)
+	}
+	return presence
+}
+
+func TestPresenceUpdatesAreThrottled(t *testing.T) {
+	client := testApplyClient(t, t.TempDir())
+	client.outbound = newOutboundScheduler(nil, 0)
+
+	for line := 1; line <= 5; line++ {
+		if err := client.UpdatePresence(Cursor{Path: "src/main.go", Line: line}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.UpdatePresence(Cursor{Path: "../outside.go"}); err == nil {
+		t.Fatal("accepted a cursor outside the share")
+	}
+
+	first, _ := client.outbound.next()
+	if presence := sentPresence(t, client, first); presence.Line != 1 {
+		t.Fatalf("first update sent line %d, want 1", presence.Line)
+	}
+	second, _ := client.outbound.next()
+	if presence := sentPresence(t, client, second); presence.Line != 5 || presence.Path != "src/main.go" {
+		t.Fatalf("coalesced update sent %+v, want the latest cursor", presence)
+	}
+
+	time.Sleep(2 * presenceInterval)
+	if err := client.UpdatePresence(Cursor{Path: "src/main.go", Line: 5}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * presenceInterval)
+	queued, _, _ := client.outbound.stats()
+	if queued != 0 {
+		t.Fatal("an unchanged cursor was sent again")
+	}
+}
+
+func TestPeerCursorsAreReportedAndCleared(t *testing.T) {
+	client := testApplyClient(t, t.TempDir())
+	client.roster = map[string]*PeerInfo{"2": {ID: "2", Name: "bob"}}
+	client.cursors = make(map[string]Cursor)
+	client.onEvent = func(string, string, string) {}
+	var updates []PeerCursor
+	client.onPresence = func(update PeerCursor) { updates = append(updates, update) }
+
+	client.applyPresence("2", protocol.Presence{Path: "../escape.go", Line: 1})
+	client.applyPresence("2", protocol.Presence{
+		Path:      "main.go",
+		Line:      3,
+		Column:    4,
+		Selection: &protocol.Selection{Start: protocol.Position{Line: 3}, End: protocol.Position{Line: 3, Column: 4}},
+	})
+	if len(updates) != 1 {
+		t.Fatalf("got %d updates, want only the valid cursor", len(updates))
+	}
+	if update := updates[0]; update.Peer.Name != "bob" || update.Cursor.Line != 3 || update.Cursor.Selection.End.Column != 4 {
+		t.Fatalf("got %+v", update)
+	}
+
+	client.peerLeft("2")
+	if len(updates) != 2 || updates[1].Cursor.Path != "" || updates[1].Peer.ID != "2" {
+		t.Fatalf("departed peer's cursor was not cleared: %+v", updates)
+	}
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/ui"
+)
+
+const (
+	bootstrapProgressInterval = 250 * time.Millisecond
+	bootstrapProgressBarWidth = 24
+)
+
+// BootstrapProgress describes how much of the initial snapshot a joiner has
+// received. Totals come from the host's manifest and grow if more data arrives
+// than was announced.
+type BootstrapProgress struct {
+	FilesDone  int
+	FilesTotal int
+	BytesDone  int64
+	BytesTotal int64
+	// ETA is zero until enough data has arrived to estimate it.
+	ETA  time.Duration
+	Done bool
+}
+
+// bootstrapTracker is guarded by outboundMu.
+type bootstrapTracker struct {
+	progress   BootstrapProgress
+	started    time.Time
+	lastReport time.Time
+	active     bool
+}
+
+func (c *Client) startBootstrapProgress(files int, bytes int64) {
+	now := time.Now()
+	c.bootstrap = bootstrapTracker{
+		progress:   BootstrapProgress{FilesTotal: files, BytesTotal: bytes},
+		started:    now,
+		lastReport: now,
+		active:     true,
+	}
+	c.notifyBootstrapProgress(c.bootstrap.progress)
+}
+
+func (c *Client) recordBootstrapFile(size int) {
+	tracker := &c.bootstrap
+	if !tracker.active {
+		return
+	}
+	progress := &tracker.progress
+	progress.FilesDone++
+	progress.BytesDone += int64(size)
+	if progress.FilesDone > progress.FilesTotal {
+		progress.FilesTotal = progress.FilesDone
+	}
+	if progress.BytesDone > progress.BytesTotal {
+		progress.BytesTotal = progress.BytesDone
+	}
+
+	now := time.Now()
+	if now.Sub(tracker.lastReport) < bootstrapProgressInterval && progress.FilesDone < progress.FilesTotal {
+		return
+	}
+	tracker.lastReport = now
+	progress.ETA = estimateRemaining(progress.BytesDone, progress.BytesTotal, now.Sub(tracker.started))
+	c.notifyBootstrapProgress(*progress)
+}
+
+func (c *Client) finishBootstrapProgress() {
+	c.outboundMu.Lock()
+	defer c.outboundMu.Unlock()
+	if !c.bootstrap.active {
+		return
+	}
+	c.bootstrap.active = false
+	c.bootstrap.progress.ETA = 0
+	c.bootstrap.progress.Done = true
+	c.notifyBootstrapProgress(c.bootstrap.progress)
+}
+
+func estimateRemaining(done, total int64, elapsed time.Duration) time.Duration {
+	if done <= 0 || total <= done || elapsed <= 0 {
+		return 0
+	}
+	rate := float64(done) / elapsed.Seconds()
+	return time.Duration(float64(total-done) / rate * float64(time.Second))
+}
+
+func (c *Client) notifyBootstrapProgress(progress BootstrapProgress) {
+	if c.onBootstrapProgress != nil {
+		c.onBootstrapProgress(progress)
+		return
+	}
+	if c.onEvent != nil {
+		c.onEvent("bootstrap_progress", "", formatBootstrapProgress(progress))
+		return
+	}
+	if progress.Done {
+		fmt.Printf("\r\033[K%s\n", ui.Dim(fmt.Sprintf("synced %d files · %s", progress.FilesDone, formatBytes(float64(progress.BytesDone)))))
+		return
+	}
+	fmt.Printf("\r\033[K%s %s", progressBar(progress), ui.Dim(formatBootstrapProgress(progress)))
+}
+
+func formatBootstrapProgress(progress BootstrapProgress) string {
+	msg := fmt.Sprintf("%d/%d files · %s/%s", progress.FilesDone, progress.FilesTotal,
+		formatBytes(float64(progress.BytesDone)), formatBytes(float64(progress.BytesTotal)))
+	if progress.ETA > 0 {
+		msg += fmt.Sprintf(" · %s left", progress.ETA.Round(time.Second))
+	}
+	return msg
+}
+
+func progressBar(progress BootstrapProgress) string {
+	fraction := 0.0
+	switch {
+	case progress.BytesTotal > 0:
+		fraction = float64(progress.BytesDone) / float64(progress.BytesTotal)
+	case progress.FilesTotal > 0:
+		fraction = float64(progress.FilesDone) / float64(progress.FilesTotal)
+	}
+	filled := int(fraction * bootstrapProgressBarWidth)
+	if filled > bootstrapProgressBarWidth {
+		filled = bootstrapProgressBarWidth
+	}
+	return "[" + ui.Accent(strings.Repeat("█", filled)) + ui.Dim(strings.Repeat("░", bootstrapProgressBarWidth-filled)) + "]"
+}
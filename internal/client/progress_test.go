@@ -0,0 +1,62 @@
+package client
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+)
+
+func TestBootstrapProgressCountsFilesAndBytes(t *testing.T) {
+	client := testApplyClient(t, t.TempDir())
+	var reports []BootstrapProgress
+	client.onBootstrapProgress = func(progress BootstrapProgress) {
+		reports = append(reports, progress)
+	}
+
+	manifest, err := protocol.EncodeBootstrapManifest([]string{"a.txt", "b.txt"}, nil, "", 2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedManifest, err := client.codec.Encrypt(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.applyEncryptedOperation(encryptedManifest, true); err != nil {
+		t.Fatalf("manifest apply failed: %v", err)
+	}
+	for i, content := range []string{"four", "sixsix"} {
+		operation := protocol.SyncOperation{
+			ID:          fmt.Sprintf("op-%d", i),
+			Path:        fmt.Sprintf("%c.txt", 'a'+i),
+			BaseState:   missingState,
+			DesiredHash: fileHash([]byte(content)),
+			Content:     []byte(content),
+		}
+		if err := client.applyEncryptedOperation(encryptedOperation(t, client.codec, operation), true); err != nil {
+			t.Fatalf("bootstrap apply failed: %v", err)
+		}
+	}
+	client.finishBootstrapProgress()
+
+	if len(reports) < 2 {
+		t.Fatalf("got %d progress reports, want at least 2", len(reports))
+	}
+	if first := reports[0]; first.FilesDone != 0 || first.FilesTotal != 2 || first.BytesTotal != 10 {
+		t.Fatalf("initial progress = %+v", first)
+	}
+	last := reports[len(reports)-1]
+	if !last.Done || last.FilesDone != 2 || last.BytesDone != 10 || last.ETA != 0 {
+		t.Fatalf("final progress = %+v", last)
+	}
+}
+
+func TestEstimateRemainingUsesObservedRate(t *testing.T) {
+	if got := estimateRemaining(25, 100, time.Second); got != 3*time.Second {
+		t.Fatalf("eta = %s, want 3s", got)
+	}
+	if got := estimateRemaining(0, 100, time.Second); got != 0 {
+		t.Fatalf("eta without data = %s, want 0", got)
+	}
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+)
+
+// Recorder keeps the session's file history. The host records the tree it
+// starts with and then every ordered operation it commits.
+type Recorder interface {
+	RecordSnapshot(relPath string, content []byte, dir bool) error
+	RecordOperation(sequence uint64, peerID, peerName, relPath string, content []byte, deleted bool) error
+}
+
+// recordSnapshot records the shared tree as the recording's starting point.
+// It runs before the session starts reading operations.
+func (c *Client) recordSnapshot() {
+	if c.recorder == nil {
+		return
+	}
+	paths, directories, err := c.snapshotManifest()
+	if err != nil {
+		c.stopRecording(err)
+		return
+	}
+	if singleFileRel := c.singleFileScope(); singleFileRel != "" {
+		paths, directories = []string{singleFileRel}, nil
+	}
+	isDirectory := make(map[string]bool, len(directories))
+	for _, dir := range directories {
+		isDirectory[dir] = true
+	}
+
+	c.outboundMu.Lock()
+	defer c.outboundMu.Unlock()
+	c.recordedState = make(map[string]string, len(paths))
+	for _, relPath := range paths {
+		if c.recorder == nil {
+			return
+		}
+		if isDirectory[relPath] {
+			if err := c.recorder.RecordSnapshot(relPath, nil, true); err != nil {
+				c.stopRecording(err)
+			}
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(c.baseDir, filepath.FromSlash(relPath)))
+		if err != nil || len(content) > maxSyncedFileBytes {
+			continue
+		}
+		if err := c.recorder.RecordSnapshot(relPath, content, false); err != nil {
+			c.stopRecording(err)
+			continue
+		}
+		c.recordedState[relPath] = fileHash(content)
+	}
+}
+
+// recordOperation records an ordered operation with its content resolved.
+// Operations that leave a path as already recorded, like the host's own
+// initial snapshot, are skipped. The caller holds outboundMu.
+func (c *Client) recordOperation(sequence uint64, originID, relPath string, operation protocol.SyncOperation) {
+	if c.recorder == nil || c.recordedState[relPath] == operation.DesiredHash {
+		return
+	}
+	peer := c.peerInfo(originID)
+	if originID == c.selfID() {
+		peer.Name = c.profile.Name
+	}
+	if err := c.recorder.RecordOperation(sequence, originID, peer.Name, relPath, operation.Content, operation.Delete); err != nil {
+		c.stopRecording(err)
+		return
+	}
+	if c.recordedState == nil {
+		c.recordedState = make(map[string]string)
+	}
+	c.recordedState[relPath] = operation.DesiredHash
+}
+
+// stopRecording gives up on a recording that can no longer be written. The
+// caller holds outboundMu, or runs before the session starts.
+func (c *Client) stopRecording(err error) {
+	c.recorder = nil
+	c.notifyWarning("recording stopped: " + err.Error())
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+)
+
+type recordedEntry struct {
+	sequence uint64
+	peerID   string
+	path     string
+	content  string
+	deleted  bool
+	snapshot bool
+}
+
+type fakeRecorder struct {
+	entries []recordedEntry
+}
+
+func (r *fakeRecorder) RecordSnapshot(relPath string, content []byte, dir bool) error {
+	if !dir {
+		r.entries = append(r.entries, recordedEntry{path: relPath, content: string(content), snapshot: true})
+	}
+	return nil
+}
+
+func (r *fakeRecorder) RecordOperation(sequence uint64, peerID, peerName, relPath string, content []byte, deleted bool) error {
+	r.entries = append(r.entries, recordedEntry{sequence: sequence, peerID: peerID, path: relPath, content: string(content), deleted: deleted})
+	return nil
+}
+
+func TestHostRecordsSnapshotAndNewOperations(t *testing.T) {
+	baseDir := t.TempDir()
+	original := []byte("package main\n")
+	if err := os.WriteFile(filepath.Join(baseDir, "main.go"), original, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	client := testApplyClient(t, baseDir)
+	client.isHost.Store(true)
+	client.selfPeerID.Store("1")
+	client.onEvent = func(string, string, string) {}
+	recorder := &fakeRecorder{}
+	client.recorder = recorder
+	client.recordSnapshot()
+
+	// The host's own snapshot echo changes nothing and is left out.
+	echo := protocol.SyncOperation{ID: "host-1", Path: "main.go", BaseState: missingState, DesiredHash: fileHash(original), Content: original}
+	if err := client.applyOrderedOperation(1, "1", encryptedOperation(t, client.codec, echo)); err != nil {
+		t.Fatal(err)
+	}
+	changed := []byte("package main\n\nfunc main() {}\n")
+	edit := protocol.SyncOperation{ID: "joiner-1", Path: "main.go", BaseState: fileHash(original), DesiredHash: fileHash(changed), Content: changed}
+	if err := client.applyOrderedOperation(2, "2", encryptedOperation(t, client.codec, edit)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []recordedEntry{
+		{path: "main.go", content: string(original), snapshot: true},
+		{sequence: 2, peerID: "2", path: "main.go", content: string(changed)},
+	}
+	if len(recorder.entries) != len(want) {
+		t.Fatalf("recorded %+v, want %+v", recorder.entries, want)
+	}
+	for i := range want {
+		if recorder.entries[i] != want[i] {
+			t.Fatalf("entry %d = %+v, want %+v", i, recorder.entries[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+)
+
+const digestSettleTimeout = 5 * time.Second
+
+// repairLoop periodically reconciles the shared path with the session. Every
+// peer resends local changes the watcher missed; the host also broadcasts a
+// digest of its committed states so joiners can ask for paths that drifted.
+func (c *Client) repairLoop(ctx context.Context) {
+	if c.repairInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.repairInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.doneCh:
+			return
+		case <-ticker.C:
+			c.runRepairRound()
+		}
+	}
+}
+
+func (c *Client) runRepairRound() {
+	if !c.syncReady.Load() || c.stopping.Load() {
+		return
+	}
+	c.reconcileLocal()
+	if c.isHost.Load() {
+		if err := c.broadcastStateDigest(); err != nil {
+			log.Printf("failed to send state digest: %v", err)
+		}
+	}
+}
+
+// reconcileLocal sends local edits and deletions the file watcher missed.
+func (c *Client) reconcileLocal() {
+	if _, err := c.SendInitialSnapshot(); err != nil {
+		log.Printf("failed to rescan during repair: %v", err)
+	}
+	missing := make([]string, 0)
+	for relPath := range c.committedContentStates() {
+		if _, err := os.Lstat(filepath.Join(c.baseDir, filepath.FromSlash(relPath))); errors.Is(err, os.ErrNotExist) {
+			missing = append(missing, relPath)
+		}
+	}
+	sort.Strings(missing)
+	for _, relPath := range missing {
+		c.sendDelete(relPath, true)
+	}
+}
+
+func (c *Client) broadcastStateDigest() error {
+	c.waitForPendingAcks(digestSettleTimeout)
+	c.outboundMu.Lock()
+	defer c.outboundMu.Unlock()
+	plaintext, err := protocol.EncodeStateDigest(c.lastSequence.Load(), c.committedContentStates())
+	if err != nil {
+		return err
+	}
+	return c.writeEncrypted(priorityBulk, "", plaintext, protocol.EncodeEncrypted)
+}
+
+// waitForPendingAcks gives in-flight operations a chance to be echoed so the
+// digest is not sent in the middle of a burst.
+func (c *Client) waitForPendingAcks(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		c.pendingMu.Lock()
+		idle := len(c.pending) == 0
+		c.pendingMu.Unlock()
+		if idle {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// compareStateDigest runs with the ordered stream paused at the digest, so it
+// only compares when this peer has applied exactly the operations the host had.
+func (c *Client) compareStateDigest(digest protocol.StateDigest) {
+	if c.isHost.Load() || !c.syncReady.Load() || digest.Sequence != c.lastSequence.Load() {
+		return
+	}
+	drifted := c.driftedPaths(digest.States)
+	if len(drifted) == 0 {
+		return
+	}
+	plaintext, err := protocol.EncodeRepairRequest(drifted)
+	if err != nil {
+		log.Printf("failed to encode repair request: %v", err)
+		return
+	}
+	if err := c.writeEncrypted(priorityBulk, "", plaintext, protocol.EncodeHostEncrypted); err != nil {
+		log.Printf("failed to send repair request: %v", err)
+		return
+	}
+	c.notifyRepair(fmt.Sprintf("requested repair of %d %s", len(drifted), pluralPaths(len(drifted))))
+}
+
+// driftedPaths returns this peer's committed state for every path that differs
+// from the host's digest.
+func (c *Client) driftedPaths(hostStates map[string]string) map[string]string {
+	local := c.committedContentStates()
+	singleFileRel := c.singleFileScope()
+	drifted := make(map[string]string)
+	for rawPath, state := range hostStates {
+		relPath, err := normalizeIncomingPath(rawPath)
+		if err != nil || relPath != rawPath || !isContentState(state) || c.shouldIgnoreInboundRel(relPath) {
+			continue
+		}
+		if singleFileRel != "" && relPath != singleFileRel {
+			continue
+		}
+		if local[relPath] != state {
+			drifted[relPath] = c.committedPathState(relPath)
+		}
+	}
+	for relPath, state := range local {
+		if _, ok := hostStates[relPath]; !ok {
+			drifted[relPath] = state
+		}
+	}
+	return drifted
+}
+
+func (c *Client) committedContentStates() map[string]string {
+	states := make(map[string]string)
+	c.lastHash.Range(func(key, value any) bool {
+		relPath, pathOK := key.(string)
+		state, stateOK := value.(string)
+		if pathOK && stateOK && isContentState(state) {
+			states[relPath] = state
+		}
+		return true
+	})
+	return states
+}
+
+func (c *Client) handlePeerMessage(peerID, encryptedPayload string) error {
+	decrypted, err := c.codec.Decrypt(encryptedPayload)
+	if err != nil {
+		return fmt.Errorf("decrypt: %w", err)
+	}
+	request, isRepair, err := protocol.DecodeRepairRequest(decrypted)
+	if err != nil {
+		return err
+	}
+	if isRepair {
+		c.repairPaths(peerID, request.States)
+		return nil
+	}
+	blobRequest, isBlobRequest, err := protocol.DecodeBlobRequest(decrypted)
+	if err != nil {
+		return err
+	}
+	if isBlobRequest {
+		return c.serveBlob(peerID, blobRequest)
+	}
+	terminalRequest, isTerminal, err := protocol.DecodeTerminalRequest(decrypted)
+	if err != nil {
+		return err
+	}
+	if isTerminal {
+		return c.handleTerminalRequest(peerID, terminalRequest)
+	}
+	tunnel, isTunnel, err := protocol.DecodeTunnel(decrypted)
+	if err != nil {
+		return err
+	}
+	if isTunnel {
+		return c.handleTunnel(peerID, tunnel)
+	}
+	taskRun, isTaskRun, err := protocol.DecodeTaskRun(decrypted)
+	if err != nil {
+		return err
+	}
+	if isTaskRun {
+		return c.handleTaskRun(peerID, taskRun)
+	}
+	return c.queueProposal(peerID, encryptedPayload, decrypted)
+}
+
+// handleHostMessage processes a message the host addressed to this peer.
+func (c *Client) handleHostMessage(encryptedPayload string) error {
+	decrypted, err := c.codec.Decrypt(encryptedPayload)
+	if err != nil {
+		return fmt.Errorf("decrypt: %w", err)
+	}
+	rejected, isRejected, err := protocol.DecodeWriteRejected(decrypted)
+	if err != nil {
+		return err
+	}
+	if isRejected {
+		c.keepRejectedCopy(rejected)
+		return nil
+	}
+	result, isResult, err := protocol.DecodeProposalResult(decrypted)
+	if err != nil {
+		return err
+	}
+	if isResult {
+		c.applyProposalResult(result)
+		return nil
+	}
+	response, isBlob, err := protocol.DecodeBlobResponse(decrypted)
+	if err != nil {
+		return err
+	}
+	if isBlob {
+		return c.applyBlobResponse(response)
+	}
+	output, isTerminal, err := protocol.DecodeTerminalOutput(decrypted)
+	if err != nil {
+		return err
+	}
+	if isTerminal {
+		c.applyTerminalOutput(output)
+		return nil
+	}
+	tunnel, isTunnel, err := protocol.DecodeTunnel(decrypted)
+	if err != nil {
+		return err
+	}
+	if isTunnel {
+		return c.handleTunnel("", tunnel)
+	}
+	taskOutput, isTaskOutput, err := protocol.DecodeTaskOutput(decrypted)
+	if err != nil {
+		return err
+	}
+	if isTaskOutput {
+		c.applyTaskOutput(taskOutput)
+		return nil
+	}
+	return fmt.Errorf("unsupported message")
+}
+
+// repairPaths resends the host's current state for each requested path. The
+// requester's state is used as the base so the resend replaces it cleanly.
+// Requests come from joiners, so only paths this host shares are repaired.
+func (c *Client) repairPaths(peerID string, states map[string]string) {
+	relPaths := make([]string, 0, len(states))
+	for rawPath, baseState := range states {
+		relPath, err := normalizeIncomingPath(rawPath)
+		if err != nil || relPath != rawPath || !validPathState(baseState) || c.shouldIgnoreInboundRel(relPath) || c.shouldIgnoreOutboundRel(relPath, false) {
+			continue
+		}
+		if singleFileRel := c.singleFileScope(); singleFileRel != "" && relPath != singleFileRel {
+			continue
+		}
+		relPaths = append(relPaths, relPath)
+	}
+	sort.Strings(relPaths)
+
+	c.outboundMu.Lock()
+	repaired := 0
+	for _, relPath := range relPaths {
+		if c.repairPathUnlocked(relPath, states[relPath]) {
+			repaired++
+		}
+	}
+	c.outboundMu.Unlock()
+	if repaired > 0 {
+		c.notifyRepair(fmt.Sprintf("repaired %d %s for peer %s", repaired, pluralPaths(repaired), peerID))
+	}
+}
+
+// repairPathUnlocked resends a path the host has committed: its content for
+// a committed file, or a Delete for a committed deletion. Paths the host
+// never committed are left alone, so a peer cannot have the host read or
+// delete anything outside the session.
+func (c *Client) repairPathUnlocked(relPath, baseState string) bool {
+	committed, ok := c.lastHash.Load(relPath)
+	if !ok {
+		return false
+	}
+	switch state := committed.(string); {
+	case isContentState(state):
+		return c.resendPathUnlocked(relPath, baseState, false)
+	case state == missingState:
+		return c.resendPathUnlocked(relPath, baseState, true)
+	}
+	return false
+}
+
+// resendPathUnlocked sends the host's copy of a path to every peer, or a
+// Delete if it has none and allowDelete is set. Paths the outbound ignore
+// rules keep private are never sent.
+func (c *Client) resendPathUnlocked(relPath, baseState string, allowDelete bool) bool {
+	if c.shouldIgnoreOutboundRel(relPath, false) {
+		return false
+	}
+	absPath := filepath.Join(c.baseDir, filepath.FromSlash(relPath))
+	operation := protocol.SyncOperation{
+		ID:        c.nextOperationID(),
+		Path:      relPath,
+		BaseState: baseState,
+	}
+	info, err := os.Lstat(absPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if !allowDelete {
+			return false
+		}
+		operation.DesiredHash = missingState
+		operation.Delete = true
+	case err != nil || !info.Mode().IsRegular() || info.Size() > c.maxFileBytes():
+		return false
+	default:
+		content, err := os.ReadFile(absPath)
+		if err != nil {
+			return false
+		}
+		operation.DesiredHash = fileHash(content)
+		operation.Content = content
+	}
+	if err := c.sendOperationUnlocked(operation, nil, priorityBulk); err != nil {
+		log.Printf("failed to resend %s: %v", relPath, err)
+		return false
+	}
+	return true
+}
+
+func isContentState(state string) bool {
+	return state != missingState && state != directoryState && state != otherState && validPathState(state)
+}
+
+func pluralPaths(count int) string {
+	if count == 1 {
+		return "path"
+	}
+	return "paths"
+}
@@ -0,0 +1,229 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+	"github.com/go-johnnyhe/shadow/server"
+	"github.com/gorilla/websocket"
+)
+
+func TestDriftedPathsReportsMismatchedAndExtraPaths(t *testing.T) {
+	client := testApplyClient(t, t.TempDir())
+	same := fileHash([]byte("same"))
+	stale := fileHash([]byte("stale"))
+	fresh := fileHash([]byte("fresh"))
+	extra := fileHash([]byte("extra"))
+	client.lastHash.Store("same.txt", same)
+	client.lastHash.Store("drifted.txt", stale)
+	client.lastHash.Store("extra.txt", extra)
+	client.lastHash.Store("dir", directoryState)
+
+	drifted := client.driftedPaths(map[string]string{
+		"same.txt":    same,
+		"drifted.txt": fresh,
+		"missing.txt": fresh,
+		"../escape":   fresh,
+	})
+
+	want := map[string]string{
+		"drifted.txt": stale,
+		"missing.txt": missingState,
+		"extra.txt":   extra,
+	}
+	if len(drifted) != len(want) {
+		t.Fatalf("drifted = %v, want %v", drifted, want)
+	}
+	for relPath, state := range want {
+		if drifted[relPath] != state {
+			t.Fatalf("drifted[%q] = %q, want %q", relPath, drifted[relPath], state)
+		}
+	}
+}
+
+func TestStateDigestIsIgnoredAfterConcurrentOperations(t *testing.T) {
+	client := testApplyClient(t, t.TempDir())
+	client.outbound = newOutboundScheduler(nil, 0)
+	client.syncReady.Store(true)
+	client.lastSequence.Store(7)
+	client.lastHash.Store("file.txt", fileHash([]byte("local")))
+
+	digest, err := protocol.EncodeStateDigest(6, map[string]string{"file.txt": fileHash([]byte("host"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := client.codec.Encrypt(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.applyEncryptedOperation(encrypted, false); err != nil {
+		t.Fatalf("digest was rejected: %v", err)
+	}
+	if queued, _, _ := client.outbound.stats(); queued != 0 {
+		t.Fatalf("stale digest queued %d frames, want no repair request", queued)
+	}
+}
+
+func TestRepairSkipsIgnoredAndUncommittedPaths(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	baseDir := t.TempDir()
+	if err := runGit(baseDir, "init"); err != nil {
+		t.Fatalf("git init failed: %v", err)
+	}
+	files := map[string]string{".gitignore": ".env\n", ".env": "SECRET=1\n", "stray.txt": "local only\n", "main.go": "package main\n"}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(baseDir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := testApplyClient(t, baseDir)
+	client.outbound = newOutboundScheduler(nil, 0)
+	client.lastHash.Store(".env", fileHash([]byte("SECRET=1\n")))
+	client.lastHash.Store("main.go", fileHash([]byte("package main\n")))
+
+	client.repairPaths("joiner", map[string]string{".env": missingState, "stray.txt": missingState, "gone.txt": fileHash([]byte("x"))})
+	if queued, _, _ := client.outbound.stats(); queued != 0 {
+		t.Fatalf("repair of ignored or uncommitted paths queued %d frames, want none", queued)
+	}
+
+	client.repairPaths("joiner", map[string]string{"main.go": missingState})
+	if queued, _, _ := client.outbound.stats(); queued != 1 {
+		t.Fatalf("repair of a committed path queued %d frames, want 1", queued)
+	}
+}
+
+func TestHostRepairsDriftedJoinerPath(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/ws", server.NewRelay(server.SessionConfig{HostToken: "host-token", JoinToken: "join-token"}))
+	relay := httptest.NewServer(mux)
+	defer relay.Close()
+	wsURL := "ws" + strings.TrimPrefix(relay.URL, "http") + "/ws"
+	dial := func(token string) *websocket.Conn {
+		dialer := *websocket.DefaultDialer
+		dialer.Subprotocols = []string{protocol.WebSocketSubprotocol}
+		conn, _, err := dialer.Dial(wsURL, http.Header{"Authorization": {"Bearer " + token}})
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		return conn
+	}
+
+	hostDir, joinDir := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(hostDir, "file.txt"), []byte("host"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	host, err := NewClient(dial("host-token"), Options{IsHost: true, E2EKey: "repair-key", BaseDir: hostDir, RepairInterval: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	joiner, err := NewClient(dial("join-token"), Options{E2EKey: "repair-key", BaseDir: joinDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	host.Start(ctx)
+	joiner.Start(ctx)
+	if _, err := host.SendInitialSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	joinPath := filepath.Join(joinDir, "file.txt")
+	waitForContent(t, joinPath, "host")
+
+	// Simulate an operation the joiner lost: its committed state and its
+	// copy disagree with the host, while matching each other so the
+	// joiner's own reconcile has nothing to send.
+	joiner.lastHash.Store("file.txt", fileHash([]byte("stale")))
+	if err := os.WriteFile(joinPath, []byte("stale"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitForContent(t, joinPath, "host")
+	if state, _ := joiner.lastHash.Load("file.txt"); state != fileHash([]byte("host")) {
+		t.Fatalf("joiner committed state after repair = %v", state)
+	}
+}
+
+func TestReconnectedHostRepairsDriftWithoutWaiting(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/ws", server.NewRelay(server.SessionConfig{HostToken: "host-token", JoinToken: "join-token", HostGracePeriod: 10 * time.Second}))
+	relay := httptest.NewServer(mux)
+	defer relay.Close()
+	wsURL := "ws" + strings.TrimPrefix(relay.URL, "http") + "/ws"
+	dial := func(token string, header http.Header) (*websocket.Conn, error) {
+		dialer := *websocket.DefaultDialer
+		dialer.Subprotocols = []string{protocol.WebSocketSubprotocol}
+		header.Set("Authorization", "Bearer "+token)
+		conn, _, err := dialer.Dial(wsURL, header)
+		return conn, err
+	}
+
+	hostDir, joinDir := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(hostDir, "file.txt"), []byte("host"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	hostConn, err := dial("host-token", http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err := NewClient(hostConn, Options{
+		IsHost:  true,
+		E2EKey:  "repair-key",
+		BaseDir: hostDir,
+		Redial: func(resumeSequence uint64) (*websocket.Conn, error) {
+			return dial("host-token", http.Header{protocol.ResumeHeader: {strconv.FormatUint(resumeSequence, 10)}})
+		},
+		ReconnectWindow: 10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	joinConn, err := dial("join-token", http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	joiner, err := NewClient(joinConn, Options{E2EKey: "repair-key", BaseDir: joinDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	host.Start(ctx)
+	joiner.Start(ctx)
+	if _, err := host.SendInitialSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	joinPath := filepath.Join(joinDir, "file.txt")
+	waitForContent(t, joinPath, "host")
+
+	// With no repair interval, only the reconnect can send a digest.
+	joiner.lastHash.Store("file.txt", fileHash([]byte("stale")))
+	if err := os.WriteFile(joinPath, []byte("stale"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_ = hostConn.Close()
+	waitForContent(t, joinPath, "host")
+}
+
+func waitForContent(t *testing.T, path, want string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if got, err := os.ReadFile(path); err == nil && string(got) == want {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	got, _ := os.ReadFile(path)
+	t.Fatalf("%s = %q, want %q", path, got, want)
+}
@@ -0,0 +1,306 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+	"github.com/go-johnnyhe/shadow/internal/ui"
+)
+
+// Profile is how this client introduces itself to the other peers.
+type Profile struct {
+	Name    string
+	Editor  string
+	Version string
+}
+
+// PeerInfo describes another peer in the session. Name, Editor and Version
+// are empty until the peer's profile arrives.
+type PeerInfo struct {
+	ID      string
+	Name    string
+	Editor  string
+	Version string
+	Host    bool
+	Joined  time.Time
+}
+
+// Label is the peer's display name, falling back to its relay ID.
+func (p PeerInfo) Label() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return "peer " + p.ID
+}
+
+// FileReceived describes a path another peer changed. Peer is zero for files
+// received in the initial snapshot.
+type FileReceived struct {
+	Path    string
+	Deleted bool
+	Peer    PeerInfo
+}
+
+// Peers returns the other connected peers ordered by join time.
+func (c *Client) Peers() []PeerInfo {
+	c.rosterMu.Lock()
+	defer c.rosterMu.Unlock()
+	return c.peersLocked()
+}
+
+func (c *Client) peersLocked() []PeerInfo {
+	peers := make([]PeerInfo, 0, len(c.roster))
+	for _, peer := range c.roster {
+		peers = append(peers, *peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		a, _ := strconv.ParseUint(peers[i].ID, 10, 64)
+		b, _ := strconv.ParseUint(peers[j].ID, 10, 64)
+		return a < b
+	})
+	return peers
+}
+
+func (c *Client) peerInfo(peerID string) PeerInfo {
+	if peerID == "" {
+		return PeerInfo{}
+	}
+	c.rosterMu.Lock()
+	defer c.rosterMu.Unlock()
+	if peer, ok := c.roster[peerID]; ok {
+		return *peer
+	}
+	return PeerInfo{ID: peerID}
+}
+
+// announceProfile sends this client's profile to every other peer. It runs
+// on start, after a reconnect and whenever a peer joins, so newcomers learn
+// who is already here.
+func (c *Client) announceProfile() {
+	if c.profile.Name == "" {
+		return
+	}
+	plaintext, err := protocol.EncodeProfile(c.profile.Name, c.profile.Editor, c.profile.Version)
+	if err == nil {
+		err = c.writeEncrypted(priorityInteractive, "", plaintext, protocol.EncodeBroadcastEncrypted)
+	}
+	if err != nil && !c.stopping.Load() {
+		log.Printf("failed to announce profile: %v", err)
+	}
+}
+
+// resetRoster forgets every peer. The relay introduces them again after a
+// reconnect.
+func (c *Client) resetRoster() {
+	c.rosterMu.Lock()
+	c.roster = make(map[string]*PeerInfo)
+	cursors := c.cursors
+	c.cursors = make(map[string]Cursor)
+	c.rosterIntroduced = false
+	c.rosterMu.Unlock()
+	// Frames in flight were lost with the connection.
+	c.closeTunnels(func(tunnelKey) bool { return true })
+	for peerID := range cursors {
+		c.notifyPresence(PeerCursor{Peer: PeerInfo{ID: peerID}})
+	}
+}
+
+// peerJoined runs on the read loop when the relay announces a peer. A known
+// peer announced again has become the host.
+func (c *Client) peerJoined(peerID string, host bool) {
+	if peerID == c.selfID() {
+		return
+	}
+	c.rosterMu.Lock()
+	if peer, ok := c.roster[peerID]; ok {
+		peer.Host = host
+		c.rosterMu.Unlock()
+		c.notifyRoster()
+		return
+	}
+	c.roster[peerID] = &PeerInfo{ID: peerID, Host: host, Joined: time.Now()}
+	c.rosterMu.Unlock()
+	c.announceProfile()
+	c.announceForwards()
+	c.announceTasks()
+	c.notifyRoster()
+}
+
+func (c *Client) peerLeft(peerID string) {
+	c.rosterMu.Lock()
+	peer, ok := c.roster[peerID]
+	if ok {
+		delete(c.roster, peerID)
+	}
+	hadCursor := c.clearPresenceLocked(peerID)
+	c.rosterMu.Unlock()
+	if ok && peer.Host {
+		c.closeTunnels(func(tunnelKey) bool { return true })
+	} else {
+		c.closeTunnels(func(key tunnelKey) bool { return key.peer == peerID })
+		c.cancelTaskRuns(func(key taskRunKey) bool { return key.peer == peerID })
+	}
+	if hadCursor {
+		c.notifyPresence(PeerCursor{Peer: PeerInfo{ID: peerID}})
+	}
+	if !ok {
+		return
+	}
+	c.notifyMembership("peer_left", *peer)
+	c.notifyRoster()
+}
+
+// handlePeerBroadcast handles a message another peer sent to everyone.
+func (c *Client) handlePeerBroadcast(peerID, encryptedPayload string) error {
+	decrypted, err := c.codec.Decrypt(encryptedPayload)
+	if err != nil {
+		return fmt.Errorf("decrypt: %w", err)
+	}
+	profile, isProfile, err := protocol.DecodeProfile(decrypted)
+	if err != nil {
+		return err
+	}
+	if isProfile {
+		c.applyProfile(peerID, profile)
+		return nil
+	}
+	presence, isPresence, err := protocol.DecodePresence(decrypted)
+	if err != nil {
+		return err
+	}
+	if isPresence {
+		c.applyPresence(peerID, presence)
+		return nil
+	}
+	chat, isChat, err := protocol.DecodeChat(decrypted)
+	if err != nil {
+		return err
+	}
+	if isChat {
+		c.applyChat(peerID, chat)
+		return nil
+	}
+	focus, isFocus, err := protocol.DecodeFocus(decrypted)
+	if err != nil {
+		return err
+	}
+	if isFocus {
+		c.applyFocus(peerID, focus)
+		return nil
+	}
+	output, isTerminal, err := protocol.DecodeTerminalOutput(decrypted)
+	if err != nil {
+		return err
+	}
+	if isTerminal {
+		if c.isHost.Load() || !c.peerInfo(peerID).Host {
+			return fmt.Errorf("terminal output from a peer that is not the host")
+		}
+		c.applyTerminalOutput(output)
+		return nil
+	}
+	forwards, isForwards, err := protocol.DecodeForwards(decrypted)
+	if err != nil {
+		return err
+	}
+	if isForwards {
+		if c.isHost.Load() || !c.peerInfo(peerID).Host {
+			return fmt.Errorf("forwarded ports from a peer that is not the host")
+		}
+		c.applyForwards(forwards)
+		return nil
+	}
+	tasks, isTasks, err := protocol.DecodeTasks(decrypted)
+	if err != nil {
+		return err
+	}
+	if isTasks {
+		if c.isHost.Load() || !c.peerInfo(peerID).Host {
+			return fmt.Errorf("tasks from a peer that is not the host")
+		}
+		c.applyTasks(tasks)
+		return nil
+	}
+	return fmt.Errorf("unsupported peer message")
+}
+
+// applyProfile records a profile broadcast by another peer.
+func (c *Client) applyProfile(peerID string, profile protocol.Profile) {
+	c.rosterMu.Lock()
+	peer, ok := c.roster[peerID]
+	if !ok {
+		peer = &PeerInfo{ID: peerID, Joined: time.Now()}
+		c.roster[peerID] = peer
+	}
+	first := peer.Name == ""
+	peer.Name = sanitizeLabel(profile.Name)
+	peer.Editor = sanitizeLabel(profile.Editor)
+	peer.Version = sanitizeLabel(profile.ClientVersion)
+	info := *peer
+	introduced := c.rosterIntroduced
+	c.rosterMu.Unlock()
+
+	if first {
+		eventType := "peer_here"
+		if introduced {
+			eventType = "peer_joined"
+		}
+		c.notifyMembership(eventType, info)
+	}
+	c.notifyRoster()
+}
+
+// markRosterIntroduced notes that the relay has finished introducing the
+// peers that were connected before this client.
+func (c *Client) markRosterIntroduced() {
+	c.rosterMu.Lock()
+	c.rosterIntroduced = true
+	c.rosterMu.Unlock()
+}
+
+// sanitizeLabel strips control characters so a peer cannot rewrite the
+// terminal through its display name.
+func sanitizeLabel(value string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return -1
+		}
+		return r
+	}, value))
+}
+
+func (c *Client) notifyRoster() {
+	if c.onRoster != nil {
+		c.onRoster(c.Peers())
+	}
+}
+
+func (c *Client) notifyMembership(eventType string, peer PeerInfo) {
+	detail := peer.Label()
+	if peer.Editor != "" {
+		detail += " · " + peer.Editor
+	}
+	if c.onEvent != nil {
+		switch eventType {
+		case "peer_left":
+			c.onEvent("peer_left", "", peer.Label()+" left")
+		case "peer_joined":
+			c.onEvent("peer_joined", "", detail+" joined")
+		}
+		return
+	}
+	switch eventType {
+	case "peer_left":
+		fmt.Println(ui.Dim("○ " + peer.Label() + " left"))
+	case "peer_joined":
+		fmt.Printf("%s %s\n", ui.Accent("●"), detail+ui.Dim(" joined"))
+	default:
+		fmt.Printf("%s %s\n", ui.Accent("●"), detail+ui.Dim(" is here"))
+	}
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+)
+
+func TestRosterTracksPeerProfiles(t *testing.T) {
+	client := testApplyClient(t, t.TempDir())
+	client.outbound = newOutboundScheduler(nil, 0)
+	client.onEvent = func(string, string, string) {}
+	client.roster = make(map[string]*PeerInfo)
+	client.cursors = make(map[string]Cursor)
+	client.selfPeerID.Store("1")
+	client.profile = Profile{Name: "host", Editor: "vim", Version: "1.0.0"}
+	var rosters [][]PeerInfo
+	client.onRoster = func(peers []PeerInfo) { rosters = append(rosters, peers) }
+
+	client.peerJoined("1", true)
+	client.peerJoined("10", false)
+	client.peerJoined("2", false)
+	if len(client.Peers()) != 2 {
+		t.Fatalf("roster has %d peers, want 2 (self excluded)", len(client.Peers()))
+	}
+	frame, ok := client.outbound.next()
+	if !ok {
+		t.Fatal("joining peer did not trigger a profile announcement")
+	}
+	encrypted, ok := protocol.ParseBroadcastEncrypted(frame.data)
+	if !ok {
+		t.Fatalf("profile was not broadcast: %q", frame.data)
+	}
+	decrypted, err := client.codec.Decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile, isProfile, err := protocol.DecodeProfile(decrypted); err != nil || !isProfile || profile.Name != "host" {
+		t.Fatalf("announced %+v (%v), want this client's profile", profile, err)
+	}
+
+	plaintext, err := protocol.EncodeProfile("ali\x1b[2Jce", "vscode", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := client.codec.Encrypt(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.handlePeerBroadcast("10", payload); err != nil {
+		t.Fatal(err)
+	}
+
+	peers := client.Peers()
+	if peers[0].ID != "2" || peers[1].ID != "10" {
+		t.Fatalf("roster order %s, %s; want join order", peers[0].ID, peers[1].ID)
+	}
+	if peers[1].Name != "ali[2Jce" || peers[1].Editor != "vscode" {
+		t.Fatalf("profile applied as %+v", peers[1])
+	}
+	if peers[0].Label() != "peer 2" {
+		t.Fatalf("peer without a profile labelled %q", peers[0].Label())
+	}
+
+	var received FileReceived
+	client.onFileReceived = func(file FileReceived) { received = file }
+	client.notifyFileReceived("main.go", false, "10")
+	if received.Peer.Name != "ali[2Jce" || received.Path != "main.go" {
+		t.Fatalf("file_received carried %+v", received)
+	}
+
+	client.peerLeft("10")
+	if len(client.Peers()) != 1 || len(rosters[len(rosters)-1]) != 1 {
+		t.Fatal("departed peer is still in the roster")
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -25,12 +27,17 @@ const (
 
 func newSmokeServer(t *testing.T, readOnly bool) string {
 	t.Helper()
-	mux := http.NewServeMux()
-	mux.Handle("/ws", server.NewRelay(server.SessionConfig{
+	return newSmokeRelay(t, server.SessionConfig{
 		ReadOnlyJoiners: readOnly,
 		HostToken:       smokeHostToken,
 		JoinToken:       smokeJoinToken,
-	}))
+	})
+}
+
+func newSmokeRelay(t *testing.T, config server.SessionConfig) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.Handle("/ws", server.NewRelay(config))
 	httpServer := httptest.NewServer(mux)
 	t.Cleanup(httpServer.Close)
 	return "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/ws"
@@ -38,11 +45,7 @@ func newSmokeServer(t *testing.T, readOnly bool) string {
 
 func dialSmoke(t *testing.T, wsURL, token string) *websocket.Conn {
 	t.Helper()
-	dialer := *websocket.DefaultDialer
-	dialer.Subprotocols = []string{protocol.WebSocketSubprotocol}
-	header := http.Header{}
-	header.Set("Authorization", "Bearer "+token)
-	conn, _, err := dialer.Dial(wsURL, header)
+	conn, err := dialSmokeHeader(wsURL, token, http.Header{})
 	if err != nil {
 		t.Fatalf("websocket dial failed: %v", err)
 	}
@@ -50,6 +53,14 @@ func dialSmoke(t *testing.T, wsURL, token string) *websocket.Conn {
 	return conn
 }
 
+func dialSmokeHeader(wsURL, token string, header http.Header) (*websocket.Conn, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{protocol.WebSocketSubprotocol}
+	header.Set("Authorization", "Bearer "+token)
+	conn, _, err := dialer.Dial(wsURL, header)
+	return conn, err
+}
+
 func TestSmokeSyncNearLimitFile(t *testing.T) {
 	wsURL := newSmokeServer(t, false)
 	hostDir := t.TempDir()
@@ -319,6 +330,241 @@ func TestConcurrentEditsConvergeAndPreserveBothVersions(t *testing.T) {
 	}
 }
 
+func TestHostReconnectsAndCatchesUp(t *testing.T) {
+	wsURL := newSmokeRelay(t, server.SessionConfig{
+		HostToken:       smokeHostToken,
+		JoinToken:       smokeJoinToken,
+		HostGracePeriod: 10 * time.Second,
+	})
+	hostDir := t.TempDir()
+	joinDir := t.TempDir()
+
+	hostConn := dialSmoke(t, wsURL, smokeHostToken)
+	joinConn := dialSmoke(t, wsURL, smokeJoinToken)
+	redialed := make(chan *websocket.Conn, 1)
+
+	key := "smoke-reconnect-key"
+	hostClient, err := client.NewClient(hostConn, client.Options{
+		IsHost:  true,
+		E2EKey:  key,
+		BaseDir: hostDir,
+		Redial: func(resumeSequence uint64) (*websocket.Conn, error) {
+			header := http.Header{}
+			header.Set(protocol.ResumeHeader, strconv.FormatUint(resumeSequence, 10))
+			conn, err := dialSmokeHeader(wsURL, smokeHostToken, header)
+			if err == nil {
+				select {
+				case redialed <- conn:
+				default:
+				}
+			}
+			return conn, err
+		},
+		ReconnectWindow: 10 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to create host client: %v", err)
+	}
+	joinClient, err := client.NewClient(joinConn, client.Options{
+		E2EKey:  key,
+		BaseDir: joinDir,
+	})
+	if err != nil {
+		t.Fatalf("failed to create join client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hostClient.Start(ctx)
+	joinClient.Start(ctx)
+	readyCtx, readyCancel := context.WithTimeout(ctx, 6*time.Second)
+	defer readyCancel()
+	if err := joinClient.WaitReady(readyCtx); err != nil {
+		t.Fatalf("joiner did not finish syncing: %v", err)
+	}
+
+	_ = hostConn.Close()
+	joinerEdit := []byte("written while the host was away")
+	if err := os.WriteFile(filepath.Join(joinDir, "away.txt"), joinerEdit, 0o644); err != nil {
+		t.Fatalf("failed to write joiner file: %v", err)
+	}
+	waitForFileContent(t, filepath.Join(hostDir, "away.txt"), joinerEdit, 8*time.Second)
+	select {
+	case conn := <-redialed:
+		t.Cleanup(func() { _ = conn.Close() })
+	default:
+		t.Fatal("host caught up without redialing")
+	}
+
+	hostEdit := []byte("written after reconnecting")
+	if err := os.WriteFile(filepath.Join(hostDir, "back.txt"), hostEdit, 0o644); err != nil {
+		t.Fatalf("failed to write host file: %v", err)
+	}
+	waitForFileContent(t, filepath.Join(joinDir, "back.txt"), hostEdit, 6*time.Second)
+}
+
+func TestPeersSeeEachOthersProfiles(t *testing.T) {
+	wsURL := newSmokeServer(t, false)
+	hostConn := dialSmoke(t, wsURL, smokeHostToken)
+	joinConn := dialSmoke(t, wsURL, smokeJoinToken)
+
+	key := "smoke-roster-key"
+	hostClient, err := client.NewClient(hostConn, client.Options{
+		IsHost:  true,
+		E2EKey:  key,
+		BaseDir: t.TempDir(),
+		Profile: client.Profile{Name: "alice", Editor: "vim"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create host client: %v", err)
+	}
+	joinClient, err := client.NewClient(joinConn, client.Options{
+		E2EKey:  key,
+		BaseDir: t.TempDir(),
+		Profile: client.Profile{Name: "bob", Editor: "vscode"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create join client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hostClient.Start(ctx)
+	joinClient.Start(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		hostPeers, joinPeers := hostClient.Peers(), joinClient.Peers()
+		if len(hostPeers) == 1 && hostPeers[0].Name == "bob" && !hostPeers[0].Host &&
+			len(joinPeers) == 1 && joinPeers[0].Name == "alice" && joinPeers[0].Host && joinPeers[0].Editor == "vim" {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("rosters did not converge: host sees %+v, joiner sees %+v", hostClient.Peers(), joinClient.Peers())
+}
+
+func TestChatReachesOtherPeers(t *testing.T) {
+	wsURL := newSmokeServer(t, false)
+	hostConn := dialSmoke(t, wsURL, smokeHostToken)
+	joinConn := dialSmoke(t, wsURL, smokeJoinToken)
+
+	key := "smoke-chat-key"
+	received := make(chan client.ChatMessage, 4)
+	hostClient, err := client.NewClient(hostConn, client.Options{
+		IsHost:  true,
+		E2EKey:  key,
+		BaseDir: t.TempDir(),
+		Profile: client.Profile{Name: "alice"},
+		OnChat:  func(client.ChatMessage) {},
+	})
+	if err != nil {
+		t.Fatalf("failed to create host client: %v", err)
+	}
+	joinClient, err := client.NewClient(joinConn, client.Options{
+		E2EKey:  key,
+		BaseDir: t.TempDir(),
+		OnChat:  func(message client.ChatMessage) { received <- message },
+	})
+	if err != nil {
+		t.Fatalf("failed to create join client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hostClient.Start(ctx)
+	joinClient.Start(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if peers := joinClient.Peers(); len(peers) == 1 && peers[0].Name == "alice" {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	trace := "panic: boom\n\tmain.go:12 \x1b[31m"
+	if err := hostClient.Say(trace); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case message := <-received:
+		if message.Self || message.Peer.Name != "alice" || message.Text != "panic: boom\n\tmain.go:12 [31m" {
+			t.Fatalf("joiner got %+v", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("joiner did not receive the chat message")
+	}
+	if history := hostClient.ChatHistory(); len(history) != 1 || !history[0].Self {
+		t.Fatalf("host history is %+v, want its own message", history)
+	}
+}
+
+func TestForwardedPortReachesHostServer(t *testing.T) {
+	body := bytes.Repeat([]byte("shadow "), 200*1024)
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(body)
+	}))
+	defer app.Close()
+	_, portText, _ := strings.Cut(strings.TrimPrefix(app.URL, "http://"), ":")
+	port, _ := strconv.Atoi(portText)
+
+	wsURL := newSmokeServer(t, false)
+	hostConn := dialSmoke(t, wsURL, smokeHostToken)
+	joinConn := dialSmoke(t, wsURL, smokeJoinToken)
+	key := "smoke-forward-key"
+	hostClient, err := client.NewClient(hostConn, client.Options{
+		IsHost:       true,
+		E2EKey:       key,
+		BaseDir:      t.TempDir(),
+		OnEvent:      func(string, string, string) {},
+		ForwardPorts: []int{port},
+	})
+	if err != nil {
+		t.Fatalf("failed to create host client: %v", err)
+	}
+	joinClient, err := client.NewClient(joinConn, client.Options{
+		E2EKey:  key,
+		BaseDir: t.TempDir(),
+		OnEvent: func(string, string, string) {},
+	})
+	if err != nil {
+		t.Fatalf("failed to create join client: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hostClient.Start(ctx)
+	joinClient.Start(ctx)
+	if _, err := hostClient.SendInitialSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	var forwarded []client.ForwardedPort
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && len(forwarded) == 0 {
+		forwarded = joinClient.ForwardedPorts()
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(forwarded) != 1 || forwarded[0].Port != port {
+		t.Fatalf("joiner forwards %+v, want port %d", forwarded, port)
+	}
+
+	// The host's port is taken on this machine, so the joiner listens elsewhere.
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	for i := 0; i < 2; i++ {
+		resp, err := httpClient.Get("http://" + forwarded[0].Local + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || !bytes.Equal(got, body) {
+			t.Fatalf("got %d bytes (%v), want %d", len(got), err, len(body))
+		}
+	}
+}
+
 func conflictContentExists(baseDir string, expected []byte) bool {
 	found := false
 	_ = filepath.WalkDir(filepath.Join(baseDir, ".shadow-conflicts"), func(path string, entry os.DirEntry, err error) error {
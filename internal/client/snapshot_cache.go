@@ -0,0 +1,63 @@
+package client
+
+import (
+	"context"
+	"log"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+)
+
+// snapshotCacheChanged runs on the read loop when the relay says whether it
+// keeps a snapshot for new joiners.
+func (c *Client) snapshotCacheChanged(enabled bool) {
+	c.snapshotCache.Store(enabled)
+	if !enabled || !c.isHost.Load() {
+		return
+	}
+	// The relay drops a partial upload when the host reconnects, so send a
+	// fresh one even if the session has not changed.
+	c.requestSnapshotUpload()
+}
+
+// requestSnapshotUpload has snapshotCacheLoop upload a snapshot. The relay
+// asks for one when its backlog is about to stop reaching back to the
+// cached snapshot, so hosts never re-send the files on a timer.
+func (c *Client) requestSnapshotUpload() {
+	select {
+	case c.snapshotCacheNow <- struct{}{}:
+	default:
+	}
+}
+
+// snapshotCacheLoop uploads a sealed snapshot to the relay while this client
+// hosts a session that caches one, each time the relay asks. The relay
+// serves it to new joiners, with the ordered operations since, so they do
+// not each cost the host a full bootstrap.
+func (c *Client) snapshotCacheLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.doneCh:
+			return
+		case <-c.snapshotCacheNow:
+		}
+		if !c.isHost.Load() || !c.snapshotCache.Load() || c.stopping.Load() {
+			continue
+		}
+		if err := c.uploadSnapshot(c.lastSequence.Load()); err != nil {
+			log.Printf("failed to cache snapshot on relay: %v", err)
+		}
+	}
+}
+
+// uploadSnapshot sends the relay a bootstrap of the shared files. Sequence is
+// read before the files, so the snapshot holds at least every operation up to
+// it; joiners replay the operations after it.
+func (c *Client) uploadSnapshot(sequence uint64) error {
+	frame := func(payload string) []byte {
+		return protocol.EncodeSnapshotEncrypted(sequence, payload)
+	}
+	_, err := c.streamBootstrap(frame, protocol.EncodeSnapshotDone(sequence))
+	return err
+}
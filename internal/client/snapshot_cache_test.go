@@ -0,0 +1,94 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+func TestHostUploadsSnapshotOnlyWhenRelayAsks(t *testing.T) {
+	uploads := make(chan uint64, 8)
+	refresh := make(chan struct{})
+	upgrader := websocket.Upgrader{Subprotocols: []string{protocol.WebSocketSubprotocol}}
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go func() {
+			chunks := 0
+			for {
+				_, message, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				if _, _, ok := protocol.ParseSnapshotEncrypted(message); ok {
+					chunks++
+				}
+				if sequence, ok := protocol.ParseSnapshotDone(message); ok && chunks > 0 {
+					chunks = 0
+					uploads <- sequence
+				}
+			}
+		}()
+		if conn.WriteMessage(websocket.TextMessage, protocol.EncodeControlSnapshotCache(true)) != nil {
+			return
+		}
+		for {
+			select {
+			case <-refresh:
+				if conn.WriteMessage(websocket.TextMessage, protocol.EncodeControlSnapshotRefresh()) != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer relay.Close()
+
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{protocol.WebSocketSubprotocol}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(relay.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	baseDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(baseDir, "file.txt"), []byte("host"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	host, err := NewClient(conn, Options{IsHost: true, E2EKey: "cache-key", BaseDir: baseDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	host.Start(ctx)
+
+	waitForUpload := func(reason string) {
+		t.Helper()
+		select {
+		case <-uploads:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("host did not upload a snapshot %s", reason)
+		}
+	}
+	waitForUpload("when the relay enabled the cache")
+	select {
+	case <-uploads:
+		t.Fatal("host uploaded a snapshot the relay did not ask for")
+	case <-time.After(300 * time.Millisecond):
+	}
+	refresh <- struct{}{}
+	waitForUpload("when the relay asked for a refresh")
+}
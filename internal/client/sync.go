@@ -8,9 +8,11 @@ import (
 	"fmt"
 	"io/fs"
 	"log"
+	"net"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
 	"sync"
@@ -35,10 +37,21 @@ const (
 	renameRescanDelay       = 100 * time.Millisecond
 	maxProtocolPathBytes    = 4096
 	maxQueuedSnapshots      = 4
+	maxBootstrapWorkers     = 8
+	// maxConcurrentBootstraps is how many joiners the host syncs at once.
+	// Further sync requests wait in the snapshot queue.
+	maxConcurrentBootstraps = 2
 )
 
 type Client struct {
+	connMu             sync.Mutex
 	conn               *wsutil.Peer
+	connChanged        chan struct{}
+	redial             func(resumeSequence uint64) (*websocket.Conn, error)
+	reconnectWindow    time.Duration
+	outbound           *outboundScheduler
+	blobs              *blobCache
+	held               []heldOperation
 	codec              *e2e.Codec
 	baseDir            string
 	singleFileRel      string
@@ -51,10 +64,13 @@ type Client struct {
 	renameRescanTimer  *time.Timer
 	renameRescanMu     sync.Mutex
 	rescan             func()
-	isHost             bool
+	isHost             atomic.Bool
 	readOnlyJoinerMode atomic.Bool
 	syncReady          atomic.Bool
 	connectedPeers     atomic.Int64
+	fileSizeLimit      atomic.Int64
+	snapshotCache      atomic.Bool
+	snapshotCacheNow   chan struct{}
 	lastHash           sync.Map
 	pendingMu          sync.Mutex
 	pending            map[string][]pendingOperation
@@ -66,11 +82,63 @@ type Client struct {
 	watcherReadyCh     chan struct{}
 	watcherReadyOnce   sync.Once
 	snapshotRequests   chan string
-	manifestReceived   bool
-	doneCh             chan struct{}
-	doneOnce           sync.Once
-	stopping           atomic.Bool
-	onEvent            func(eventType, relPath, message string)
+	// bootstrapSlots holds one token per bootstrap in progress, and
+	// bootstrapWorkers one per file being read and encrypted for any of
+	// them, so concurrent joiners share one bounded pool.
+	bootstrapSlots      chan struct{}
+	bootstrapWorkers    chan struct{}
+	manifestReceived    bool
+	bootstrap           bootstrapTracker
+	doneCh              chan struct{}
+	doneOnce            sync.Once
+	stopping            atomic.Bool
+	repairInterval      time.Duration
+	onEvent             func(eventType, relPath, message string)
+	onBootstrapProgress func(BootstrapProgress)
+	approveJoinerEdits  bool
+	approveAllowedEdits bool
+	writePolicy         *WritePolicy
+	selfPeerID          atomic.Value
+	proposalsMu         sync.Mutex
+	proposals           []queuedProposal
+	nextProposal        int
+	onProposal          func(Proposal)
+	profile             Profile
+	rosterMu            sync.Mutex
+	roster              map[string]*PeerInfo
+	cursors             map[string]Cursor
+	rosterIntroduced    bool
+	onRoster            func([]PeerInfo)
+	onFileReceived      func(FileReceived)
+	presenceMu          sync.Mutex
+	presence            presenceThrottle
+	onPresence          func(PeerCursor)
+	chatMu              sync.Mutex
+	chat                []ChatMessage
+	onChat              func(ChatMessage)
+	onFocus             func(PeerFocus)
+	terminalMu          sync.Mutex
+	terminal            terminalState
+	forwardPorts        []int
+	forwardMu           sync.Mutex
+	forwardListeners    map[int]net.Listener
+	tunnels             map[tunnelKey]*tunnel
+	nextTunnel          atomic.Uint64
+	tasksMu             sync.Mutex
+	taskNames           []string
+	remoteTasks         []string
+	runTask             TaskRunner
+	confirmTasks        bool
+	onTaskRun           func(TaskRun)
+	taskRuns            map[taskRunKey]*hostTaskRun
+	nextHostTaskRun     int
+	nextTaskRun         atomic.Uint64
+	taskWaiters         map[uint64]chan protocol.TaskOutput
+	recorder            Recorder
+	recordedState       map[string]string
+	exportPatch         bool
+	baselineMu          sync.Mutex
+	baseline            map[string]baselineFile
 }
 
 type pendingOperation struct {
@@ -83,7 +151,67 @@ type Options struct {
 	E2EKey     string
 	BaseDir    string
 	SingleFile string
-	OnEvent    func(eventType, relPath, message string)
+	// RepairInterval sets how often local files are reconciled with the
+	// session state. Zero disables periodic repair.
+	RepairInterval time.Duration
+	// MaxUploadRate caps outbound bytes per second. Zero means unlimited.
+	MaxUploadRate int64
+	OnEvent       func(eventType, relPath, message string)
+	// OnBootstrapProgress receives progress while a joiner downloads the
+	// initial snapshot. When nil, progress goes through OnEvent or the terminal.
+	OnBootstrapProgress func(BootstrapProgress)
+	// ApproveJoinerEdits makes the host queue joiner operations for review
+	// instead of rejecting them. It must match the relay's session config.
+	ApproveJoinerEdits bool
+	// OnProposal is called on the host when a joiner operation is queued.
+	OnProposal func(Proposal)
+	// ApproveAllowedEdits applies proposals WritePolicy allows at once
+	// instead of queuing them, for sessions that route joiner edits to the
+	// host only to enforce the policy.
+	ApproveAllowedEdits bool
+	// WritePolicy limits which paths joiners may change. Proposals that
+	// break it are rejected; operations that reach the ordered stream anyway
+	// are reverted. Nil allows every path.
+	WritePolicy *WritePolicy
+	// Redial reconnects the host to the relay after its connection drops,
+	// passing the last ordered sequence it received. It is retried for up to
+	// ReconnectWindow before the client gives up.
+	Redial          func(resumeSequence uint64) (*websocket.Conn, error)
+	ReconnectWindow time.Duration
+	// Profile is shared, encrypted, with the other peers. An empty name
+	// keeps this client anonymous.
+	Profile Profile
+	// OnRoster is called with the other connected peers whenever the roster
+	// changes.
+	OnRoster func([]PeerInfo)
+	// OnFileReceived replaces the file_received event with one that names
+	// the peer who made the change.
+	OnFileReceived func(FileReceived)
+	// OnPresence receives other peers' cursor updates.
+	OnPresence func(PeerCursor)
+	// OnChat receives chat messages, including the ones this client sends.
+	// When nil, they go through OnEvent or the terminal.
+	OnChat func(ChatMessage)
+	// OnFocus receives other peers' requests to look at a location. When
+	// nil, they go through OnEvent or the terminal.
+	OnFocus func(PeerFocus)
+	// ForwardPorts lists the host's localhost ports joiners can reach through
+	// the session. Joiners learn them from the host.
+	ForwardPorts []int
+	// Tasks names the tasks joiners may ask the host to run with RunTask.
+	Tasks   []string
+	RunTask TaskRunner
+	// ConfirmTasks holds each joiner's run until ResolveTaskRun allows it.
+	ConfirmTasks bool
+	// OnTaskRun reports joiners' runs on the host. When nil, runs are
+	// reported through OnEvent or the terminal.
+	OnTaskRun func(TaskRun)
+	// Recorder keeps the session's file history on the host.
+	Recorder Recorder
+	// ExportPatch keeps a copy of the shared files as they were when the
+	// session started, so SessionPatch can diff against it. The copy is
+	// held in memory, so it is off unless a patch is wanted.
+	ExportPatch bool
 }
 
 func NewClient(conn *websocket.Conn, opts ...Options) (*Client, error) {
@@ -120,27 +248,62 @@ func NewClient(conn *websocket.Conn, opts ...Options) (*Client, error) {
 	}
 
 	c := &Client{
-		conn:             wsutil.NewPeer(conn),
-		codec:            codec,
-		baseDir:          baseDirAbs,
-		singleFileRel:    singleFileRel,
-		outboundIgnore:   NewOutboundIgnore(baseDirAbs),
-		isHost:           opt.IsHost,
-		clientID:         clientID,
-		readyCh:          make(chan struct{}),
-		watcherReadyCh:   make(chan struct{}),
-		snapshotRequests: make(chan string, maxQueuedSnapshots),
-		doneCh:           make(chan struct{}),
-		fileTimers:       make(map[string]*time.Timer),
-		pending:          make(map[string][]pendingOperation),
-		onEvent:          opt.OnEvent,
-	}
+		conn:                wsutil.NewPeer(conn),
+		connChanged:         make(chan struct{}),
+		redial:              opt.Redial,
+		reconnectWindow:     opt.ReconnectWindow,
+		blobs:               newBlobCache(maxBlobCacheBytes),
+		codec:               codec,
+		baseDir:             baseDirAbs,
+		singleFileRel:       singleFileRel,
+		outboundIgnore:      NewOutboundIgnore(baseDirAbs),
+		clientID:            clientID,
+		readyCh:             make(chan struct{}),
+		watcherReadyCh:      make(chan struct{}),
+		snapshotRequests:    make(chan string, maxQueuedSnapshots),
+		bootstrapSlots:      make(chan struct{}, maxConcurrentBootstraps),
+		bootstrapWorkers:    make(chan struct{}, bootstrapWorkerCount()),
+		snapshotCacheNow:    make(chan struct{}, 1),
+		doneCh:              make(chan struct{}),
+		fileTimers:          make(map[string]*time.Timer),
+		pending:             make(map[string][]pendingOperation),
+		repairInterval:      opt.RepairInterval,
+		onEvent:             opt.OnEvent,
+		onBootstrapProgress: opt.OnBootstrapProgress,
+		approveJoinerEdits:  opt.ApproveJoinerEdits,
+		onProposal:          opt.OnProposal,
+		approveAllowedEdits: opt.ApproveAllowedEdits,
+		writePolicy:         opt.WritePolicy,
+		profile:             opt.Profile,
+		roster:              make(map[string]*PeerInfo),
+		cursors:             make(map[string]Cursor),
+		onRoster:            opt.OnRoster,
+		onFileReceived:      opt.OnFileReceived,
+		onPresence:          opt.OnPresence,
+		onChat:              opt.OnChat,
+		onFocus:             opt.OnFocus,
+		forwardPorts:        opt.ForwardPorts,
+		taskNames:           opt.Tasks,
+		runTask:             opt.RunTask,
+		confirmTasks:        opt.ConfirmTasks,
+		onTaskRun:           opt.OnTaskRun,
+		recorder:            opt.Recorder,
+		exportPatch:         opt.ExportPatch,
+	}
+	c.isHost.Store(opt.IsHost)
+	c.outbound = newOutboundScheduler(c.writeFrame, opt.MaxUploadRate)
+	go c.outbound.run(func(err error) {
+		if !c.stopping.Load() {
+			log.Printf("failed to write to session: %v", err)
+		}
+		c.closeConn()
+	})
 	c.rescan = func() {
 		if _, snapshotErr := c.SendInitialSnapshot(); snapshotErr != nil {
 			log.Printf("failed to rescan after rename: %v", snapshotErr)
 		}
 	}
-	if c.isHost {
+	if c.isHost.Load() {
 		c.syncReady.Store(true)
 		c.markReady()
 	}
@@ -148,17 +311,30 @@ func NewClient(conn *websocket.Conn, opts ...Options) (*Client, error) {
 }
 
 func (c *Client) Start(ctx context.Context) {
+	if c.isHost.Load() {
+		c.recordSnapshot()
+		c.captureBaseline()
+	}
 	go c.readLoop()
 	go c.monitorFiles(ctx)
-	if c.isHost {
+	go c.repairLoop(ctx)
+	go c.snapshotCacheLoop(ctx)
+	go c.reportOutbound()
+	c.announceProfile()
+	c.announceForwards()
+	c.announceTasks()
+	if c.isHost.Load() {
 		go c.processSnapshotRequests()
 	}
 	go func() {
 		<-ctx.Done()
 		c.stopping.Store(true)
 		c.stopAllFileTimers()
+		c.stopForwarding()
+		c.cancelTaskRuns(func(taskRunKey) bool { return true })
 		c.outboundIgnore.Close()
-		_ = c.conn.Close()
+		c.outbound.close(nil)
+		c.closeConn()
 	}()
 }
 
@@ -166,9 +342,17 @@ func (c *Client) processSnapshotRequests() {
 	for {
 		select {
 		case target := <-c.snapshotRequests:
-			if _, err := c.sendSnapshot(true, target); err != nil {
-				log.Printf("failed to sync new peer: %v", err)
+			select {
+			case c.bootstrapSlots <- struct{}{}:
+			case <-c.doneCh:
+				return
 			}
+			go func() {
+				defer func() { <-c.bootstrapSlots }()
+				if _, err := c.sendBootstrap(target); err != nil {
+					log.Printf("failed to sync new peer: %v", err)
+				}
+			}()
 		case <-c.doneCh:
 			return
 		}
@@ -207,48 +391,22 @@ func (c *Client) stopAllFileTimers() {
 }
 
 func (c *Client) SendInitialSnapshot() (int, error) {
-	return c.sendSnapshot(false, "")
+	return c.sendSnapshot(false)
 }
 
-// sendSnapshot walks the shared path and sends its current contents. A target
-// identifies a new peer that is receiving an isolated bootstrap snapshot.
-func (c *Client) sendSnapshot(force bool, target string) (int, error) {
+// sendSnapshot walks the shared path and sends its current contents on the
+// ordered stream. New peers are bootstrapped separately by sendBootstrap.
+func (c *Client) sendSnapshot(force bool) (int, error) {
 	c.snapshotMu.Lock()
 	defer c.snapshotMu.Unlock()
-	c.outboundMu.Lock()
-	defer c.outboundMu.Unlock()
 
 	sentCount := 0
-	singleFileRel := c.singleFileScope()
-	if singleFileRel != "" {
-		manifestPaths := make([]string, 0, 1)
-		if target != "" {
-			if _, err := os.Lstat(filepath.Join(c.baseDir, filepath.FromSlash(singleFileRel))); err == nil {
-				manifestPaths = append(manifestPaths, singleFileRel)
-			}
-			if err := c.sendBootstrapManifestUnlocked(target, manifestPaths, nil); err != nil {
-				return sentCount, err
-			}
-		}
-		if c.sendFileUnlocked(filepath.Join(c.baseDir, filepath.FromSlash(singleFileRel)), false, force, target) {
+	if singleFileRel := c.singleFileScope(); singleFileRel != "" {
+		if c.sendSnapshotFile(filepath.Join(c.baseDir, filepath.FromSlash(singleFileRel)), force) {
 			sentCount++
 		}
-		if target != "" {
-			if err := c.conn.Write(websocket.TextMessage, protocol.EncodeSyncDone(target)); err != nil {
-				return sentCount, err
-			}
-		}
 		return sentCount, nil
 	}
-	if target != "" {
-		manifestPaths, directories, manifestErr := c.snapshotManifest()
-		if manifestErr != nil {
-			return sentCount, manifestErr
-		}
-		if err := c.sendBootstrapManifestUnlocked(target, manifestPaths, directories); err != nil {
-			return sentCount, err
-		}
-	}
 
 	walkErr := filepath.WalkDir(c.baseDir, func(currentPath string, d fs.DirEntry, walkErr error) error {
 		if walkErr != nil {
@@ -277,20 +435,117 @@ func (c *Client) sendSnapshot(force bool, target string) (int, error) {
 		if err != nil || !info.Mode().IsRegular() {
 			return nil
 		}
-		if c.sendFileUnlocked(currentPath, false, force, target) {
+		if c.sendSnapshotFile(currentPath, force) {
 			sentCount++
 		}
 		return nil
 	})
-	if walkErr != nil {
-		return sentCount, walkErr
+	return sentCount, walkErr
+}
+
+// sendBootstrap streams an isolated snapshot to a new peer.
+func (c *Client) sendBootstrap(target string) (int, error) {
+	frame := func(payload string) []byte {
+		return protocol.EncodeTargetedEncrypted(target, payload)
+	}
+	return c.streamBootstrap(frame, protocol.EncodeSyncDone(target))
+}
+
+// streamBootstrap sends a manifest and every shared file, each framed by frame,
+// followed by done. Files are read and encrypted by a bounded worker pool and
+// queued as bulk traffic, so live operations keep flowing while a large tree
+// is sent.
+func (c *Client) streamBootstrap(frame func(string) []byte, done []byte) (int, error) {
+	var manifestPaths, directories []string
+	if singleFileRel := c.singleFileScope(); singleFileRel != "" {
+		if _, err := os.Lstat(filepath.Join(c.baseDir, filepath.FromSlash(singleFileRel))); err == nil {
+			manifestPaths = append(manifestPaths, singleFileRel)
+		}
+	} else {
+		var err error
+		manifestPaths, directories, err = c.snapshotManifest()
+		if err != nil {
+			return 0, err
+		}
+	}
+	isDirectory := make(map[string]struct{}, len(directories))
+	for _, relPath := range directories {
+		isDirectory[relPath] = struct{}{}
+	}
+	totalFiles, totalBytes := c.bootstrapTotals(manifestPaths, isDirectory)
+	if err := c.sendBootstrapManifest(frame, manifestPaths, directories, totalFiles, totalBytes); err != nil {
+		return 0, err
+	}
+
+	files := make(chan string)
+	var sentCount atomic.Int64
+	var workers sync.WaitGroup
+	for i := 0; i < bootstrapWorkerCount(); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for relPath := range files {
+				c.outbound.waitForBulkCapacity()
+				c.bootstrapWorkers <- struct{}{}
+				if c.sendFileUnlocked(filepath.Join(c.baseDir, filepath.FromSlash(relPath)), false, true, frame) {
+					sentCount.Add(1)
+				}
+				<-c.bootstrapWorkers
+			}
+		}()
 	}
-	if target != "" {
-		if err := c.conn.Write(websocket.TextMessage, protocol.EncodeSyncDone(target)); err != nil {
-			return sentCount, err
+	for _, relPath := range manifestPaths {
+		if _, ok := isDirectory[relPath]; !ok {
+			files <- relPath
 		}
 	}
-	return sentCount, nil
+	close(files)
+	workers.Wait()
+
+	if err := c.outbound.enqueue(priorityBulk, "", done); err != nil {
+		return int(sentCount.Load()), err
+	}
+	return int(sentCount.Load()), nil
+}
+
+// bootstrapTotals estimates how many files and bytes a bootstrap will send so
+// the joiner can report progress. Oversized files are left out, as they are
+// skipped when sending.
+func (c *Client) bootstrapTotals(manifestPaths []string, isDirectory map[string]struct{}) (int, int64) {
+	files := 0
+	var bytes int64
+	for _, relPath := range manifestPaths {
+		if _, ok := isDirectory[relPath]; ok {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(c.baseDir, filepath.FromSlash(relPath)))
+		if err != nil || !info.Mode().IsRegular() || info.Size() > c.maxFileBytes() {
+			continue
+		}
+		files++
+		bytes += info.Size()
+	}
+	return files, bytes
+}
+
+func bootstrapWorkerCount() int {
+	workers := runtime.NumCPU()
+	if workers > maxBootstrapWorkers {
+		return maxBootstrapWorkers
+	}
+	if workers < 1 {
+		return 1
+	}
+	return workers
+}
+
+// sendSnapshotFile takes the outbound lock per file so live edits and incoming
+// operations can interleave with a long snapshot.
+func (c *Client) sendSnapshotFile(filePath string, force bool) bool {
+	c.outbound.waitForBulkCapacity()
+	c.outboundMu.Lock()
+	defer c.outboundMu.Unlock()
+	return c.sendFileUnlocked(filePath, false, force, nil)
 }
 
 func (c *Client) snapshotManifest() ([]string, []string, error) {
@@ -323,16 +578,33 @@ func (c *Client) snapshotManifest() ([]string, []string, error) {
 	return paths, directories, err
 }
 
-func (c *Client) sendBootstrapManifestUnlocked(target string, paths, directories []string) error {
-	plaintext, err := protocol.EncodeBootstrapManifest(paths, directories, c.singleFileScope())
+func (c *Client) sendBootstrapManifest(frame func(string) []byte, paths, directories []string, files int, bytes int64) error {
+	plaintext, err := protocol.EncodeBootstrapManifest(paths, directories, c.singleFileScope(), files, bytes)
 	if err != nil {
 		return err
 	}
-	encrypted, err := c.codec.Encrypt(plaintext)
-	if err != nil {
-		return err
+	return c.writeEncrypted(priorityBulk, "", plaintext, frame)
+}
+
+// maxFileBytes is the largest file this client sends, lowered when the relay
+// reports a message limit that a maxSyncedFileBytes file would not fit in.
+func (c *Client) maxFileBytes() int64 {
+	if limit := c.fileSizeLimit.Load(); limit > 0 {
+		return limit
 	}
-	return c.conn.Write(websocket.TextMessage, protocol.EncodeTargetedEncrypted(target, encrypted))
+	return maxSyncedFileBytes
+}
+
+// syncedFileLimit is the largest file whose encrypted operation fits in a
+// relay message of maxMessageBytes. File content is base64-encoded twice on
+// the wire, once in the operation and once around the ciphertext.
+func syncedFileLimit(maxMessageBytes int) int64 {
+	const envelopeBytes = 16 * 1024
+	limit := int64(maxMessageBytes)*9/16 - envelopeBytes
+	if limit <= 0 || limit > maxSyncedFileBytes {
+		return maxSyncedFileBytes
+	}
+	return limit
 }
 
 func fileHash(b []byte) string {
@@ -343,11 +615,13 @@ func fileHash(b []byte) string {
 func (c *Client) SendFile(filePath string) {
 	c.outboundMu.Lock()
 	defer c.outboundMu.Unlock()
-	c.sendFileUnlocked(filePath, true, false, "")
+	c.sendFileUnlocked(filePath, true, false, nil)
 }
 
-func (c *Client) sendFileUnlocked(filePath string, verbose, force bool, target string) bool {
-	if (target == "" && !c.syncReady.Load()) || c.readOnlyJoinerMode.Load() {
+// sendFileUnlocked sends a file on the ordered stream, or as part of a
+// bootstrap when bootstrap frames it.
+func (c *Client) sendFileUnlocked(filePath string, verbose, force bool, bootstrap func(string) []byte) bool {
+	if (bootstrap == nil && !c.syncReady.Load()) || c.readOnlyJoinerMode.Load() {
 		return false
 	}
 
@@ -365,7 +639,7 @@ func (c *Client) sendFileUnlocked(filePath string, verbose, force bool, target s
 	if err != nil || !fileInfo.Mode().IsRegular() {
 		return false
 	}
-	if fileInfo.Size() > maxSyncedFileBytes {
+	if fileInfo.Size() > c.maxFileBytes() {
 		if verbose {
 			sizeMB := float64(fileInfo.Size()) / (1024 * 1024)
 			c.notifySkipped(relPath, sizeMB)
@@ -391,28 +665,20 @@ func (c *Client) sendFileUnlocked(filePath string, verbose, force bool, target s
 		DesiredHash: newHash,
 		Content:     content,
 	}
-	plaintextMessage, err := protocol.EncodeSyncOperation(operation)
-	if err != nil {
-		log.Println("error encoding the file: ", err)
-		return false
+	if bootstrap == nil && len(content) >= minBlobRefBytes && c.blobs.isShared(newHash) {
+		// Every ready peer has already seen these bytes on the ordered stream.
+		operation.Content = nil
+		operation.ContentRef = true
 	}
-	encryptedPayload, err := c.codec.Encrypt(plaintextMessage)
-	if err != nil {
-		log.Println("error encrypting the file: ", err)
-		return false
+	if bootstrap == nil {
+		c.blobs.add(newHash, content, false)
 	}
-	message := protocol.EncodeEncrypted(encryptedPayload)
-	if target != "" {
-		message = protocol.EncodeTargetedEncrypted(target, encryptedPayload)
-	} else {
-		c.addPending(relPath, pendingOperation{id: operation.ID, desiredState: newHash})
+	priority := priorityBulk
+	if verbose && bootstrap == nil {
+		priority = priorityInteractive
 	}
-
-	if err := c.conn.Write(websocket.TextMessage, message); err != nil {
-		if target == "" {
-			c.removePending(relPath, operation.ID)
-		}
-		log.Println("error writing the file: ", err)
+	if err := c.sendOperationUnlocked(operation, bootstrap, priority); err != nil {
+		log.Println("error sending the file: ", err)
 		return false
 	}
 
@@ -422,6 +688,34 @@ func (c *Client) sendFileUnlocked(filePath string, verbose, force bool, target s
 	return true
 }
 
+// sendOperationUnlocked encrypts an operation and queues it for the ordered
+// stream, or as part of a bootstrap when bootstrap frames it.
+func (c *Client) sendOperationUnlocked(operation protocol.SyncOperation, bootstrap func(string) []byte, priority sendPriority) error {
+	plaintextMessage, err := protocol.EncodeSyncOperation(operation)
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	if bootstrap != nil {
+		return c.writeEncrypted(priority, "", plaintextMessage, bootstrap)
+	}
+	c.addPending(operation.Path, pendingOperation{id: operation.ID, desiredState: operation.DesiredHash})
+	if err := c.writeEncrypted(priority, operation.Path, plaintextMessage, protocol.EncodeEncrypted); err != nil {
+		c.removePending(operation.Path, operation.ID)
+		return err
+	}
+	return nil
+}
+
+// writeEncrypted encrypts a plaintext message and queues the framed result.
+// relPath names the synced path the frame changes, if any.
+func (c *Client) writeEncrypted(priority sendPriority, relPath string, plaintext []byte, frame func(string) []byte) error {
+	encryptedPayload, err := c.codec.Encrypt(plaintext)
+	if err != nil {
+		return fmt.Errorf("encrypt: %w", err)
+	}
+	return c.outbound.enqueue(priority, relPath, frame(encryptedPayload))
+}
+
 func (c *Client) sendDelete(relPath string, verbose bool) bool {
 	c.outboundMu.Lock()
 	defer c.outboundMu.Unlock()
@@ -446,22 +740,12 @@ func (c *Client) sendDeleteUnlocked(relPath string, verbose bool) bool {
 		DesiredHash: missingState,
 		Delete:      true,
 	}
-	plaintextMessage, err := protocol.EncodeSyncOperation(operation)
-	if err != nil {
-		log.Println("error encoding delete message: ", err)
-		return false
-	}
-	encryptedPayload, err := c.codec.Encrypt(plaintextMessage)
-	if err != nil {
-		log.Println("error encrypting delete message: ", err)
-		return false
+	priority := priorityBulk
+	if verbose {
+		priority = priorityInteractive
 	}
-	message := protocol.EncodeEncrypted(encryptedPayload)
-	c.addPending(relPath, pendingOperation{id: operation.ID, desiredState: missingState})
-
-	if err := c.conn.Write(websocket.TextMessage, message); err != nil {
-		c.removePending(relPath, operation.ID)
-		log.Println("error writing delete message: ", err)
+	if err := c.sendOperationUnlocked(operation, nil, priority); err != nil {
+		log.Println("error sending delete message: ", err)
 		return false
 	}
 
@@ -473,18 +757,35 @@ func (c *Client) sendDeleteUnlocked(relPath string, verbose bool) bool {
 
 func (c *Client) readLoop() {
 	defer c.doneOnce.Do(func() { close(c.doneCh) })
-	defer c.conn.Close()
+	defer c.outbound.close(nil)
 	for {
-		_, message, err := c.conn.ReadMessage()
+		conn, _ := c.currentConn()
+		lost := c.readMessages(conn)
+		_ = conn.Close()
+		if !lost || !c.reconnect() {
+			return
+		}
+	}
+}
+
+// readMessages handles frames from one connection until it fails. It reports
+// whether the connection dropped in a way a redial can recover from.
+func (c *Client) readMessages(conn *wsutil.Peer) bool {
+	for {
+		_, message, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsCloseError(err, websocket.CloseMessageTooBig) || strings.Contains(err.Error(), "read limit exceeded") {
 				c.notifyWarning("⚠ incoming data exceeded transport limit")
-				return
+				return false
 			}
-			if !c.stopping.Load() {
-				c.notifyDisconnected()
+			if c.stopping.Load() {
+				return false
 			}
-			return
+			if c.redial != nil {
+				return true
+			}
+			c.notifyDisconnected()
+			return false
 		}
 
 		parts := strings.SplitN(string(message), "|", 2)
@@ -495,64 +796,108 @@ func (c *Client) readLoop() {
 
 		if parts[0] == protocol.ControlChannel {
 			readOnly, ok := protocol.ParseReadOnlyJoinersControl(parts[1])
-			if ok && !c.isHost {
+			if ok && !c.isHost.Load() {
 				c.readOnlyJoinerMode.Store(readOnly)
 				if readOnly {
 					c.notifyReadOnly()
 				}
 			}
+			if approval, ok := protocol.ParseApproveJoinerEditsControl(parts[1]); ok && approval && !c.isHost.Load() {
+				c.notifyApprovalMode()
+			}
+			if peerID, ok := protocol.ParsePeerIDControl(parts[1]); ok {
+				c.selfPeerID.Store(peerID)
+			}
+			if enabled, ok := protocol.ParseSnapshotCacheControl(parts[1]); ok {
+				c.snapshotCacheChanged(enabled)
+			}
+			if protocol.ParseSnapshotRefreshControl(parts[1]) && c.isHost.Load() {
+				c.requestSnapshotUpload()
+			}
+			if limits, ok := protocol.ParseLimitsControl(parts[1]); ok {
+				c.fileSizeLimit.Store(syncedFileLimit(limits.MaxMessageBytes))
+			}
+			if present, ok := protocol.ParseHostPresentControl(parts[1]); ok {
+				c.hostPresenceChanged(present)
+			}
+			if protocol.ParsePromotedControl(parts[1]) {
+				c.promote()
+			}
+			if peerID, host, ok := protocol.ParsePeerJoinedControl(parts[1]); ok {
+				c.peerJoined(peerID, host)
+			}
+			if peerID, ok := protocol.ParsePeerLeftControl(parts[1]); ok {
+				c.peerLeft(peerID)
+			}
 			if peerCount, ok := protocol.ParsePeerCountControl(parts[1]); ok {
+				c.markRosterIntroduced()
 				others := peerCount - 1
 				c.connectedPeers.Store(int64(others))
 				c.notifyPeerCount(others)
 			}
-			if targetID, ok := protocol.ParseSyncRequestControl(parts[1]); ok && c.isHost {
+			if targetID, ok := protocol.ParseSyncRequestControl(parts[1]); ok && c.isHost.Load() {
 				select {
 				case c.snapshotRequests <- targetID:
 				default:
 					log.Printf("ignored sync request for peer %s: snapshot queue is full", targetID)
 				}
 			}
-			if baseline, ok := protocol.ParseSyncBaselineControl(parts[1]); ok && !c.isHost && !c.syncReady.Load() {
+			if baseline, ok := protocol.ParseSyncBaselineControl(parts[1]); ok && !c.isHost.Load() && !c.syncReady.Load() {
 				c.lastSequence.Store(baseline)
 			}
-			if protocol.ParseSyncCompleteControl(parts[1]) && !c.isHost {
+			if protocol.ParseSyncCompleteControl(parts[1]) && !c.isHost.Load() {
 				if !c.manifestReceived {
 					c.notifyDisconnected()
-					return
+					return false
 				}
+				c.finishBootstrapProgress()
 				<-c.watcherReadyCh
 				c.syncReady.Store(true)
 				if _, snapshotErr := c.SendInitialSnapshot(); snapshotErr != nil {
 					log.Printf("failed to rescan after bootstrap: %v", snapshotErr)
 					c.notifyDisconnected()
-					return
+					return false
 				}
+				c.captureBaseline()
 				c.markReady()
+				c.sendDeferredTerminalRequest()
 			}
 			continue
 		}
 
-		if sequence, encryptedPayload, ok := protocol.ParseOrderedEncrypted(message); ok {
-			previous := c.lastSequence.Load()
-			if sequence != previous+1 {
-				log.Printf("invalid operation sequence: got %d after %d", sequence, previous)
+		if sequence, originID, encryptedPayload, ok := protocol.ParseOrderedEncrypted(message); ok {
+			if err := c.receiveOrdered(sequence, originID, encryptedPayload); err != nil {
+				log.Printf("failed to apply operation %d: %v", sequence, err)
 				c.notifyDisconnected()
-				return
+				return false
 			}
-			if err := c.applyEncryptedOperation(encryptedPayload, false); err != nil {
-				log.Printf("failed to apply operation %d: %v", sequence, err)
+			continue
+		}
+		if peerID, encryptedPayload, ok := protocol.ParseFromEncrypted(message); ok {
+			if c.isHost.Load() {
+				if err := c.handlePeerMessage(peerID, encryptedPayload); err != nil {
+					log.Printf("ignored message from peer %s: %v", peerID, err)
+				}
+				continue
+			}
+			if err := c.handleHostMessage(encryptedPayload); err != nil {
+				log.Printf("failed to handle message from host: %v", err)
 				c.notifyDisconnected()
-				return
+				return false
+			}
+			continue
+		}
+		if peerID, encryptedPayload, ok := protocol.ParsePeerEncrypted(message); ok {
+			if err := c.handlePeerBroadcast(peerID, encryptedPayload); err != nil {
+				log.Printf("ignored message from peer %s: %v", peerID, err)
 			}
-			c.lastSequence.Store(sequence)
 			continue
 		}
 		if encryptedPayload, ok := protocol.ParseBootstrapEncrypted(message); ok {
 			if err := c.applyEncryptedOperation(encryptedPayload, true); err != nil {
 				log.Printf("failed to apply bootstrap: %v", err)
 				c.notifyDisconnected()
-				return
+				return false
 			}
 			continue
 		}
@@ -563,7 +908,22 @@ func (c *Client) readLoop() {
 func (c *Client) applyEncryptedOperation(encryptedPayload string, bootstrap bool) error {
 	c.outboundMu.Lock()
 	defer c.outboundMu.Unlock()
+	return c.applyEncryptedOperationLocked(encryptedPayload, "", 0, bootstrap)
+}
+
+// applyOrderedOperation records the sequence under the same lock as the
+// operation so state digests always describe a single point in the stream.
+func (c *Client) applyOrderedOperation(sequence uint64, originID, encryptedPayload string) error {
+	c.outboundMu.Lock()
+	defer c.outboundMu.Unlock()
+	if err := c.applyEncryptedOperationLocked(encryptedPayload, originID, sequence, false); err != nil {
+		return err
+	}
+	c.lastSequence.Store(sequence)
+	return nil
+}
 
+func (c *Client) applyEncryptedOperationLocked(encryptedPayload, originID string, sequence uint64, bootstrap bool) error {
 	decrypted, err := c.codec.Decrypt(encryptedPayload)
 	if err != nil {
 		return fmt.Errorf("decrypt: %w", err)
@@ -581,6 +941,16 @@ func (c *Client) applyEncryptedOperation(encryptedPayload string, bootstrap bool
 				return err
 			}
 			c.manifestReceived = true
+			c.startBootstrapProgress(manifest.Files, manifest.Bytes)
+			return nil
+		}
+	} else {
+		digest, isDigest, digestErr := protocol.DecodeStateDigest(decrypted)
+		if digestErr != nil {
+			return digestErr
+		}
+		if isDigest {
+			c.compareStateDigest(digest)
 			return nil
 		}
 	}
@@ -601,6 +971,20 @@ func (c *Client) applyEncryptedOperation(encryptedPayload string, bootstrap bool
 	if !validPathState(operation.BaseState) || !validPathState(operation.DesiredHash) {
 		return fmt.Errorf("invalid state hash for %s", relPath)
 	}
+	if !c.allowsPeerWrite(originID, relPath, operation.Delete) {
+		c.revertPeerWriteLocked(originID, operation, relPath)
+		return nil
+	}
+	if operation.ContentRef {
+		if bootstrap || operation.Delete || len(operation.Content) != 0 {
+			return fmt.Errorf("invalid content reference for %s", relPath)
+		}
+		content, ok := c.resolveContent(operation.DesiredHash, relPath)
+		if !ok {
+			return &missingBlobError{hash: operation.DesiredHash, path: relPath}
+		}
+		operation.Content = content
+	}
 	if operation.Delete {
 		if operation.DesiredHash != missingState || len(operation.Content) != 0 {
 			return fmt.Errorf("invalid delete operation for %s", relPath)
@@ -612,6 +996,13 @@ func (c *Client) applyEncryptedOperation(encryptedPayload string, bootstrap bool
 		if fileHash(operation.Content) != operation.DesiredHash {
 			return fmt.Errorf("content hash mismatch for %s", relPath)
 		}
+		if bootstrap {
+			c.recordBootstrapFile(len(operation.Content))
+		}
+		c.blobs.add(operation.DesiredHash, operation.Content, !bootstrap)
+	}
+	if sequence != 0 {
+		c.recordOperation(sequence, originID, relPath, operation)
 	}
 
 	parentConflicts, err := c.prepareIncomingParents(relPath, operation.ID)
@@ -659,14 +1050,14 @@ func (c *Client) applyEncryptedOperation(encryptedPayload string, bootstrap bool
 	if operation.Delete {
 		c.dropPathHashes(relPath)
 		c.lastHash.Store(relPath, missingState)
-		c.notifyFileReceived(relPath, true)
+		c.notifyFileReceived(relPath, true, originID)
 		return nil
 	}
 
 	now := time.Now()
 	_ = os.Chtimes(destPath, now, now)
 	c.storeAppliedState(relPath, operation.DesiredHash)
-	c.notifyFileReceived(relPath, false)
+	c.notifyFileReceived(relPath, false, originID)
 	return nil
 }
 
@@ -1092,15 +1483,28 @@ func (c *Client) notifyFileSent(relPath string, deleted bool) {
 	}
 }
 
-func (c *Client) notifyFileReceived(relPath string, deleted bool) {
+func (c *Client) notifyFileReceived(relPath string, deleted bool, originID string) {
+	peer := c.peerInfo(originID)
+	if c.onFileReceived != nil {
+		c.onFileReceived(FileReceived{Path: relPath, Deleted: deleted, Peer: peer})
+		return
+	}
 	if c.onEvent != nil {
 		c.onEvent("file_received", relPath, relPath)
 		return
 	}
+	if c.bootstrap.active {
+		// The progress bar stands in for per-file lines during bootstrap.
+		return
+	}
+	from := ""
+	if originID != "" {
+		from = " " + ui.Dim("· "+peer.Label())
+	}
 	if deleted {
-		fmt.Printf("%s %s %s\n", ui.InArrow("←"), relPath, ui.Dim("(deleted)"))
+		fmt.Printf("%s %s %s%s\n", ui.InArrow("←"), relPath, ui.Dim("(deleted)"), from)
 	} else {
-		fmt.Printf("%s %s\n", ui.InArrow("←"), relPath)
+		fmt.Printf("%s %s%s\n", ui.InArrow("←"), relPath, from)
 	}
 }
 
@@ -1150,6 +1554,14 @@ func (c *Client) notifySkipped(relPath string, sizeMB float64) {
 	fmt.Println(ui.Dim(fmt.Sprintf("⊘ skipped %s (%.0fMB, exceeds 10MB limit)", relPath, sizeMB)))
 }
 
+func (c *Client) notifyRepair(msg string) {
+	if c.onEvent != nil {
+		c.onEvent("repair", "", msg)
+		return
+	}
+	fmt.Println(ui.Dim("⟳ " + msg))
+}
+
 func (c *Client) notifyInfo(msg string) {
 	if c.onEvent != nil {
 		return
@@ -1539,6 +1951,12 @@ func (c *Client) dropPathHashes(relPath string) {
 	})
 }
 
+// selfID returns the ID the relay gave this client, or "" before it arrives.
+func (c *Client) selfID() string {
+	peerID, _ := c.selfPeerID.Load().(string)
+	return peerID
+}
+
 func (c *Client) shouldIgnoreOutboundRel(relPath string, isDir bool) bool {
 	if c.outboundIgnore == nil {
 		return hardcodedIgnore.MatchString(relPath)
@@ -2,6 +2,7 @@ package client
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -307,11 +308,13 @@ func testApplyClient(t *testing.T, baseDir string) *Client {
 	ignore := NewOutboundIgnore(baseDir)
 	t.Cleanup(ignore.Close)
 	return &Client{
-		codec:          codec,
-		baseDir:        baseDir,
-		outboundIgnore: ignore,
-		fileTimers:     make(map[string]*time.Timer),
-		pending:        make(map[string][]pendingOperation),
+		blobs:            newBlobCache(maxBlobCacheBytes),
+		codec:            codec,
+		baseDir:          baseDir,
+		outboundIgnore:   ignore,
+		fileTimers:       make(map[string]*time.Timer),
+		pending:          make(map[string][]pendingOperation),
+		bootstrapWorkers: make(chan struct{}, bootstrapWorkerCount()),
 	}
 }
 
@@ -343,3 +346,108 @@ func conflictTreeContains(t *testing.T, baseDir string, content []byte) bool {
 	})
 	return found
 }
+
+func TestSnapshotRequestsWaitForBootstrapSlot(t *testing.T) {
+	baseDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(baseDir, "file.txt"), []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	client := testApplyClient(t, baseDir)
+	client.isHost.Store(true)
+	client.outbound = newOutboundScheduler(nil, 0)
+	client.snapshotRequests = make(chan string, maxQueuedSnapshots)
+	client.bootstrapSlots = make(chan struct{}, maxConcurrentBootstraps)
+	client.doneCh = make(chan struct{})
+	defer close(client.doneCh)
+	for i := 0; i < maxConcurrentBootstraps; i++ {
+		client.bootstrapSlots <- struct{}{}
+	}
+	go client.processSnapshotRequests()
+
+	client.snapshotRequests <- "7"
+	time.Sleep(100 * time.Millisecond)
+	if queued, _, _ := client.outbound.stats(); queued != 0 {
+		t.Fatalf("bootstrap started with every slot busy; %d frames queued", queued)
+	}
+
+	<-client.bootstrapSlots
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if queued, _, _ := client.outbound.stats(); queued == 3 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	queued, _, _ := client.outbound.stats()
+	t.Fatalf("bootstrap queued %d frames after a slot freed, want manifest, file and sync done", queued)
+}
+
+func TestParallelBootstrapSendsManifestFilesThenSyncDone(t *testing.T) {
+	baseDir := t.TempDir()
+	const fileCount = 40
+	for i := 0; i < fileCount; i++ {
+		dir := filepath.Join(baseDir, "pkg", fmt.Sprintf("dir-%d", i%4))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file-%d.txt", i)), []byte(fmt.Sprintf("content %d", i)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := testApplyClient(t, baseDir)
+	client.isHost.Store(true)
+	client.outbound = newOutboundScheduler(nil, 0)
+
+	sent, err := client.sendBootstrap("7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != fileCount {
+		t.Fatalf("bootstrap sent %d files, want %d", sent, fileCount)
+	}
+
+	client.outbound.mu.Lock()
+	frames := make([][]byte, 0, len(client.outbound.bulk))
+	for _, frame := range client.outbound.bulk {
+		frames = append(frames, frame.data)
+	}
+	client.outbound.mu.Unlock()
+	if len(frames) != fileCount+2 {
+		t.Fatalf("bootstrap queued %d frames, want %d", len(frames), fileCount+2)
+	}
+	paths := make(map[string]struct{})
+	for index, frame := range frames {
+		if index == len(frames)-1 {
+			if string(frame) != string(protocol.EncodeSyncDone("7")) {
+				t.Fatalf("last frame is not sync done: %q", frame)
+			}
+			continue
+		}
+		target, payload, ok := protocol.ParseTargetedEncrypted(frame)
+		if !ok || target != "7" {
+			t.Fatalf("frame %d is not targeted at the new peer: %q", index, frame)
+		}
+		plaintext, err := client.codec.Decrypt(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, isManifest, err := protocol.DecodeBootstrapManifest(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index == 0 {
+			if !isManifest {
+				t.Fatal("first bootstrap frame is not the manifest")
+			}
+			continue
+		}
+		operation, err := protocol.DecodeSyncOperation(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths[operation.Path] = struct{}{}
+	}
+	if len(paths) != fileCount {
+		t.Fatalf("bootstrap covered %d distinct files, want %d", len(paths), fileCount)
+	}
+}
@@ -39,3 +39,37 @@ func TestWireLimitAllowsValidTenMBEncryptedMessage(t *testing.T) {
 		t.Fatalf("valid 10MB file produced %d-byte wire message above %d-byte read limit", len(wireMessage), maxIncomingMessageBytes)
 	}
 }
+
+func TestSyncedFileLimitFitsRelayMessageLimit(t *testing.T) {
+	codec, err := e2e.NewCodec("test-key")
+	if err != nil {
+		t.Fatalf("failed to build codec: %v", err)
+	}
+
+	const maxMessageBytes = 1 << 20
+	limit := syncedFileLimit(maxMessageBytes)
+	if limit >= maxSyncedFileBytes {
+		t.Fatalf("expected a 1MB message limit to lower the file limit, got %d", limit)
+	}
+	content := strings.Repeat("x", int(limit))
+	plaintext, err := protocol.EncodeSyncOperation(protocol.SyncOperation{
+		ID:          "client-1",
+		Path:        strings.Repeat("p", maxProtocolPathBytes),
+		BaseState:   missingState,
+		DesiredHash: fileHash([]byte(content)),
+		Content:     []byte(content),
+	})
+	if err != nil {
+		t.Fatalf("failed to encode operation: %v", err)
+	}
+	encryptedPayload, err := codec.Encrypt(plaintext)
+	if err != nil {
+		t.Fatalf("failed to encrypt payload: %v", err)
+	}
+	if wireMessage := protocol.EncodeEncrypted(encryptedPayload); len(wireMessage) > maxMessageBytes {
+		t.Fatalf("%d-byte file produced %d-byte wire message above %d-byte relay limit", limit, len(wireMessage), maxMessageBytes)
+	}
+	if syncedFileLimit(20<<20) != maxSyncedFileBytes {
+		t.Fatal("expected the default message limit to keep the default file limit")
+	}
+}
@@ -0,0 +1,411 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+	"github.com/go-johnnyhe/shadow/internal/ui"
+)
+
+const (
+	maxTaskRunsPerPeer = 4
+	// maxTaskOutput bounds what one run streams back; the rest is dropped.
+	maxTaskOutput   = 8 * 1024 * 1024
+	taskOutputQueue = 1024
+)
+
+// Task run states reported through OnTaskRun.
+const (
+	TaskPending  = "pending"
+	TaskRunning  = "running"
+	TaskFinished = "finished"
+	TaskDenied   = "denied"
+)
+
+// TaskRunner runs the named task, writing its output to out, and returns its
+// exit code. It must stop when ctx is cancelled.
+type TaskRunner func(ctx context.Context, name string, out io.Writer) (int, error)
+
+// TaskRun is a joiner's request to run one of the host's tasks.
+type TaskRun struct {
+	// ID is the host's number for the run, used to allow or deny it.
+	ID       int
+	Peer     PeerInfo
+	Task     string
+	State    string
+	ExitCode int
+	Err      error
+}
+
+type taskRunKey struct {
+	peer string
+	run  uint64
+}
+
+type hostTaskRun struct {
+	TaskRun
+	key    taskRunKey
+	cancel context.CancelFunc
+}
+
+// Tasks lists the tasks that can be run in this session: the host's own, or
+// the ones it announced to this joiner.
+func (c *Client) Tasks() []string {
+	c.tasksMu.Lock()
+	defer c.tasksMu.Unlock()
+	if c.isHost.Load() {
+		return append([]string(nil), c.taskNames...)
+	}
+	return append([]string(nil), c.remoteTasks...)
+}
+
+// RunTask runs a task and streams its output to out. On the host the task
+// runs directly; a joiner asks the host, which may first ask its user.
+func (c *Client) RunTask(ctx context.Context, name string, out io.Writer) (int, error) {
+	if c.isHost.Load() {
+		if c.runTask == nil || !c.hasTask(name) {
+			return 0, fmt.Errorf("no task named %q", name)
+		}
+		return c.runTask(ctx, name, out)
+	}
+	if !c.syncReady.Load() {
+		return 0, fmt.Errorf("still syncing with the host")
+	}
+
+	id := c.nextTaskRun.Add(1)
+	outputs := make(chan protocol.TaskOutput, taskOutputQueue)
+	c.tasksMu.Lock()
+	if c.taskWaiters == nil {
+		c.taskWaiters = make(map[uint64]chan protocol.TaskOutput)
+	}
+	c.taskWaiters[id] = outputs
+	c.tasksMu.Unlock()
+	defer func() {
+		c.tasksMu.Lock()
+		delete(c.taskWaiters, id)
+		c.tasksMu.Unlock()
+	}()
+
+	if err := c.sendTaskRun(protocol.TaskRun{Run: id, Task: name}); err != nil {
+		return 0, err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			_ = c.sendTaskRun(protocol.TaskRun{Run: id, Cancel: true})
+			return 0, ctx.Err()
+		case <-c.doneCh:
+			return 0, fmt.Errorf("disconnected from the session")
+		case output, ok := <-outputs:
+			if !ok {
+				return 0, fmt.Errorf("lost output from the host; run the task again")
+			}
+			if output.Pending {
+				_, _ = fmt.Fprintf(out, "waiting for the host to allow %s…\n", name)
+			}
+			if len(output.Data) > 0 {
+				if _, err := out.Write(output.Data); err != nil {
+					_ = c.sendTaskRun(protocol.TaskRun{Run: id, Cancel: true})
+					return 0, err
+				}
+			}
+			if output.Done {
+				if output.Error != "" {
+					return output.ExitCode, errors.New(output.Error)
+				}
+				return output.ExitCode, nil
+			}
+		}
+	}
+}
+
+func (c *Client) sendTaskRun(run protocol.TaskRun) error {
+	plaintext, err := protocol.EncodeTaskRun(run)
+	if err != nil {
+		return err
+	}
+	if err := c.writeEncrypted(priorityInteractive, "", plaintext, protocol.EncodeHostEncrypted); err != nil {
+		return fmt.Errorf("failed to reach the host: %w", err)
+	}
+	return nil
+}
+
+// TaskRuns lists runs waiting for the host's decision, oldest first.
+func (c *Client) TaskRuns() []TaskRun {
+	c.tasksMu.Lock()
+	defer c.tasksMu.Unlock()
+	runs := make([]TaskRun, 0, len(c.taskRuns))
+	for _, run := range c.taskRuns {
+		if run.State == TaskPending {
+			runs = append(runs, run.TaskRun)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ID < runs[j].ID })
+	return runs
+}
+
+// ResolveTaskRun allows or denies a run waiting for confirmation.
+func (c *Client) ResolveTaskRun(id int, allow bool) error {
+	c.tasksMu.Lock()
+	var run *hostTaskRun
+	for _, candidate := range c.taskRuns {
+		if candidate.ID == id && candidate.State == TaskPending {
+			run = candidate
+			break
+		}
+	}
+	if run == nil {
+		c.tasksMu.Unlock()
+		return fmt.Errorf("no task run #%d is waiting", id)
+	}
+	if !allow {
+		run.State = TaskDenied
+		delete(c.taskRuns, run.key)
+		c.tasksMu.Unlock()
+		c.sendTaskOutput(run.key, protocol.TaskOutput{Done: true, Error: "the host declined to run " + run.Task})
+		c.notifyTaskRun(run.TaskRun)
+		return nil
+	}
+	run.State = TaskRunning
+	c.tasksMu.Unlock()
+	c.startTaskRun(run)
+	return nil
+}
+
+// announceTasks tells every peer which tasks the host offers. It runs on
+// start and whenever a peer joins.
+func (c *Client) announceTasks() {
+	if !c.isHost.Load() || len(c.taskNames) == 0 {
+		return
+	}
+	plaintext, err := protocol.EncodeTasks(c.taskNames)
+	if err == nil {
+		err = c.writeEncrypted(priorityInteractive, "", plaintext, protocol.EncodeBroadcastEncrypted)
+	}
+	if err != nil && !c.stopping.Load() {
+		log.Printf("failed to announce tasks: %v", err)
+	}
+}
+
+func (c *Client) applyTasks(tasks protocol.Tasks) {
+	c.tasksMu.Lock()
+	c.remoteTasks = tasks.Names
+	c.tasksMu.Unlock()
+}
+
+func (c *Client) hasTask(name string) bool {
+	for _, task := range c.taskNames {
+		if task == name {
+			return true
+		}
+	}
+	return false
+}
+
+// handleTaskRun handles a joiner's request to run or cancel a task.
+func (c *Client) handleTaskRun(peerID string, request protocol.TaskRun) error {
+	key := taskRunKey{peer: peerID, run: request.Run}
+	c.tasksMu.Lock()
+	if request.Cancel {
+		run, ok := c.taskRuns[key]
+		if ok && run.State == TaskPending {
+			delete(c.taskRuns, key)
+		}
+		c.tasksMu.Unlock()
+		if ok && run.cancel != nil {
+			run.cancel()
+		}
+		return nil
+	}
+	refuse := func(err error) error {
+		c.sendTaskOutput(key, protocol.TaskOutput{Done: true, Error: err.Error()})
+		return err
+	}
+	if _, ok := c.taskRuns[key]; ok {
+		c.tasksMu.Unlock()
+		return fmt.Errorf("task run %d is already known", request.Run)
+	}
+	if c.runTask == nil || !c.hasTask(request.Task) {
+		c.tasksMu.Unlock()
+		return refuse(fmt.Errorf("the host has no task named %q", request.Task))
+	}
+	active := 0
+	for other := range c.taskRuns {
+		if other.peer == peerID {
+			active++
+		}
+	}
+	if active >= maxTaskRunsPerPeer {
+		c.tasksMu.Unlock()
+		return refuse(fmt.Errorf("too many tasks running; wait for one to finish"))
+	}
+	if c.taskRuns == nil {
+		c.taskRuns = make(map[taskRunKey]*hostTaskRun)
+	}
+	c.nextHostTaskRun++
+	run := &hostTaskRun{
+		TaskRun: TaskRun{ID: c.nextHostTaskRun, Peer: c.peerInfo(peerID), Task: request.Task, State: TaskPending},
+		key:     key,
+	}
+	c.taskRuns[key] = run
+	c.tasksMu.Unlock()
+
+	if c.confirmTasks {
+		c.sendTaskOutput(key, protocol.TaskOutput{Pending: true})
+		c.notifyTaskRun(run.TaskRun)
+		return nil
+	}
+	c.startTaskRun(run)
+	return nil
+}
+
+// startTaskRun runs an allowed task and streams it to the joiner.
+func (c *Client) startTaskRun(run *hostTaskRun) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.tasksMu.Lock()
+	run.State = TaskRunning
+	run.cancel = cancel
+	started := run.TaskRun
+	c.tasksMu.Unlock()
+	c.notifyTaskRun(started)
+
+	go func() {
+		defer cancel()
+		out := &taskOutputWriter{client: c, key: run.key}
+		code, err := c.runTask(ctx, run.Task, out)
+		out.flush()
+		done := protocol.TaskOutput{Done: true, ExitCode: code}
+		if err != nil {
+			done.Error = err.Error()
+		}
+		c.sendTaskOutput(run.key, done)
+
+		c.tasksMu.Lock()
+		run.State = TaskFinished
+		run.ExitCode = code
+		run.Err = err
+		delete(c.taskRuns, run.key)
+		finished := run.TaskRun
+		c.tasksMu.Unlock()
+		c.notifyTaskRun(finished)
+	}()
+}
+
+// cancelTaskRuns stops the host's runs for requests that match.
+func (c *Client) cancelTaskRuns(match func(taskRunKey) bool) {
+	c.tasksMu.Lock()
+	var cancels []context.CancelFunc
+	for key, run := range c.taskRuns {
+		if !match(key) {
+			continue
+		}
+		if run.cancel != nil {
+			cancels = append(cancels, run.cancel)
+		} else {
+			delete(c.taskRuns, key)
+		}
+	}
+	c.tasksMu.Unlock()
+	for _, cancel := range cancels {
+		cancel()
+	}
+}
+
+func (c *Client) sendTaskOutput(key taskRunKey, output protocol.TaskOutput) {
+	output.Run = key.run
+	plaintext, err := protocol.EncodeTaskOutput(output)
+	if err == nil {
+		err = c.writeEncrypted(priorityInteractive, "", plaintext, func(payload string) []byte {
+			return protocol.EncodeDirectEncrypted(key.peer, payload)
+		})
+	}
+	if err != nil && !c.stopping.Load() {
+		log.Printf("failed to send task output: %v", err)
+	}
+}
+
+// applyTaskOutput hands output from the host to the RunTask call waiting for
+// it. A caller that falls too far behind loses the run.
+func (c *Client) applyTaskOutput(output protocol.TaskOutput) {
+	c.tasksMu.Lock()
+	defer c.tasksMu.Unlock()
+	outputs, ok := c.taskWaiters[output.Run]
+	if !ok {
+		return
+	}
+	select {
+	case outputs <- output:
+	default:
+		delete(c.taskWaiters, output.Run)
+		close(outputs)
+	}
+}
+
+// taskOutputWriter streams a run's output to the joiner in bounded chunks.
+type taskOutputWriter struct {
+	client    *Client
+	key       taskRunKey
+	mu        sync.Mutex
+	sent      int
+	truncated bool
+}
+
+func (w *taskOutputWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for data := p; len(data) > 0 && !w.truncated; {
+		if w.sent >= maxTaskOutput {
+			w.truncated = true
+			break
+		}
+		chunk := data[:min(len(data), protocol.MaxTaskOutputBytes, maxTaskOutput-w.sent)]
+		data = data[len(chunk):]
+		w.sent += len(chunk)
+		w.client.sendTaskOutput(w.key, protocol.TaskOutput{Data: append([]byte(nil), chunk...)})
+	}
+	return len(p), nil
+}
+
+func (w *taskOutputWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.truncated {
+		w.client.sendTaskOutput(w.key, protocol.TaskOutput{Data: []byte("\n[output truncated]\n")})
+	}
+}
+
+func (c *Client) notifyTaskRun(run TaskRun) {
+	if c.onTaskRun != nil {
+		c.onTaskRun(run)
+		return
+	}
+	var msg string
+	switch run.State {
+	case TaskPending:
+		msg = fmt.Sprintf("%s wants to run %s · allow %d or deny %d", run.Peer.Label(), run.Task, run.ID, run.ID)
+	case TaskRunning:
+		msg = fmt.Sprintf("%s is running %s", run.Peer.Label(), run.Task)
+	case TaskDenied:
+		msg = fmt.Sprintf("denied %s for %s", run.Task, run.Peer.Label())
+	default:
+		msg = fmt.Sprintf("%s finished for %s with exit code %d", run.Task, run.Peer.Label(), run.ExitCode)
+		if run.Err != nil {
+			msg = fmt.Sprintf("%s failed for %s: %v", run.Task, run.Peer.Label(), run.Err)
+		}
+	}
+	if c.onEvent != nil {
+		c.onEvent("task", "", msg)
+		return
+	}
+	if run.State == TaskPending {
+		fmt.Printf("%s %s\n", ui.Accent("?"), msg)
+		return
+	}
+	fmt.Printf("%s %s\n", ui.Accent("▶"), ui.Dim(msg))
+}
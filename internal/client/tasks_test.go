@@ -0,0 +1,108 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+)
+
+func TestJoinerRunsHostTaskAfterConfirmation(t *testing.T) {
+	host := testApplyClient(t, t.TempDir())
+	host.isHost.Store(true)
+	host.outbound = newOutboundScheduler(nil, 0)
+	host.onEvent = func(string, string, string) {}
+	host.taskNames = []string{"test"}
+	host.confirmTasks = true
+	host.runTask = func(ctx context.Context, name string, out io.Writer) (int, error) {
+		_, _ = out.Write([]byte("FAIL: TestThing\n"))
+		return 3, nil
+	}
+	joiner := testApplyClient(t, t.TempDir())
+	joiner.outbound = newOutboundScheduler(nil, 0)
+	joiner.syncReady.Store(true)
+
+	type result struct {
+		code int
+		err  error
+	}
+	var output bytes.Buffer
+	done := make(chan result, 1)
+	go func() {
+		code, err := joiner.RunTask(context.Background(), "test", &output)
+		done <- result{code, err}
+	}()
+
+	frame, _ := joiner.outbound.next()
+	request, ok := protocol.ParseHostEncrypted(frame.data)
+	if !ok {
+		t.Fatalf("task run was not sent to the host: %q", frame.data)
+	}
+	if err := host.handlePeerMessage("2", request); err != nil {
+		t.Fatal(err)
+	}
+	runs := host.TaskRuns()
+	if len(runs) != 1 || runs[0].Task != "test" || runs[0].Peer.ID != "2" {
+		t.Fatalf("pending runs = %+v", runs)
+	}
+	if err := host.ResolveTaskRun(runs[0].ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pending notice, output, then the exit code.
+	for range 3 {
+		frame, _ = host.outbound.next()
+		peerID, reply, ok := protocol.ParseDirectEncrypted(frame.data)
+		if !ok || peerID != "2" {
+			t.Fatalf("task output was not sent to the joiner: %q", frame.data)
+		}
+		if err := joiner.handleHostMessage(reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case got := <-done:
+		if got.err != nil || got.code != 3 {
+			t.Fatalf("RunTask = %d, %v; want exit code 3", got.code, got.err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the run did not finish")
+	}
+	if want := "waiting for the host to allow test…\nFAIL: TestThing\n"; output.String() != want {
+		t.Fatalf("output = %q, want %q", output.String(), want)
+	}
+	if runs := host.TaskRuns(); len(runs) != 0 {
+		t.Fatalf("runs still pending: %+v", runs)
+	}
+}
+
+func TestHostRefusesUnknownTask(t *testing.T) {
+	host := testApplyClient(t, t.TempDir())
+	host.isHost.Store(true)
+	host.outbound = newOutboundScheduler(nil, 0)
+	host.taskNames = []string{"test"}
+	host.runTask = func(context.Context, string, io.Writer) (int, error) {
+		t.Error("ran a task that was not defined")
+		return 0, nil
+	}
+
+	if err := host.handleTaskRun("2", protocol.TaskRun{Run: 1, Task: "deploy"}); err == nil {
+		t.Fatal("accepted a task the host does not define")
+	}
+	frame, _ := host.outbound.next()
+	_, reply, ok := protocol.ParseDirectEncrypted(frame.data)
+	if !ok {
+		t.Fatalf("refusal was not sent to the joiner: %q", frame.data)
+	}
+	plaintext, err := host.codec.Decrypt(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, ok, err := protocol.DecodeTaskOutput(plaintext)
+	if err != nil || !ok || !output.Done || output.Error == "" {
+		t.Fatalf("refusal = %+v", output)
+	}
+}
@@ -0,0 +1,419 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+	"github.com/go-johnnyhe/shadow/internal/ui"
+)
+
+const (
+	// maxTerminalScrollback is how much recent output is kept for viewers
+	// that attach late.
+	maxTerminalScrollback = 64 * 1024
+	// terminalFlushInterval batches output so a busy command does not send a
+	// message per write.
+	terminalFlushInterval = 30 * time.Millisecond
+	// maxTerminalPending bounds output waiting to be broadcast. Older output
+	// is dropped beyond it and peers that need it catch up from history.
+	maxTerminalPending = 32 * 1024
+	maxTerminalInput   = 64
+	terminalWatchQueue = 256
+)
+
+// ErrTerminalReadOnly is returned when writing to a shared terminal the host
+// has not opened to input.
+var ErrTerminalReadOnly = errors.New("the host has not allowed input to the shared terminal")
+
+// TerminalUpdate is new output from the shared terminal. Reset means Data
+// replaces everything shown so far.
+type TerminalUpdate struct {
+	Data     []byte
+	Reset    bool
+	Writable bool
+	Closed   bool
+}
+
+// TerminalWatch follows the shared terminal from the point History ends.
+// Updates is closed when the terminal closes, the watch is closed, or the
+// watcher falls too far behind.
+type TerminalWatch struct {
+	History  []byte
+	Writable bool
+	Closed   bool
+	Updates  <-chan TerminalUpdate
+
+	client  *Client
+	updates chan TerminalUpdate
+}
+
+// terminalState is guarded by Client.terminalMu.
+type terminalState struct {
+	// shared is set on the host once ShareTerminal has been called; seen is
+	// set on a joiner once the host's terminal has been heard from.
+	shared     bool
+	seen       bool
+	closed     bool
+	peerInput  bool
+	input      chan []byte
+	resize     func(cols, rows int) error
+	scrollback []byte
+	end        uint64
+	pending    []byte
+	flushTimer *time.Timer
+	// requested is set while a joiner waits for the host to replay history.
+	// deferred holds the request until the joiner has finished syncing.
+	requested bool
+	deferred  bool
+	watchers  map[*TerminalWatch]struct{}
+}
+
+// ShareTerminal streams everything read from terminal to the session until
+// it returns an error, and lets peers type into it when allowInput is set.
+// resize, if not nil, is called when the host's own viewer changes size.
+func (c *Client) ShareTerminal(terminal io.ReadWriter, allowInput bool, resize func(cols, rows int) error) {
+	input := make(chan []byte, maxTerminalInput)
+	c.terminalMu.Lock()
+	c.terminal.shared = true
+	c.terminal.peerInput = allowInput
+	c.terminal.input = input
+	c.terminal.resize = resize
+	c.terminalMu.Unlock()
+
+	go func() {
+		for data := range input {
+			if _, err := terminal.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := terminal.Read(buf)
+			if n > 0 {
+				c.terminalOutput(buf[:n])
+			}
+			if err != nil {
+				break
+			}
+		}
+		c.closeTerminal()
+	}()
+	c.notifyTerminal("sharing a terminal · peers attach with `shadow terminal`")
+}
+
+// WatchTerminal returns the shared terminal's recent output and follows new
+// output. Close the watch when done.
+func (c *Client) WatchTerminal() *TerminalWatch {
+	w := &TerminalWatch{client: c, updates: make(chan TerminalUpdate, terminalWatchQueue)}
+	w.Updates = w.updates
+
+	c.terminalMu.Lock()
+	defer c.terminalMu.Unlock()
+	st := &c.terminal
+	w.History = append([]byte(nil), st.scrollback...)
+	if c.isHost.Load() {
+		w.Writable = st.shared && !st.closed
+		w.Closed = !st.shared || st.closed
+	} else {
+		w.Writable = st.peerInput && !st.closed
+		w.Closed = st.closed
+		if !st.seen && !st.closed {
+			c.requestTerminalLocked()
+		}
+	}
+	if w.Closed {
+		close(w.updates)
+		return w
+	}
+	if st.watchers == nil {
+		st.watchers = make(map[*TerminalWatch]struct{})
+	}
+	st.watchers[w] = struct{}{}
+	return w
+}
+
+// Close stops the watch and closes Updates.
+func (w *TerminalWatch) Close() {
+	c := w.client
+	c.terminalMu.Lock()
+	defer c.terminalMu.Unlock()
+	if _, ok := c.terminal.watchers[w]; ok {
+		delete(c.terminal.watchers, w)
+		close(w.updates)
+	}
+}
+
+// TerminalWrite types data into the shared terminal. Joiners can only write
+// when the host allowed input.
+func (c *Client) TerminalWrite(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	c.terminalMu.Lock()
+	st := &c.terminal
+	if c.isHost.Load() {
+		defer c.terminalMu.Unlock()
+		if !st.shared || st.closed {
+			return fmt.Errorf("no terminal is shared")
+		}
+		select {
+		case st.input <- append([]byte(nil), data...):
+			return nil
+		default:
+			return fmt.Errorf("the shared terminal is not reading input")
+		}
+	}
+	writable := st.peerInput && !st.closed
+	c.terminalMu.Unlock()
+	if !writable {
+		return ErrTerminalReadOnly
+	}
+	if !c.syncReady.Load() {
+		return fmt.Errorf("still syncing with the host")
+	}
+	for len(data) > 0 {
+		chunk := data[:min(len(data), protocol.MaxTerminalBytes)]
+		data = data[len(chunk):]
+		plaintext, err := protocol.EncodeTerminalRequest(chunk)
+		if err != nil {
+			return err
+		}
+		if err := c.writeEncrypted(priorityInteractive, "", plaintext, protocol.EncodeHostEncrypted); err != nil {
+			return fmt.Errorf("failed to send terminal input: %w", err)
+		}
+	}
+	return nil
+}
+
+// ResizeTerminal sets the size of the host's shared terminal. Joiners'
+// viewers adapt to the host's size, so it does nothing for them.
+func (c *Client) ResizeTerminal(cols, rows int) error {
+	if !c.isHost.Load() || cols <= 0 || rows <= 0 {
+		return nil
+	}
+	c.terminalMu.Lock()
+	resize := c.terminal.resize
+	closed := c.terminal.closed
+	c.terminalMu.Unlock()
+	if resize == nil || closed {
+		return nil
+	}
+	return resize(cols, rows)
+}
+
+// terminalOutput records host terminal output and schedules its broadcast.
+func (c *Client) terminalOutput(data []byte) {
+	c.terminalMu.Lock()
+	defer c.terminalMu.Unlock()
+	st := &c.terminal
+	st.appendScrollback(data)
+	st.end += uint64(len(data))
+	st.pending = append(st.pending, data...)
+	if len(st.pending) > maxTerminalPending {
+		st.pending = append([]byte(nil), st.pending[len(st.pending)-maxTerminalPending:]...)
+	}
+	if st.flushTimer == nil {
+		st.flushTimer = time.AfterFunc(terminalFlushInterval, c.flushTerminal)
+	}
+	c.notifyTerminalWatchersLocked(TerminalUpdate{Data: append([]byte(nil), data...), Writable: true})
+}
+
+func (c *Client) flushTerminal() {
+	c.terminalMu.Lock()
+	defer c.terminalMu.Unlock()
+	c.flushTerminalLocked()
+}
+
+// flushTerminalLocked broadcasts pending output. It queues while holding
+// terminalMu so chunks leave in offset order.
+func (c *Client) flushTerminalLocked() {
+	st := &c.terminal
+	if st.flushTimer != nil {
+		st.flushTimer.Stop()
+		st.flushTimer = nil
+	}
+	if len(st.pending) == 0 {
+		return
+	}
+	output := protocol.TerminalOutput{
+		Offset:   st.end - uint64(len(st.pending)),
+		Data:     st.pending,
+		Writable: st.peerInput,
+	}
+	st.pending = nil
+	c.broadcastTerminal(output)
+}
+
+// closeTerminal runs on the host once the shared terminal exits.
+func (c *Client) closeTerminal() {
+	c.terminalMu.Lock()
+	defer c.terminalMu.Unlock()
+	st := &c.terminal
+	c.flushTerminalLocked()
+	st.closed = true
+	close(st.input)
+	c.broadcastTerminal(protocol.TerminalOutput{Offset: st.end, Closed: true})
+	c.notifyTerminalWatchersLocked(TerminalUpdate{Closed: true})
+	c.closeTerminalWatchersLocked()
+	c.notifyTerminal("shared terminal exited")
+}
+
+func (c *Client) broadcastTerminal(output protocol.TerminalOutput) {
+	plaintext, err := protocol.EncodeTerminalOutput(output)
+	if err == nil {
+		err = c.writeEncrypted(priorityInteractive, "", plaintext, protocol.EncodeBroadcastEncrypted)
+	}
+	if err != nil && !c.stopping.Load() {
+		log.Printf("failed to send terminal output: %v", err)
+	}
+}
+
+// handleTerminalRequest serves a joiner's history request or input.
+func (c *Client) handleTerminalRequest(peerID string, request protocol.TerminalRequest) error {
+	c.terminalMu.Lock()
+	defer c.terminalMu.Unlock()
+	st := &c.terminal
+	if request.Type == protocol.TerminalInputType {
+		if !st.shared || st.closed || !st.peerInput {
+			return ErrTerminalReadOnly
+		}
+		select {
+		case st.input <- request.Data:
+			return nil
+		default:
+			return fmt.Errorf("dropped terminal input: the shared terminal is not reading")
+		}
+	}
+	output := protocol.TerminalOutput{
+		Offset:   st.end - uint64(len(st.scrollback)),
+		Data:     st.scrollback,
+		History:  true,
+		Writable: st.peerInput,
+		Closed:   !st.shared || st.closed,
+	}
+	plaintext, err := protocol.EncodeTerminalOutput(output)
+	if err != nil {
+		return err
+	}
+	return c.writeEncrypted(priorityInteractive, "", plaintext, func(payload string) []byte {
+		return protocol.EncodeDirectEncrypted(peerID, payload)
+	})
+}
+
+// applyTerminalOutput handles output from the host's shared terminal, either
+// live or replayed in answer to a request.
+func (c *Client) applyTerminalOutput(output protocol.TerminalOutput) {
+	c.terminalMu.Lock()
+	defer c.terminalMu.Unlock()
+	st := &c.terminal
+	firstSeen := !st.seen && !(output.History && output.Closed && len(output.Data) == 0)
+	st.peerInput = output.Writable
+
+	end := output.Offset + uint64(len(output.Data))
+	switch {
+	case output.History:
+		st.requested = false
+		if end >= st.end {
+			st.scrollback = append([]byte(nil), output.Data...)
+			st.end = end
+			c.notifyTerminalWatchersLocked(TerminalUpdate{Data: append([]byte(nil), output.Data...), Reset: true, Writable: st.peerInput})
+		}
+	case end > st.end:
+		data := output.Data
+		if output.Offset < st.end {
+			data = data[st.end-output.Offset:]
+		} else if output.Offset > st.end && st.end == 0 && !st.requested {
+			// Output started before this peer was here; fetch what it missed.
+			c.requestTerminalLocked()
+		}
+		st.appendScrollback(data)
+		st.end = end
+		c.notifyTerminalWatchersLocked(TerminalUpdate{Data: append([]byte(nil), data...), Writable: st.peerInput})
+	}
+	if firstSeen {
+		st.seen = true
+	}
+	if output.Closed && !st.closed {
+		st.closed = true
+		c.notifyTerminalWatchersLocked(TerminalUpdate{Closed: true})
+		c.closeTerminalWatchersLocked()
+		if st.seen {
+			c.notifyTerminal("the host's shared terminal exited")
+		}
+		return
+	}
+	if firstSeen && !output.Closed {
+		c.notifyTerminal("the host is sharing a terminal · watch it with `shadow terminal`")
+	}
+}
+
+// requestTerminalLocked asks the host to replay its terminal. The relay only
+// forwards joiner messages to the host once the joiner has synced, so until
+// then the request waits for sendDeferredTerminalRequest.
+func (c *Client) requestTerminalLocked() {
+	st := &c.terminal
+	st.requested = true
+	if !c.syncReady.Load() {
+		st.deferred = true
+		return
+	}
+	plaintext, err := protocol.EncodeTerminalRequest(nil)
+	if err == nil {
+		err = c.writeEncrypted(priorityInteractive, "", plaintext, protocol.EncodeHostEncrypted)
+	}
+	if err != nil && !c.stopping.Load() {
+		st.requested = false
+		log.Printf("failed to request terminal history: %v", err)
+	}
+}
+
+// sendDeferredTerminalRequest sends a history request made while syncing.
+func (c *Client) sendDeferredTerminalRequest() {
+	c.terminalMu.Lock()
+	defer c.terminalMu.Unlock()
+	if c.terminal.deferred {
+		c.terminal.deferred = false
+		c.requestTerminalLocked()
+	}
+}
+
+func (st *terminalState) appendScrollback(data []byte) {
+	st.scrollback = append(st.scrollback, data...)
+	if len(st.scrollback) > maxTerminalScrollback {
+		st.scrollback = append([]byte(nil), st.scrollback[len(st.scrollback)-maxTerminalScrollback:]...)
+	}
+}
+
+// notifyTerminalWatchersLocked sends update to every watcher, dropping any
+// that have fallen too far behind to keep up.
+func (c *Client) notifyTerminalWatchersLocked(update TerminalUpdate) {
+	for w := range c.terminal.watchers {
+		select {
+		case w.updates <- update:
+		default:
+			delete(c.terminal.watchers, w)
+			close(w.updates)
+		}
+	}
+}
+
+func (c *Client) closeTerminalWatchersLocked() {
+	for w := range c.terminal.watchers {
+		delete(c.terminal.watchers, w)
+		close(w.updates)
+	}
+}
+
+func (c *Client) notifyTerminal(msg string) {
+	if c.onEvent != nil {
+		c.onEvent("terminal", "", msg)
+		return
+	}
+	fmt.Printf("%s %s\n", ui.Accent("▌"), ui.Dim(msg))
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+)
+
+type fakeTerminal struct {
+	io.Reader
+	input chan []byte
+}
+
+func (f fakeTerminal) Write(data []byte) (int, error) {
+	f.input <- append([]byte(nil), data...)
+	return len(data), nil
+}
+
+func nextTerminalUpdate(t *testing.T, watch *TerminalWatch) TerminalUpdate {
+	t.Helper()
+	select {
+	case update, ok := <-watch.Updates:
+		if !ok {
+			t.Fatal("watch ended")
+		}
+		return update
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for terminal output")
+	}
+	return TerminalUpdate{}
+}
+
+func TestSharedTerminalReachesLateJoinerAndTakesInput(t *testing.T) {
+	host := testApplyClient(t, t.TempDir())
+	host.isHost.Store(true)
+	host.outbound = newOutboundScheduler(nil, 0)
+	host.onEvent = func(string, string, string) {}
+	joiner := testApplyClient(t, t.TempDir())
+	joiner.outbound = newOutboundScheduler(nil, 0)
+	joiner.onEvent = func(string, string, string) {}
+	joiner.syncReady.Store(true)
+	joiner.roster = map[string]*PeerInfo{"1": {ID: "1", Host: true}, "3": {ID: "3"}}
+
+	output, shell := io.Pipe()
+	input := make(chan []byte, 4)
+	host.ShareTerminal(fakeTerminal{Reader: output, input: input}, true, nil)
+	hostWatch := host.WatchTerminal()
+	defer hostWatch.Close()
+	if _, err := shell.Write([]byte("$ ls\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if update := nextTerminalUpdate(t, hostWatch); string(update.Data) != "$ ls\r\n" {
+		t.Fatalf("host watcher got %q", update.Data)
+	}
+	frame, _ := host.outbound.next()
+	broadcast, ok := protocol.ParseBroadcastEncrypted(frame.data)
+	if !ok {
+		t.Fatalf("terminal output was not broadcast: %q", frame.data)
+	}
+	if err := joiner.handlePeerBroadcast("3", broadcast); err == nil {
+		t.Fatal("accepted terminal output from a peer that is not the host")
+	}
+
+	// A joiner that missed the start asks the host for history.
+	joinWatch := joiner.WatchTerminal()
+	defer joinWatch.Close()
+	frame, _ = joiner.outbound.next()
+	request, ok := protocol.ParseHostEncrypted(frame.data)
+	if !ok {
+		t.Fatalf("history was not requested: %q", frame.data)
+	}
+	if err := host.handlePeerMessage("2", request); err != nil {
+		t.Fatal(err)
+	}
+	frame, _ = host.outbound.next()
+	peerID, reply, ok := protocol.ParseDirectEncrypted(frame.data)
+	if !ok || peerID != "2" {
+		t.Fatalf("history was not sent to the joiner: %q", frame.data)
+	}
+	if err := joiner.handleHostMessage(reply); err != nil {
+		t.Fatal(err)
+	}
+	update := nextTerminalUpdate(t, joinWatch)
+	if !update.Reset || string(update.Data) != "$ ls\r\n" || !update.Writable {
+		t.Fatalf("joiner got %+v", update)
+	}
+
+	// The live broadcast of the same output is a duplicate by now.
+	if err := joiner.handlePeerBroadcast("1", broadcast); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case update := <-joinWatch.Updates:
+		t.Fatalf("duplicate output was shown again: %+v", update)
+	default:
+	}
+
+	if err := joiner.TerminalWrite([]byte("pwd\r")); err != nil {
+		t.Fatal(err)
+	}
+	frame, _ = joiner.outbound.next()
+	keystrokes, _ := protocol.ParseHostEncrypted(frame.data)
+	if err := host.handlePeerMessage("2", keystrokes); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-input:
+		if string(data) != "pwd\r" {
+			t.Fatalf("terminal got input %q", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("input did not reach the terminal")
+	}
+
+	_ = shell.Close()
+	if update := nextTerminalUpdate(t, hostWatch); !update.Closed {
+		t.Fatalf("host watcher got %+v, want closed", update)
+	}
+	frame, _ = host.outbound.next()
+	broadcast, _ = protocol.ParseBroadcastEncrypted(frame.data)
+	if err := joiner.handlePeerBroadcast("1", broadcast); err != nil {
+		t.Fatal(err)
+	}
+	if update := nextTerminalUpdate(t, joinWatch); !update.Closed {
+		t.Fatalf("joiner got %+v, want closed", update)
+	}
+}
+
+func TestReadOnlySharedTerminalRejectsJoinerInput(t *testing.T) {
+	host := testApplyClient(t, t.TempDir())
+	host.isHost.Store(true)
+	host.outbound = newOutboundScheduler(nil, 0)
+	host.onEvent = func(string, string, string) {}
+	output, _ := io.Pipe()
+	host.ShareTerminal(fakeTerminal{Reader: output, input: make(chan []byte, 1)}, false, nil)
+
+	if err := host.handleTerminalRequest("2", protocol.TerminalRequest{Type: protocol.TerminalInputType, Data: []byte("rm -rf /\r")}); err != ErrTerminalReadOnly {
+		t.Fatalf("got %v, want ErrTerminalReadOnly", err)
+	}
+
+	joiner := testApplyClient(t, t.TempDir())
+	joiner.onEvent = func(string, string, string) {}
+	joiner.applyTerminalOutput(protocol.TerminalOutput{Data: []byte("$ ")})
+	if err := joiner.TerminalWrite([]byte("ls\r")); err != ErrTerminalReadOnly {
+		t.Fatalf("got %v, want ErrTerminalReadOnly", err)
+	}
+}
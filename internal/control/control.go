@@ -0,0 +1,318 @@
+// Package control serves the local interface editor plugins and shadow
+// subcommands use to talk to a running session. It listens on loopback TCP
+// and speaks newline-delimited JSON. The port and a random token are written
+// to <runtime home>/sessions/<pid>.json, readable only by the current user.
+package control
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/runtimehome"
+)
+
+const (
+	SessionsDir = "sessions"
+
+	TypeHello   = "hello"
+	TypeWelcome = "welcome"
+	TypeCursor  = "cursor"
+	TypeChat    = "chat"
+	TypeFocus   = "focus"
+	TypeOK      = "ok"
+	TypeError   = "error"
+
+	// Messages on attached streams.
+	TypeOutput = "output"
+	TypeInput  = "input"
+	TypeResize = "resize"
+	TypeTasks  = "tasks"
+	TypeExit   = "exit"
+
+	maxLineBytes     = 256 * 1024
+	maxQueuedLines   = 256
+	helloTimeout     = 5 * time.Second
+	writeTimeout     = 5 * time.Second
+	tokenRandomBytes = 24
+)
+
+// Info describes a running session to local tools.
+type Info struct {
+	PID   int    `json:"pid"`
+	Port  int    `json:"port"`
+	Token string `json:"token"`
+	// Root is the absolute path of the shared directory.
+	Root string `json:"root"`
+}
+
+type Position struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+type Selection struct {
+	Start Position `json:"start"`
+	End   Position `json:"end"`
+}
+
+// Message is one line of the control protocol. A tool's first message must
+// be a hello carrying the token. Cursor messages name files by absolute path;
+// lines and columns are zero-based and columns count UTF-16 code units. A
+// message with an ID is answered with an ok or error carrying the same ID.
+// A hello with Attach set turns the connection into a Stream.
+type Message struct {
+	Type      string     `json:"type"`
+	ID        string     `json:"id,omitempty"`
+	Token     string     `json:"token,omitempty"`
+	Root      string     `json:"root,omitempty"`
+	PeerID    string     `json:"peer_id,omitempty"`
+	PeerName  string     `json:"peer_name,omitempty"`
+	File      string     `json:"file,omitempty"`
+	Line      int        `json:"line,omitempty"`
+	Column    int        `json:"column,omitempty"`
+	Selection *Selection `json:"selection,omitempty"`
+	Text      string     `json:"text,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Attach    string     `json:"attach,omitempty"`
+	Data      []byte     `json:"data,omitempty"`
+	Cols      int        `json:"cols,omitempty"`
+	Rows      int        `json:"rows,omitempty"`
+	Writable  bool       `json:"writable,omitempty"`
+	Reset     bool       `json:"reset,omitempty"`
+	Closed    bool       `json:"closed,omitempty"`
+	Tasks     []string   `json:"tasks,omitempty"`
+	ExitCode  *int       `json:"exit_code,omitempty"`
+	Files     int        `json:"files,omitempty"`
+}
+
+// Handler handles a message from a connected tool. A returned error is sent
+// back to that tool.
+type Handler func(Message) error
+
+type Server struct {
+	listener net.Listener
+	info     Info
+	infoPath string
+
+	mu       sync.Mutex
+	conns    map[*conn]struct{}
+	attached map[*conn]struct{}
+	streams  map[string]StreamHandler
+	cursors  map[string]Message
+	closed   bool
+}
+
+type conn struct {
+	net.Conn
+	out  chan []byte
+	done chan struct{}
+	once sync.Once
+}
+
+// Listen opens the control interface for a session sharing root and
+// publishes its Info file.
+func Listen(root string) (*Server, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := runtimehome.Join(SessionsDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create sessions directory: %w", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open control interface: %w", err)
+	}
+
+	s := &Server{
+		listener: listener,
+		info: Info{
+			PID:   os.Getpid(),
+			Port:  listener.Addr().(*net.TCPAddr).Port,
+			Token: token,
+			Root:  root,
+		},
+		infoPath: filepath.Join(dir, strconv.Itoa(os.Getpid())+".json"),
+		conns:    make(map[*conn]struct{}),
+		attached: make(map[*conn]struct{}),
+		streams:  make(map[string]StreamHandler),
+		cursors:  make(map[string]Message),
+	}
+	data, err := json.Marshal(s.info)
+	if err == nil {
+		err = os.WriteFile(s.infoPath, data, 0o600)
+	}
+	if err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("failed to write session file: %w", err)
+	}
+	return s, nil
+}
+
+func (s *Server) Info() Info {
+	return s.info
+}
+
+// Serve accepts tools until the server is closed.
+func (s *Server) Serve(handle Handler) {
+	for {
+		netConn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &conn{Conn: netConn, out: make(chan []byte, maxQueuedLines), done: make(chan struct{})}
+		go s.serveConn(c, handle)
+	}
+}
+
+func (s *Server) serveConn(c *conn, handle Handler) {
+	defer s.drop(c)
+	scanner := bufio.NewScanner(c)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineBytes)
+
+	_ = c.SetReadDeadline(time.Now().Add(helloTimeout))
+	var hello Message
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &hello) != nil || hello.Type != TypeHello ||
+		subtle.ConstantTimeCompare([]byte(hello.Token), []byte(s.info.Token)) != 1 {
+		return
+	}
+	_ = c.SetReadDeadline(time.Time{})
+	if hello.Attach != "" {
+		s.serveStream(c, scanner, hello)
+		return
+	}
+	if !s.add(c) {
+		return
+	}
+
+	for scanner.Scan() {
+		var message Message
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			c.send(Message{Type: TypeError, Error: "invalid message"})
+			continue
+		}
+		if err := handle(message); err != nil {
+			c.send(Message{Type: TypeError, ID: message.ID, Error: err.Error()})
+		} else if message.ID != "" {
+			c.send(Message{Type: TypeOK, ID: message.ID})
+		}
+	}
+}
+
+// add registers an authenticated tool, greets it and replays the cursors it
+// missed.
+func (s *Server) add(c *conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	go c.writeLoop()
+	c.send(Message{Type: TypeWelcome, Root: s.info.Root})
+	for _, cursor := range s.cursors {
+		c.send(cursor)
+	}
+	return true
+}
+
+func (s *Server) drop(c *conn) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+	c.close()
+}
+
+// Publish sends a message to every connected tool. The latest cursor of each
+// peer is kept for tools that connect later; a cursor without a file clears it.
+func (s *Server) Publish(message Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if message.Type == TypeCursor && message.PeerID != "" {
+		if message.File == "" {
+			delete(s.cursors, message.PeerID)
+		} else {
+			s.cursors[message.PeerID] = message
+		}
+	}
+	for c := range s.conns {
+		c.send(message)
+	}
+}
+
+// Close stops the interface and removes the session file.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	conns := s.conns
+	s.conns = make(map[*conn]struct{})
+	for c := range s.attached {
+		conns[c] = struct{}{}
+	}
+	s.attached = make(map[*conn]struct{})
+	s.mu.Unlock()
+	for c := range conns {
+		c.close()
+	}
+	_ = os.Remove(s.infoPath)
+	return s.listener.Close()
+}
+
+// send queues a message for the tool. A tool that stops reading is
+// disconnected rather than allowed to hold up the session.
+func (c *conn) send(message Message) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	select {
+	case c.out <- append(data, '\n'):
+	case <-c.done:
+	default:
+		c.close()
+	}
+}
+
+func (c *conn) writeLoop() {
+	for {
+		select {
+		case data := <-c.out:
+			_ = c.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if _, err := c.Write(data); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *conn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		_ = c.Conn.Close()
+	})
+}
+
+func newToken() (string, error) {
+	buf := make([]byte, tokenRandomBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to create control token: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
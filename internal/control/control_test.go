@@ -0,0 +1,183 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/runtimehome"
+)
+
+func dialTest(t *testing.T, info Info, token string) (net.Conn, *bufio.Scanner) {
+	t.Helper()
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", info.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	writeTest(t, conn, Message{Type: TypeHello, Token: token})
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	return conn, bufio.NewScanner(conn)
+}
+
+func writeTest(t *testing.T, conn net.Conn, message Message) {
+	t.Helper()
+	data, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTest(t *testing.T, scanner *bufio.Scanner) Message {
+	t.Helper()
+	if !scanner.Scan() {
+		t.Fatalf("connection closed: %v", scanner.Err())
+	}
+	var message Message
+	if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func TestControlServerAuthenticatesAndRelaysCursors(t *testing.T) {
+	t.Setenv(runtimehome.EnvVar, t.TempDir())
+	root := t.TempDir()
+	server, err := Listen(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan Message, 1)
+	go server.Serve(func(message Message) error {
+		received <- message
+		return nil
+	})
+
+	infoPath, _ := runtimehome.Join(SessionsDir, fmt.Sprintf("%d.json", os.Getpid()))
+	data, err := os.ReadFile(infoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info Info
+	if err := json.Unmarshal(data, &info); err != nil || info != server.Info() || info.Root != root {
+		t.Fatalf("session file has %+v (%v), want %+v", info, err, server.Info())
+	}
+
+	_, rejected := dialTest(t, info, "wrong")
+	if rejected.Scan() {
+		t.Fatalf("unauthenticated tool got %q", rejected.Text())
+	}
+
+	server.Publish(Message{Type: TypeCursor, PeerID: "2", File: root + "/main.go", Line: 4})
+	conn, scanner := dialTest(t, info, info.Token)
+	if welcome := readTest(t, scanner); welcome.Type != TypeWelcome || welcome.Root != root {
+		t.Fatalf("got %+v, want a welcome", welcome)
+	}
+	if cursor := readTest(t, scanner); cursor.PeerID != "2" || cursor.Line != 4 {
+		t.Fatalf("got %+v, want the retained cursor", cursor)
+	}
+
+	writeTest(t, conn, Message{Type: TypeCursor, File: root + "/main.go", Line: 7})
+	select {
+	case message := <-received:
+		if message.Line != 7 {
+			t.Fatalf("handler got %+v", message)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler did not receive the cursor")
+	}
+
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(infoPath); !os.IsNotExist(err) {
+		t.Fatal("session file was not removed on close")
+	}
+}
+
+func TestCallFindsSessionAndReportsErrors(t *testing.T) {
+	t.Setenv(runtimehome.EnvVar, t.TempDir())
+	if _, err := Find(t.TempDir()); err != ErrNoSession {
+		t.Fatalf("got %v, want ErrNoSession", err)
+	}
+
+	root := t.TempDir()
+	server, err := Listen(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Serve(func(message Message) error {
+		if message.Text == "" {
+			return fmt.Errorf("message is empty")
+		}
+		return nil
+	})
+
+	info, err := Find(filepath.Join(root, "src"))
+	if err != nil || info != server.Info() {
+		t.Fatalf("found %+v (%v), want the session sharing root", info, err)
+	}
+	if err := Call(info, Message{Type: TypeChat, Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Call(info, Message{Type: TypeChat}); err == nil || err.Error() != "message is empty" {
+		t.Fatalf("got %v, want the handler's error", err)
+	}
+}
+
+func TestAttachHandsConnectionToStreamHandler(t *testing.T) {
+	t.Setenv(runtimehome.EnvVar, t.TempDir())
+	server, err := Listen(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.HandleStream(AttachTerminal, func(hello Message, stream *Stream) {
+		_ = stream.Send(Message{Type: TypeOutput, Data: []byte("$ "), Cols: hello.Cols})
+		for {
+			message, err := stream.Receive()
+			if err != nil {
+				return
+			}
+			_ = stream.Send(Message{Type: TypeOutput, Data: message.Data})
+		}
+	})
+	go server.Serve(func(Message) error { return nil })
+
+	stream, err := Attach(server.Info(), Message{Attach: AttachTerminal, Cols: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	first, err := stream.Receive()
+	if err != nil || string(first.Data) != "$ " || first.Cols != 80 {
+		t.Fatalf("got %+v, %v", first, err)
+	}
+	// Published messages go to tools on the message bus, not to streams.
+	server.Publish(Message{Type: TypeCursor, PeerID: "2", File: "/x"})
+	if err := stream.Send(Message{Type: TypeInput, Data: []byte("ls\r")}); err != nil {
+		t.Fatal(err)
+	}
+	echo, err := stream.Receive()
+	if err != nil || echo.Type != TypeOutput || string(echo.Data) != "ls\r" {
+		t.Fatalf("got %+v, %v", echo, err)
+	}
+
+	other, err := Attach(server.Info(), Message{Attach: "unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if reply, err := other.Receive(); err != nil || reply.Type != TypeError {
+		t.Fatalf("got %+v, %v for an unknown stream", reply, err)
+	}
+}
@@ -0,0 +1,119 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/runtimehome"
+)
+
+const callTimeout = 5 * time.Second
+
+// ErrNoSession means no running session could be found.
+var ErrNoSession = errors.New("no running shadow session found")
+
+// Sessions lists the session files of running sessions. Files left behind by
+// sessions that crashed are listed too; Call fails for them.
+func Sessions() ([]Info, error) {
+	dir, err := runtimehome.Join(SessionsDir)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var sessions []Info
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var info Info
+		if json.Unmarshal(data, &info) == nil && info.Port > 0 && info.Token != "" {
+			sessions = append(sessions, info)
+		}
+	}
+	return sessions, nil
+}
+
+// Find picks the session a command run in dir talks to: the one sharing the
+// deepest directory containing dir, or the only session that is running.
+func Find(dir string) (Info, error) {
+	sessions, err := Sessions()
+	if err != nil {
+		return Info{}, err
+	}
+	var best Info
+	for _, info := range sessions {
+		if within(info.Root, dir) && len(info.Root) > len(best.Root) {
+			best = info
+		}
+	}
+	if best.Port != 0 {
+		return best, nil
+	}
+	switch len(sessions) {
+	case 0:
+		return Info{}, ErrNoSession
+	case 1:
+		return sessions[0], nil
+	default:
+		roots := make([]string, 0, len(sessions))
+		for _, info := range sessions {
+			roots = append(roots, info.Root)
+		}
+		return Info{}, fmt.Errorf("several sessions are running; run this inside one of: %s", strings.Join(roots, ", "))
+	}
+}
+
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Call sends one message to a running session and waits for its answer.
+func Call(info Info, message Message) error {
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(info.Port), callTimeout)
+	if err != nil {
+		return fmt.Errorf("session %d is not responding: %w", info.PID, err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(callTimeout))
+
+	message.ID = "1"
+	for _, line := range []Message{{Type: TypeHello, Token: info.Token}, message} {
+		data, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(append(data, '\n')); err != nil {
+			return fmt.Errorf("failed to reach session %d: %w", info.PID, err)
+		}
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineBytes)
+	for scanner.Scan() {
+		var reply Message
+		if json.Unmarshal(scanner.Bytes(), &reply) != nil || reply.ID != message.ID {
+			continue
+		}
+		if reply.Type == TypeError {
+			return errors.New(reply.Error)
+		}
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("session %d did not answer: %w", info.PID, err)
+	}
+	return fmt.Errorf("session %d closed the connection", info.PID)
+}
@@ -0,0 +1,119 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AttachTerminal attaches a tool to the session's shared terminal. The
+// session sends the terminal's recent output as an output message, then
+// every new output message; the tool sends input and resize messages.
+const AttachTerminal = "terminal"
+
+// AttachTask runs the session task named by the hello's Text, streaming its
+// output as output messages and ending with an exit message. Without a name
+// the session answers with a tasks message listing what can be run.
+const AttachTask = "task"
+
+// AttachPatch streams a patch of everything changed since the session
+// started as output messages, ending with an exit message whose Files counts
+// the changed files.
+const AttachPatch = "patch"
+
+// Stream is a tool connection attached to a session feature, such as the
+// shared terminal, instead of receiving published messages.
+type Stream struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+	writeMu sync.Mutex
+}
+
+// StreamHandler serves a tool that attached with hello. The connection is
+// closed when it returns.
+type StreamHandler func(hello Message, stream *Stream)
+
+// HandleStream serves tools that attach to kind with handler.
+func (s *Server) HandleStream(kind string, handler StreamHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams[kind] = handler
+}
+
+func (s *Server) serveStream(c *conn, scanner *bufio.Scanner, hello Message) {
+	s.mu.Lock()
+	handler := s.streams[hello.Attach]
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.attached[c] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.attached, c)
+		s.mu.Unlock()
+	}()
+
+	stream := &Stream{conn: c.Conn, scanner: scanner}
+	if handler == nil {
+		_ = stream.Send(Message{Type: TypeError, Error: "this session does not support " + hello.Attach})
+		return
+	}
+	handler(hello, stream)
+}
+
+// Attach connects to a running session's feature named by hello.Attach.
+func Attach(info Info, hello Message) (*Stream, error) {
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(info.Port), callTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("session %d is not responding: %w", info.PID, err)
+	}
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineBytes)
+	stream := &Stream{conn: conn, scanner: scanner}
+	hello.Type = TypeHello
+	hello.Token = info.Token
+	if err := stream.Send(hello); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to reach session %d: %w", info.PID, err)
+	}
+	return stream, nil
+}
+
+// Receive reads the next message. It returns io.EOF once the other side has
+// closed the stream.
+func (s *Stream) Receive() (Message, error) {
+	for s.scanner.Scan() {
+		var message Message
+		if json.Unmarshal(s.scanner.Bytes(), &message) == nil {
+			return message, nil
+		}
+	}
+	if err := s.scanner.Err(); err != nil {
+		return Message{}, err
+	}
+	return Message{}, io.EOF
+}
+
+// Send writes a message. It is safe to call from several goroutines.
+func (s *Stream) Send(message Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_ = s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err = s.conn.Write(append(data, '\n'))
+	return err
+}
+
+func (s *Stream) Close() error {
+	return s.conn.Close()
+}
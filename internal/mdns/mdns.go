@@ -0,0 +1,449 @@
+// Package mdns advertises and finds services on the local network with
+// multicast DNS service discovery (RFC 6762 and RFC 6763).
+//
+// It implements only what shadow needs: a responder for one service instance
+// on each IPv4 interface, and a browser that sends one-shot queries and
+// collects the unicast replies. Nothing it learns is authenticated; anyone on
+// the network can answer, so callers must not trust an entry with secrets.
+package mdns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Port is the mDNS port; queries from any other port get unicast answers.
+const Port = 5353
+
+const (
+	// ptrTTL and hostTTL are RFC 6762's recommended record lifetimes.
+	ptrTTL  = 4500
+	hostTTL = 120
+	// legacyTTL caps the lifetime of records sent to one-shot queriers.
+	legacyTTL = 10
+	// announceInterval separates the announcements a responder sends when
+	// it starts.
+	announceInterval = time.Second
+	maxPacketBytes   = 9000
+)
+
+var group = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: Port}
+
+// servicesName lists every service type on the network.
+const servicesName = "_services._dns-sd._udp.local."
+
+// Service is an instance to advertise. Type is a service type such as
+// "_shadow._tcp", Text its TXT record's key=value pairs.
+type Service struct {
+	Type string
+	Port int
+	Text map[string]string
+}
+
+// Entry is a service instance found by Browse. Addr is the address it
+// answered from, which is known to reach the browser; advertised addresses
+// may belong to other networks.
+type Entry struct {
+	Instance string
+	Addr     net.IP
+	Port     int
+	Text     map[string]string
+}
+
+// Responder answers queries for a Service until closed.
+type Responder struct {
+	service  Service
+	instance string // full instance name, e.g. shadow-1a2b3c._shadow._tcp.local.
+	host     string // target of the SRV record, e.g. shadow-1a2b3c.local.
+	conns    []*interfaceConn
+	wg       sync.WaitGroup
+	once     sync.Once
+}
+
+// interfaceConn is the multicast socket for one interface and the IPv4
+// addresses advertised on it.
+type interfaceConn struct {
+	conn  *net.UDPConn
+	addrs []net.IP
+}
+
+// Advertise starts answering for service on every IPv4 interface that can
+// multicast, and announces it. Instance names are random, so two sessions
+// never collide and nothing about the host leaks into the name.
+func Advertise(service Service) (*Responder, error) {
+	label := make([]byte, 3)
+	if _, err := rand.Read(label); err != nil {
+		return nil, err
+	}
+	name := "shadow-" + hex.EncodeToString(label)
+	r := &Responder{
+		service:  service,
+		instance: name + "." + serviceName(service.Type),
+		host:     name + ".local.",
+	}
+	for _, iface := range multicastInterfaces() {
+		addrs := interfaceIPv4(iface)
+		if len(addrs) == 0 {
+			continue
+		}
+		conn, err := net.ListenMulticastUDP("udp4", &iface, group)
+		if err != nil {
+			continue
+		}
+		r.conns = append(r.conns, &interfaceConn{conn: conn, addrs: addrs})
+	}
+	if len(r.conns) == 0 {
+		return nil, errors.New("no network interface can send multicast")
+	}
+	for _, ic := range r.conns {
+		r.wg.Add(1)
+		go r.serve(ic)
+	}
+	go r.announce()
+	return r, nil
+}
+
+// Close says goodbye, so browsers drop the instance at once, and stops
+// answering.
+func (r *Responder) Close() {
+	r.once.Do(func() {
+		for _, ic := range r.conns {
+			goodbye := &message{flags: flagResponse, answers: []record{r.ptrRecord(0)}}
+			ic.conn.WriteToUDP(goodbye.encode(), group)
+			ic.conn.Close()
+		}
+		r.wg.Wait()
+	})
+}
+
+// announce sends the instance's records unasked, twice as RFC 6762 asks, so
+// browsers already listening see it.
+func (r *Responder) announce() {
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			time.Sleep(announceInterval)
+		}
+		for _, ic := range r.conns {
+			announcement := &message{flags: flagResponse, answers: r.records(ic, false)}
+			if _, err := ic.conn.WriteToUDP(announcement.encode(), group); errors.Is(err, net.ErrClosed) {
+				return
+			}
+		}
+	}
+}
+
+func (r *Responder) serve(ic *interfaceConn) {
+	defer r.wg.Done()
+	buf := make([]byte, maxPacketBytes)
+	for {
+		n, from, err := ic.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("mdns: read failed: %v", err)
+			continue
+		}
+		query, err := parseMessage(buf[:n])
+		if err != nil || query.response() {
+			continue
+		}
+		if reply, unicast := r.reply(ic, query, from); reply != nil {
+			to := group
+			if unicast {
+				to = from
+			}
+			ic.conn.WriteToUDP(reply.encode(), to)
+		}
+	}
+}
+
+// reply builds the answer to query, if it asks about this instance, and
+// says whether it goes straight back to the sender. Queries from a port
+// other than 5353 are one-shot queries: their answers echo the question
+// and are only good for a few seconds.
+func (r *Responder) reply(ic *interfaceConn, query *message, from *net.UDPAddr) (*message, bool) {
+	legacy := from.Port != Port
+	reply := &message{flags: flagResponse}
+	unicast := legacy
+	for _, q := range query.questions {
+		answers := r.answer(ic, q, legacy)
+		if len(answers) == 0 {
+			continue
+		}
+		reply.answers = append(reply.answers, answers...)
+		if q.class&unicastBit != 0 {
+			unicast = true
+		}
+		if legacy {
+			reply.questions = append(reply.questions, question{name: q.name, qtype: q.qtype, class: classIN})
+		}
+	}
+	if len(reply.answers) == 0 {
+		return nil, false
+	}
+	if legacy {
+		reply.id = query.id
+	}
+	// Browsers need the SRV, TXT and address records to use a PTR answer;
+	// send them along rather than waiting to be asked.
+	have := map[uint16]bool{}
+	for _, a := range reply.answers {
+		have[a.rtype] = true
+	}
+	for _, extra := range r.records(ic, legacy) {
+		if !have[extra.rtype] {
+			reply.additionals = append(reply.additionals, extra)
+		}
+	}
+	return reply, unicast
+}
+
+// answer returns the records answering q, if it is about this instance.
+func (r *Responder) answer(ic *interfaceConn, q question, legacy bool) []record {
+	ttl := func(ttl uint32) uint32 {
+		if legacy {
+			return min(ttl, legacyTTL)
+		}
+		return ttl
+	}
+	switch {
+	case sameName(q.name, servicesName) && (q.qtype == typePTR || q.qtype == typeANY):
+		return []record{{name: servicesName, rtype: typePTR, class: classIN, ttl: ttl(ptrTTL), data: ptrData(serviceName(r.service.Type))}}
+	case sameName(q.name, serviceName(r.service.Type)) && (q.qtype == typePTR || q.qtype == typeANY):
+		return []record{r.ptrRecord(ttl(ptrTTL))}
+	case sameName(q.name, r.instance) || sameName(q.name, r.host):
+		var records []record
+		for _, rec := range r.records(ic, legacy) {
+			if sameName(rec.name, q.name) && (q.qtype == rec.rtype || q.qtype == typeANY) {
+				records = append(records, rec)
+			}
+		}
+		return records
+	}
+	return nil
+}
+
+func (r *Responder) ptrRecord(ttl uint32) record {
+	return record{name: serviceName(r.service.Type), rtype: typePTR, class: classIN, ttl: ttl, data: ptrData(r.instance)}
+}
+
+// records is the full set for this instance on one interface: the PTR, SRV
+// and TXT records and the interface's addresses.
+func (r *Responder) records(ic *interfaceConn, legacy bool) []record {
+	// Legacy queriers are not mDNS caches, so the cache-flush bit and long
+	// lifetimes mean nothing to them.
+	class, ptr, host := uint16(classIN|cacheFlush), uint32(ptrTTL), uint32(hostTTL)
+	if legacy {
+		class, ptr, host = classIN, legacyTTL, legacyTTL
+	}
+	records := []record{
+		r.ptrRecord(ptr),
+		{name: r.instance, rtype: typeSRV, class: class, ttl: host, data: srvData(r.service.Port, r.host)},
+		{name: r.instance, rtype: typeTXT, class: class, ttl: ptr, data: txtData(textEntries(r.service.Text))},
+	}
+	for _, addr := range ic.addrs {
+		records = append(records, record{name: r.host, rtype: typeA, class: class, ttl: host, data: addr.To4()})
+	}
+	return records
+}
+
+// Browse asks for instances of serviceType, such as "_shadow._tcp", on every
+// IPv4 interface and returns those that answer before ctx is done.
+func Browse(ctx context.Context, serviceType string) ([]Entry, error) {
+	var conns []*net.UDPConn
+	for _, iface := range multicastInterfaces() {
+		for _, addr := range interfaceIPv4(iface) {
+			// Bound to the interface's address, the query leaves through that
+			// interface.
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: addr})
+			if err == nil {
+				conns = append(conns, conn)
+			}
+		}
+	}
+	if len(conns) == 0 {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+
+	b := newBrowser(serviceName(serviceType))
+	query := (&message{questions: []question{{name: b.service, qtype: typePTR, class: classIN}}}).encode()
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.read(conn)
+		}()
+	}
+	go func() {
+		// Ask again once, in case the first query or its answer was lost.
+		for i := 0; i < 2; i++ {
+			sent := false
+			for _, conn := range conns {
+				if _, err := conn.WriteToUDP(query, group); err == nil {
+					sent = true
+				}
+			}
+			if !sent {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(announceInterval):
+			}
+		}
+	}()
+	<-ctx.Done()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	wg.Wait()
+	return b.entries(), nil
+}
+
+// browser collects the records answering a query.
+type browser struct {
+	service string
+
+	mu      sync.Mutex
+	sources map[string]net.IP
+	ports   map[string]int
+	texts   map[string]map[string]string
+}
+
+func newBrowser(service string) *browser {
+	return &browser{
+		service: service,
+		sources: map[string]net.IP{},
+		ports:   map[string]int{},
+		texts:   map[string]map[string]string{},
+	}
+}
+
+func (b *browser) read(conn *net.UDPConn) {
+	buf := make([]byte, maxPacketBytes)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		packet := append([]byte(nil), buf[:n]...)
+		if reply, err := parseMessage(packet); err == nil && reply.response() {
+			b.add(reply, from.IP)
+		}
+	}
+}
+
+// add records what a reply from source says about the service's instances.
+func (b *browser) add(reply *message, source net.IP) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	records := append(append([]record(nil), reply.answers...), reply.additionals...)
+	for _, rec := range records {
+		name := strings.ToLower(rec.name)
+		switch rec.rtype {
+		case typePTR:
+			if !sameName(rec.name, b.service) {
+				continue
+			}
+			instance, err := reply.parsePTR(rec)
+			if err != nil {
+				continue
+			}
+			instance = strings.ToLower(instance)
+			// A zero lifetime is a goodbye.
+			if rec.ttl == 0 {
+				delete(b.sources, instance)
+				continue
+			}
+			b.sources[instance] = source
+		case typeSRV:
+			if port, _, err := reply.parseSRV(rec); err == nil {
+				b.ports[name] = port
+			}
+		case typeTXT:
+			if text, err := parseTXT(rec.data); err == nil {
+				b.texts[name] = text
+			}
+		}
+	}
+}
+
+// entries returns the instances that gave a port, sorted by name.
+func (b *browser) entries() []Entry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var entries []Entry
+	for instance, addr := range b.sources {
+		port, ok := b.ports[instance]
+		if !ok {
+			continue
+		}
+		label := strings.TrimSuffix(instance, "."+b.service)
+		entries = append(entries, Entry{Instance: label, Addr: addr, Port: port, Text: b.texts[instance]})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Instance < entries[j].Instance })
+	return entries
+}
+
+// serviceName is the DNS name of a service type, e.g. _shadow._tcp.local.
+func serviceName(serviceType string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(serviceType, "."), ".local") + ".local."
+}
+
+func textEntries(text map[string]string) []string {
+	keys := make([]string, 0, len(text))
+	for key := range text {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	entries := make([]string, 0, len(keys))
+	for _, key := range keys {
+		entries = append(entries, key+"="+text[key])
+	}
+	return entries
+}
+
+// multicastInterfaces lists the interfaces that are up and can multicast,
+// leaving out loopback.
+func multicastInterfaces() []net.Interface {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var usable []net.Interface
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 && iface.Flags&net.FlagLoopback == 0 {
+			usable = append(usable, iface)
+		}
+	}
+	return usable
+}
+
+func interfaceIPv4(iface net.Interface) []net.IP {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			ips = append(ips, ipNet.IP.To4())
+		}
+	}
+	return ips
+}
@@ -0,0 +1,140 @@
+package mdns
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResponderAnswersOneShotBrowseQuery(t *testing.T) {
+	r := &Responder{
+		service:  Service{Type: "_shadow._tcp", Port: 8443, Text: map[string]string{"name": "project", "user": "alice"}},
+		instance: "shadow-abc123._shadow._tcp.local.",
+		host:     "shadow-abc123.local.",
+	}
+	ic := &interfaceConn{addrs: []net.IP{net.IPv4(192, 168, 1, 20).To4()}}
+	query := &message{id: 7, questions: []question{{name: "_SHADOW._tcp.local.", qtype: typePTR, class: classIN}}}
+	parsed, err := parseMessage(query.encode())
+	if err != nil {
+		t.Fatalf("parse query: %v", err)
+	}
+
+	reply, unicast := r.reply(ic, parsed, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 30), Port: 50000})
+	if reply == nil || !unicast {
+		t.Fatalf("reply = %v, unicast = %v; want a unicast reply", reply, unicast)
+	}
+	if reply.id != 7 || len(reply.questions) != 1 {
+		t.Fatalf("one-shot reply should echo the query's id and question, got id %d and %d questions", reply.id, len(reply.questions))
+	}
+	response, err := parseMessage(reply.encode())
+	if err != nil {
+		t.Fatalf("parse reply: %v", err)
+	}
+	for _, rec := range append(response.answers, response.additionals...) {
+		if rec.ttl > legacyTTL || rec.class&cacheFlush != 0 {
+			t.Fatalf("one-shot reply record %s type %d has ttl %d class %#x", rec.name, rec.rtype, rec.ttl, rec.class)
+		}
+	}
+
+	b := newBrowser(serviceName("_shadow._tcp"))
+	b.add(response, net.IPv4(192, 168, 1, 20))
+	entries := b.entries()
+	if len(entries) != 1 {
+		t.Fatalf("entries = %+v, want one", entries)
+	}
+	entry := entries[0]
+	if entry.Instance != "shadow-abc123" || entry.Port != 8443 || !entry.Addr.Equal(net.IPv4(192, 168, 1, 20)) {
+		t.Fatalf("entry = %+v", entry)
+	}
+	if entry.Text["name"] != "project" || entry.Text["user"] != "alice" {
+		t.Fatalf("entry text = %v", entry.Text)
+	}
+}
+
+func TestResponderIgnoresOtherServices(t *testing.T) {
+	r := &Responder{service: Service{Type: "_shadow._tcp", Port: 1}, instance: "shadow-1._shadow._tcp.local.", host: "shadow-1.local."}
+	query := &message{questions: []question{{name: "_http._tcp.local.", qtype: typePTR, class: classIN}}}
+	if reply, _ := r.reply(&interfaceConn{}, query, &net.UDPAddr{Port: Port}); reply != nil {
+		t.Fatalf("reply to another service's query: %+v", reply)
+	}
+}
+
+func TestBrowserDropsInstanceOnGoodbye(t *testing.T) {
+	r := &Responder{service: Service{Type: "_shadow._tcp", Port: 1}, instance: "shadow-1._shadow._tcp.local.", host: "shadow-1.local."}
+	ic := &interfaceConn{}
+	b := newBrowser(serviceName("_shadow._tcp"))
+	announcement, _ := parseMessage((&message{flags: flagResponse, answers: r.records(ic, false)}).encode())
+	b.add(announcement, net.IPv4(10, 0, 0, 2))
+	if len(b.entries()) != 1 {
+		t.Fatalf("announced instance not found")
+	}
+	goodbye, _ := parseMessage((&message{flags: flagResponse, answers: []record{r.ptrRecord(0)}}).encode())
+	b.add(goodbye, net.IPv4(10, 0, 0, 2))
+	if entries := b.entries(); len(entries) != 0 {
+		t.Fatalf("entries after goodbye = %+v", entries)
+	}
+}
+
+func TestParseMessageFollowsCompressedNames(t *testing.T) {
+	// A PTR answer for _shadow._tcp.local. whose data points back into the
+	// question's name, as other responders write it.
+	packet := []byte{0, 0, 0x84, 0, 0, 1, 0, 1, 0, 0, 0, 0}
+	packet = appendName(packet, "_shadow._tcp.local.")
+	packet = binary.BigEndian.AppendUint16(packet, typePTR)
+	packet = binary.BigEndian.AppendUint16(packet, classIN)
+	packet = append(packet, 0xC0, 12) // answer name: pointer to the question
+	packet = binary.BigEndian.AppendUint16(packet, typePTR)
+	packet = binary.BigEndian.AppendUint16(packet, classIN)
+	packet = binary.BigEndian.AppendUint32(packet, 120)
+	data := append([]byte{4, 'd', 'e', 'm', 'o'}, 0xC0, 12)
+	packet = binary.BigEndian.AppendUint16(packet, uint16(len(data)))
+	packet = append(packet, data...)
+
+	m, err := parseMessage(packet)
+	if err != nil {
+		t.Fatalf("parseMessage: %v", err)
+	}
+	if len(m.answers) != 1 || m.answers[0].name != "_shadow._tcp.local." {
+		t.Fatalf("answers = %+v", m.answers)
+	}
+	target, err := m.parsePTR(m.answers[0])
+	if err != nil || target != "demo._shadow._tcp.local." {
+		t.Fatalf("parsePTR = %q, %v", target, err)
+	}
+}
+
+func TestParseMessageRejectsMalformedPackets(t *testing.T) {
+	valid := (&message{questions: []question{{name: "_shadow._tcp.local.", qtype: typePTR, class: classIN}}}).encode()
+	for i := 0; i < len(valid); i++ {
+		if _, err := parseMessage(valid[:i]); err == nil {
+			t.Fatalf("truncated packet of %d bytes parsed", i)
+		}
+	}
+	loop := []byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xC0, 12, 0, 12, 0, 1}
+	if _, err := parseMessage(loop); err == nil {
+		t.Fatalf("packet with a compression loop parsed")
+	}
+}
+
+func TestBrowseFindsAdvertisedService(t *testing.T) {
+	responder, err := Advertise(Service{Type: "_shadowtest._tcp", Port: 9000, Text: map[string]string{"name": "project"}})
+	if err != nil {
+		t.Skipf("cannot advertise on this machine: %v", err)
+	}
+	defer responder.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	entries, err := Browse(ctx, "_shadowtest._tcp")
+	if err != nil {
+		t.Fatalf("Browse: %v", err)
+	}
+	if len(entries) == 0 {
+		t.Skip("no multicast delivery on this machine")
+	}
+	if entries[0].Port != 9000 || entries[0].Text["name"] != "project" {
+		t.Fatalf("entries = %+v", entries)
+	}
+}
@@ -0,0 +1,278 @@
+package mdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// Record types and classes used by DNS-SD.
+const (
+	typeA   = 1
+	typePTR = 12
+	typeTXT = 16
+	typeSRV = 33
+	typeANY = 255
+
+	classIN = 1
+	// cacheFlush marks a record this responder owns outright; unicastBit is
+	// the same bit in a question, asking for a unicast reply.
+	cacheFlush = 0x8000
+	unicastBit = 0x8000
+
+	flagResponse = 0x8400 // QR and AA
+)
+
+var errMalformed = errors.New("malformed DNS message")
+
+type question struct {
+	name  string
+	qtype uint16
+	class uint16
+}
+
+// record is a resource record. Data is kept as sent, since names inside it
+// may be compressed against the rest of the message; parse records with the
+// message they came from. Offset is where data starts in that message.
+type record struct {
+	name   string
+	rtype  uint16
+	class  uint16
+	ttl    uint32
+	data   []byte
+	offset int
+}
+
+type message struct {
+	id        uint16
+	flags     uint16
+	questions []question
+	answers   []record
+	// additionals also holds authority records, which mDNS does not use.
+	additionals []record
+	// raw is the packet a parsed message came from.
+	raw []byte
+}
+
+func (m *message) response() bool {
+	return m.flags&0x8000 != 0
+}
+
+// encode builds the packet for m. Names are written without compression.
+func (m *message) encode() []byte {
+	out := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(out[0:], m.id)
+	binary.BigEndian.PutUint16(out[2:], m.flags)
+	binary.BigEndian.PutUint16(out[4:], uint16(len(m.questions)))
+	binary.BigEndian.PutUint16(out[6:], uint16(len(m.answers)))
+	binary.BigEndian.PutUint16(out[10:], uint16(len(m.additionals)))
+	for _, q := range m.questions {
+		out = appendName(out, q.name)
+		out = binary.BigEndian.AppendUint16(out, q.qtype)
+		out = binary.BigEndian.AppendUint16(out, q.class)
+	}
+	for _, records := range [][]record{m.answers, m.additionals} {
+		for _, r := range records {
+			out = appendName(out, r.name)
+			out = binary.BigEndian.AppendUint16(out, r.rtype)
+			out = binary.BigEndian.AppendUint16(out, r.class)
+			out = binary.BigEndian.AppendUint32(out, r.ttl)
+			out = binary.BigEndian.AppendUint16(out, uint16(len(r.data)))
+			out = append(out, r.data...)
+		}
+	}
+	return out
+}
+
+// parseMessage reads a packet. It fails on anything truncated or malformed
+// rather than returning part of it.
+func parseMessage(packet []byte) (*message, error) {
+	if len(packet) < 12 {
+		return nil, errMalformed
+	}
+	m := &message{
+		id:    binary.BigEndian.Uint16(packet[0:]),
+		flags: binary.BigEndian.Uint16(packet[2:]),
+		raw:   packet,
+	}
+	counts := [4]int{}
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(packet[4+2*i:]))
+	}
+	offset := 12
+	for i := 0; i < counts[0]; i++ {
+		name, next, err := readName(packet, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(packet) {
+			return nil, errMalformed
+		}
+		m.questions = append(m.questions, question{
+			name:  name,
+			qtype: binary.BigEndian.Uint16(packet[next:]),
+			class: binary.BigEndian.Uint16(packet[next+2:]),
+		})
+		offset = next + 4
+	}
+	for section := 1; section < 4; section++ {
+		for i := 0; i < counts[section]; i++ {
+			name, next, err := readName(packet, offset)
+			if err != nil {
+				return nil, err
+			}
+			if next+10 > len(packet) {
+				return nil, errMalformed
+			}
+			length := int(binary.BigEndian.Uint16(packet[next+8:]))
+			start := next + 10
+			if start+length > len(packet) {
+				return nil, errMalformed
+			}
+			r := record{
+				name:   name,
+				rtype:  binary.BigEndian.Uint16(packet[next:]),
+				class:  binary.BigEndian.Uint16(packet[next+2:]),
+				ttl:    binary.BigEndian.Uint32(packet[next+4:]),
+				data:   packet[start : start+length],
+				offset: start,
+			}
+			if section == 1 {
+				m.answers = append(m.answers, r)
+			} else {
+				m.additionals = append(m.additionals, r)
+			}
+			offset = start + length
+		}
+	}
+	return m, nil
+}
+
+// appendName writes a dotted name as DNS labels. Labels longer than a DNS
+// label allows are cut short.
+func appendName(out []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		out = append(out, byte(len(label)))
+		out = append(out, label...)
+	}
+	return append(out, 0)
+}
+
+// readName reads the name at offset, following compression pointers, and
+// returns it with a trailing dot and the offset just past it.
+func readName(packet []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if offset >= len(packet) {
+			return "", 0, errMalformed
+		}
+		length := int(packet[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xC0 == 0xC0:
+			if offset+1 >= len(packet) {
+				return "", 0, errMalformed
+			}
+			// A packet can only point backwards so far; more jumps than that
+			// is a loop.
+			if jumps++; jumps > len(packet)/2 {
+				return "", 0, errMalformed
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(packet[offset:]) & 0x3FFF)
+		case length&0xC0 != 0:
+			return "", 0, errMalformed
+		default:
+			if offset+1+length > len(packet) {
+				return "", 0, errMalformed
+			}
+			labels = append(labels, string(packet[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+// sameName compares DNS names, which are case-insensitive.
+func sameName(a, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, "."), strings.TrimSuffix(b, "."))
+}
+
+func ptrData(target string) []byte {
+	return appendName(nil, target)
+}
+
+func srvData(port int, target string) []byte {
+	out := make([]byte, 6, 6+len(target)+2)
+	binary.BigEndian.PutUint16(out[4:], uint16(port))
+	return appendName(out, target)
+}
+
+// txtData encodes key=value strings. An empty TXT record still holds one
+// empty string.
+func txtData(entries []string) []byte {
+	var out []byte
+	for _, entry := range entries {
+		if len(entry) > 255 {
+			entry = entry[:255]
+		}
+		out = append(out, byte(len(entry)))
+		out = append(out, entry...)
+	}
+	if len(out) == 0 {
+		out = []byte{0}
+	}
+	return out
+}
+
+// parsePTR returns the name a PTR record in m points to.
+func (m *message) parsePTR(r record) (string, error) {
+	name, _, err := readName(m.raw, r.offset)
+	return name, err
+}
+
+// parseSRV returns the port and target host of an SRV record in m.
+func (m *message) parseSRV(r record) (int, string, error) {
+	if len(r.data) < 7 {
+		return 0, "", errMalformed
+	}
+	target, _, err := readName(m.raw, r.offset+6)
+	if err != nil {
+		return 0, "", err
+	}
+	return int(binary.BigEndian.Uint16(r.data[4:])), target, nil
+}
+
+func parseTXT(data []byte) (map[string]string, error) {
+	text := map[string]string{}
+	for len(data) > 0 {
+		length := int(data[0])
+		if 1+length > len(data) {
+			return nil, errMalformed
+		}
+		entry := string(data[1 : 1+length])
+		data = data[1+length:]
+		if entry == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(entry, "=")
+		key = strings.ToLower(key)
+		// RFC 6763 says only the first of a repeated key counts.
+		if _, ok := text[key]; !ok {
+			text[key] = value
+		}
+	}
+	return text, nil
+}
@@ -0,0 +1,98 @@
+package opener
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// neovim is reached through a running instance's RPC socket, so it is not in
+// knownEditors: launching it from the background would have no terminal.
+var neovim = Editor{"Neovim", "nvim"}
+
+// jetBrainsEditors take the line as a flag rather than a file:line suffix.
+var jetBrainsEditors = map[string]bool{
+	"idea": true, "goland": true, "webstorm": true, "pycharm": true, "clion": true,
+	"phpstorm": true, "rubymine": true, "rider": true, "rustrover": true,
+}
+
+// Preferred picks the editor to open locations in. A non-empty command
+// selects that editor; otherwise the editor shadow is running inside wins,
+// then the first installed one.
+func Preferred(command string) (Editor, error) {
+	if command != "" {
+		if command == neovim.Command {
+			return neovim, nil
+		}
+		for _, e := range knownEditors {
+			if e.Command == command {
+				return e, nil
+			}
+		}
+		return Editor{Name: command, Command: command}, nil
+	}
+	if nvimServer() != "" {
+		return neovim, nil
+	}
+	if os.Getenv("TERM_PROGRAM") == "vscode" {
+		if _, err := exec.LookPath("code"); err == nil {
+			return knownEditors[0], nil
+		}
+	}
+	for _, e := range knownEditors {
+		if _, err := exec.LookPath(e.Command); err == nil {
+			return e, nil
+		}
+	}
+	return Editor{}, fmt.Errorf("no supported editor found on PATH")
+}
+
+// OpenAt opens file at a one-based line in e, reusing a running window where
+// the editor supports it. It returns without waiting for the editor.
+func OpenAt(e Editor, file string, line int) error {
+	if line < 1 {
+		line = 1
+	}
+	args, err := openAtArgs(e, file, line)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(e.Command, args...)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+func openAtArgs(e Editor, file string, line int) ([]string, error) {
+	location := file + ":" + strconv.Itoa(line)
+	switch {
+	case e.Command == neovim.Command:
+		server := nvimServer()
+		if server == "" {
+			return nil, fmt.Errorf("no running Neovim found; start it with --listen or set NVIM_LISTEN_ADDRESS")
+		}
+		expr := fmt.Sprintf("execute('edit +%d ' .. fnameescape('%s'))", line, strings.ReplaceAll(file, "'", "''"))
+		return []string{"--server", server, "--remote-expr", expr}, nil
+	case e.Command == "code" || e.Command == "cursor" || e.Command == "windsurf" || e.Command == "kiro":
+		return []string{"--reuse-window", "--goto", location}, nil
+	case e.Command == "zed" || e.Command == "subl":
+		return []string{location}, nil
+	case jetBrainsEditors[e.Command]:
+		return []string{"--line", strconv.Itoa(line), file}, nil
+	default:
+		return []string{file}, nil
+	}
+}
+
+// nvimServer returns the RPC address of the Neovim instance shadow runs in,
+// or the one named by NVIM_LISTEN_ADDRESS.
+func nvimServer() string {
+	if server := os.Getenv("NVIM"); server != "" {
+		return server
+	}
+	return os.Getenv("NVIM_LISTEN_ADDRESS")
+}
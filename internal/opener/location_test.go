@@ -0,0 +1,32 @@
+package opener
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOpenAtArgs(t *testing.T) {
+	t.Setenv("NVIM", "/tmp/nvim.sock")
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{"code", []string{"--reuse-window", "--goto", "/src/main.go:80"}},
+		{"subl", []string{"/src/main.go:80"}},
+		{"idea", []string{"--line", "80", "/src/main.go"}},
+		{"nvim", []string{"--server", "/tmp/nvim.sock", "--remote-expr", "execute('edit +80 ' .. fnameescape('/src/main.go'))"}},
+		{"nova", []string{"/src/main.go"}},
+	}
+	for _, test := range tests {
+		got, err := openAtArgs(Editor{Command: test.command}, "/src/main.go", 80)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q (%v), want %q", test.command, got, err, test.want)
+		}
+	}
+
+	t.Setenv("NVIM", "")
+	t.Setenv("NVIM_LISTEN_ADDRESS", "")
+	if _, err := openAtArgs(neovim, "/src/main.go", 1); err == nil {
+		t.Error("opened a file in Neovim without a server to send it to")
+	}
+}
@@ -0,0 +1,65 @@
+package patch
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+)
+
+// base85Alphabet is the alphabet of git's base85 encoding.
+const base85Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz!#$%&()*+-;<=>?@^_`{|}~"
+
+// binaryLineBytes is how many bytes of compressed data one line encodes.
+const binaryLineBytes = 52
+
+// writeBinary writes a git binary patch that replaces old with updated,
+// followed by the reverse hunk so the patch can also be reverted.
+func writeBinary(out *bufio.Writer, old, updated []byte) {
+	out.WriteString("GIT binary patch\n")
+	writeLiteral(out, updated)
+	writeLiteral(out, old)
+}
+
+func writeLiteral(out *bufio.Writer, content []byte) {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(content)
+	zw.Close()
+
+	fmt.Fprintf(out, "literal %d\n", len(content))
+	data := compressed.Bytes()
+	for len(data) > 0 {
+		n := min(len(data), binaryLineBytes)
+		if n <= 26 {
+			out.WriteByte(byte('A' + n - 1))
+		} else {
+			out.WriteByte(byte('a' + n - 27))
+		}
+		writeBase85(out, data[:n])
+		out.WriteByte('\n')
+		data = data[n:]
+	}
+	out.WriteByte('\n')
+}
+
+// writeBase85 encodes data four bytes at a time, zero-padding the last
+// group, as git does.
+func writeBase85(out *bufio.Writer, data []byte) {
+	for len(data) > 0 {
+		var acc uint32
+		for i := 0; i < 4; i++ {
+			acc <<= 8
+			if i < len(data) {
+				acc |= uint32(data[i])
+			}
+		}
+		var group [5]byte
+		for i := 4; i >= 0; i-- {
+			group[i] = base85Alphabet[acc%85]
+			acc /= 85
+		}
+		out.Write(group[:])
+		data = data[min(len(data), 4):]
+	}
+}
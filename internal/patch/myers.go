@@ -0,0 +1,169 @@
+package patch
+
+// opKind is what an edit does to one line.
+type opKind byte
+
+const (
+	opEqual opKind = iota
+	opDelete
+	opInsert
+)
+
+// op is one line of an edit script. a indexes the old lines for equal and
+// delete ops; b indexes the new lines for equal and insert ops.
+type op struct {
+	kind opKind
+	a, b int
+}
+
+// diffLines returns an edit script that turns a into b. It uses Myers'
+// linear-space algorithm, so memory stays proportional to the inputs even
+// when they share little.
+func diffLines(a, b []string) []op {
+	// Compare small integers instead of strings.
+	ids := make(map[string]int, len(a)+len(b))
+	intern := func(lines []string) []int {
+		out := make([]int, len(lines))
+		for i, line := range lines {
+			id, ok := ids[line]
+			if !ok {
+				id = len(ids)
+				ids[line] = id
+			}
+			out[i] = id
+		}
+		return out
+	}
+	d := &differ{a: intern(a), b: intern(b)}
+	d.compare(0, len(a), 0, len(b))
+
+	ops := make([]op, 0, len(a)+len(b))
+	i, j := 0, 0
+	for _, m := range d.matches {
+		for ; i < m[0]; i++ {
+			ops = append(ops, op{kind: opDelete, a: i})
+		}
+		for ; j < m[1]; j++ {
+			ops = append(ops, op{kind: opInsert, b: j})
+		}
+		ops = append(ops, op{kind: opEqual, a: i, b: j})
+		i++
+		j++
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, op{kind: opDelete, a: i})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, op{kind: opInsert, b: j})
+	}
+	return ops
+}
+
+// differ collects the matching lines of a and b in order.
+type differ struct {
+	a, b    []int
+	matches [][2]int
+}
+
+func (d *differ) compare(aLo, aHi, bLo, bHi int) {
+	for aLo < aHi && bLo < bHi && d.a[aLo] == d.b[bLo] {
+		d.matches = append(d.matches, [2]int{aLo, bLo})
+		aLo++
+		bLo++
+	}
+	suffix := 0
+	for aLo < aHi-suffix && bLo < bHi-suffix && d.a[aHi-suffix-1] == d.b[bHi-suffix-1] {
+		suffix++
+	}
+	aEnd, bEnd := aHi-suffix, bHi-suffix
+	if aLo < aEnd && bLo < bEnd {
+		if x, y, ok := d.middleSnake(aLo, aEnd, bLo, bEnd); ok {
+			d.compare(aLo, x, bLo, y)
+			d.compare(x, aEnd, y, bEnd)
+		}
+	}
+	for i := 0; i < suffix; i++ {
+		d.matches = append(d.matches, [2]int{aEnd + i, bEnd + i})
+	}
+}
+
+// middleSnake finds where an optimal path through the edit graph of
+// a[aLo:aHi] and b[bLo:bHi] crosses its middle diagonal, searching from both
+// ends at once. ok is false when the ranges have nothing in common.
+func (d *differ) middleSnake(aLo, aHi, bLo, bHi int) (x, y int, ok bool) {
+	n, m := aHi-aLo, bHi-bLo
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	size := 2*maxD + 2
+	forward := make([]int, size)
+	backward := make([]int, size)
+	for i := range forward {
+		forward[i] = -1
+		backward[i] = -1
+	}
+	forward[offset+1] = 0
+	backward[offset+1] = 0
+	delta := n - m
+	odd := delta%2 != 0
+	kStart, kEnd, rStart, rEnd := 0, 0, 0, 0
+
+	for step := 0; step < maxD; step++ {
+		for k := -step + kStart; k <= step-kEnd; k += 2 {
+			i := offset + k
+			var x1 int
+			if k == -step || (k != step && forward[i-1] < forward[i+1]) {
+				x1 = forward[i+1]
+			} else {
+				x1 = forward[i-1] + 1
+			}
+			y1 := x1 - k
+			for x1 < n && y1 < m && d.a[aLo+x1] == d.b[bLo+y1] {
+				x1++
+				y1++
+			}
+			forward[i] = x1
+			switch {
+			case x1 > n:
+				kEnd += 2
+			case y1 > m:
+				kStart += 2
+			case odd:
+				j := offset + delta - k
+				if j >= 0 && j < size && backward[j] != -1 && x1 >= n-backward[j] {
+					return aLo + x1, bLo + y1, true
+				}
+			}
+		}
+		for k := -step + rStart; k <= step-rEnd; k += 2 {
+			i := offset + k
+			var x2 int
+			if k == -step || (k != step && backward[i-1] < backward[i+1]) {
+				x2 = backward[i+1]
+			} else {
+				x2 = backward[i-1] + 1
+			}
+			y2 := x2 - k
+			for x2 < n && y2 < m && d.a[aHi-x2-1] == d.b[bHi-y2-1] {
+				x2++
+				y2++
+			}
+			backward[i] = x2
+			switch {
+			case x2 > n:
+				rEnd += 2
+			case y2 > m:
+				rStart += 2
+			case !odd:
+				j := offset + delta - k
+				if j >= 0 && j < size && forward[j] != -1 {
+					x1 := forward[j]
+					y1 := offset + x1 - j
+					if x1 >= n-x2 {
+						return aLo + x1, bLo + y1, true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,243 @@
+// Package patch writes file changes as a git-style unified diff that
+// `git apply` accepts, with binary files as git binary patches.
+package patch
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// context is how many unchanged lines surround each hunk.
+const context = 3
+
+// binarySniffBytes is how much of a file is checked for NUL bytes, as git
+// does, to decide whether it is binary.
+const binarySniffBytes = 8000
+
+// File is one changed path. Created and Deleted mark files that did not
+// exist before or do not exist after; their Old or New content is ignored.
+type File struct {
+	Path    string
+	Old     []byte
+	New     []byte
+	OldMode os.FileMode
+	NewMode os.FileMode
+	Created bool
+	Deleted bool
+}
+
+// Write writes files as one patch.
+func Write(w io.Writer, files []File) error {
+	out := bufio.NewWriter(w)
+	for _, file := range files {
+		writeFile(out, file)
+	}
+	return out.Flush()
+}
+
+func writeFile(out *bufio.Writer, file File) {
+	oldName, newName := quotePath("a/"+file.Path), quotePath("b/"+file.Path)
+	fmt.Fprintf(out, "diff --git %s %s\n", oldName, newName)
+	oldHash, newHash := blobHash(file.Old), blobHash(file.New)
+	switch {
+	case file.Created:
+		oldHash = zeroHash
+		fmt.Fprintf(out, "new file mode %s\n", gitMode(file.NewMode))
+	case file.Deleted:
+		newHash = zeroHash
+		fmt.Fprintf(out, "deleted file mode %s\n", gitMode(file.OldMode))
+	case gitMode(file.OldMode) != gitMode(file.NewMode):
+		fmt.Fprintf(out, "old mode %s\nnew mode %s\n", gitMode(file.OldMode), gitMode(file.NewMode))
+	}
+	var old, updated []byte
+	if !file.Created {
+		old = file.Old
+	}
+	if !file.Deleted {
+		updated = file.New
+	}
+	if bytes.Equal(old, updated) && !file.Created && !file.Deleted {
+		// Only the mode changed.
+		return
+	}
+
+	modeSuffix := ""
+	if !file.Created && !file.Deleted && gitMode(file.OldMode) == gitMode(file.NewMode) {
+		modeSuffix = " " + gitMode(file.NewMode)
+	}
+	if isBinary(old) || isBinary(updated) {
+		// git only applies binary patches with the full preimage hash.
+		fmt.Fprintf(out, "index %s..%s%s\n", oldHash, newHash, modeSuffix)
+		writeBinary(out, old, updated)
+		return
+	}
+	fmt.Fprintf(out, "index %s..%s%s\n", oldHash[:7], newHash[:7], modeSuffix)
+	if len(old) == 0 && len(updated) == 0 {
+		return
+	}
+	fromName, toName := oldName, newName
+	if file.Created {
+		fromName = "/dev/null"
+	}
+	if file.Deleted {
+		toName = "/dev/null"
+	}
+	fmt.Fprintf(out, "--- %s\n+++ %s\n", fromName, toName)
+	writeHunks(out, splitLines(old), splitLines(updated))
+}
+
+// writeHunks writes the changes between a and b with context lines, merging
+// changes close enough to share their context.
+func writeHunks(out *bufio.Writer, a, b []string) {
+	ops := diffLines(a, b)
+	for start := 0; start < len(ops); {
+		for start < len(ops) && ops[start].kind == opEqual {
+			start++
+		}
+		if start == len(ops) {
+			return
+		}
+		// Extend the hunk while the next change is within two contexts.
+		end := start
+		for i := start; i < len(ops); i++ {
+			if ops[i].kind != opEqual {
+				end = i + 1
+				continue
+			}
+			if i-end >= 2*context {
+				break
+			}
+		}
+		first := max(start-context, 0)
+		last := min(end+context, len(ops))
+		writeHunk(out, a, b, ops[first:last])
+		start = last
+	}
+}
+
+func writeHunk(out *bufio.Writer, a, b []string, ops []op) {
+	aStart, bStart := -1, -1
+	aCount, bCount := 0, 0
+	for _, o := range ops {
+		if o.kind != opInsert {
+			if aStart < 0 {
+				aStart = o.a
+			}
+			aCount++
+		}
+		if o.kind != opDelete {
+			if bStart < 0 {
+				bStart = o.b
+			}
+			bCount++
+		}
+	}
+	// A side with no lines in the hunk is empty, and git numbers it 0.
+	aStart++
+	bStart++
+	fmt.Fprintf(out, "@@ -%s +%s @@\n", hunkRange(aStart, aCount), hunkRange(bStart, bCount))
+	for _, o := range ops {
+		switch o.kind {
+		case opEqual:
+			writeLine(out, ' ', a[o.a])
+		case opDelete:
+			writeLine(out, '-', a[o.a])
+		case opInsert:
+			writeLine(out, '+', b[o.b])
+		}
+	}
+}
+
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return strconv.Itoa(start)
+	}
+	return strconv.Itoa(start) + "," + strconv.Itoa(count)
+}
+
+func writeLine(out *bufio.Writer, prefix byte, line string) {
+	out.WriteByte(prefix)
+	out.WriteString(line)
+	if !strings.HasSuffix(line, "\n") {
+		out.WriteString("\n\\ No newline at end of file\n")
+	}
+}
+
+// splitLines splits content after each newline, keeping them so a missing
+// final newline counts as a change.
+func splitLines(content []byte) []string {
+	var lines []string
+	for len(content) > 0 {
+		n := bytes.IndexByte(content, '\n') + 1
+		if n == 0 {
+			n = len(content)
+		}
+		lines = append(lines, string(content[:n]))
+		content = content[n:]
+	}
+	return lines
+}
+
+func isBinary(content []byte) bool {
+	return bytes.IndexByte(content[:min(len(content), binarySniffBytes)], 0) >= 0
+}
+
+const zeroHash = "0000000000000000000000000000000000000000"
+
+// blobHash is the object name git gives content.
+func blobHash(content []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(content))
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func gitMode(mode os.FileMode) string {
+	if mode&0o111 != 0 {
+		return "100755"
+	}
+	return "100644"
+}
+
+// quotePath quotes a name the way git does when it holds characters that
+// would be ambiguous in a patch header.
+func quotePath(name string) string {
+	needsQuote := false
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < 0x20 || c >= 0x7f || c == '"' || c == '\\' {
+			needsQuote = true
+			break
+		}
+	}
+	if !needsQuote {
+		return name
+	}
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; c {
+		case '"', '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+		case '\t':
+			quoted.WriteString(`\t`)
+		case '\n':
+			quoted.WriteString(`\n`)
+		default:
+			if c < 0x20 || c >= 0x7f {
+				fmt.Fprintf(&quoted, "\\%03o", c)
+			} else {
+				quoted.WriteByte(c)
+			}
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
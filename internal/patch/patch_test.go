@@ -0,0 +1,144 @@
+package patch
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiffLinesFindsLongestCommonSubsequence(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, rng.Intn(40))
+		for i := range lines {
+			lines[i] = string(rune('a' + rng.Intn(4)))
+		}
+		return lines
+	}
+	for round := 0; round < 500; round++ {
+		a, b := randomLines(), randomLines()
+		ops := diffLines(a, b)
+
+		var rebuilt []string
+		equal := 0
+		for _, o := range ops {
+			switch o.kind {
+			case opEqual:
+				if a[o.a] != b[o.b] {
+					t.Fatalf("matched %q with %q", a[o.a], b[o.b])
+				}
+				rebuilt = append(rebuilt, a[o.a])
+				equal++
+			case opInsert:
+				rebuilt = append(rebuilt, b[o.b])
+			}
+		}
+		if strings.Join(rebuilt, "") != strings.Join(b, "") {
+			t.Fatalf("edit script of %q -> %q rebuilds %q", a, b, rebuilt)
+		}
+		if want := lcsLength(a, b); equal != want {
+			t.Fatalf("%q -> %q kept %d lines, want %d", a, b, equal, want)
+		}
+	}
+}
+
+func lcsLength(a, b []string) int {
+	table := make([][]int, len(a)+1)
+	for i := range table {
+		table[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				table[i][j] = table[i+1][j+1] + 1
+			} else {
+				table[i][j] = max(table[i+1][j], table[i][j+1])
+			}
+		}
+	}
+	return table[0][0]
+}
+
+func TestWriteProducesPatchGitApplies(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	var long, longChanged strings.Builder
+	for i := 1; i <= 40; i++ {
+		fmt.Fprintf(&long, "line %d\n", i)
+		switch i {
+		case 2:
+			longChanged.WriteString("line two\n")
+		case 30:
+		default:
+			fmt.Fprintf(&longChanged, "line %d\n", i)
+		}
+	}
+	binary := []byte{0x89, 'P', 'N', 'G', 0, 1, 2, 3}
+	binaryChanged := append(bytes.Repeat([]byte{0, 7}, 500), 'x')
+
+	files := []File{
+		{Path: "long.txt", Old: []byte(long.String()), New: []byte(longChanged.String()), OldMode: 0o644, NewMode: 0o644},
+		{Path: "no newline.txt", Old: []byte("a\nb"), New: []byte("a\nc"), OldMode: 0o644, NewMode: 0o644},
+		{Path: "src/new.go", New: []byte("package src\n"), NewMode: 0o644, Created: true},
+		{Path: "empty", NewMode: 0o644, Created: true},
+		{Path: "gone.txt", Old: []byte("bye\n"), OldMode: 0o644, Deleted: true},
+		{Path: "run.sh", Old: []byte("echo hi\n"), New: []byte("echo hi\n"), OldMode: 0o644, NewMode: 0o755},
+		{Path: "logo.png", Old: binary, New: binaryChanged, OldMode: 0o644, NewMode: 0o644},
+		{Path: "data.bin", New: binary, NewMode: 0o644, Created: true},
+		{Path: "café.txt", Old: []byte("x\n"), New: []byte("y\n"), OldMode: 0o644, NewMode: 0o644},
+	}
+
+	dir := t.TempDir()
+	for _, file := range files {
+		if file.Created {
+			continue
+		}
+		path := filepath.Join(dir, filepath.FromSlash(file.Path))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, file.Old, file.OldMode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var patch bytes.Buffer
+	if err := Write(&patch, files); err != nil {
+		t.Fatal(err)
+	}
+	patchPath := filepath.Join(t.TempDir(), "session.patch")
+	if err := os.WriteFile(patchPath, patch.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	apply := exec.Command("git", "apply", "--unsafe-paths", patchPath)
+	apply.Dir = dir
+	if output, err := apply.CombinedOutput(); err != nil {
+		t.Fatalf("git apply failed: %v\n%s\npatch:\n%s", err, output, patch.String())
+	}
+
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file.Path))
+		got, err := os.ReadFile(path)
+		if file.Deleted {
+			if !os.IsNotExist(err) {
+				t.Errorf("%s was not deleted", file.Path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", file.Path, err)
+			continue
+		}
+		if !bytes.Equal(got, file.New) {
+			t.Errorf("%s = %q, want %q", file.Path, got, file.New)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dir, "run.sh")); err == nil && info.Mode()&0o100 == 0 {
+		t.Error("run.sh did not become executable")
+	}
+}
@@ -5,10 +5,11 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
-	WebSocketSubprotocol      = "shadow-v2"
+	WebSocketSubprotocol      = "shadow-v3"
 	SyncProtocolVersion       = 2
 	ControlChannel            = "__shadow_control__"
 	EncryptedChannel          = "__shadow_e2e__"
@@ -16,12 +17,67 @@ const (
 	TargetedEncryptedChannel  = "__shadow_e2e_target__"
 	BootstrapEncryptedChannel = "__shadow_e2e_bootstrap__"
 	SyncDoneChannel           = "__shadow_sync_done__"
+	HostEncryptedChannel      = "__shadow_e2e_host__"
+	FromEncryptedChannel      = "__shadow_e2e_from__"
+	DirectEncryptedChannel    = "__shadow_e2e_direct__"
+	BroadcastEncryptedChannel = "__shadow_e2e_broadcast__"
+	PeerEncryptedChannel      = "__shadow_e2e_peer__"
+	SnapshotEncryptedChannel  = "__shadow_e2e_snapshot__"
+	SnapshotDoneChannel       = "__shadow_snapshot_done__"
 	ReadOnlyJoinersKey        = "read_only_joiners"
+	ApproveJoinerEditsKey     = "approve_joiner_edits"
 	PeerCountKey              = "peer_count"
+	PeerIDKey                 = "peer_id"
 	SyncRequestKey            = "sync_request"
 	SyncBaselineKey           = "sync_baseline"
 	SyncCompleteKey           = "sync_complete"
+	HostPresentKey            = "host_present"
+	PromotedKey               = "promoted"
+	PeerJoinedKey             = "peer_joined"
+	PeerLeftKey               = "peer_left"
+	LimitsKey                 = "limits"
+	SnapshotCacheKey          = "snapshot_cache"
+	SnapshotRefreshKey        = "snapshot_refresh"
 	BootstrapManifestType     = "manifest"
+	StateDigestType           = "digest"
+	RepairRequestType         = "repair_request"
+	BlobRequestType           = "blob_request"
+	BlobResponseType          = "blob"
+	ProposalResultType        = "proposal_result"
+	WriteRejectedType         = "write_rejected"
+	ProfileType               = "profile"
+	PresenceType              = "presence"
+	ChatType                  = "chat"
+	FocusType                 = "focus"
+	TerminalOutputType        = "terminal_output"
+	TerminalRequestType       = "terminal_request"
+	TerminalInputType         = "terminal_input"
+	ForwardsType              = "forwards"
+	TunnelType                = "tunnel"
+	TasksType                 = "tasks"
+	TaskRunType               = "task_run"
+	TaskOutputType            = "task_output"
+	// MaxTerminalBytes bounds the data in one terminal message.
+	MaxTerminalBytes = 64 * 1024
+	// MaxTunnelBytes bounds the data in one tunnel message.
+	MaxTunnelBytes  = 32 * 1024
+	maxForwardPorts = 64
+	// MaxTaskOutputBytes bounds the output in one task output message.
+	MaxTaskOutputBytes = 32 * 1024
+	maxTasks           = 64
+	maxTaskName        = 64
+	// MaxChatBytes bounds one chat message, enough for a long stack trace.
+	MaxChatBytes    = 16 * 1024
+	maxMessagePaths = 100000
+	maxProfileField = 64
+)
+
+const (
+	// ResumeHeader carries the last ordered sequence a reconnecting host
+	// applied, so the relay can replay what it missed.
+	ResumeHeader = "X-Shadow-Resume"
+	// StandbyHeader marks a joiner willing to take over as host.
+	StandbyHeader = "X-Shadow-Standby"
 )
 
 type SyncOperation struct {
@@ -32,6 +88,9 @@ type SyncOperation struct {
 	DesiredHash string `json:"desired_hash"`
 	Delete      bool   `json:"delete,omitempty"`
 	Content     []byte `json:"content,omitempty"`
+	// ContentRef marks an operation whose content is omitted because peers
+	// already hold the blob with hash DesiredHash.
+	ContentRef bool `json:"content_ref,omitempty"`
 }
 
 type BootstrapManifest struct {
@@ -40,6 +99,192 @@ type BootstrapManifest struct {
 	Paths       []string `json:"paths"`
 	Directories []string `json:"directories,omitempty"`
 	SingleFile  string   `json:"single_file,omitempty"`
+	// Files and Bytes count the file contents that will follow the manifest.
+	// They are estimates used for progress reporting only.
+	Files int   `json:"files,omitempty"`
+	Bytes int64 `json:"bytes,omitempty"`
+}
+
+// StateDigest lists the host's committed path states after the operation with
+// the given sequence. Joiners compare it against their own committed states.
+type StateDigest struct {
+	Version  int               `json:"v"`
+	Type     string            `json:"type"`
+	Sequence uint64            `json:"sequence"`
+	States   map[string]string `json:"states"`
+}
+
+// RepairRequest asks the host to resend the listed paths. States holds the
+// requester's committed state for each path so the resend applies cleanly.
+type RepairRequest struct {
+	Version int               `json:"v"`
+	Type    string            `json:"type"`
+	States  map[string]string `json:"states"`
+}
+
+// BlobRequest asks the host for content referenced by an operation. Path is
+// a hint for where the host may still have the bytes on disk.
+type BlobRequest struct {
+	Version int    `json:"v"`
+	Type    string `json:"type"`
+	Hash    string `json:"hash"`
+	Path    string `json:"path"`
+}
+
+// BlobResponse answers a BlobRequest. Missing is set when the host no longer
+// has the content.
+type BlobResponse struct {
+	Version int    `json:"v"`
+	Type    string `json:"type"`
+	Hash    string `json:"hash"`
+	Content []byte `json:"content,omitempty"`
+	Missing bool   `json:"missing,omitempty"`
+}
+
+// ProposalResult tells a joiner whether the host accepted one of its
+// operations when joiner edits need approval.
+type ProposalResult struct {
+	Version     int    `json:"v"`
+	Type        string `json:"type"`
+	OperationID string `json:"operation_id"`
+	Path        string `json:"path"`
+	Approved    bool   `json:"approved"`
+}
+
+// WriteRejected tells a joiner that the host's write policy blocked one of its
+// operations and that the host is reverting the path.
+type WriteRejected struct {
+	Version     int    `json:"v"`
+	Type        string `json:"type"`
+	OperationID string `json:"operation_id"`
+	Path        string `json:"path"`
+}
+
+// Profile describes a peer to the rest of the session. It travels encrypted,
+// so the relay never sees names.
+type Profile struct {
+	Version       int    `json:"v"`
+	Type          string `json:"type"`
+	Name          string `json:"name"`
+	Editor        string `json:"editor,omitempty"`
+	ClientVersion string `json:"client_version,omitempty"`
+}
+
+// Position is a zero-based line and column. Columns count UTF-16 code units,
+// as in the Language Server Protocol.
+type Position struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+type Selection struct {
+	Start Position `json:"start"`
+	End   Position `json:"end"`
+}
+
+// Presence reports where a peer's cursor is. An empty Path means the peer has
+// no shared file focused. It is broadcast unordered and may be dropped.
+type Presence struct {
+	Version   int        `json:"v"`
+	Type      string     `json:"type"`
+	Path      string     `json:"path,omitempty"`
+	Line      int        `json:"line,omitempty"`
+	Column    int        `json:"column,omitempty"`
+	Selection *Selection `json:"selection,omitempty"`
+}
+
+// Focus asks the other peers to look at a location. Line is zero-based, as in
+// Presence.
+type Focus struct {
+	Version int    `json:"v"`
+	Type    string `json:"type"`
+	Path    string `json:"path"`
+	Line    int    `json:"line,omitempty"`
+}
+
+// TerminalOutput carries output of the host's shared terminal. Offset is the
+// position of Data in everything the terminal has written, so a peer can tell
+// when it missed output. History marks a replay of recent output sent in
+// answer to a TerminalRequest. Closed means the terminal has exited, or for a
+// History reply that none is shared.
+type TerminalOutput struct {
+	Version  int    `json:"v"`
+	Type     string `json:"type"`
+	Offset   uint64 `json:"offset"`
+	Data     []byte `json:"data,omitempty"`
+	History  bool   `json:"history,omitempty"`
+	Writable bool   `json:"writable,omitempty"`
+	Closed   bool   `json:"closed,omitempty"`
+}
+
+// TerminalRequest asks the host to replay recent terminal output. Data is
+// empty; TerminalInput reuses the shape to carry keystrokes.
+type TerminalRequest struct {
+	Version int    `json:"v"`
+	Type    string `json:"type"`
+	Data    []byte `json:"data,omitempty"`
+}
+
+// Forwards lists the host's localhost ports a session forwards to joiners.
+type Forwards struct {
+	Version int    `json:"v"`
+	Type    string `json:"type"`
+	Ports   []int  `json:"ports"`
+}
+
+// Tunnel carries one forwarded TCP connection. A joiner opens a stream by
+// sending Port with a new Stream number. Both sides then send Data, Ack the
+// bytes they have written to their end of the connection, and Close once
+// their end stops sending. Error explains a Close the other side did not ask
+// for.
+type Tunnel struct {
+	Version int    `json:"v"`
+	Type    string `json:"type"`
+	Stream  uint64 `json:"stream"`
+	Port    int    `json:"port,omitempty"`
+	Data    []byte `json:"data,omitempty"`
+	Ack     int    `json:"ack,omitempty"`
+	Close   bool   `json:"close,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Tasks lists the names of the tasks the host lets joiners run.
+type Tasks struct {
+	Version int      `json:"v"`
+	Type    string   `json:"type"`
+	Names   []string `json:"names"`
+}
+
+// TaskRun asks the host to run a task, or with Cancel to stop a run. Run is
+// chosen by the joiner and names the run in the host's replies.
+type TaskRun struct {
+	Version int    `json:"v"`
+	Type    string `json:"type"`
+	Run     uint64 `json:"run"`
+	Task    string `json:"task,omitempty"`
+	Cancel  bool   `json:"cancel,omitempty"`
+}
+
+// TaskOutput streams a run back to the joiner that asked for it. Pending
+// means the run waits for the host to allow it. The last message has Done
+// set, with the exit code or an Error when the task did not run.
+type TaskOutput struct {
+	Version  int    `json:"v"`
+	Type     string `json:"type"`
+	Run      uint64 `json:"run"`
+	Data     []byte `json:"data,omitempty"`
+	Pending  bool   `json:"pending,omitempty"`
+	Done     bool   `json:"done,omitempty"`
+	ExitCode int    `json:"exit_code,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Chat is a message typed by a peer. The relay stamps the sender, so only the
+// text travels.
+type Chat struct {
+	Version int    `json:"v"`
+	Type    string `json:"type"`
+	Text    string `json:"text"`
 }
 
 func EncodeSyncOperation(operation SyncOperation) ([]byte, error) {
@@ -76,13 +321,15 @@ func validOperationID(operationID string) bool {
 	return true
 }
 
-func EncodeBootstrapManifest(paths, directories []string, singleFile string) ([]byte, error) {
+func EncodeBootstrapManifest(paths, directories []string, singleFile string, files int, bytes int64) ([]byte, error) {
 	return json.Marshal(BootstrapManifest{
 		Version:     SyncProtocolVersion,
 		Type:        BootstrapManifestType,
 		Paths:       paths,
 		Directories: directories,
 		SingleFile:  singleFile,
+		Files:       files,
+		Bytes:       bytes,
 	})
 }
 
@@ -97,12 +344,429 @@ func DecodeBootstrapManifest(payload []byte) (BootstrapManifest, bool, error) {
 	if err := json.Unmarshal(payload, &manifest); err != nil {
 		return BootstrapManifest{}, true, fmt.Errorf("invalid bootstrap manifest: %w", err)
 	}
-	if manifest.Version != SyncProtocolVersion || len(manifest.Paths) > 100000 || len(manifest.Directories) > len(manifest.Paths) {
+	if manifest.Version != SyncProtocolVersion || len(manifest.Paths) > maxMessagePaths || len(manifest.Directories) > len(manifest.Paths) ||
+		manifest.Files < 0 || manifest.Files > len(manifest.Paths) || manifest.Bytes < 0 {
 		return BootstrapManifest{}, true, fmt.Errorf("invalid bootstrap manifest")
 	}
 	return manifest, true, nil
 }
 
+func EncodeStateDigest(sequence uint64, states map[string]string) ([]byte, error) {
+	return json.Marshal(StateDigest{
+		Version:  SyncProtocolVersion,
+		Type:     StateDigestType,
+		Sequence: sequence,
+		States:   states,
+	})
+}
+
+func DecodeStateDigest(payload []byte) (StateDigest, bool, error) {
+	if messageType(payload) != StateDigestType {
+		return StateDigest{}, false, nil
+	}
+	var digest StateDigest
+	if err := json.Unmarshal(payload, &digest); err != nil {
+		return StateDigest{}, true, fmt.Errorf("invalid state digest: %w", err)
+	}
+	if digest.Version != SyncProtocolVersion || len(digest.States) > maxMessagePaths {
+		return StateDigest{}, true, fmt.Errorf("invalid state digest")
+	}
+	return digest, true, nil
+}
+
+func EncodeRepairRequest(states map[string]string) ([]byte, error) {
+	return json.Marshal(RepairRequest{
+		Version: SyncProtocolVersion,
+		Type:    RepairRequestType,
+		States:  states,
+	})
+}
+
+func DecodeRepairRequest(payload []byte) (RepairRequest, bool, error) {
+	if messageType(payload) != RepairRequestType {
+		return RepairRequest{}, false, nil
+	}
+	var request RepairRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return RepairRequest{}, true, fmt.Errorf("invalid repair request: %w", err)
+	}
+	if request.Version != SyncProtocolVersion || len(request.States) > maxMessagePaths {
+		return RepairRequest{}, true, fmt.Errorf("invalid repair request")
+	}
+	return request, true, nil
+}
+
+func EncodeBlobRequest(hash, path string) ([]byte, error) {
+	return json.Marshal(BlobRequest{
+		Version: SyncProtocolVersion,
+		Type:    BlobRequestType,
+		Hash:    hash,
+		Path:    path,
+	})
+}
+
+func DecodeBlobRequest(payload []byte) (BlobRequest, bool, error) {
+	if messageType(payload) != BlobRequestType {
+		return BlobRequest{}, false, nil
+	}
+	var request BlobRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return BlobRequest{}, true, fmt.Errorf("invalid blob request: %w", err)
+	}
+	if request.Version != SyncProtocolVersion || request.Hash == "" || request.Path == "" {
+		return BlobRequest{}, true, fmt.Errorf("invalid blob request")
+	}
+	return request, true, nil
+}
+
+func EncodeBlobResponse(hash string, content []byte, missing bool) ([]byte, error) {
+	return json.Marshal(BlobResponse{
+		Version: SyncProtocolVersion,
+		Type:    BlobResponseType,
+		Hash:    hash,
+		Content: content,
+		Missing: missing,
+	})
+}
+
+func DecodeBlobResponse(payload []byte) (BlobResponse, bool, error) {
+	if messageType(payload) != BlobResponseType {
+		return BlobResponse{}, false, nil
+	}
+	var response BlobResponse
+	if err := json.Unmarshal(payload, &response); err != nil {
+		return BlobResponse{}, true, fmt.Errorf("invalid blob response: %w", err)
+	}
+	if response.Version != SyncProtocolVersion || response.Hash == "" || (response.Missing && len(response.Content) != 0) {
+		return BlobResponse{}, true, fmt.Errorf("invalid blob response")
+	}
+	return response, true, nil
+}
+
+func EncodeProposalResult(operationID, path string, approved bool) ([]byte, error) {
+	return json.Marshal(ProposalResult{
+		Version:     SyncProtocolVersion,
+		Type:        ProposalResultType,
+		OperationID: operationID,
+		Path:        path,
+		Approved:    approved,
+	})
+}
+
+func DecodeProposalResult(payload []byte) (ProposalResult, bool, error) {
+	if messageType(payload) != ProposalResultType {
+		return ProposalResult{}, false, nil
+	}
+	var result ProposalResult
+	if err := json.Unmarshal(payload, &result); err != nil {
+		return ProposalResult{}, true, fmt.Errorf("invalid proposal result: %w", err)
+	}
+	if result.Version != SyncProtocolVersion || !validOperationID(result.OperationID) || result.Path == "" {
+		return ProposalResult{}, true, fmt.Errorf("invalid proposal result")
+	}
+	return result, true, nil
+}
+
+func EncodeWriteRejected(operationID, path string) ([]byte, error) {
+	return json.Marshal(WriteRejected{
+		Version:     SyncProtocolVersion,
+		Type:        WriteRejectedType,
+		OperationID: operationID,
+		Path:        path,
+	})
+}
+
+func DecodeWriteRejected(payload []byte) (WriteRejected, bool, error) {
+	if messageType(payload) != WriteRejectedType {
+		return WriteRejected{}, false, nil
+	}
+	var rejected WriteRejected
+	if err := json.Unmarshal(payload, &rejected); err != nil {
+		return WriteRejected{}, true, fmt.Errorf("invalid write rejection: %w", err)
+	}
+	if rejected.Version != SyncProtocolVersion || !validOperationID(rejected.OperationID) || rejected.Path == "" {
+		return WriteRejected{}, true, fmt.Errorf("invalid write rejection")
+	}
+	return rejected, true, nil
+}
+
+func EncodeProfile(name, editor, clientVersion string) ([]byte, error) {
+	return json.Marshal(Profile{
+		Version:       SyncProtocolVersion,
+		Type:          ProfileType,
+		Name:          name,
+		Editor:        editor,
+		ClientVersion: clientVersion,
+	})
+}
+
+func DecodeProfile(payload []byte) (Profile, bool, error) {
+	if messageType(payload) != ProfileType {
+		return Profile{}, false, nil
+	}
+	var profile Profile
+	if err := json.Unmarshal(payload, &profile); err != nil {
+		return Profile{}, true, fmt.Errorf("invalid profile: %w", err)
+	}
+	if profile.Version != SyncProtocolVersion || profile.Name == "" ||
+		len(profile.Name) > maxProfileField || len(profile.Editor) > maxProfileField || len(profile.ClientVersion) > maxProfileField {
+		return Profile{}, true, fmt.Errorf("invalid profile")
+	}
+	return profile, true, nil
+}
+
+func EncodePresence(presence Presence) ([]byte, error) {
+	presence.Version = SyncProtocolVersion
+	presence.Type = PresenceType
+	return json.Marshal(presence)
+}
+
+func DecodePresence(payload []byte) (Presence, bool, error) {
+	if messageType(payload) != PresenceType {
+		return Presence{}, false, nil
+	}
+	var presence Presence
+	if err := json.Unmarshal(payload, &presence); err != nil {
+		return Presence{}, true, fmt.Errorf("invalid presence: %w", err)
+	}
+	valid := presence.Version == SyncProtocolVersion && len(presence.Path) <= 4096 &&
+		validPosition(Position{Line: presence.Line, Column: presence.Column})
+	if presence.Selection != nil {
+		valid = valid && validPosition(presence.Selection.Start) && validPosition(presence.Selection.End)
+	}
+	if !valid {
+		return Presence{}, true, fmt.Errorf("invalid presence")
+	}
+	return presence, true, nil
+}
+
+func EncodeChat(chat Chat) ([]byte, error) {
+	chat.Version = SyncProtocolVersion
+	chat.Type = ChatType
+	return json.Marshal(chat)
+}
+
+func DecodeChat(payload []byte) (Chat, bool, error) {
+	if messageType(payload) != ChatType {
+		return Chat{}, false, nil
+	}
+	var chat Chat
+	if err := json.Unmarshal(payload, &chat); err != nil {
+		return Chat{}, true, fmt.Errorf("invalid chat message: %w", err)
+	}
+	if chat.Version != SyncProtocolVersion || chat.Text == "" || len(chat.Text) > MaxChatBytes {
+		return Chat{}, true, fmt.Errorf("invalid chat message")
+	}
+	return chat, true, nil
+}
+
+func EncodeFocus(focus Focus) ([]byte, error) {
+	focus.Version = SyncProtocolVersion
+	focus.Type = FocusType
+	return json.Marshal(focus)
+}
+
+func DecodeFocus(payload []byte) (Focus, bool, error) {
+	if messageType(payload) != FocusType {
+		return Focus{}, false, nil
+	}
+	var focus Focus
+	if err := json.Unmarshal(payload, &focus); err != nil {
+		return Focus{}, true, fmt.Errorf("invalid focus: %w", err)
+	}
+	if focus.Version != SyncProtocolVersion || focus.Path == "" || len(focus.Path) > 4096 || focus.Line < 0 {
+		return Focus{}, true, fmt.Errorf("invalid focus")
+	}
+	return focus, true, nil
+}
+
+func EncodeTerminalOutput(output TerminalOutput) ([]byte, error) {
+	output.Version = SyncProtocolVersion
+	output.Type = TerminalOutputType
+	return json.Marshal(output)
+}
+
+func DecodeTerminalOutput(payload []byte) (TerminalOutput, bool, error) {
+	if messageType(payload) != TerminalOutputType {
+		return TerminalOutput{}, false, nil
+	}
+	var output TerminalOutput
+	if err := json.Unmarshal(payload, &output); err != nil {
+		return TerminalOutput{}, true, fmt.Errorf("invalid terminal output: %w", err)
+	}
+	if output.Version != SyncProtocolVersion || len(output.Data) > MaxTerminalBytes {
+		return TerminalOutput{}, true, fmt.Errorf("invalid terminal output")
+	}
+	return output, true, nil
+}
+
+// EncodeTerminalRequest encodes a TerminalRequest, or TerminalInput when
+// data is not empty.
+func EncodeTerminalRequest(data []byte) ([]byte, error) {
+	request := TerminalRequest{Version: SyncProtocolVersion, Type: TerminalRequestType}
+	if len(data) > 0 {
+		request.Type = TerminalInputType
+		request.Data = data
+	}
+	return json.Marshal(request)
+}
+
+// DecodeTerminalRequest decodes a TerminalRequest or TerminalInput.
+func DecodeTerminalRequest(payload []byte) (TerminalRequest, bool, error) {
+	if kind := messageType(payload); kind != TerminalRequestType && kind != TerminalInputType {
+		return TerminalRequest{}, false, nil
+	}
+	var request TerminalRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return TerminalRequest{}, true, fmt.Errorf("invalid terminal request: %w", err)
+	}
+	if request.Version != SyncProtocolVersion || len(request.Data) > MaxTerminalBytes ||
+		(request.Type == TerminalInputType) != (len(request.Data) > 0) {
+		return TerminalRequest{}, true, fmt.Errorf("invalid terminal request")
+	}
+	return request, true, nil
+}
+
+func EncodeForwards(ports []int) ([]byte, error) {
+	return json.Marshal(Forwards{Version: SyncProtocolVersion, Type: ForwardsType, Ports: ports})
+}
+
+func DecodeForwards(payload []byte) (Forwards, bool, error) {
+	if messageType(payload) != ForwardsType {
+		return Forwards{}, false, nil
+	}
+	var forwards Forwards
+	if err := json.Unmarshal(payload, &forwards); err != nil {
+		return Forwards{}, true, fmt.Errorf("invalid forwards: %w", err)
+	}
+	if forwards.Version != SyncProtocolVersion || len(forwards.Ports) > maxForwardPorts {
+		return Forwards{}, true, fmt.Errorf("invalid forwards")
+	}
+	for _, port := range forwards.Ports {
+		if !ValidPort(port) {
+			return Forwards{}, true, fmt.Errorf("invalid forwarded port %d", port)
+		}
+	}
+	return forwards, true, nil
+}
+
+func EncodeTunnel(tunnel Tunnel) ([]byte, error) {
+	tunnel.Version = SyncProtocolVersion
+	tunnel.Type = TunnelType
+	return json.Marshal(tunnel)
+}
+
+func DecodeTunnel(payload []byte) (Tunnel, bool, error) {
+	if messageType(payload) != TunnelType {
+		return Tunnel{}, false, nil
+	}
+	var tunnel Tunnel
+	if err := json.Unmarshal(payload, &tunnel); err != nil {
+		return Tunnel{}, true, fmt.Errorf("invalid tunnel message: %w", err)
+	}
+	if tunnel.Version != SyncProtocolVersion || tunnel.Stream == 0 || len(tunnel.Data) > MaxTunnelBytes ||
+		tunnel.Ack < 0 || tunnel.Ack > MaxTunnelBytes || (tunnel.Port != 0 && !ValidPort(tunnel.Port)) || len(tunnel.Error) > 1024 {
+		return Tunnel{}, true, fmt.Errorf("invalid tunnel message")
+	}
+	return tunnel, true, nil
+}
+
+func EncodeTasks(names []string) ([]byte, error) {
+	return json.Marshal(Tasks{Version: SyncProtocolVersion, Type: TasksType, Names: names})
+}
+
+func DecodeTasks(payload []byte) (Tasks, bool, error) {
+	if messageType(payload) != TasksType {
+		return Tasks{}, false, nil
+	}
+	var tasks Tasks
+	if err := json.Unmarshal(payload, &tasks); err != nil {
+		return Tasks{}, true, fmt.Errorf("invalid tasks: %w", err)
+	}
+	if tasks.Version != SyncProtocolVersion || len(tasks.Names) > maxTasks {
+		return Tasks{}, true, fmt.Errorf("invalid tasks")
+	}
+	for _, name := range tasks.Names {
+		if !ValidTaskName(name) {
+			return Tasks{}, true, fmt.Errorf("invalid task name %q", name)
+		}
+	}
+	return tasks, true, nil
+}
+
+func EncodeTaskRun(run TaskRun) ([]byte, error) {
+	run.Version = SyncProtocolVersion
+	run.Type = TaskRunType
+	return json.Marshal(run)
+}
+
+func DecodeTaskRun(payload []byte) (TaskRun, bool, error) {
+	if messageType(payload) != TaskRunType {
+		return TaskRun{}, false, nil
+	}
+	var run TaskRun
+	if err := json.Unmarshal(payload, &run); err != nil {
+		return TaskRun{}, true, fmt.Errorf("invalid task run: %w", err)
+	}
+	if run.Version != SyncProtocolVersion || run.Run == 0 || (!run.Cancel && !ValidTaskName(run.Task)) {
+		return TaskRun{}, true, fmt.Errorf("invalid task run")
+	}
+	return run, true, nil
+}
+
+func EncodeTaskOutput(output TaskOutput) ([]byte, error) {
+	output.Version = SyncProtocolVersion
+	output.Type = TaskOutputType
+	return json.Marshal(output)
+}
+
+func DecodeTaskOutput(payload []byte) (TaskOutput, bool, error) {
+	if messageType(payload) != TaskOutputType {
+		return TaskOutput{}, false, nil
+	}
+	var output TaskOutput
+	if err := json.Unmarshal(payload, &output); err != nil {
+		return TaskOutput{}, true, fmt.Errorf("invalid task output: %w", err)
+	}
+	if output.Version != SyncProtocolVersion || output.Run == 0 || len(output.Data) > MaxTaskOutputBytes || len(output.Error) > 1024 {
+		return TaskOutput{}, true, fmt.Errorf("invalid task output")
+	}
+	return output, true, nil
+}
+
+// ValidTaskName reports whether name can name a task: short, without spaces
+// or control characters.
+func ValidTaskName(name string) bool {
+	if name == "" || len(name) > maxTaskName {
+		return false
+	}
+	for _, r := range name {
+		if r <= ' ' || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidPort reports whether port is a TCP port number that can be forwarded.
+func ValidPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+func validPosition(position Position) bool {
+	return position.Line >= 0 && position.Column >= 0
+}
+
+func messageType(payload []byte) string {
+	var header struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(payload, &header); err != nil {
+		return ""
+	}
+	return header.Type
+}
+
 func EncodeEncrypted(payload string) []byte {
 	return []byte(EncryptedChannel + "|" + payload)
 }
@@ -119,20 +783,22 @@ func ParseTargetedEncrypted(message []byte) (string, string, bool) {
 	return parts[1], parts[2], true
 }
 
-func EncodeOrderedEncrypted(sequence uint64, encryptedPayload string) []byte {
-	return []byte(fmt.Sprintf("%s|%d|%s", OrderedEncryptedChannel, sequence, encryptedPayload))
+// EncodeOrderedEncrypted frames an operation in the ordered stream, tagged
+// with the ID of the peer that sent it.
+func EncodeOrderedEncrypted(sequence uint64, originID, encryptedPayload string) []byte {
+	return []byte(fmt.Sprintf("%s|%d|%s|%s", OrderedEncryptedChannel, sequence, originID, encryptedPayload))
 }
 
-func ParseOrderedEncrypted(message []byte) (uint64, string, bool) {
-	parts := strings.SplitN(string(message), "|", 3)
-	if len(parts) != 3 || parts[0] != OrderedEncryptedChannel || parts[2] == "" {
-		return 0, "", false
+func ParseOrderedEncrypted(message []byte) (uint64, string, string, bool) {
+	parts := strings.SplitN(string(message), "|", 4)
+	if len(parts) != 4 || parts[0] != OrderedEncryptedChannel || !validPeerID(parts[2]) || parts[3] == "" {
+		return 0, "", "", false
 	}
 	sequence, err := strconv.ParseUint(parts[1], 10, 64)
 	if err != nil || sequence == 0 {
-		return 0, "", false
+		return 0, "", "", false
 	}
-	return sequence, parts[2], true
+	return sequence, parts[2], parts[3], true
 }
 
 func EncodeBootstrapEncrypted(encryptedPayload string) []byte {
@@ -147,6 +813,70 @@ func ParseBootstrapEncrypted(message []byte) (string, bool) {
 	return string(message[len(prefix):]), true
 }
 
+func EncodeHostEncrypted(payload string) []byte {
+	return []byte(HostEncryptedChannel + "|" + payload)
+}
+
+func ParseHostEncrypted(message []byte) (string, bool) {
+	prefix := HostEncryptedChannel + "|"
+	if !strings.HasPrefix(string(message), prefix) || len(message) == len(prefix) {
+		return "", false
+	}
+	return string(message[len(prefix):]), true
+}
+
+func EncodeFromEncrypted(peerID, payload string) []byte {
+	return []byte(fmt.Sprintf("%s|%s|%s", FromEncryptedChannel, peerID, payload))
+}
+
+func ParseFromEncrypted(message []byte) (string, string, bool) {
+	parts := strings.SplitN(string(message), "|", 3)
+	if len(parts) != 3 || parts[0] != FromEncryptedChannel || !validPeerID(parts[1]) || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// EncodeDirectEncrypted addresses a host message to a single peer. The relay
+// delivers it on the from channel.
+func EncodeDirectEncrypted(peerID, payload string) []byte {
+	return []byte(fmt.Sprintf("%s|%s|%s", DirectEncryptedChannel, peerID, payload))
+}
+
+func ParseDirectEncrypted(message []byte) (string, string, bool) {
+	parts := strings.SplitN(string(message), "|", 3)
+	if len(parts) != 3 || parts[0] != DirectEncryptedChannel || !validPeerID(parts[1]) || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// EncodeBroadcastEncrypted sends a message to every other peer, including
+// joiners that are still syncing. The relay delivers it on the peer channel.
+func EncodeBroadcastEncrypted(payload string) []byte {
+	return []byte(BroadcastEncryptedChannel + "|" + payload)
+}
+
+func ParseBroadcastEncrypted(message []byte) (string, bool) {
+	prefix := BroadcastEncryptedChannel + "|"
+	if !strings.HasPrefix(string(message), prefix) || len(message) == len(prefix) {
+		return "", false
+	}
+	return string(message[len(prefix):]), true
+}
+
+func EncodePeerEncrypted(peerID, payload string) []byte {
+	return []byte(fmt.Sprintf("%s|%s|%s", PeerEncryptedChannel, peerID, payload))
+}
+
+func ParsePeerEncrypted(message []byte) (string, string, bool) {
+	parts := strings.SplitN(string(message), "|", 3)
+	if len(parts) != 3 || parts[0] != PeerEncryptedChannel || !validPeerID(parts[1]) || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
 func EncodeSyncDone(peerID string) []byte {
 	return []byte(SyncDoneChannel + "|" + peerID)
 }
@@ -159,6 +889,42 @@ func ParseSyncDone(message []byte) (string, bool) {
 	return parts[1], true
 }
 
+// EncodeSnapshotEncrypted frames one bootstrap message of a snapshot the host
+// caches on the relay. Sequence is the last ordered operation the snapshot
+// includes.
+func EncodeSnapshotEncrypted(sequence uint64, encryptedPayload string) []byte {
+	return []byte(fmt.Sprintf("%s|%d|%s", SnapshotEncryptedChannel, sequence, encryptedPayload))
+}
+
+func ParseSnapshotEncrypted(message []byte) (uint64, string, bool) {
+	parts := strings.SplitN(string(message), "|", 3)
+	if len(parts) != 3 || parts[0] != SnapshotEncryptedChannel || parts[2] == "" {
+		return 0, "", false
+	}
+	sequence, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return sequence, parts[2], true
+}
+
+// EncodeSnapshotDone ends a cached snapshot, which replaces the previous one.
+func EncodeSnapshotDone(sequence uint64) []byte {
+	return []byte(fmt.Sprintf("%s|%d", SnapshotDoneChannel, sequence))
+}
+
+func ParseSnapshotDone(message []byte) (uint64, bool) {
+	parts := strings.SplitN(string(message), "|", 2)
+	if len(parts) != 2 || parts[0] != SnapshotDoneChannel {
+		return 0, false
+	}
+	sequence, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return sequence, true
+}
+
 func validPeerID(peerID string) bool {
 	if peerID == "" || len(peerID) > 64 {
 		return false
@@ -192,6 +958,38 @@ func ParseReadOnlyJoinersControl(payload string) (bool, bool) {
 	return n == 1, true
 }
 
+func EncodeControlApproveJoinerEdits(enabled bool) []byte {
+	value := "0"
+	if enabled {
+		value = "1"
+	}
+	return []byte(fmt.Sprintf("%s|%s=%s", ControlChannel, ApproveJoinerEditsKey, value))
+}
+
+func ParseApproveJoinerEditsControl(payload string) (bool, bool) {
+	key, value, ok := strings.Cut(payload, "=")
+	if !ok || key != ApproveJoinerEditsKey {
+		return false, false
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return false, false
+	}
+	return n == 1, true
+}
+
+func EncodeControlPeerID(peerID string) []byte {
+	return []byte(fmt.Sprintf("%s|%s=%s", ControlChannel, PeerIDKey, peerID))
+}
+
+func ParsePeerIDControl(payload string) (string, bool) {
+	key, value, ok := strings.Cut(payload, "=")
+	if !ok || key != PeerIDKey || !validPeerID(value) {
+		return "", false
+	}
+	return value, true
+}
+
 func EncodeControlPeerCount(count int) []byte {
 	return []byte(fmt.Sprintf("%s|%s=%d", ControlChannel, PeerCountKey, count))
 }
@@ -241,3 +1039,142 @@ func ParseSyncCompleteControl(payload string) bool {
 	key, value, ok := strings.Cut(payload, "=")
 	return ok && key == SyncCompleteKey && value == "1"
 }
+
+func EncodeControlHostPresent(present bool) []byte {
+	value := "0"
+	if present {
+		value = "1"
+	}
+	return []byte(fmt.Sprintf("%s|%s=%s", ControlChannel, HostPresentKey, value))
+}
+
+func ParseHostPresentControl(payload string) (bool, bool) {
+	key, value, ok := strings.Cut(payload, "=")
+	if !ok || key != HostPresentKey {
+		return false, false
+	}
+	return value == "1", value == "0" || value == "1"
+}
+
+func EncodeControlPromoted() []byte {
+	return []byte(fmt.Sprintf("%s|%s=1", ControlChannel, PromotedKey))
+}
+
+func ParsePromotedControl(payload string) bool {
+	key, value, ok := strings.Cut(payload, "=")
+	return ok && key == PromotedKey && value == "1"
+}
+
+// EncodeControlPeerJoined announces a peer. Host marks the session host.
+func EncodeControlPeerJoined(peerID string, host bool) []byte {
+	value := peerID
+	if host {
+		value += ":host"
+	}
+	return []byte(fmt.Sprintf("%s|%s=%s", ControlChannel, PeerJoinedKey, value))
+}
+
+func ParsePeerJoinedControl(payload string) (string, bool, bool) {
+	key, value, ok := strings.Cut(payload, "=")
+	if !ok || key != PeerJoinedKey {
+		return "", false, false
+	}
+	peerID, role, hasRole := strings.Cut(value, ":")
+	if !validPeerID(peerID) || (hasRole && role != "host") {
+		return "", false, false
+	}
+	return peerID, hasRole, true
+}
+
+func EncodeControlPeerLeft(peerID string) []byte {
+	return []byte(fmt.Sprintf("%s|%s=%s", ControlChannel, PeerLeftKey, peerID))
+}
+
+func ParsePeerLeftControl(payload string) (string, bool) {
+	key, value, ok := strings.Cut(payload, "=")
+	if !ok || key != PeerLeftKey || !validPeerID(value) {
+		return "", false
+	}
+	return value, true
+}
+
+// EncodeControlSnapshotCache tells the host whether the relay keeps a
+// snapshot for new joiners.
+func EncodeControlSnapshotCache(enabled bool) []byte {
+	value := "0"
+	if enabled {
+		value = "1"
+	}
+	return []byte(fmt.Sprintf("%s|%s=%s", ControlChannel, SnapshotCacheKey, value))
+}
+
+func ParseSnapshotCacheControl(payload string) (bool, bool) {
+	key, value, ok := strings.Cut(payload, "=")
+	if !ok || key != SnapshotCacheKey {
+		return false, false
+	}
+	return value == "1", value == "0" || value == "1"
+}
+
+// EncodeControlSnapshotRefresh asks the host for a new snapshot, because the
+// relay will soon no longer hold every operation since the cached one.
+func EncodeControlSnapshotRefresh() []byte {
+	return []byte(fmt.Sprintf("%s|%s=1", ControlChannel, SnapshotRefreshKey))
+}
+
+func ParseSnapshotRefreshControl(payload string) bool {
+	key, value, ok := strings.Cut(payload, "=")
+	return ok && key == SnapshotRefreshKey && value == "1"
+}
+
+// Limits are the relay's limits for a session, reported to each peer as it
+// connects. Zero fields are unknown.
+type Limits struct {
+	MaxPeers          int
+	MaxSyncingPeers   int
+	MaxQueuedMessages int
+	MaxQueuedBytes    int
+	MaxMessageBytes   int
+	SyncTimeout       time.Duration
+}
+
+func EncodeControlLimits(limits Limits) []byte {
+	return []byte(fmt.Sprintf("%s|%s=peers:%d,syncing:%d,queued:%d,queued_bytes:%d,message_bytes:%d,sync_timeout_ms:%d",
+		ControlChannel, LimitsKey, limits.MaxPeers, limits.MaxSyncingPeers, limits.MaxQueuedMessages,
+		limits.MaxQueuedBytes, limits.MaxMessageBytes, limits.SyncTimeout.Milliseconds()))
+}
+
+// ParseLimitsControl reads a limits message. Unknown fields are ignored so
+// relays can report more limits later.
+func ParseLimitsControl(payload string) (Limits, bool) {
+	key, value, ok := strings.Cut(payload, "=")
+	if !ok || key != LimitsKey {
+		return Limits{}, false
+	}
+	var limits Limits
+	for _, field := range strings.Split(value, ",") {
+		name, raw, ok := strings.Cut(field, ":")
+		if !ok {
+			return Limits{}, false
+		}
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 0 {
+			return Limits{}, false
+		}
+		switch name {
+		case "peers":
+			limits.MaxPeers = int(n)
+		case "syncing":
+			limits.MaxSyncingPeers = int(n)
+		case "queued":
+			limits.MaxQueuedMessages = int(n)
+		case "queued_bytes":
+			limits.MaxQueuedBytes = int(n)
+		case "message_bytes":
+			limits.MaxMessageBytes = int(n)
+		case "sync_timeout_ms":
+			limits.SyncTimeout = time.Duration(n) * time.Millisecond
+		}
+	}
+	return limits, true
+}
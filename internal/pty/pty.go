@@ -0,0 +1,30 @@
+// Package pty runs a command attached to a pseudo-terminal, so a shell shared
+// with peers behaves as it would in a real terminal window.
+package pty
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Start runs cmd with a new pseudo-terminal of the given size as its
+// controlling terminal and returns the terminal's master side. Reads return
+// the command's output; writes are its keyboard input.
+func Start(cmd *exec.Cmd, cols, rows int) (*os.File, error) {
+	master, slave, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer slave.Close()
+	if err := Resize(master, cols, rows); err != nil {
+		_ = master.Close()
+		return nil, err
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	setControllingTerminal(cmd)
+	if err := cmd.Start(); err != nil {
+		_ = master.Close()
+		return nil, err
+	}
+	return master, nil
+}
@@ -0,0 +1,21 @@
+//go:build !linux && !darwin
+
+package pty
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+var errUnsupported = errors.New("shared terminals are only supported on Linux and macOS")
+
+func open() (*os.File, *os.File, error) {
+	return nil, nil, errUnsupported
+}
+
+func Resize(master *os.File, cols, rows int) error {
+	return errUnsupported
+}
+
+func setControllingTerminal(cmd *exec.Cmd) {}
@@ -0,0 +1,29 @@
+//go:build linux || darwin
+
+package pty
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestStartRunsCommandInTerminal(t *testing.T) {
+	cmd := exec.Command("sh", "-c", `test -t 0 && echo "$(stty size) tty"`)
+	master, err := Start(cmd, 100, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer master.Close()
+
+	var output bytes.Buffer
+	_, _ = io.Copy(&output, master) // ends with EIO once the command exits
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if got := output.String(); !strings.Contains(got, "30 100") || !strings.Contains(got, "tty") {
+		t.Fatalf("got %q, want the terminal size and a tty", got)
+	}
+}
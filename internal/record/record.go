@@ -0,0 +1,182 @@
+// Package record keeps an encrypted log of a session's file changes so it
+// can be replayed later.
+//
+// A recording starts with a plain header line, followed by one line per
+// entry. Each entry is JSON sealed with the session's E2E key, so the log is
+// as private as the session itself.
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/e2e"
+)
+
+const header = "shadowrec 1"
+
+// Entry is one recorded change. Snapshot entries describe the tree when the
+// recording started; the rest are the session's ordered operations.
+type Entry struct {
+	// At is how long after the recording started the change happened.
+	At       time.Duration `json:"at"`
+	Snapshot bool          `json:"snapshot,omitempty"`
+	Sequence uint64        `json:"seq,omitempty"`
+	PeerID   string        `json:"peer_id,omitempty"`
+	PeerName string        `json:"peer_name,omitempty"`
+	Path     string        `json:"path"`
+	Dir      bool          `json:"dir,omitempty"`
+	Delete   bool          `json:"delete,omitempty"`
+	Content  []byte        `json:"content,omitempty"`
+}
+
+// start is the first sealed line; it dates the recording.
+type start struct {
+	Started time.Time `json:"started"`
+}
+
+// Writer appends entries to a recording. It is safe for concurrent use.
+type Writer struct {
+	mu      sync.Mutex
+	file    *os.File
+	codec   *e2e.Codec
+	started time.Time
+}
+
+// Create starts a new recording at path, sealed with key. It refuses to
+// overwrite an existing file.
+func Create(path, key string) (*Writer, error) {
+	codec, err := e2e.NewCodec(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		return nil, fmt.Errorf("%s already exists; choose another file to record to", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %w", err)
+	}
+	w := &Writer{file: file, codec: codec, started: time.Now()}
+	if _, err := io.WriteString(file, header+"\n"); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to write recording: %w", err)
+	}
+	if err := w.append(start{Started: w.started.UTC()}); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// RecordSnapshot records a path as it was when the recording started.
+func (w *Writer) RecordSnapshot(relPath string, content []byte, dir bool) error {
+	return w.append(Entry{Snapshot: true, Path: relPath, Dir: dir, Content: content})
+}
+
+// RecordOperation records an ordered operation that peerID made.
+func (w *Writer) RecordOperation(sequence uint64, peerID, peerName, relPath string, content []byte, deleted bool) error {
+	return w.append(Entry{
+		At:       time.Since(w.started),
+		Sequence: sequence,
+		PeerID:   peerID,
+		PeerName: peerName,
+		Path:     relPath,
+		Delete:   deleted,
+		Content:  content,
+	})
+}
+
+func (w *Writer) append(value any) error {
+	plaintext, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	sealed, err := w.codec.Encrypt(plaintext)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := io.WriteString(w.file, sealed+"\n"); err != nil {
+		return fmt.Errorf("failed to write recording: %w", err)
+	}
+	return nil
+}
+
+// Close flushes the recording to disk and closes it.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.file.Sync(); err != nil {
+		_ = w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// Reader reads a recording's entries in order.
+type Reader struct {
+	in    *bufio.Reader
+	codec *e2e.Codec
+	// Started is when the recording began.
+	Started time.Time
+}
+
+// NewReader checks the recording's header and opens it with key.
+func NewReader(in io.Reader, key string) (*Reader, error) {
+	codec, err := e2e.NewCodec(key)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{in: bufio.NewReader(in), codec: codec}
+	line, err := r.in.ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != header {
+		return nil, fmt.Errorf("not a shadow recording")
+	}
+	var first start
+	if err := r.next(&first); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("the recording is empty")
+		}
+		return nil, err
+	}
+	r.Started = first.Started
+	return r, nil
+}
+
+// Next returns the next entry, or io.EOF after the last one. A final line
+// cut short, as when the host was killed mid-write, counts as the end.
+func (r *Reader) Next() (Entry, error) {
+	var entry Entry
+	if err := r.next(&entry); err != nil {
+		return Entry{}, err
+	}
+	return entry, nil
+}
+
+func (r *Reader) next(value any) error {
+	line, err := r.in.ReadString('\n')
+	if errors.Is(err, io.EOF) {
+		// A line without its newline was never finished.
+		return io.EOF
+	}
+	if err != nil {
+		return err
+	}
+	plaintext, err := r.codec.Decrypt(strings.TrimSuffix(line, "\n"))
+	if err != nil {
+		return fmt.Errorf("cannot read the recording; check the key: %w", err)
+	}
+	if err := json.Unmarshal(plaintext, value); err != nil {
+		return fmt.Errorf("corrupt recording entry: %w", err)
+	}
+	return nil
+}
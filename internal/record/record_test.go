@@ -0,0 +1,78 @@
+package record
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordingRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.shadowrec")
+	w, err := Create(path, "session-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.RecordSnapshot("src", nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.RecordSnapshot("src/main.go", []byte("package main\n"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.RecordOperation(7, "2", "bob", "src/main.go", nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Create(path, "session-key"); err == nil {
+		t.Fatal("overwrote an existing recording")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("package main")) || bytes.Contains(data, []byte("bob")) {
+		t.Fatal("recording is not encrypted")
+	}
+	if _, err := NewReader(bytes.NewReader(data), "wrong-key"); err == nil {
+		t.Fatal("opened the recording with the wrong key")
+	}
+
+	// Drop the end of the last line, as if the host was killed mid-write.
+	r, err := NewReader(bytes.NewReader(data[:len(data)-5]), "session-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Started.IsZero() {
+		t.Fatal("recording has no start time")
+	}
+	var entries []Entry
+	for {
+		entry, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 2 || !entries[0].Dir || string(entries[1].Content) != "package main\n" || !entries[1].Snapshot {
+		t.Fatalf("entries = %+v", entries)
+	}
+
+	r, _ = NewReader(bytes.NewReader(data), "session-key")
+	_, _ = r.Next()
+	_, _ = r.Next()
+	operation, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if operation.Snapshot || operation.Sequence != 7 || operation.PeerName != "bob" || !operation.Delete {
+		t.Fatalf("operation = %+v", operation)
+	}
+}
@@ -2,12 +2,17 @@ package mcp
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"sync"
 	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/control"
 )
 
 // Session states mirror the VS Code extension's state machine.
@@ -24,26 +29,72 @@ const (
 
 // Event name constants — local copy to avoid cross-package dependency.
 const (
-	eventStarting         = "starting"
-	eventTunnelReady      = "tunnel_ready"
-	eventConnected        = "connected"
-	eventSnapshotComplete = "snapshot_complete"
-	eventStopped          = "stopped"
-	eventFileSent         = "file_sent"
-	eventFileReceived     = "file_received"
-	eventReadOnly         = "read_only"
-	eventError            = "error"
+	eventStarting          = "starting"
+	eventTunnelReady       = "tunnel_ready"
+	eventConnected         = "connected"
+	eventSnapshotComplete  = "snapshot_complete"
+	eventStopped           = "stopped"
+	eventFileSent          = "file_sent"
+	eventFileReceived      = "file_received"
+	eventReadOnly          = "read_only"
+	eventError             = "error"
+	eventBootstrapProgress = "bootstrap_progress"
+	eventRoster            = "roster"
+	eventControlReady      = "control_ready"
+	eventChat              = "chat"
 )
 
+// maxChatHistory is how many chat messages are kept for shadow_chat_read.
+const maxChatHistory = 200
+
 // jsonEvent mirrors cmd.JSONEvent for parsing child process stdout.
 type jsonEvent struct {
-	Event       string `json:"event"`
-	Message     string `json:"message"`
-	JoinURL     string `json:"join_url,omitempty"`
-	JoinCommand string `json:"join_command,omitempty"`
-	FileCount   int    `json:"file_count,omitempty"`
-	RelPath     string `json:"rel_path,omitempty"`
-	Timestamp   string `json:"timestamp"`
+	Event        string `json:"event"`
+	Message      string `json:"message"`
+	JoinURL      string `json:"join_url,omitempty"`
+	JoinCommand  string `json:"join_command,omitempty"`
+	FileCount    int    `json:"file_count,omitempty"`
+	RelPath      string `json:"rel_path,omitempty"`
+	FilesDone    int    `json:"files_done,omitempty"`
+	FilesTotal   int    `json:"files_total,omitempty"`
+	BytesDone    int64  `json:"bytes_done,omitempty"`
+	BytesTotal   int64  `json:"bytes_total,omitempty"`
+	ETASeconds   int64  `json:"eta_seconds,omitempty"`
+	Done         bool   `json:"done,omitempty"`
+	PeerID       string `json:"peer_id,omitempty"`
+	PeerName     string `json:"peer_name,omitempty"`
+	Peers        []Peer `json:"peers,omitempty"`
+	Self         bool   `json:"self,omitempty"`
+	ControlPort  int    `json:"control_port,omitempty"`
+	ControlToken string `json:"control_token,omitempty"`
+	Timestamp    string `json:"timestamp"`
+}
+
+// Peer is another participant in the session.
+type Peer struct {
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Editor  string `json:"editor,omitempty"`
+	Version string `json:"version,omitempty"`
+	Host    bool   `json:"host,omitempty"`
+}
+
+// ChatMessage is one message from the session chat.
+type ChatMessage struct {
+	From string    `json:"from"`
+	Self bool      `json:"self,omitempty"`
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+}
+
+// BootstrapProgress tracks a joiner's initial download.
+type BootstrapProgress struct {
+	FilesDone  int   `json:"files_done"`
+	FilesTotal int   `json:"files_total"`
+	BytesDone  int64 `json:"bytes_done"`
+	BytesTotal int64 `json:"bytes_total"`
+	ETASeconds int64 `json:"eta_seconds,omitempty"`
+	Done       bool  `json:"done,omitempty"`
 }
 
 // SessionInfo holds runtime details about the active session.
@@ -56,6 +107,9 @@ type SessionInfo struct {
 	ReadOnly      bool     `json:"read_only,omitempty"`
 	RecentFiles   []string `json:"recent_files,omitempty"`
 	LastError     string   `json:"last_error,omitempty"`
+	Peers         []Peer   `json:"peers,omitempty"`
+
+	Bootstrap *BootstrapProgress `json:"bootstrap,omitempty"`
 }
 
 // SessionManager manages a single shadow child process and its state.
@@ -65,6 +119,9 @@ type SessionManager struct {
 	info            *SessionInfo
 	proc            *exec.Cmd
 	sawStoppedEvent bool
+	// control reaches the child's control interface; nil until it is ready.
+	control *control.Info
+	chat    []ChatMessage
 
 	// ready is closed when the session reaches a running state or errors.
 	ready chan struct{}
@@ -97,6 +154,7 @@ func (sm *SessionManager) Info() *SessionInfo {
 	recentCopy := make([]string, len(sm.info.RecentFiles))
 	copy(recentCopy, sm.info.RecentFiles)
 	cp.RecentFiles = recentCopy
+	cp.Peers = append([]Peer(nil), sm.info.Peers...)
 	return &cp
 }
 
@@ -109,6 +167,7 @@ func (sm *SessionManager) Start(path string, readOnlyJoiners bool) (*SessionInfo
 	}
 
 	sm.info = &SessionInfo{Mode: "host", WorkspacePath: path}
+	sm.resetChat()
 	sm.ready = make(chan struct{})
 	sm.done = make(chan struct{})
 	sm.sawStoppedEvent = false
@@ -151,6 +210,7 @@ func (sm *SessionManager) Join(url, path string) (*SessionInfo, error) {
 		path = "."
 	}
 	sm.info = &SessionInfo{Mode: "joiner", JoinURL: url, WorkspacePath: path}
+	sm.resetChat()
 	sm.ready = make(chan struct{})
 	sm.done = make(chan struct{})
 	sm.sawStoppedEvent = false
@@ -221,7 +281,7 @@ func (sm *SessionManager) spawn(args []string) error {
 	sm.setState(StateStarting)
 
 	cmd := exec.Command(exe, args...)
-	cmd.Env = append(os.Environ(), "NO_COLOR=1")
+	cmd.Env = append(os.Environ(), "NO_COLOR=1", "SHADOW_EDITOR=mcp")
 	cmd.Stdin = nil
 
 	stdout, err := cmd.StdoutPipe()
@@ -254,10 +314,12 @@ func (sm *SessionManager) spawn(args []string) error {
 		sm.mu.Lock()
 		defer sm.mu.Unlock()
 		sm.proc = nil
+		sm.control = nil
 
 		if sm.state == StateStopping || sm.sawStoppedEvent {
 			sm.setState(StateIdle)
 			sm.info = nil
+			sm.chat = nil
 		} else if sm.state != StateIdle && sm.state != StateError {
 			if sm.info != nil {
 				sm.info.LastError = "process exited unexpectedly"
@@ -313,6 +375,38 @@ func (sm *SessionManager) parseLine(line string) {
 			sm.addRecentFile(evt.RelPath)
 		}
 
+	case eventBootstrapProgress:
+		if sm.info != nil {
+			sm.info.Bootstrap = &BootstrapProgress{
+				FilesDone:  evt.FilesDone,
+				FilesTotal: evt.FilesTotal,
+				BytesDone:  evt.BytesDone,
+				BytesTotal: evt.BytesTotal,
+				ETASeconds: evt.ETASeconds,
+				Done:       evt.Done,
+			}
+		}
+
+	case eventRoster:
+		if sm.info != nil {
+			sm.info.Peers = evt.Peers
+		}
+
+	case eventControlReady:
+		sm.control = &control.Info{Port: evt.ControlPort, Token: evt.ControlToken}
+
+	case eventChat:
+		from := evt.PeerName
+		if evt.Self {
+			from = "you"
+		} else if from == "" {
+			from = "peer " + evt.PeerID
+		}
+		sm.chat = append(sm.chat, ChatMessage{From: from, Self: evt.Self, Text: evt.Message, Time: eventTime(evt.Timestamp)})
+		if len(sm.chat) > maxChatHistory {
+			sm.chat = sm.chat[len(sm.chat)-maxChatHistory:]
+		}
+
 	case eventReadOnly:
 		if sm.info != nil {
 			sm.info.ReadOnly = true
@@ -333,6 +427,144 @@ func (sm *SessionManager) parseLine(line string) {
 	}
 }
 
+// Say posts a chat message to the active session.
+func (sm *SessionManager) Say(text string) error {
+	sm.mu.Lock()
+	info := sm.control
+	running := sm.state == StateRunningHost || sm.state == StateRunningJoiner
+	sm.mu.Unlock()
+	if !running {
+		return fmt.Errorf("no active session")
+	}
+	if info == nil {
+		return fmt.Errorf("chat is not available in this session")
+	}
+	return control.Call(*info, control.Message{Type: control.TypeChat, Text: text})
+}
+
+// Focus asks the session's peers to look at a one-based line of path. A
+// relative path is resolved against the workspace.
+func (sm *SessionManager) Focus(path string, line int) error {
+	sm.mu.Lock()
+	info := sm.control
+	running := sm.state == StateRunningHost || sm.state == StateRunningJoiner
+	workspace := ""
+	if sm.info != nil {
+		workspace = sm.info.WorkspacePath
+	}
+	sm.mu.Unlock()
+	if !running {
+		return fmt.Errorf("no active session")
+	}
+	if info == nil {
+		return fmt.Errorf("focus is not available in this session")
+	}
+	if line < 1 {
+		return fmt.Errorf("line must be 1 or more")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workspace, path)
+	}
+	file, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	return control.Call(*info, control.Message{Type: control.TypeFocus, File: file, Line: line - 1})
+}
+
+// maxTaskResult bounds the task output returned to the model; the start of
+// long output is dropped.
+const maxTaskResult = 64 * 1024
+
+// TaskResult is the outcome of RunTask. Without a task name, only Tasks is set.
+type TaskResult struct {
+	Tasks     []string
+	Output    string
+	Truncated bool
+	ExitCode  int
+}
+
+// RunTask runs one of the host's tasks and waits for it to finish, or lists
+// the tasks when task is empty. Cancelling ctx stops the task.
+func (sm *SessionManager) RunTask(ctx context.Context, task string) (TaskResult, error) {
+	sm.mu.Lock()
+	info := sm.control
+	running := sm.state == StateRunningHost || sm.state == StateRunningJoiner
+	sm.mu.Unlock()
+	if !running {
+		return TaskResult{}, fmt.Errorf("no active session")
+	}
+	if info == nil {
+		return TaskResult{}, fmt.Errorf("tasks are not available in this session")
+	}
+	stream, err := control.Attach(*info, control.Message{Attach: control.AttachTask, Text: task})
+	if err != nil {
+		return TaskResult{}, err
+	}
+	defer stream.Close()
+	stop := context.AfterFunc(ctx, func() { stream.Close() })
+	defer stop()
+
+	var result TaskResult
+	var output []byte
+	for {
+		message, err := stream.Receive()
+		if err != nil {
+			if ctx.Err() != nil {
+				return TaskResult{}, ctx.Err()
+			}
+			return TaskResult{}, fmt.Errorf("the session ended before the task finished")
+		}
+		switch message.Type {
+		case control.TypeTasks:
+			result.Tasks = message.Tasks
+			return result, nil
+		case control.TypeOutput:
+			output = append(output, message.Data...)
+			if len(output) > maxTaskResult {
+				output = append(output[:0], output[len(output)-maxTaskResult:]...)
+				result.Truncated = true
+			}
+		case control.TypeError:
+			return TaskResult{}, errors.New(message.Error)
+		case control.TypeExit:
+			if message.Error != "" {
+				return TaskResult{}, errors.New(message.Error)
+			}
+			if message.ExitCode != nil {
+				result.ExitCode = *message.ExitCode
+			}
+			result.Output = string(output)
+			return result, nil
+		}
+	}
+}
+
+// Chat returns up to limit of the most recent chat messages, oldest first.
+func (sm *SessionManager) Chat(limit int) []ChatMessage {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	messages := sm.chat
+	if limit > 0 && len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	return append([]ChatMessage(nil), messages...)
+}
+
+// resetChat forgets the previous session's chat (caller must hold mu).
+func (sm *SessionManager) resetChat() {
+	sm.control = nil
+	sm.chat = nil
+}
+
+func eventTime(timestamp string) time.Time {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
+
 // addRecentFile appends a file path to the recent files list (max 20).
 func (sm *SessionManager) addRecentFile(relPath string) {
 	if relPath == "" {
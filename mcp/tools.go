@@ -3,6 +3,7 @@ package mcp
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/mark3labs/mcp-go/mcp"
 )
@@ -13,6 +14,10 @@ func RegisterTools(s MCPServer, sm *SessionManager) {
 	s.AddTool(shadowJoinTool(), handleJoin(sm))
 	s.AddTool(shadowStatusTool(), handleStatus(sm))
 	s.AddTool(shadowStopTool(), handleStop(sm))
+	s.AddTool(shadowChatPostTool(), handleChatPost(sm))
+	s.AddTool(shadowChatReadTool(), handleChatRead(sm))
+	s.AddTool(shadowFocusTool(), handleFocus(sm))
+	s.AddTool(shadowRunTaskTool(), handleRunTask(sm))
 }
 
 // --- Tool definitions ---
@@ -57,6 +62,48 @@ func shadowStopTool() mcp.Tool {
 	)
 }
 
+func shadowChatPostTool() mcp.Tool {
+	return mcp.NewTool("shadow_chat_post",
+		mcp.WithDescription("Post a message to the active Shadow session's end-to-end encrypted chat. Everyone connected sees it in their terminal or editor."),
+		mcp.WithString("text",
+			mcp.Required(),
+			mcp.Description("The message to send, up to 16KB; multi-line text such as stack traces is kept as is"),
+		),
+	)
+}
+
+func shadowChatReadTool() mcp.Tool {
+	return mcp.NewTool("shadow_chat_read",
+		mcp.WithDescription("Read recent messages from the active Shadow session's chat. History is kept only while the session runs."),
+		mcp.WithNumber("limit",
+			mcp.Description("Maximum number of most recent messages to return (default 20)"),
+		),
+		mcp.WithReadOnlyHintAnnotation(true),
+	)
+}
+
+func shadowFocusTool() mcp.Tool {
+	return mcp.NewTool("shadow_focus",
+		mcp.WithDescription("Point the active Shadow session's peers at a file and line. Peers see the location, and peers running with --follow jump there in their editor."),
+		mcp.WithString("path",
+			mcp.Required(),
+			mcp.Description("File to show, absolute or relative to the shared workspace"),
+		),
+		mcp.WithNumber("line",
+			mcp.Description("One-based line number (default 1)"),
+		),
+	)
+}
+
+func shadowRunTaskTool() mcp.Tool {
+	return mcp.NewTool("shadow_run_task",
+		mcp.WithDescription("Run one of the tasks the Shadow session's host defined, such as tests or a linter, on the host's machine and return its output and exit code. Call it without a task to list the tasks. The host may have to allow each run."),
+		mcp.WithString("task",
+			mcp.Description("Name of the task to run; omit to list the available tasks"),
+		),
+	)
+}
+
 // --- Tool handlers ---
 
 func handleStart(sm *SessionManager) func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
@@ -124,9 +171,25 @@ func handleStatus(sm *SessionManager) func(ctx context.Context, req mcp.CallTool
 			if info.FileCount > 0 {
 				msg += fmt.Sprintf("\nFiles synced: %d", info.FileCount)
 			}
+			if progress := info.Bootstrap; progress != nil {
+				if progress.Done {
+					msg += fmt.Sprintf("\nInitial sync: complete (%d files)", progress.FilesDone)
+				} else {
+					msg += fmt.Sprintf("\nInitial sync: %d/%d files, %d/%d bytes", progress.FilesDone, progress.FilesTotal, progress.BytesDone, progress.BytesTotal)
+					if progress.ETASeconds > 0 {
+						msg += fmt.Sprintf(", about %ds left", progress.ETASeconds)
+					}
+				}
+			}
 			if info.ReadOnly {
 				msg += "\nRead-only: yes"
 			}
+			if len(info.Peers) > 0 {
+				msg += "\nConnected peers:"
+				for _, peer := range info.Peers {
+					msg += "\n  - " + peerSummary(peer)
+				}
+			}
 			if len(info.RecentFiles) > 0 {
 				msg += "\nRecent files:"
 				for _, f := range info.RecentFiles {
@@ -149,3 +212,97 @@ func handleStop(sm *SessionManager) func(ctx context.Context, req mcp.CallToolRe
 		return mcp.NewToolResultText("Session stopped."), nil
 	}
 }
+
+func handleChatPost(sm *SessionManager) func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		text, err := req.RequireString("text")
+		if err != nil {
+			return mcp.NewToolResultError("missing required parameter: text"), nil
+		}
+		if err := sm.Say(text); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return mcp.NewToolResultText("Message sent."), nil
+	}
+}
+
+func handleChatRead(sm *SessionManager) func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		messages := sm.Chat(req.GetInt("limit", 20))
+		if len(messages) == 0 {
+			return mcp.NewToolResultText("No chat messages yet."), nil
+		}
+		var msg strings.Builder
+		for i, message := range messages {
+			if i > 0 {
+				msg.WriteString("\n")
+			}
+			fmt.Fprintf(&msg, "[%s] %s: %s", message.Time.Local().Format("15:04:05"), message.From, message.Text)
+		}
+		return mcp.NewToolResultText(msg.String()), nil
+	}
+}
+
+func handleFocus(sm *SessionManager) func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		path, err := req.RequireString("path")
+		if err != nil {
+			return mcp.NewToolResultError("missing required parameter: path"), nil
+		}
+		line := req.GetInt("line", 1)
+		if err := sm.Focus(path, line); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return mcp.NewToolResultText(fmt.Sprintf("Peers were pointed at %s:%d.", path, line)), nil
+	}
+}
+
+func handleRunTask(sm *SessionManager) func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		task := req.GetString("task", "")
+		result, err := sm.RunTask(ctx, task)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		if task == "" {
+			if len(result.Tasks) == 0 {
+				return mcp.NewToolResultText("The host has not defined any tasks."), nil
+			}
+			return mcp.NewToolResultText("Tasks: " + strings.Join(result.Tasks, ", ")), nil
+		}
+		var msg strings.Builder
+		fmt.Fprintf(&msg, "%s exited with code %d.", task, result.ExitCode)
+		if result.Truncated {
+			msg.WriteString(" Only the end of its output is shown.")
+		}
+		if result.Output != "" {
+			msg.WriteString("\n\n")
+			msg.WriteString(result.Output)
+		}
+		if result.ExitCode != 0 {
+			return mcp.NewToolResultError(msg.String()), nil
+		}
+		return mcp.NewToolResultText(msg.String()), nil
+	}
+}
+
+func peerSummary(peer Peer) string {
+	summary := peer.Name
+	if summary == "" {
+		summary = "peer " + peer.ID
+	}
+	var details []string
+	if peer.Host {
+		details = append(details, "host")
+	}
+	if peer.Editor != "" {
+		details = append(details, peer.Editor)
+	}
+	if peer.Version != "" {
+		details = append(details, peer.Version)
+	}
+	if len(details) > 0 {
+		summary += " (" + strings.Join(details, ", ") + ")"
+	}
+	return summary
+}
@@ -0,0 +1,374 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxSessions     = 100
+	defaultIdleTimeout     = 10 * time.Minute
+	maxHostGracePeriod     = time.Hour
+	maxCreateRequestBytes  = 4096
+	sessionIDBytes         = 12
+	sessionTokenBytes      = 32
+	idleSweepMinimumPeriod = time.Second
+)
+
+// HubConfig configures a Hub.
+type HubConfig struct {
+	// AdminToken authorizes creating sessions. Ending one early takes that
+	// session's host token, so hosts sharing the admin token cannot end
+	// each other's sessions.
+	AdminToken string
+	// MaxSessions caps how many sessions exist at once. Zero means
+	// defaultMaxSessions.
+	MaxSessions int
+	// IdleTimeout removes a session once it has had no peers for this long,
+	// including sessions nobody has connected to yet. Zero means
+	// defaultIdleTimeout.
+	IdleTimeout time.Duration
+	// SessionCaps bounds the sessions POST /sessions creates. Each nonzero
+	// limit in it, and its HostGracePeriod, is the most a request may ask
+	// for: a request above one is refused, and one that leaves a limit at
+	// its default gets the lower of the default and the cap. Its other
+	// fields are ignored.
+	SessionCaps SessionConfig
+	// NoSnapshotCache refuses sessions that ask for SnapshotCache. Cached
+	// snapshots are held in the relay's memory, each up to the capped
+	// MaxSnapshotBytes.
+	NoSnapshotCache bool
+}
+
+// Hub relays many sessions, each reachable at /s/<id>/ws with its own host
+// and join tokens. Like Relay, it only sees encrypted payloads.
+//
+// Sessions are created with an authenticated POST /sessions and may be
+// ended early by their host with DELETE /sessions/<id>. The hub does not
+// serve its metrics; ServeMetrics is meant for a separate listener.
+type Hub struct {
+	config HubConfig
+	mux    *http.ServeMux
+
+	mu       sync.Mutex
+	sessions map[string]*sessionRelay
+	created  uint64
+	counters *relayCounters
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// CreateSessionRequest is the body of POST /sessions. Every field is
+// optional.
+type CreateSessionRequest struct {
+	ReadOnlyJoiners    bool `json:"read_only_joiners,omitempty"`
+	ApproveJoinerEdits bool `json:"approve_joiner_edits,omitempty"`
+	// HostGraceSeconds is the session's HostGracePeriod.
+	HostGraceSeconds int `json:"host_grace_seconds,omitempty"`
+	// AllowStandby is the session's AllowStandby.
+	AllowStandby bool `json:"allow_standby,omitempty"`
+	// The session's limits, as in SessionConfig. Zero uses the default.
+	MaxPeers           int `json:"max_peers,omitempty"`
+	MaxSyncingPeers    int `json:"max_syncing_peers,omitempty"`
+	MaxQueuedMessages  int `json:"max_queued_messages,omitempty"`
+	MaxQueuedBytes     int `json:"max_queued_bytes,omitempty"`
+	MaxMessageBytes    int `json:"max_message_bytes,omitempty"`
+	SyncTimeoutSeconds int `json:"sync_timeout_seconds,omitempty"`
+	// SnapshotCache is the session's SnapshotCache.
+	SnapshotCache bool `json:"snapshot_cache,omitempty"`
+}
+
+// CreatedSession is the response to POST /sessions. Path is where the host
+// and joiners connect, relative to the hub's URL.
+type CreatedSession struct {
+	ID        string `json:"id"`
+	Path      string `json:"path"`
+	HostToken string `json:"host_token"`
+	JoinToken string `json:"join_token"`
+}
+
+// NewHub returns a hub and starts removing idle sessions until Close.
+func NewHub(config HubConfig) (*Hub, error) {
+	if strings.TrimSpace(config.AdminToken) == "" {
+		return nil, fmt.Errorf("relay needs an admin token")
+	}
+	if config.MaxSessions < 0 || config.IdleTimeout < 0 || config.SessionCaps.HostGracePeriod < 0 {
+		return nil, fmt.Errorf("relay limits must not be negative")
+	}
+	if err := config.SessionCaps.Validate(); err != nil {
+		return nil, fmt.Errorf("relay session caps: %w", err)
+	}
+	if config.MaxSessions == 0 {
+		config.MaxSessions = defaultMaxSessions
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = defaultIdleTimeout
+	}
+	h := &Hub{
+		config:   config,
+		mux:      http.NewServeMux(),
+		sessions: make(map[string]*sessionRelay),
+		counters: &relayCounters{},
+		stop:     make(chan struct{}),
+	}
+	h.mux.HandleFunc("POST /sessions", h.createSession)
+	h.mux.HandleFunc("DELETE /sessions/{id}", h.deleteSession)
+	h.mux.HandleFunc("GET /s/{id}/ws", h.serveSession)
+	go h.sweepIdle()
+	return h, nil
+}
+
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Close stops removing idle sessions and disconnects every peer.
+func (h *Hub) Close() {
+	h.stopOnce.Do(func() { close(h.stop) })
+	h.mu.Lock()
+	sessions := h.sessions
+	h.sessions = make(map[string]*sessionRelay)
+	h.mu.Unlock()
+	for _, session := range sessions {
+		session.retire()
+	}
+}
+
+// SessionCount reports how many sessions the hub holds.
+func (h *Hub) SessionCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.sessions)
+}
+
+func (h *Hub) authorized(r *http.Request) bool {
+	return bearerMatches(r, h.config.AdminToken)
+}
+
+// bearerMatches reports whether r carries token as its bearer token.
+func bearerMatches(r *http.Request, token string) bool {
+	const bearer = "Bearer "
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, bearer) {
+		return false
+	}
+	return secureTokenEqual(strings.TrimSpace(strings.TrimPrefix(authorization, bearer)), token)
+}
+
+func (h *Hub) createSession(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var request CreateSessionRequest
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxCreateRequestBytes+1))
+	if err != nil || len(body) > maxCreateRequestBytes {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(strings.TrimSpace(string(body))) > 0 {
+		if err := json.Unmarshal(body, &request); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	grace := time.Duration(request.HostGraceSeconds) * time.Second
+	if grace < 0 || grace > maxHostGracePeriod {
+		http.Error(w, fmt.Sprintf("host_grace_seconds must be between 0 and %d", int(maxHostGracePeriod.Seconds())), http.StatusBadRequest)
+		return
+	}
+
+	config := SessionConfig{
+		ReadOnlyJoiners:    request.ReadOnlyJoiners,
+		ApproveJoinerEdits: request.ApproveJoinerEdits && !request.ReadOnlyJoiners,
+		HostGracePeriod:    grace,
+		AllowStandby:       request.AllowStandby,
+		MaxPeers:           request.MaxPeers,
+		MaxSyncingPeers:    request.MaxSyncingPeers,
+		MaxQueuedMessages:  request.MaxQueuedMessages,
+		MaxQueuedBytes:     request.MaxQueuedBytes,
+		MaxMessageBytes:    request.MaxMessageBytes,
+		SyncTimeout:        time.Duration(request.SyncTimeoutSeconds) * time.Second,
+		SnapshotCache:      request.SnapshotCache,
+	}
+	config, err = h.capSession(config)
+	if err == nil {
+		err = config.Validate()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, hostToken, joinToken, err := newSessionCredentials()
+	if err != nil {
+		http.Error(w, "failed to create session", http.StatusInternalServerError)
+		return
+	}
+	config.HostToken, config.JoinToken = hostToken, joinToken
+	session := newSessionRelay()
+	session.counters.parent = h.counters
+	session.config = config.withDefaults()
+
+	h.mu.Lock()
+	if len(h.sessions) >= h.config.MaxSessions {
+		h.mu.Unlock()
+		http.Error(w, "relay has too many sessions", http.StatusServiceUnavailable)
+		return
+	}
+	h.sessions[id] = session
+	h.created++
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(CreatedSession{
+		ID:        id,
+		Path:      "/s/" + id + "/ws",
+		HostToken: hostToken,
+		JoinToken: joinToken,
+	})
+}
+
+// capSession holds a requested session to the hub's SessionCaps, filling in
+// capped defaults. Fields are named as in CreateSessionRequest.
+func (h *Hub) capSession(config SessionConfig) (SessionConfig, error) {
+	caps := h.config.SessionCaps
+	if config.SnapshotCache && h.config.NoSnapshotCache {
+		return config, fmt.Errorf("snapshot_cache is turned off on this relay")
+	}
+	if caps.HostGracePeriod > 0 && config.HostGracePeriod > caps.HostGracePeriod {
+		return config, fmt.Errorf("host_grace_seconds must be at most %d on this relay", int(caps.HostGracePeriod.Seconds()))
+	}
+	if caps.SyncTimeout > 0 {
+		if config.SyncTimeout > caps.SyncTimeout {
+			return config, fmt.Errorf("sync_timeout_seconds must be at most %d on this relay", int(caps.SyncTimeout.Seconds()))
+		}
+		if config.SyncTimeout == 0 {
+			config.SyncTimeout = min(syncTimeout, caps.SyncTimeout)
+		}
+	}
+	if err := capLimit("max_peers", &config.MaxPeers, caps.MaxPeers, maxSessionPeers); err != nil {
+		return config, err
+	}
+	// The default syncing peers depend on the peers just settled.
+	defaults := config.withDefaults()
+	for _, limit := range []struct {
+		name               string
+		value              *int
+		most, defaultValue int
+	}{
+		{"max_syncing_peers", &config.MaxSyncingPeers, caps.MaxSyncingPeers, defaults.MaxSyncingPeers},
+		{"max_queued_messages", &config.MaxQueuedMessages, caps.MaxQueuedMessages, defaults.MaxQueuedMessages},
+		{"max_queued_bytes", &config.MaxQueuedBytes, caps.MaxQueuedBytes, defaults.MaxQueuedBytes},
+		{"max_message_bytes", &config.MaxMessageBytes, caps.MaxMessageBytes, defaults.MaxMessageBytes},
+		{"max_snapshot_bytes", &config.MaxSnapshotBytes, caps.MaxSnapshotBytes, defaults.MaxSnapshotBytes},
+	} {
+		if err := capLimit(limit.name, limit.value, limit.most, limit.defaultValue); err != nil {
+			return config, err
+		}
+	}
+	return config, nil
+}
+
+// capLimit refuses a value above most, unless most is zero, and replaces a
+// default one with the lower of defaultValue and most.
+func capLimit(name string, value *int, most, defaultValue int) error {
+	switch {
+	case most == 0:
+	case *value > most:
+		return fmt.Errorf("%s must be at most %d on this relay", name, most)
+	case *value == 0:
+		*value = min(defaultValue, most)
+	}
+	return nil
+}
+
+func (h *Hub) deleteSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	h.mu.Lock()
+	session, ok := h.sessions[id]
+	h.mu.Unlock()
+	if !ok {
+		http.Error(w, "no such session", http.StatusNotFound)
+		return
+	}
+	session.mu.Lock()
+	hostToken := session.config.HostToken
+	session.mu.Unlock()
+	if !bearerMatches(r, hostToken) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	h.mu.Lock()
+	if h.sessions[id] == session {
+		delete(h.sessions, id)
+	}
+	h.mu.Unlock()
+	session.retire()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Hub) serveSession(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	session, ok := h.sessions[r.PathValue("id")]
+	h.mu.Unlock()
+	if !ok {
+		http.Error(w, "no such session", http.StatusNotFound)
+		return
+	}
+	session.serveHTTP(w, r)
+}
+
+// sweepIdle removes sessions that have been empty for IdleTimeout.
+func (h *Hub) sweepIdle() {
+	ticker := time.NewTicker(max(h.config.IdleTimeout/4, idleSweepMinimumPeriod))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case now := <-ticker.C:
+			h.removeIdle(now)
+		}
+	}
+}
+
+func (h *Hub) removeIdle(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, session := range h.sessions {
+		if session.retireIfIdle(now, h.config.IdleTimeout) {
+			delete(h.sessions, id)
+		}
+	}
+}
+
+func newSessionCredentials() (id, hostToken, joinToken string, err error) {
+	if id, err = randomToken(sessionIDBytes); err != nil {
+		return "", "", "", err
+	}
+	if hostToken, err = randomToken(sessionTokenBytes); err != nil {
+		return "", "", "", err
+	}
+	if joinToken, err = randomToken(sessionTokenBytes); err != nil {
+		return "", "", "", err
+	}
+	return id, hostToken, joinToken, nil
+}
+
+func randomToken(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+func createHubSession(t *testing.T, serverURL, adminToken, body string) (*http.Response, CreatedSession) {
+	t.Helper()
+	request, err := http.NewRequest("POST", serverURL+"/sessions", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Authorization", "Bearer "+adminToken)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var created CreatedSession
+	if response.StatusCode == http.StatusCreated {
+		if err := json.NewDecoder(response.Body).Decode(&created); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return response, created
+}
+
+func dialHubSession(serverURL, path, token string) (*websocket.Conn, int, error) {
+	dialer := websocket.Dialer{Subprotocols: []string{protocol.WebSocketSubprotocol}}
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+	conn, response, err := dialer.Dial("ws"+strings.TrimPrefix(serverURL, "http")+path, header)
+	status := 0
+	if response != nil {
+		status = response.StatusCode
+	}
+	return conn, status, err
+}
+
+func TestHubRelaysSeparateSessions(t *testing.T) {
+	hub, err := NewHub(HubConfig{AdminToken: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	server := httptest.NewServer(hub)
+	defer server.Close()
+
+	if response, _ := createHubSession(t, server.URL, "wrong", ""); response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("create with a bad admin token = %d, want 401", response.StatusCode)
+	}
+	if response, _ := createHubSession(t, server.URL, "admin", `{"host_grace_seconds":-1}`); response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("create with a negative grace = %d, want 400", response.StatusCode)
+	}
+	_, first := createHubSession(t, server.URL, "admin", "")
+	_, second := createHubSession(t, server.URL, "admin", `{"read_only_joiners":true}`)
+	if first.ID == "" || second.ID == "" || first.ID == second.ID || first.HostToken == first.JoinToken {
+		t.Fatalf("unexpected sessions: %+v %+v", first, second)
+	}
+	if hub.SessionCount() != 2 {
+		t.Fatalf("hub has %d sessions, want 2", hub.SessionCount())
+	}
+
+	if _, status, _ := dialHubSession(server.URL, "/s/missing/ws", first.HostToken); status != http.StatusNotFound {
+		t.Fatalf("unknown session status = %d, want 404", status)
+	}
+	if _, status, _ := dialHubSession(server.URL, second.Path, first.HostToken); status != http.StatusUnauthorized {
+		t.Fatalf("another session's token status = %d, want 401", status)
+	}
+
+	host, _, err := dialHubSession(server.URL, first.Path, first.HostToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	joiner, _, err := dialHubSession(server.URL, first.Path, first.JoinToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer joiner.Close()
+
+	host.SetReadDeadline(time.Now().Add(5 * time.Second))
+	sawSyncRequest := false
+	for !sawSyncRequest {
+		_, message, err := host.ReadMessage()
+		if err != nil {
+			t.Fatalf("host did not get the joiner's sync request: %v", err)
+		}
+		sawSyncRequest = strings.Contains(string(message), protocol.SyncRequestKey)
+	}
+
+	deleteAs := func(token string) int {
+		t.Helper()
+		request, _ := http.NewRequest("DELETE", server.URL+"/sessions/"+first.ID, nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+	for _, token := range []string{"admin", first.JoinToken} {
+		if status := deleteAs(token); status != http.StatusUnauthorized {
+			t.Fatalf("delete with a token other than the host's: status = %d, want 401", status)
+		}
+	}
+	if status := deleteAs(first.HostToken); status != http.StatusNoContent {
+		t.Fatalf("delete status = %d, want 204", status)
+	}
+	for {
+		if _, _, err := host.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if _, status, _ := dialHubSession(server.URL, first.Path, first.HostToken); status != http.StatusNotFound {
+		t.Fatalf("deleted session status = %d, want 404", status)
+	}
+}
+
+func TestHubRemovesIdleSessions(t *testing.T) {
+	hub, err := NewHub(HubConfig{AdminToken: "admin", IdleTimeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	server := httptest.NewServer(hub)
+	defer server.Close()
+
+	_, created := createHubSession(t, server.URL, "admin", "")
+	hub.removeIdle(time.Now())
+	if hub.SessionCount() != 1 {
+		t.Fatal("removed a session before it went idle")
+	}
+	hub.removeIdle(time.Now().Add(2 * time.Minute))
+	if hub.SessionCount() != 0 {
+		t.Fatal("kept an idle session")
+	}
+	if _, status, _ := dialHubSession(server.URL, created.Path, created.HostToken); status != http.StatusNotFound {
+		t.Fatalf("idle session status = %d, want 404", status)
+	}
+}
+
+func TestHubLimitsSessions(t *testing.T) {
+	if _, err := NewHub(HubConfig{}); err == nil {
+		t.Fatal("created a hub without an admin token")
+	}
+	hub, err := NewHub(HubConfig{AdminToken: "admin", MaxSessions: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	server := httptest.NewServer(hub)
+	defer server.Close()
+
+	createHubSession(t, server.URL, "admin", "")
+	if response, _ := createHubSession(t, server.URL, "admin", ""); response.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("create over the limit = %d, want 503", response.StatusCode)
+	}
+}
+
+func TestHubCapsRequestedSessions(t *testing.T) {
+	if _, err := NewHub(HubConfig{AdminToken: "admin", SessionCaps: SessionConfig{MaxPeers: 1}}); err == nil {
+		t.Fatal("created a hub whose cap leaves no room for a joiner")
+	}
+	hub, err := NewHub(HubConfig{AdminToken: "admin", SessionCaps: SessionConfig{
+		MaxPeers:        4,
+		MaxQueuedBytes:  maxRelayMessageBytes,
+		HostGracePeriod: time.Minute,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	server := httptest.NewServer(hub)
+	defer server.Close()
+
+	for _, body := range []string{`{"max_peers":5}`, `{"max_queued_bytes":33554432}`, `{"host_grace_seconds":120}`} {
+		if response, _ := createHubSession(t, server.URL, "admin", body); response.StatusCode != http.StatusBadRequest {
+			t.Fatalf("create with %s over the caps = %d, want 400", body, response.StatusCode)
+		}
+	}
+	response, created := createHubSession(t, server.URL, "admin", `{"max_peers":3}`)
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("create within the caps = %d, want 201", response.StatusCode)
+	}
+	hub.mu.Lock()
+	config := hub.sessions[created.ID].config
+	hub.mu.Unlock()
+	if config.MaxPeers != 3 || config.MaxQueuedBytes != maxRelayMessageBytes || config.MaxQueuedMessages != maxQueuedMessages {
+		t.Fatalf("capped session limits = peers %d, queued bytes %d, queued messages %d", config.MaxPeers, config.MaxQueuedBytes, config.MaxQueuedMessages)
+	}
+}
+
+func TestHubCanRefuseSnapshotCache(t *testing.T) {
+	hub, err := NewHub(HubConfig{AdminToken: "admin", NoSnapshotCache: true, SessionCaps: SessionConfig{MaxSnapshotBytes: minMessageBytesLimit}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	server := httptest.NewServer(hub)
+	defer server.Close()
+	if response, _ := createHubSession(t, server.URL, "admin", `{"snapshot_cache":true}`); response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("create with snapshot_cache on a relay without it = %d, want 400", response.StatusCode)
+	}
+	response, created := createHubSession(t, server.URL, "admin", "")
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("create = %d, want 201", response.StatusCode)
+	}
+	hub.mu.Lock()
+	snapshotBytes := hub.sessions[created.ID].config.MaxSnapshotBytes
+	hub.mu.Unlock()
+	if snapshotBytes != minMessageBytesLimit {
+		t.Fatalf("session snapshot cap = %d, want %d", snapshotBytes, minMessageBytesLimit)
+	}
+}
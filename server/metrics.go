@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Reasons a peer's registration was refused.
+const (
+	rejectUnauthorized   = "unauthorized"
+	rejectSessionClosed  = "session_closed"
+	rejectSessionFull    = "session_full"
+	rejectHostTaken      = "host_taken"
+	rejectResumeGap      = "resume_gap"
+	rejectNoHost         = "no_host"
+	rejectTooManySyncing = "too_many_syncing"
+	rejectQueueFull      = "queue_full"
+	rejectStandbyRefused = "standby_refused"
+)
+
+// Reasons the relay disconnected a peer.
+const (
+	dropQueueFull   = "queue_full"
+	dropPendingFull = "pending_full"
+	dropSyncTimeout = "sync_timeout"
+	dropWriteFailed = "write_failed"
+)
+
+// Reasons a session ended.
+const (
+	endHostLeft     = "host_left"
+	endGraceExpired = "grace_expired"
+	endClosed       = "closed"
+)
+
+type counterKind int
+
+const (
+	counterRejected counterKind = iota
+	counterDropped
+	counterEnded
+	counterKinds
+)
+
+// relayCounters counts events by reason. Counts also go to parent, so a hub
+// keeps its totals after a session is removed.
+type relayCounters struct {
+	mu     sync.Mutex
+	counts [counterKinds]map[string]uint64
+	parent *relayCounters
+}
+
+func (c *relayCounters) add(kind counterKind, reason string) {
+	for ; c != nil; c = c.parent {
+		c.mu.Lock()
+		if c.counts[kind] == nil {
+			c.counts[kind] = make(map[string]uint64)
+		}
+		c.counts[kind][reason]++
+		c.mu.Unlock()
+	}
+}
+
+func (c *relayCounters) reject(reason string) { c.add(counterRejected, reason) }
+func (c *relayCounters) drop(reason string)   { c.add(counterDropped, reason) }
+func (c *relayCounters) end(reason string)    { c.add(counterEnded, reason) }
+
+func (c *relayCounters) snapshot(kind counterKind) map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]uint64, len(c.counts[kind]))
+	for reason, count := range c.counts[kind] {
+		counts[reason] = count
+	}
+	return counts
+}
+
+// sessionStats is what /metrics reports about one session.
+type sessionStats struct {
+	peers          int
+	syncingPeers   int
+	hostConnected  bool
+	queuedMessages int
+	queuedBytes    int
+	pendingBytes   int
+	backlogBytes   int
+	snapshotBytes  int
+	sequence       uint64
+}
+
+func (s *sessionRelay) stats() sessionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := sessionStats{
+		peers:         len(s.peers),
+		hostConnected: s.host != nil,
+		backlogBytes:  s.backlogBytes,
+		sequence:      s.sequence,
+	}
+	if s.snapshot != nil {
+		stats.snapshotBytes = s.snapshot.bytes
+	}
+	for peer := range s.peers {
+		if peer.syncing {
+			stats.syncingPeers++
+		}
+		stats.pendingBytes += peer.pendingBytes
+		peer.queueMu.Lock()
+		stats.queuedMessages += len(peer.queue)
+		stats.queuedBytes += peer.queueBytes
+		peer.queueMu.Unlock()
+	}
+	return stats
+}
+
+// ServeMetrics reports the session in the Prometheus text format.
+func (r *Relay) ServeMetrics(w http.ResponseWriter, _ *http.Request) {
+	writeMetrics(w, map[string]*sessionRelay{"default": r.session}, r.session.counters, nil)
+}
+
+// ServeMetrics reports every session and the hub's totals in the
+// Prometheus text format.
+func (h *Hub) ServeMetrics(w http.ResponseWriter, _ *http.Request) {
+	h.mu.Lock()
+	sessions := make(map[string]*sessionRelay, len(h.sessions))
+	for id, session := range h.sessions {
+		sessions[id] = session
+	}
+	created := h.created
+	h.mu.Unlock()
+	writeMetrics(w, sessions, h.counters, []metricFamily{{
+		name:    "shadow_relay_sessions_created_total",
+		help:    "Sessions created on the relay.",
+		kind:    "counter",
+		samples: []metricSample{{value: float64(created)}},
+	}})
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	samples []metricSample
+}
+
+type metricSample struct {
+	labels []string // name, value pairs
+	value  float64
+}
+
+func writeMetrics(w http.ResponseWriter, sessions map[string]*sessionRelay, totals *relayCounters, extra []metricFamily) {
+	ids := make([]string, 0, len(sessions))
+	for id := range sessions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	perSession := []struct {
+		name, help string
+		value      func(sessionStats) float64
+	}{
+		{"shadow_relay_session_peers", "Peers connected to the session.", func(s sessionStats) float64 { return float64(s.peers) }},
+		{"shadow_relay_session_syncing_peers", "Joiners still receiving the session's files.", func(s sessionStats) float64 { return float64(s.syncingPeers) }},
+		{"shadow_relay_session_host_connected", "Whether the session's host is connected.", func(s sessionStats) float64 { return boolValue(s.hostConnected) }},
+		{"shadow_relay_session_queued_messages", "Messages waiting to be written to the session's peers.", func(s sessionStats) float64 { return float64(s.queuedMessages) }},
+		{"shadow_relay_session_queued_bytes", "Bytes waiting to be written to the session's peers.", func(s sessionStats) float64 { return float64(s.queuedBytes) }},
+		{"shadow_relay_session_pending_bootstrap_bytes", "Bytes of updates held for joiners until their sync completes.", func(s sessionStats) float64 { return float64(s.pendingBytes) }},
+		{"shadow_relay_session_backlog_bytes", "Bytes of updates kept for a reconnecting host.", func(s sessionStats) float64 { return float64(s.backlogBytes) }},
+		{"shadow_relay_session_snapshot_bytes", "Bytes of the encrypted snapshot cached for new joiners.", func(s sessionStats) float64 { return float64(s.snapshotBytes) }},
+		{"shadow_relay_session_sequence", "Sequence number of the session's latest ordered update.", func(s sessionStats) float64 { return float64(s.sequence) }},
+	}
+	families := make([]metricFamily, 0, len(perSession)+12)
+	stats := make([]sessionStats, len(ids))
+	for i, id := range ids {
+		stats[i] = sessions[id].stats()
+	}
+	var total sessionStats
+	for _, s := range stats {
+		total.peers += s.peers
+		total.syncingPeers += s.syncingPeers
+		total.queuedBytes += s.queuedBytes
+		total.pendingBytes += s.pendingBytes
+	}
+	families = append(families,
+		metricFamily{name: "shadow_relay_sessions", help: "Sessions the relay holds.", kind: "gauge", samples: []metricSample{{value: float64(len(ids))}}},
+		metricFamily{name: "shadow_relay_peers", help: "Peers connected across all sessions.", kind: "gauge", samples: []metricSample{{value: float64(total.peers)}}},
+		metricFamily{name: "shadow_relay_syncing_peers", help: "Joiners still receiving files across all sessions.", kind: "gauge", samples: []metricSample{{value: float64(total.syncingPeers)}}},
+		metricFamily{name: "shadow_relay_queued_bytes", help: "Bytes waiting to be written to peers across all sessions.", kind: "gauge", samples: []metricSample{{value: float64(total.queuedBytes)}}},
+		metricFamily{name: "shadow_relay_pending_bootstrap_bytes", help: "Bytes of updates held for syncing joiners across all sessions.", kind: "gauge", samples: []metricSample{{value: float64(total.pendingBytes)}}},
+	)
+	families = append(families, extra...)
+	families = append(families,
+		reasonFamily("shadow_relay_rejected_registrations_total", "Peers refused when connecting, by reason.", nil, totals.snapshot(counterRejected)),
+		reasonFamily("shadow_relay_dropped_peers_total", "Peers the relay disconnected, by reason.", nil, totals.snapshot(counterDropped)),
+		reasonFamily("shadow_relay_sessions_ended_total", "Sessions that ended, by reason.", nil, totals.snapshot(counterEnded)),
+	)
+
+	for _, metric := range perSession {
+		family := metricFamily{name: metric.name, help: metric.help, kind: "gauge"}
+		for i, id := range ids {
+			family.samples = append(family.samples, metricSample{labels: []string{"session", id}, value: metric.value(stats[i])})
+		}
+		families = append(families, family)
+	}
+	rejected := metricFamily{name: "shadow_relay_session_rejected_registrations_total", help: "Peers refused when connecting to the session, by reason.", kind: "counter"}
+	dropped := metricFamily{name: "shadow_relay_session_dropped_peers_total", help: "Peers the relay disconnected from the session, by reason.", kind: "counter"}
+	ended := metricFamily{name: "shadow_relay_session_ended_total", help: "Times the session ended, by reason.", kind: "counter"}
+	for _, id := range ids {
+		counters := sessions[id].counters
+		rejected.samples = append(rejected.samples, reasonFamily("", "", []string{"session", id}, counters.snapshot(counterRejected)).samples...)
+		dropped.samples = append(dropped.samples, reasonFamily("", "", []string{"session", id}, counters.snapshot(counterDropped)).samples...)
+		ended.samples = append(ended.samples, reasonFamily("", "", []string{"session", id}, counters.snapshot(counterEnded)).samples...)
+	}
+	families = append(families, rejected, dropped, ended)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	for _, family := range families {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		for _, sample := range family.samples {
+			out.WriteString(family.name)
+			if len(sample.labels) > 0 {
+				out.WriteByte('{')
+				for i := 0; i < len(sample.labels); i += 2 {
+					if i > 0 {
+						out.WriteByte(',')
+					}
+					fmt.Fprintf(out, "%s=\"%s\"", sample.labels[i], escapeLabel(sample.labels[i+1]))
+				}
+				out.WriteByte('}')
+			}
+			out.WriteByte(' ')
+			out.WriteString(strconv.FormatFloat(sample.value, 'g', -1, 64))
+			out.WriteByte('\n')
+		}
+	}
+	_ = out.Flush()
+}
+
+// reasonFamily turns counts by reason into a counter family, one sample per
+// reason in a stable order.
+func reasonFamily(name, help string, labels []string, counts map[string]uint64) metricFamily {
+	family := metricFamily{name: name, help: help, kind: "counter"}
+	reasons := make([]string, 0, len(counts))
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		sampleLabels := append(append([]string(nil), labels...), "reason", reason)
+		family.samples = append(family.samples, metricSample{labels: sampleLabels, value: float64(counts[reason])})
+	}
+	return family
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRelayMetricsReportDropsAndEndings(t *testing.T) {
+	relay := NewRelay(SessionConfig{HostToken: "host-token", JoinToken: "join-token"})
+	session := relay.session
+	host := newRelayPeer(&mockPeer{}, roleHost)
+	joiner := newRelayPeer(&mockPeer{}, roleJoiner)
+	late := newRelayPeer(&mockPeer{}, roleJoiner)
+	if !session.register(host) || !session.register(joiner) {
+		t.Fatal("failed to register test peers")
+	}
+	if !session.acceptNormal(host, "ordered") {
+		t.Fatal("update was rejected")
+	}
+	session.timeoutSync(joiner)
+	session.unregister(host)
+	if session.register(late) {
+		t.Fatal("joiner registered without a host")
+	}
+
+	response := httptest.NewRecorder()
+	relay.ServeMetrics(response, httptest.NewRequest("GET", "/metrics", nil))
+	body := response.Body.String()
+	for _, want := range []string{
+		"# TYPE shadow_relay_sessions gauge\nshadow_relay_sessions 1\n",
+		`shadow_relay_session_sequence{session="default"} 1`,
+		`shadow_relay_session_peers{session="default"} 0`,
+		`shadow_relay_dropped_peers_total{reason="sync_timeout"} 1`,
+		`shadow_relay_rejected_registrations_total{reason="no_host"} 1`,
+		`shadow_relay_sessions_ended_total{reason="host_left"} 1`,
+		`shadow_relay_session_dropped_peers_total{session="default",reason="sync_timeout"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("metrics are missing %q:\n%s", want, body)
+		}
+	}
+	if got := response.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Fatalf("content type = %q", got)
+	}
+}
+
+func TestHubMetricsKeepTotalsOfRemovedSessions(t *testing.T) {
+	hub, err := NewHub(HubConfig{AdminToken: "admin", IdleTimeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	server := httptest.NewServer(hub)
+	defer server.Close()
+
+	_, created := createHubSession(t, server.URL, "admin", "")
+	if _, status, _ := dialHubSession(server.URL, created.Path, "wrong-token"); status != 401 {
+		t.Fatalf("bad token status = %d, want 401", status)
+	}
+	hub.removeIdle(time.Now().Add(2 * time.Minute))
+
+	public := httptest.NewRecorder()
+	hub.ServeHTTP(public, httptest.NewRequest("GET", "/metrics", nil))
+	if public.Code != 404 {
+		t.Fatalf("hub served /metrics next to the sessions: status %d", public.Code)
+	}
+	response := httptest.NewRecorder()
+	hub.ServeMetrics(response, httptest.NewRequest("GET", "/metrics", nil))
+	body := response.Body.String()
+	for _, want := range []string{
+		"shadow_relay_sessions 0\n",
+		"shadow_relay_sessions_created_total 1\n",
+		`shadow_relay_rejected_registrations_total{reason="unauthorized"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("metrics are missing %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// maxSnapshotBytes is the default MaxSnapshotBytes. A host whose files
+	// outgrow it is told to stop uploading, and joiners sync from the host
+	// instead.
+	maxSnapshotBytes = 256 * 1024 * 1024
+	// snapshotFeedBytes is roughly how much of a cached snapshot is queued
+	// for a joiner at a time.
+	snapshotFeedBytes = 4 * 1024 * 1024
+)
+
+// cachedSnapshot is a host's bootstrap messages, still encrypted and framed
+// for joiners, as of the ordered operation numbered sequence. It is not
+// changed once complete, so joiners can be fed from it without the lock.
+type cachedSnapshot struct {
+	sequence uint64
+	chunks   [][]byte
+	bytes    int
+}
+
+// acceptSnapshot adds one message to the snapshot the host is uploading. A
+// message for a different sequence starts a new snapshot.
+func (s *sessionRelay) acceptSnapshot(source *relayPeer, sequence uint64, encryptedPayload string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if source != s.host {
+		return false
+	}
+	if !s.config.SnapshotCache || s.snapshotRefused || sequence > s.sequence {
+		return true
+	}
+	if s.snapshotBuild == nil || s.snapshotBuild.sequence != sequence {
+		s.snapshotBuild = &cachedSnapshot{sequence: sequence}
+	}
+	chunk := protocol.EncodeBootstrapEncrypted(encryptedPayload)
+	if s.snapshotBuild.bytes+len(chunk) > s.config.MaxSnapshotBytes {
+		s.snapshotBuild = nil
+		s.snapshotRefused = true
+		if !source.enqueue(outboundMessage{
+			msgType: websocket.TextMessage,
+			data:    protocol.EncodeControlSnapshotCache(false),
+		}) {
+			s.dropLocked(source, dropQueueFull)
+		}
+		return true
+	}
+	s.snapshotBuild.chunks = append(s.snapshotBuild.chunks, chunk)
+	s.snapshotBuild.bytes += len(chunk)
+	return true
+}
+
+// completeSnapshot replaces the cached snapshot with the one just uploaded.
+func (s *sessionRelay) completeSnapshot(source *relayPeer, sequence uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if source != s.host {
+		return false
+	}
+	if s.snapshotBuild != nil && s.snapshotBuild.sequence == sequence {
+		s.snapshot = s.snapshotBuild
+		s.snapshotBuild = nil
+		s.snapshotRefreshAsked = false
+		s.snapshotTailBytes = 0
+		if s.canResumeLocked(sequence) {
+			for _, message := range s.backlog[len(s.backlog)-int(s.sequence-sequence):] {
+				s.snapshotTailBytes += len(message.data)
+			}
+		}
+		s.askSnapshotRefreshLocked()
+	}
+	return true
+}
+
+// askSnapshotRefreshLocked asks the host for a new snapshot once the ordered
+// messages since the cached one fill half of what the relay can replay to a
+// joiner from it. The host uploads only then, so the cache keeps serving
+// joiners without the host re-sending every file on a timer.
+func (s *sessionRelay) askSnapshotRefreshLocked() {
+	if s.snapshot == nil || s.snapshotBuild != nil || s.snapshotRefreshAsked || s.host == nil {
+		return
+	}
+	messageRoom := min(maxBacklogMessages, s.config.MaxQueuedMessages)
+	byteRoom := min(maxBacklogBytes, s.config.MaxQueuedBytes)
+	tail := int(s.sequence - s.snapshot.sequence)
+	if s.canResumeLocked(s.snapshot.sequence) && tail*2 < messageRoom && s.snapshotTailBytes*2 < byteRoom {
+		return
+	}
+	s.snapshotRefreshAsked = true
+	if !s.host.enqueue(outboundMessage{
+		msgType: websocket.TextMessage,
+		data:    protocol.EncodeControlSnapshotRefresh(),
+	}) {
+		s.dropLocked(s.host, dropQueueFull)
+	}
+}
+
+// snapshotTailLocked returns the ordered messages since the cached snapshot,
+// or false if the cache cannot serve a joiner: there is none, the backlog no
+// longer reaches back to it, or the messages since would not fit the limits
+// for a syncing joiner.
+func (s *sessionRelay) snapshotTailLocked() ([]outboundMessage, bool) {
+	if s.snapshot == nil || !s.canResumeLocked(s.snapshot.sequence) {
+		return nil, false
+	}
+	tail := s.backlog[len(s.backlog)-int(s.sequence-s.snapshot.sequence):]
+	bytes := 0
+	for _, message := range tail {
+		bytes += len(message.data)
+	}
+	if len(tail) > s.config.MaxQueuedMessages || bytes > s.config.MaxQueuedBytes {
+		return nil, false
+	}
+	return tail, true
+}
+
+// serveSnapshotLocked syncs a new joiner from the cached snapshot instead of
+// the host. Operations since the snapshot are held like those that arrive
+// during the sync, and sent once the snapshot has been written.
+func (s *sessionRelay) serveSnapshotLocked(peer *relayPeer, tail []outboundMessage) bool {
+	snapshot := s.snapshot
+	peer.cachedSync = true
+	peer.pending = append([]outboundMessage(nil), tail...)
+	for _, message := range tail {
+		peer.pendingBytes += len(message.data)
+	}
+	if !peer.enqueue(outboundMessage{
+		msgType: websocket.TextMessage,
+		data:    protocol.EncodeControlSyncBaseline(snapshot.sequence),
+	}) {
+		s.removePeerLocked(peer)
+		return false
+	}
+	peer.syncTimer = time.AfterFunc(s.config.SyncTimeout, func() {
+		s.timeoutSync(peer)
+	})
+	s.feedSnapshotLocked(peer, snapshot, 0)
+	_, ok := s.peers[peer]
+	return ok
+}
+
+// feedSnapshotLocked queues the cached snapshot's chunks from next on, a few
+// megabytes at a time so a large snapshot never fills the joiner's queue.
+// Writing the last chunk queued asks for more, or finishes the sync.
+func (s *sessionRelay) feedSnapshotLocked(peer *relayPeer, snapshot *cachedSnapshot, next int) {
+	if _, ok := s.peers[peer]; !ok || !peer.syncing {
+		return
+	}
+	if next == len(snapshot.chunks) {
+		s.finishSyncLocked(peer)
+		return
+	}
+	end, queued := next, 0
+	for end < len(snapshot.chunks) && (end == next || queued+len(snapshot.chunks[end]) <= snapshotFeedBytes) {
+		queued += len(snapshot.chunks[end])
+		end++
+	}
+	for i := next; i < end; i++ {
+		message := outboundMessage{msgType: websocket.TextMessage, data: snapshot.chunks[i]}
+		if i == end-1 {
+			message.afterWrite = func() {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				s.feedSnapshotLocked(peer, snapshot, end)
+			}
+		}
+		if !peer.enqueue(message) {
+			s.dropLocked(peer, dropQueueFull)
+			return
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-johnnyhe/shadow/internal/protocol"
+)
+
+func TestCachedSnapshotSyncsJoinersWithoutHost(t *testing.T) {
+	session := newSessionRelay()
+	session.config = SessionConfig{HostToken: "host-token", JoinToken: "join-token", SnapshotCache: true}.withDefaults()
+	host := newRelayPeer(&mockPeer{}, roleHost)
+	if !session.register(host) {
+		t.Fatal("failed to register host")
+	}
+	if !strings.Contains(strings.Join(queuedData(host), "\n"), string(protocol.EncodeControlSnapshotCache(true))) {
+		t.Fatal("host was not told to cache a snapshot")
+	}
+	session.acceptNormal(host, "before")
+	for _, payload := range []string{"manifest", "file"} {
+		if !session.acceptSnapshot(host, 1, payload) {
+			t.Fatal("snapshot chunk was rejected")
+		}
+	}
+	session.acceptSnapshot(host, 0, "stale")
+	if session.snapshot != nil {
+		t.Fatal("cached an unfinished snapshot")
+	}
+	if !session.completeSnapshot(host, 1) {
+		t.Fatal("snapshot completion was rejected")
+	}
+	if session.snapshot != nil {
+		t.Fatal("cached a snapshot whose upload was restarted")
+	}
+	for _, payload := range []string{"manifest", "file"} {
+		session.acceptSnapshot(host, 1, payload)
+	}
+	session.completeSnapshot(host, 1)
+	session.acceptNormal(host, "after")
+	clearQueue(host)
+
+	joiners := make([]*relayPeer, 0, maxSyncingPeers+1)
+	for i := 0; i <= maxSyncingPeers; i++ {
+		joiner := newRelayPeer(&mockPeer{}, roleJoiner)
+		if !session.register(joiner) {
+			t.Fatalf("joiner %d was refused while the cache can sync it", i)
+		}
+		joiners = append(joiners, joiner)
+	}
+	if strings.Contains(strings.Join(queuedData(host), "\n"), protocol.SyncRequestKey) {
+		t.Fatal("host was asked to sync a joiner the cache serves")
+	}
+
+	joiner := joiners[0]
+	mock := joiner.conn.(*mockPeer)
+	go joiner.writeLoop(session)
+	t.Cleanup(func() { session.unregister(joiner) })
+	want := []string{
+		string(protocol.EncodeControlSyncBaseline(1)),
+		string(protocol.EncodeBootstrapEncrypted("manifest")),
+		string(protocol.EncodeBootstrapEncrypted("file")),
+		string(protocol.EncodeOrderedEncrypted(2, host.id, "after")),
+		string(protocol.EncodeControlSyncComplete()),
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		mock.mu.Lock()
+		got := make([]string, 0, len(want))
+		for _, message := range mock.messages {
+			for _, wanted := range want {
+				if string(message) == wanted {
+					got = append(got, wanted)
+				}
+			}
+		}
+		mock.mu.Unlock()
+		if len(got) == len(want) {
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Fatalf("joiner got %q, want %q", got, want)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("joiner got %q before timing out, want %q", got, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	session.mu.Lock()
+	syncing := joiner.syncing
+	session.mu.Unlock()
+	if syncing {
+		t.Fatal("joiner is still syncing after the cached snapshot")
+	}
+}
+
+func TestSnapshotCacheFallsBackToHost(t *testing.T) {
+	session := newSessionRelay()
+	session.config = SessionConfig{HostToken: "host-token", JoinToken: "join-token", SnapshotCache: true}.withDefaults()
+	host := newRelayPeer(&mockPeer{}, roleHost)
+	if !session.register(host) {
+		t.Fatal("failed to register host")
+	}
+	session.acceptSnapshot(host, 0, "manifest")
+	session.completeSnapshot(host, 0)
+	for i := 0; i <= maxBacklogMessages; i++ {
+		session.acceptNormal(host, "update")
+	}
+	clearQueue(host)
+
+	joiner := newRelayPeer(&mockPeer{}, roleJoiner)
+	if !session.register(joiner) {
+		t.Fatal("failed to register joiner")
+	}
+	if joiner.cachedSync || !strings.Contains(strings.Join(queuedData(host), "\n"), protocol.SyncRequestKey) {
+		t.Fatal("joiner was served a snapshot the backlog no longer reaches")
+	}
+
+	session.acceptSnapshot(host, session.sequence, "manifest")
+	session.snapshotBuild.bytes = maxSnapshotBytes
+	session.acceptSnapshot(host, session.sequence, "file")
+	if session.snapshotBuild != nil || !session.snapshotRefused {
+		t.Fatal("kept a snapshot above the size limit")
+	}
+	if !strings.Contains(strings.Join(queuedData(host), "\n"), string(protocol.EncodeControlSnapshotCache(false))) {
+		t.Fatal("host was not told to stop caching")
+	}
+}
+
+func TestRelayAsksForSnapshotBeforeBacklogOutrunsIt(t *testing.T) {
+	session := newSessionRelay()
+	session.config = SessionConfig{HostToken: "host-token", JoinToken: "join-token", SnapshotCache: true}.withDefaults()
+	host := newRelayPeer(&mockPeer{}, roleHost)
+	if !session.register(host) {
+		t.Fatal("failed to register host")
+	}
+	session.acceptSnapshot(host, 0, "manifest")
+	session.completeSnapshot(host, 0)
+	clearQueue(host)
+	refreshes := func() int {
+		count := 0
+		for _, message := range queuedData(host) {
+			if message == string(protocol.EncodeControlSnapshotRefresh()) {
+				count++
+			}
+		}
+		return count
+	}
+
+	half := maxBacklogMessages / 2
+	for i := 1; i < half; i++ {
+		session.acceptNormal(host, "update")
+	}
+	if refreshes() != 0 {
+		t.Fatal("asked for a snapshot while the backlog still covers the cached one")
+	}
+	for i := 0; i < 10; i++ {
+		session.acceptNormal(host, "update")
+	}
+	if refreshes() != 1 {
+		t.Fatalf("asked for %d snapshots once the backlog was half used, want 1", refreshes())
+	}
+
+	sequence := session.sequence
+	session.acceptSnapshot(host, sequence, "manifest")
+	session.completeSnapshot(host, sequence)
+	clearQueue(host)
+	session.acceptNormal(host, "update")
+	if refreshes() != 0 || session.snapshotRefreshAsked {
+		t.Fatal("asked again right after a fresh snapshot")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -14,6 +15,7 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// Default session limits, used for SessionConfig fields left at zero.
 const (
 	maxRelayMessageBytes = 20 * 1024 * 1024
 	maxQueuedMessages    = 4096
@@ -21,12 +23,119 @@ const (
 	maxSessionPeers      = 8
 	maxSyncingPeers      = 2
 	syncTimeout          = 2 * time.Minute
+	maxBacklogMessages   = 1024
+	maxBacklogBytes      = 16 * 1024 * 1024
+)
+
+// Bounds Validate enforces on configured limits. Messages cannot exceed the
+// default, since clients will not read larger ones.
+const (
+	maxPeersLimit          = 256
+	minQueuedMessagesLimit = 64
+	maxQueuedMessagesLimit = 1 << 20
+	minMessageBytesLimit   = 1024 * 1024
+	maxQueuedBytesLimit    = 1024 * 1024 * 1024
+	minSyncTimeoutLimit    = 10 * time.Second
+	maxSyncTimeoutLimit    = time.Hour
 )
 
 type SessionConfig struct {
 	ReadOnlyJoiners bool
-	HostToken       string
-	JoinToken       string
+	// ApproveJoinerEdits routes joiner operations to the host as proposals
+	// instead of broadcasting them. ReadOnlyJoiners takes precedence.
+	ApproveJoinerEdits bool
+	HostToken          string
+	JoinToken          string
+	// HostGracePeriod keeps joiners connected for this long after the host
+	// disconnects, so the host can reconnect and resume. When it runs out, a
+	// standby joiner is promoted to host if AllowStandby is set and one is
+	// connected. Zero ends the session as soon as the host leaves.
+	HostGracePeriod time.Duration
+	// AllowStandby lets joiners offer to take over as host. It has no effect
+	// when joiners are read-only or their edits go through the host, and
+	// such sessions refuse joiners that ask to stand by.
+	AllowStandby bool
+
+	// MaxPeers caps the peers in the session, host included, and
+	// MaxSyncingPeers how many joiners may receive the files at once.
+	MaxPeers        int
+	MaxSyncingPeers int
+	// MaxQueuedMessages and MaxQueuedBytes bound what waits to be written
+	// to one peer; a peer that falls further behind is dropped.
+	MaxQueuedMessages int
+	MaxQueuedBytes    int
+	// MaxMessageBytes caps one message from a peer.
+	MaxMessageBytes int
+	// SyncTimeout drops a joiner that has not received the files in time.
+	SyncTimeout time.Duration
+
+	// SnapshotCache lets the host keep an encrypted snapshot of the files on
+	// the relay. New joiners get it and the ordered operations since, instead
+	// of each asking the host for the files. MaxSnapshotBytes caps the
+	// snapshot; a host whose files outgrow it syncs joiners itself.
+	SnapshotCache    bool
+	MaxSnapshotBytes int
+}
+
+// Validate checks the session's limits. Zero limits use the defaults.
+func (c SessionConfig) Validate() error {
+	limits := c.withDefaults()
+	switch {
+	case c.MaxPeers < 0 || c.MaxSyncingPeers < 0 || c.MaxQueuedMessages < 0 || c.MaxQueuedBytes < 0 || c.MaxMessageBytes < 0 || c.SyncTimeout < 0 || c.MaxSnapshotBytes < 0:
+		return fmt.Errorf("session limits must not be negative")
+	case limits.MaxPeers < 2 || limits.MaxPeers > maxPeersLimit:
+		return fmt.Errorf("max peers must be between 2 and %d", maxPeersLimit)
+	case limits.MaxSyncingPeers > limits.MaxPeers-1:
+		return fmt.Errorf("max syncing peers must be between 1 and %d, one less than max peers", limits.MaxPeers-1)
+	case limits.MaxQueuedMessages < minQueuedMessagesLimit || limits.MaxQueuedMessages > maxQueuedMessagesLimit:
+		return fmt.Errorf("max queued messages must be between %d and %d", minQueuedMessagesLimit, maxQueuedMessagesLimit)
+	case limits.MaxMessageBytes < minMessageBytesLimit || limits.MaxMessageBytes > maxRelayMessageBytes:
+		return fmt.Errorf("max message size must be between 1MB and %dMB", maxRelayMessageBytes/(1024*1024))
+	case limits.MaxQueuedBytes < limits.MaxMessageBytes || limits.MaxQueuedBytes > maxQueuedBytesLimit:
+		return fmt.Errorf("max queued bytes must be between the max message size and 1GB")
+	case limits.SyncTimeout < minSyncTimeoutLimit || limits.SyncTimeout > maxSyncTimeoutLimit:
+		return fmt.Errorf("sync timeout must be between %s and %s", minSyncTimeoutLimit, maxSyncTimeoutLimit)
+	case limits.MaxSnapshotBytes < minMessageBytesLimit || limits.MaxSnapshotBytes > maxQueuedBytesLimit:
+		return fmt.Errorf("max snapshot size must be between 1MB and 1GB")
+	}
+	return nil
+}
+
+// withDefaults fills limits left at zero.
+func (c SessionConfig) withDefaults() SessionConfig {
+	if c.MaxPeers == 0 {
+		c.MaxPeers = maxSessionPeers
+	}
+	if c.MaxSyncingPeers == 0 {
+		c.MaxSyncingPeers = min(maxSyncingPeers, c.MaxPeers-1)
+	}
+	if c.MaxQueuedMessages == 0 {
+		c.MaxQueuedMessages = maxQueuedMessages
+	}
+	if c.MaxQueuedBytes == 0 {
+		c.MaxQueuedBytes = maxQueuedBytes
+	}
+	if c.MaxMessageBytes == 0 {
+		c.MaxMessageBytes = maxRelayMessageBytes
+	}
+	if c.SyncTimeout == 0 {
+		c.SyncTimeout = syncTimeout
+	}
+	if c.MaxSnapshotBytes == 0 {
+		c.MaxSnapshotBytes = maxSnapshotBytes
+	}
+	return c
+}
+
+func (c SessionConfig) limits() protocol.Limits {
+	return protocol.Limits{
+		MaxPeers:          c.MaxPeers,
+		MaxSyncingPeers:   c.MaxSyncingPeers,
+		MaxQueuedMessages: c.MaxQueuedMessages,
+		MaxQueuedBytes:    c.MaxQueuedBytes,
+		MaxMessageBytes:   c.MaxMessageBytes,
+		SyncTimeout:       c.SyncTimeout,
+	}
 }
 
 type peerRole uint8
@@ -46,20 +155,40 @@ type outboundMessage struct {
 	afterWrite func()
 }
 
+// heldMessage is a message for the host from sourceID, held while the
+// session has no host.
+type heldMessage struct {
+	sourceID string
+	message  outboundMessage
+}
+
 type relayPeer struct {
 	conn clientPeer
 	role peerRole
 	id   string
+	// number orders peers by join time when choosing a successor.
+	number uint64
+	// standby marks a joiner that may be promoted to host.
+	standby bool
+	// resume is the last sequence a reconnecting host applied.
+	resume uint64
 
 	queueMu    sync.Mutex
 	queue      []outboundMessage
 	queueBytes int
-	closed     bool
-	wake       chan struct{}
-	done       chan struct{}
-	stopOnce   sync.Once
+	// maxMessages and maxBytes bound the queue; the session sets them from
+	// its limits when the peer registers.
+	maxMessages int
+	maxBytes    int
+	closed      bool
+	wake        chan struct{}
+	done        chan struct{}
+	stopOnce    sync.Once
 
-	syncing      bool
+	syncing bool
+	// cachedSync marks a joiner receiving the relay's cached snapshot rather
+	// than one from the host.
+	cachedSync   bool
 	pending      []outboundMessage
 	pendingBytes int
 	syncTimer    *time.Timer
@@ -67,16 +196,18 @@ type relayPeer struct {
 
 func newRelayPeer(conn clientPeer, role peerRole) *relayPeer {
 	return &relayPeer{
-		conn: conn,
-		role: role,
-		wake: make(chan struct{}, 1),
-		done: make(chan struct{}),
+		conn:        conn,
+		role:        role,
+		maxMessages: maxQueuedMessages,
+		maxBytes:    maxQueuedBytes,
+		wake:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
 	}
 }
 
 func (p *relayPeer) enqueue(message outboundMessage) bool {
 	p.queueMu.Lock()
-	if p.closed || len(p.queue) >= maxQueuedMessages || p.queueBytes+len(message.data) > maxQueuedBytes {
+	if p.closed || len(p.queue) >= p.maxMessages || p.queueBytes+len(message.data) > p.maxBytes {
 		p.queueMu.Unlock()
 		return false
 	}
@@ -123,7 +254,7 @@ func (p *relayPeer) writeLoop(session *sessionRelay) {
 			return
 		}
 		if err := p.conn.Write(message.msgType, message.data); err != nil {
-			session.unregister(p)
+			session.drop(p, dropWriteFailed)
 			return
 		}
 		if message.afterWrite != nil {
@@ -156,19 +287,62 @@ type sessionRelay struct {
 	host       *relayPeer
 	nextPeerID uint64
 	sequence   uint64
+
+	// backlog holds the most recent ordered messages so a reconnecting host
+	// can catch up. It is only kept when HostGracePeriod is set.
+	backlog      []outboundMessage
+	backlogBytes int
+	// graceTimer runs while the session waits for its host to come back.
+	// A resuming host keeps absentHostID so its earlier operations are
+	// still recognised as its own.
+	graceTimer   *time.Timer
+	graceRound   uint64
+	absentHostID string
+	// heldForHost keeps the joiner messages meant for the host that arrive
+	// while it is away, such as proposals, until a host is back.
+	heldForHost      []heldMessage
+	heldForHostBytes int
+
+	// snapshot is the host's latest cached snapshot, and snapshotBuild the
+	// one being uploaded. snapshotRefused is set once a snapshot outgrew
+	// MaxSnapshotBytes, and tells later hosts not to upload one.
+	// snapshotTailBytes counts the ordered messages since the snapshot, and
+	// snapshotRefreshAsked is set once the host was asked to replace it.
+	snapshot             *cachedSnapshot
+	snapshotBuild        *cachedSnapshot
+	snapshotRefused      bool
+	snapshotTailBytes    int
+	snapshotRefreshAsked bool
+
+	// emptySince is when the last peer left, or when the session was
+	// created. A Hub removes sessions that stay empty; retired sessions
+	// refuse new peers.
+	emptySince time.Time
+	retired    bool
+
+	// counters feed /metrics. live is set while the session has had a host
+	// since it last ended, so each ending is counted once.
+	counters *relayCounters
+	live     bool
 }
 
 func newSessionRelay() *sessionRelay {
-	return &sessionRelay{peers: make(map[*relayPeer]struct{})}
+	return &sessionRelay{
+		peers:      make(map[*relayPeer]struct{}),
+		emptySince: time.Now(),
+		counters:   &relayCounters{},
+	}
 }
 
 type Relay struct {
 	session *sessionRelay
 }
 
+// NewRelay returns a relay for one session. Its config should have passed
+// Validate.
 func NewRelay(config SessionConfig) *Relay {
 	session := newSessionRelay()
-	session.config = config
+	session.config = config.withDefaults()
 	return &Relay{session: session}
 }
 
@@ -212,24 +386,47 @@ func secureTokenEqual(got, expected string) bool {
 func (s *sessionRelay) register(peer *relayPeer) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-
-	if len(s.peers) >= maxSessionPeers {
+	if reason := s.registerLocked(peer); reason != "" {
+		s.counters.reject(reason)
 		return false
 	}
+	return true
+}
+
+// registerLocked adds peer to the session, or returns why it was refused.
+func (s *sessionRelay) registerLocked(peer *relayPeer) string {
+	if s.retired {
+		return rejectSessionClosed
+	}
+	if len(s.peers) >= s.config.MaxPeers {
+		return rejectSessionFull
+	}
+	resuming := peer.role == roleHost && s.graceTimer != nil
 	if peer.role == roleHost {
 		if s.host != nil {
-			return false
+			return rejectHostTaken
+		}
+		if resuming && !s.canResumeLocked(peer.resume) {
+			return rejectResumeGap
 		}
 		s.host = peer
+		s.live = true
 	} else if s.host == nil {
-		return false
-	} else if s.syncingPeerCountLocked() >= maxSyncingPeers {
-		return false
+		return rejectNoHost
+	} else if _, cached := s.snapshotTailLocked(); !cached && s.syncingPeerCountLocked() >= s.config.MaxSyncingPeers {
+		return rejectTooManySyncing
 	}
 
 	s.nextPeerID++
+	peer.number = s.nextPeerID
 	peer.id = fmt.Sprintf("%d", s.nextPeerID)
+	if resuming {
+		peer.id = s.absentHostID
+	}
 	peer.syncing = peer.role == roleJoiner
+	peer.queueMu.Lock()
+	peer.maxMessages, peer.maxBytes = s.config.MaxQueuedMessages, s.config.MaxQueuedBytes
+	peer.queueMu.Unlock()
 	s.peers[peer] = struct{}{}
 
 	if !peer.enqueue(outboundMessage{
@@ -237,38 +434,301 @@ func (s *sessionRelay) register(peer *relayPeer) bool {
 		data:    protocol.EncodeControlReadOnlyJoiners(s.config.ReadOnlyJoiners),
 	}) {
 		s.removePeerLocked(peer)
-		return false
+		return rejectQueueFull
+	}
+	if !peer.enqueue(outboundMessage{
+		msgType: websocket.TextMessage,
+		data:    protocol.EncodeControlLimits(s.config.limits()),
+	}) {
+		s.removePeerLocked(peer)
+		return rejectQueueFull
+	}
+	if !peer.enqueue(outboundMessage{
+		msgType: websocket.TextMessage,
+		data:    protocol.EncodeControlPeerID(peer.id),
+	}) {
+		s.removePeerLocked(peer)
+		return rejectQueueFull
+	}
+	if s.config.SnapshotCache && peer.role == roleHost {
+		if !peer.enqueue(outboundMessage{
+			msgType: websocket.TextMessage,
+			data:    protocol.EncodeControlSnapshotCache(!s.snapshotRefused),
+		}) {
+			s.removePeerLocked(peer)
+			return rejectQueueFull
+		}
+	}
+	if s.config.ApproveJoinerEdits && !s.config.ReadOnlyJoiners && peer.role == roleJoiner {
+		if !peer.enqueue(outboundMessage{
+			msgType: websocket.TextMessage,
+			data:    protocol.EncodeControlApproveJoinerEdits(true),
+		}) {
+			s.removePeerLocked(peer)
+			return rejectQueueFull
+		}
 	}
 
-	if peer.syncing {
+	if tail, cached := s.snapshotTailLocked(); peer.syncing && cached {
+		if !s.serveSnapshotLocked(peer, tail) {
+			return rejectQueueFull
+		}
+	} else if peer.syncing {
 		if !peer.enqueue(outboundMessage{
 			msgType: websocket.TextMessage,
 			data:    protocol.EncodeControlSyncBaseline(s.sequence),
 		}) {
 			s.removePeerLocked(peer)
-			return false
+			return rejectQueueFull
 		}
 		if !s.host.enqueue(outboundMessage{
 			msgType:    websocket.TextMessage,
 			data:       protocol.EncodeControlSyncRequest(peer.id),
 			afterWrite: func() { s.startSyncTimer(peer) },
 		}) {
-			s.removePeerLocked(s.host)
-			return false
+			s.dropLocked(s.host, dropQueueFull)
+			return rejectQueueFull
 		}
 	}
+	if resuming && !s.resumeHostLocked(peer) {
+		s.removePeerLocked(peer)
+		return rejectQueueFull
+	}
+	if !s.introducePeerLocked(peer) {
+		return rejectQueueFull
+	}
 
 	s.broadcastPeerCountLocked()
+	return ""
+}
+
+// introducePeerLocked tells a new peer who is already connected and announces
+// it to everyone else, so clients can match profiles to peer IDs.
+func (s *sessionRelay) introducePeerLocked(peer *relayPeer) bool {
+	for other := range s.peers {
+		if other == peer {
+			continue
+		}
+		if !peer.enqueue(outboundMessage{
+			msgType: websocket.TextMessage,
+			data:    protocol.EncodeControlPeerJoined(other.id, other == s.host),
+		}) {
+			s.removePeerLocked(peer)
+			return false
+		}
+	}
+	s.broadcastLocked(protocol.EncodeControlPeerJoined(peer.id, peer == s.host), peer)
+	_, ok := s.peers[peer]
+	return ok
+}
+
+// hostSlotOpen reports whether a host connecting now would be accepted. It
+// lets a reconnecting host retry before the old connection has been noticed.
+func (s *sessionRelay) hostSlotOpen(resume uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.host == nil && (s.graceTimer == nil || s.canResumeLocked(resume))
+}
+
+// canResumeLocked reports whether the backlog still holds every ordered
+// message after the given sequence.
+func (s *sessionRelay) canResumeLocked(sequence uint64) bool {
+	return sequence <= s.sequence && s.sequence-sequence <= uint64(len(s.backlog))
+}
+
+// resumeHostLocked replays the ordered messages a reconnecting host missed and
+// tells joiners their host is back.
+func (s *sessionRelay) resumeHostLocked(host *relayPeer) bool {
+	missed := s.backlog[len(s.backlog)-int(s.sequence-host.resume):]
+	for _, message := range missed {
+		if !host.enqueue(message) {
+			return false
+		}
+	}
+	if !s.releaseHeldLocked() {
+		return false
+	}
+	s.stopGraceLocked()
+	s.broadcastToJoinersLocked(protocol.EncodeControlHostPresent(true))
+	return true
+}
+
+func (s *sessionRelay) appendBacklogLocked(message outboundMessage) {
+	if s.config.HostGracePeriod <= 0 && !s.config.SnapshotCache {
+		return
+	}
+	s.backlog = append(s.backlog, message)
+	s.backlogBytes += len(message.data)
+	s.snapshotTailBytes += len(message.data)
+	for len(s.backlog) > maxBacklogMessages || s.backlogBytes > maxBacklogBytes {
+		s.backlogBytes -= len(s.backlog[0].data)
+		s.backlog[0] = outboundMessage{}
+		s.backlog = s.backlog[1:]
+	}
+}
+
+// holdForHostLocked keeps ready joiners connected after the host leaves.
+// Joiners still bootstrapping from the host cannot finish without it and are
+// dropped.
+func (s *sessionRelay) holdForHostLocked(hostID string) {
+	s.stopGraceLocked()
+	s.absentHostID = hostID
+	dropped := make([]string, 0)
+	for peer := range s.peers {
+		if peer.syncing && !peer.cachedSync {
+			delete(s.peers, peer)
+			peer.stop()
+			dropped = append(dropped, peer.id)
+		}
+	}
+	for _, peerID := range dropped {
+		s.broadcastLocked(protocol.EncodeControlPeerLeft(peerID), nil)
+	}
+	s.broadcastLocked(protocol.EncodeControlPeerLeft(hostID), nil)
+	s.graceRound++
+	round := s.graceRound
+	s.graceTimer = time.AfterFunc(s.config.HostGracePeriod, func() {
+		s.endGrace(round)
+	})
+	s.broadcastToJoinersLocked(protocol.EncodeControlHostPresent(false))
+}
+
+func (s *sessionRelay) stopGraceLocked() {
+	if s.graceTimer != nil {
+		s.graceTimer.Stop()
+		s.graceTimer = nil
+	}
+}
+
+// endGrace runs when the host has not come back in time. The earliest standby
+// joiner becomes host; without one the session ends.
+func (s *sessionRelay) endGrace(round uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.graceTimer == nil || s.graceRound != round || s.host != nil {
+		return
+	}
+	s.graceTimer = nil
+
+	successor := s.successorLocked()
+	if successor == nil || !successor.enqueue(outboundMessage{
+		msgType: websocket.TextMessage,
+		data:    protocol.EncodeControlPromoted(),
+	}) {
+		s.closeAllLocked(endGraceExpired)
+		return
+	}
+	successor.role = roleHost
+	s.host = successor
+	if s.config.SnapshotCache && !successor.enqueue(outboundMessage{
+		msgType: websocket.TextMessage,
+		data:    protocol.EncodeControlSnapshotCache(!s.snapshotRefused),
+	}) {
+		s.dropLocked(successor, dropQueueFull)
+		return
+	}
+	if !s.releaseHeldLocked() {
+		s.dropLocked(successor, dropQueueFull)
+		return
+	}
+	s.broadcastToJoinersLocked(protocol.EncodeControlHostPresent(true))
+	s.broadcastLocked(protocol.EncodeControlPeerJoined(successor.id, true), nil)
+}
+
+// standbyAllowed reports whether a joiner may be promoted to host. A
+// joiner the host does not trust with its own edits is not handed the
+// session.
+func (c SessionConfig) standbyAllowed() bool {
+	return c.AllowStandby && !c.ReadOnlyJoiners && !c.ApproveJoinerEdits
+}
+
+func (s *sessionRelay) successorLocked() *relayPeer {
+	if !s.config.standbyAllowed() {
+		return nil
+	}
+	var successor *relayPeer
+	for peer := range s.peers {
+		if peer.standby && !peer.syncing && (successor == nil || peer.number < successor.number) {
+			successor = peer
+		}
+	}
+	return successor
+}
+
+func (s *sessionRelay) closeAllLocked(reason string) {
+	if s.live {
+		s.live = false
+		s.counters.end(reason)
+	}
+	s.stopGraceLocked()
+	s.heldForHost = nil
+	s.heldForHostBytes = 0
+	for peer := range s.peers {
+		delete(s.peers, peer)
+		peer.stop()
+	}
+	s.emptySince = time.Now()
+}
+
+// retireIfIdle ends the session if it has had no peers for at least timeout,
+// and reports whether it did. A session waiting for its host is not idle.
+func (s *sessionRelay) retireIfIdle(now time.Time, timeout time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.peers) > 0 || s.graceTimer != nil || now.Sub(s.emptySince) < timeout {
+		return false
+	}
+	s.retired = true
 	return true
 }
 
+// retire ends the session and disconnects everyone in it.
+func (s *sessionRelay) retire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retired = true
+	s.closeAllLocked(endClosed)
+}
+
+// broadcastLocked sends a control message to every peer except skip,
+// including joiners that are still syncing.
+func (s *sessionRelay) broadcastLocked(data []byte, skip *relayPeer) {
+	failed := make([]*relayPeer, 0)
+	for peer := range s.peers {
+		if peer == skip {
+			continue
+		}
+		if !peer.enqueue(outboundMessage{msgType: websocket.TextMessage, data: data}) {
+			failed = append(failed, peer)
+		}
+	}
+	for _, peer := range failed {
+		s.dropLocked(peer, dropQueueFull)
+	}
+}
+
+func (s *sessionRelay) broadcastToJoinersLocked(data []byte) {
+	failed := make([]*relayPeer, 0)
+	for peer := range s.peers {
+		if peer == s.host || peer.syncing {
+			continue
+		}
+		if !peer.enqueue(outboundMessage{msgType: websocket.TextMessage, data: data}) {
+			failed = append(failed, peer)
+		}
+	}
+	for _, peer := range failed {
+		s.dropLocked(peer, dropQueueFull)
+	}
+}
+
 func (s *sessionRelay) startSyncTimer(peer *relayPeer) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if _, ok := s.peers[peer]; !ok || !peer.syncing || peer.syncTimer != nil {
 		return
 	}
-	peer.syncTimer = time.AfterFunc(syncTimeout, func() {
+	peer.syncTimer = time.AfterFunc(s.config.SyncTimeout, func() {
 		s.timeoutSync(peer)
 	})
 }
@@ -279,7 +739,7 @@ func (s *sessionRelay) timeoutSync(peer *relayPeer) {
 	if _, ok := s.peers[peer]; !ok || !peer.syncing {
 		return
 	}
-	s.removePeerLocked(peer)
+	s.dropLocked(peer, dropSyncTimeout)
 	if len(s.peers) > 0 {
 		s.broadcastPeerCountLocked()
 	}
@@ -298,6 +758,29 @@ func (s *sessionRelay) unregister(peer *relayPeer) {
 	s.mu.Unlock()
 }
 
+// drop disconnects a peer the relay gave up on.
+func (s *sessionRelay) drop(peer *relayPeer, reason string) {
+	s.mu.Lock()
+	if _, ok := s.peers[peer]; !ok {
+		s.mu.Unlock()
+		return
+	}
+	s.dropLocked(peer, reason)
+	if len(s.peers) > 0 {
+		s.broadcastPeerCountLocked()
+	}
+	s.mu.Unlock()
+}
+
+// dropLocked disconnects a peer the relay gave up on and counts why.
+func (s *sessionRelay) dropLocked(peer *relayPeer, reason string) {
+	if _, ok := s.peers[peer]; !ok {
+		return
+	}
+	s.counters.drop(reason)
+	s.removePeerLocked(peer)
+}
+
 func (s *sessionRelay) removePeerLocked(peer *relayPeer) {
 	if peer == nil {
 		return
@@ -307,14 +790,21 @@ func (s *sessionRelay) removePeerLocked(peer *relayPeer) {
 	}
 	delete(s.peers, peer)
 	peer.stop()
+	if len(s.peers) == 0 {
+		s.emptySince = time.Now()
+	}
 
 	if peer == s.host {
 		s.host = nil
-		for other := range s.peers {
-			delete(s.peers, other)
-			other.stop()
+		s.snapshotBuild = nil
+		if s.config.HostGracePeriod > 0 && len(s.peers) > 0 {
+			s.holdForHostLocked(peer.id)
+			return
 		}
+		s.closeAllLocked(endHostLeft)
+		return
 	}
+	s.broadcastLocked(protocol.EncodeControlPeerLeft(peer.id), nil)
 }
 
 func (s *sessionRelay) broadcastPeerCountLocked() {
@@ -329,7 +819,7 @@ func (s *sessionRelay) broadcastPeerCountLocked() {
 		}
 	}
 	for _, peer := range failed {
-		s.removePeerLocked(peer)
+		s.dropLocked(peer, dropQueueFull)
 	}
 }
 
@@ -342,17 +832,23 @@ func (s *sessionRelay) acceptNormal(source *relayPeer, encryptedPayload string)
 	if source.role == roleJoiner && s.config.ReadOnlyJoiners {
 		return false
 	}
+	if source.role == roleJoiner && s.config.ApproveJoinerEdits {
+		s.forwardToHostLocked(source, encryptedPayload)
+		return true
+	}
 
 	s.sequence++
 	message := outboundMessage{
 		msgType: websocket.TextMessage,
-		data:    protocol.EncodeOrderedEncrypted(s.sequence, encryptedPayload),
+		data:    protocol.EncodeOrderedEncrypted(s.sequence, source.id, encryptedPayload),
 	}
+	s.appendBacklogLocked(message)
 	failed := make([]*relayPeer, 0)
+	overflowed := make([]*relayPeer, 0)
 	for peer := range s.peers {
 		if peer.syncing {
-			if len(peer.pending) >= maxQueuedMessages || peer.pendingBytes+len(message.data) > maxQueuedBytes {
-				failed = append(failed, peer)
+			if len(peer.pending) >= s.config.MaxQueuedMessages || peer.pendingBytes+len(message.data) > s.config.MaxQueuedBytes {
+				overflowed = append(overflowed, peer)
 				continue
 			}
 			peer.pending = append(peer.pending, message)
@@ -364,8 +860,12 @@ func (s *sessionRelay) acceptNormal(source *relayPeer, encryptedPayload string)
 		}
 	}
 	for _, peer := range failed {
-		s.removePeerLocked(peer)
+		s.dropLocked(peer, dropQueueFull)
+	}
+	for _, peer := range overflowed {
+		s.dropLocked(peer, dropPendingFull)
 	}
+	s.askSnapshotRefreshLocked()
 	return true
 }
 
@@ -376,42 +876,132 @@ func (s *sessionRelay) acceptBootstrap(source *relayPeer, targetID, encryptedPay
 		return false
 	}
 	target := s.syncingPeerLocked(targetID)
-	if target == nil {
+	if target == nil || target.cachedSync {
 		return true
 	}
 	if !target.enqueue(outboundMessage{
 		msgType: websocket.TextMessage,
 		data:    protocol.EncodeBootstrapEncrypted(encryptedPayload),
 	}) {
-		s.removePeerLocked(target)
+		s.dropLocked(target, dropQueueFull)
 		return true
 	}
 	return true
 }
 
+// acceptHostDirected forwards a joiner's encrypted message to the host only,
+// tagged with the sender so the host can answer it.
+func (s *sessionRelay) acceptHostDirected(source *relayPeer, encryptedPayload string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.peers[source]; !ok || source.syncing || source == s.host {
+		return false
+	}
+	s.forwardToHostLocked(source, encryptedPayload)
+	return true
+}
+
+// forwardToHostLocked sends a joiner's message to the host, tagged with the
+// sender. While the host is away the message is held until a host is back;
+// a joiner that would overflow the hold is dropped so it reconnects rather
+// than wait on an answer that will not come.
+func (s *sessionRelay) forwardToHostLocked(source *relayPeer, encryptedPayload string) {
+	message := outboundMessage{
+		msgType: websocket.TextMessage,
+		data:    protocol.EncodeFromEncrypted(source.id, encryptedPayload),
+	}
+	if s.host == nil {
+		if len(s.heldForHost) >= s.config.MaxQueuedMessages || s.heldForHostBytes+len(message.data) > s.config.MaxQueuedBytes {
+			s.dropLocked(source, dropPendingFull)
+			return
+		}
+		s.heldForHost = append(s.heldForHost, heldMessage{sourceID: source.id, message: message})
+		s.heldForHostBytes += len(message.data)
+		return
+	}
+	if !s.host.enqueue(message) {
+		s.dropLocked(s.host, dropQueueFull)
+	}
+}
+
+// releaseHeldLocked delivers the messages held while the session had no host
+// to the host it has now. A promoted joiner does not get its own back.
+func (s *sessionRelay) releaseHeldLocked() bool {
+	for _, held := range s.heldForHost {
+		if held.sourceID == s.host.id {
+			continue
+		}
+		if !s.host.enqueue(held.message) {
+			return false
+		}
+	}
+	s.heldForHost = nil
+	s.heldForHostBytes = 0
+	return true
+}
+
+// acceptBroadcast forwards a peer's encrypted message to every other peer,
+// tagged with the sender. It is not sequenced and reaches syncing joiners too.
+func (s *sessionRelay) acceptBroadcast(source *relayPeer, encryptedPayload string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.peers[source]; !ok {
+		return false
+	}
+	s.broadcastLocked(protocol.EncodePeerEncrypted(source.id, encryptedPayload), source)
+	return true
+}
+
+// acceptDirect forwards a host message to one ready peer, tagged with the
+// host's ID. Messages for peers that have left are dropped.
+func (s *sessionRelay) acceptDirect(source *relayPeer, targetID, encryptedPayload string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if source != s.host {
+		return false
+	}
+	for peer := range s.peers {
+		if peer.id != targetID || peer == source || peer.syncing {
+			continue
+		}
+		if !peer.enqueue(outboundMessage{
+			msgType: websocket.TextMessage,
+			data:    protocol.EncodeFromEncrypted(source.id, encryptedPayload),
+		}) {
+			s.dropLocked(peer, dropQueueFull)
+		}
+		break
+	}
+	return true
+}
+
 func (s *sessionRelay) completeSync(source *relayPeer, targetID string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if source != s.host {
 		return false
 	}
-	target := s.syncingPeerLocked(targetID)
-	if target == nil {
-		return true
+	if target := s.syncingPeerLocked(targetID); target != nil && !target.cachedSync {
+		s.finishSyncLocked(target)
 	}
+	return true
+}
 
+// finishSyncLocked sends a joiner the operations held while it synced and
+// marks it ready.
+func (s *sessionRelay) finishSyncLocked(target *relayPeer) {
 	for _, message := range target.pending {
 		if !target.enqueue(message) {
-			s.removePeerLocked(target)
-			return true
+			s.dropLocked(target, dropQueueFull)
+			return
 		}
 	}
 	if !target.enqueue(outboundMessage{
 		msgType: websocket.TextMessage,
 		data:    protocol.EncodeControlSyncComplete(),
 	}) {
-		s.removePeerLocked(target)
-		return true
+		s.dropLocked(target, dropQueueFull)
+		return
 	}
 	target.pending = nil
 	target.pendingBytes = 0
@@ -420,7 +1010,6 @@ func (s *sessionRelay) completeSync(source *relayPeer, targetID string) bool {
 		target.syncTimer.Stop()
 		target.syncTimer = nil
 	}
-	return true
 }
 
 func (s *sessionRelay) syncingPeerLocked(peerID string) *relayPeer {
@@ -435,7 +1024,7 @@ func (s *sessionRelay) syncingPeerLocked(peerID string) *relayPeer {
 func (s *sessionRelay) syncingPeerCountLocked() int {
 	count := 0
 	for peer := range s.peers {
-		if peer.syncing {
+		if peer.syncing && !peer.cachedSync {
 			count++
 		}
 	}
@@ -449,7 +1038,7 @@ func (s *sessionRelay) enqueuePing(peer *relayPeer) bool {
 		return false
 	}
 	if !peer.enqueue(outboundMessage{msgType: websocket.PingMessage}) {
-		s.removePeerLocked(peer)
+		s.dropLocked(peer, dropQueueFull)
 		return false
 	}
 	return true
@@ -471,21 +1060,43 @@ func (s *sessionRelay) serveHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	role, authorized := s.roleForRequest(r)
 	if !authorized {
+		s.counters.reject(rejectUnauthorized)
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
+	var resume uint64
+	if role == roleHost {
+		resume, _ = strconv.ParseUint(r.Header.Get(protocol.ResumeHeader), 10, 64)
+		if !s.hostSlotOpen(resume) {
+			s.counters.reject(rejectHostTaken)
+			http.Error(w, "session already has a host", http.StatusConflict)
+			return
+		}
+	}
+	standby := role == roleJoiner && r.Header.Get(protocol.StandbyHeader) == "1"
+	s.mu.Lock()
+	config := s.config
+	s.mu.Unlock()
+	if standby && !config.standbyAllowed() {
+		s.counters.reject(rejectStandbyRefused)
+		http.Error(w, "session does not accept standby hosts", http.StatusForbidden)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
 	}
 	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	conn.SetReadLimit(maxRelayMessageBytes)
+	conn.SetReadLimit(int64(config.MaxMessageBytes))
 	conn.SetPongHandler(func(string) error {
 		return conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	})
 
 	peer := newRelayPeer(wsutil.NewPeer(conn), role)
+	peer.standby = standby
+	peer.resume = resume
 	if !s.register(peer) {
 		peer.stop()
 		return
@@ -531,12 +1142,27 @@ func handleClientMessage(session *sessionRelay, peer *relayPeer, message []byte)
 	if strings.HasPrefix(string(message), prefix) && len(message) > len(prefix) {
 		return session.acceptNormal(peer, string(message[len(prefix):]))
 	}
+	if payload, ok := protocol.ParseHostEncrypted(message); ok {
+		return session.acceptHostDirected(peer, payload)
+	}
+	if payload, ok := protocol.ParseBroadcastEncrypted(message); ok {
+		return session.acceptBroadcast(peer, payload)
+	}
+	if targetID, payload, ok := protocol.ParseDirectEncrypted(message); ok {
+		return session.acceptDirect(peer, targetID, payload)
+	}
 	if targetID, payload, ok := protocol.ParseTargetedEncrypted(message); ok {
 		return session.acceptBootstrap(peer, targetID, payload)
 	}
 	if targetID, ok := protocol.ParseSyncDone(message); ok {
 		return session.completeSync(peer, targetID)
 	}
+	if sequence, payload, ok := protocol.ParseSnapshotEncrypted(message); ok {
+		return session.acceptSnapshot(peer, sequence, payload)
+	}
+	if sequence, ok := protocol.ParseSnapshotDone(message); ok {
+		return session.completeSnapshot(peer, sequence)
+	}
 	return false
 }
 
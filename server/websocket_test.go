@@ -2,8 +2,10 @@ package server
 
 import (
 	"fmt"
+	"net/http"
 	"net/http/httptest"
 	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -31,7 +33,7 @@ func (m *mockPeer) count() int {
 
 func testSession(readOnly bool) *sessionRelay {
 	session := newSessionRelay()
-	session.config = SessionConfig{ReadOnlyJoiners: readOnly, HostToken: "host-token", JoinToken: "join-token"}
+	session.config = SessionConfig{ReadOnlyJoiners: readOnly, HostToken: "host-token", JoinToken: "join-token"}.withDefaults()
 	return session
 }
 
@@ -72,9 +74,9 @@ func TestRelayEchoesOrderedUpdatesToSender(t *testing.T) {
 	if len(host.queue) != 1 {
 		t.Fatalf("sender queue has %d messages, want 1", len(host.queue))
 	}
-	sequence, payload, ok := protocol.ParseOrderedEncrypted(host.queue[0].data)
-	if !ok || sequence != 1 || payload != "ciphertext" {
-		t.Fatalf("unexpected ordered echo: sequence=%d payload=%q ok=%v", sequence, payload, ok)
+	sequence, origin, payload, ok := protocol.ParseOrderedEncrypted(host.queue[0].data)
+	if !ok || sequence != 1 || origin != host.id || payload != "ciphertext" {
+		t.Fatalf("unexpected ordered echo: sequence=%d origin=%q payload=%q ok=%v", sequence, origin, payload, ok)
 	}
 }
 
@@ -104,7 +106,7 @@ func TestBootstrapBarrierQueuesOrderedUpdates(t *testing.T) {
 	if payload, ok := protocol.ParseBootstrapEncrypted(joiner.queue[0].data); !ok || payload != "snapshot" {
 		t.Fatalf("first message is not the bootstrap: %q", joiner.queue[0].data)
 	}
-	if _, payload, ok := protocol.ParseOrderedEncrypted(joiner.queue[1].data); !ok || payload != "ordered" {
+	if _, _, payload, ok := protocol.ParseOrderedEncrypted(joiner.queue[1].data); !ok || payload != "ordered" {
 		t.Fatalf("second message is not the queued update: %q", joiner.queue[1].data)
 	}
 	parts := string(joiner.queue[2].data)
@@ -287,3 +289,436 @@ func TestRelayAcceptsOnlyProtocolMessages(t *testing.T) {
 		t.Fatal("spoofed control message was accepted")
 	}
 }
+
+func TestHostDirectedMessageReachesOnlyHost(t *testing.T) {
+	session := testSession(true)
+	host := newRelayPeer(&mockPeer{}, roleHost)
+	joiner := newRelayPeer(&mockPeer{}, roleJoiner)
+	other := newRelayPeer(&mockPeer{}, roleJoiner)
+	if !session.register(host) || !session.register(joiner) || !session.register(other) {
+		t.Fatal("failed to register test peers")
+	}
+	if !session.completeSync(host, joiner.id) || !session.completeSync(host, other.id) {
+		t.Fatal("failed to complete joiner sync")
+	}
+	clearQueue(host)
+	clearQueue(joiner)
+	clearQueue(other)
+
+	if !handleClientMessage(session, joiner, protocol.EncodeHostEncrypted("ciphertext")) {
+		t.Fatal("host-directed message from read-only joiner was rejected")
+	}
+	if handleClientMessage(session, host, protocol.EncodeHostEncrypted("ciphertext")) {
+		t.Fatal("host-directed message from the host was accepted")
+	}
+
+	host.queueMu.Lock()
+	defer host.queueMu.Unlock()
+	if len(host.queue) != 1 {
+		t.Fatalf("host queue has %d messages, want 1", len(host.queue))
+	}
+	peerID, payload, ok := protocol.ParseFromEncrypted(host.queue[0].data)
+	if !ok || peerID != joiner.id || payload != "ciphertext" {
+		t.Fatalf("unexpected host-directed message: %q", host.queue[0].data)
+	}
+	other.queueMu.Lock()
+	defer other.queueMu.Unlock()
+	if len(other.queue) != 0 {
+		t.Fatal("host-directed message reached another joiner")
+	}
+}
+
+func TestDirectMessageReachesOnlyTarget(t *testing.T) {
+	session := testSession(false)
+	host := newRelayPeer(&mockPeer{}, roleHost)
+	joiner := newRelayPeer(&mockPeer{}, roleJoiner)
+	other := newRelayPeer(&mockPeer{}, roleJoiner)
+	if !session.register(host) || !session.register(joiner) || !session.register(other) {
+		t.Fatal("failed to register test peers")
+	}
+	if !session.completeSync(host, joiner.id) || !session.completeSync(host, other.id) {
+		t.Fatal("failed to complete joiner sync")
+	}
+	clearQueue(host)
+	clearQueue(joiner)
+	clearQueue(other)
+
+	if handleClientMessage(session, other, protocol.EncodeDirectEncrypted(joiner.id, "ciphertext")) {
+		t.Fatal("direct message from a joiner was accepted")
+	}
+	if !handleClientMessage(session, host, protocol.EncodeDirectEncrypted(joiner.id, "ciphertext")) {
+		t.Fatal("direct message from the host was rejected")
+	}
+
+	joiner.queueMu.Lock()
+	defer joiner.queueMu.Unlock()
+	if len(joiner.queue) != 1 {
+		t.Fatalf("joiner queue has %d messages, want 1", len(joiner.queue))
+	}
+	peerID, payload, ok := protocol.ParseFromEncrypted(joiner.queue[0].data)
+	if !ok || peerID != host.id || payload != "ciphertext" {
+		t.Fatalf("unexpected direct message: %q", joiner.queue[0].data)
+	}
+	other.queueMu.Lock()
+	defer other.queueMu.Unlock()
+	if len(other.queue) != 0 {
+		t.Fatal("direct message reached another joiner")
+	}
+}
+
+func TestJoinerUpdateNeedingApprovalReachesOnlyHost(t *testing.T) {
+	session := testSession(false)
+	session.config.ApproveJoinerEdits = true
+	host := newRelayPeer(&mockPeer{}, roleHost)
+	joiner := newRelayPeer(&mockPeer{}, roleJoiner)
+	other := newRelayPeer(&mockPeer{}, roleJoiner)
+	if !session.register(host) || !session.register(joiner) || !session.register(other) {
+		t.Fatal("failed to register test peers")
+	}
+	if !session.completeSync(host, joiner.id) || !session.completeSync(host, other.id) {
+		t.Fatal("failed to complete joiner sync")
+	}
+	clearQueue(host)
+	clearQueue(joiner)
+	clearQueue(other)
+
+	if !session.acceptNormal(joiner, "ciphertext") {
+		t.Fatal("joiner proposal was rejected")
+	}
+	if session.sequence != 0 {
+		t.Fatalf("proposal entered the ordered stream at sequence %d", session.sequence)
+	}
+	host.queueMu.Lock()
+	queue := append([]outboundMessage(nil), host.queue...)
+	host.queueMu.Unlock()
+	if len(queue) != 1 {
+		t.Fatalf("host queue has %d messages, want 1", len(queue))
+	}
+	peerID, payload, ok := protocol.ParseFromEncrypted(queue[0].data)
+	if !ok || peerID != joiner.id || payload != "ciphertext" {
+		t.Fatalf("unexpected proposal: %q", queue[0].data)
+	}
+	for _, peer := range []*relayPeer{joiner, other} {
+		peer.queueMu.Lock()
+		queued := len(peer.queue)
+		peer.queueMu.Unlock()
+		if queued != 0 {
+			t.Fatalf("proposal reached joiner %s", peer.id)
+		}
+	}
+
+	if !session.acceptNormal(host, "approved") || session.sequence != 1 {
+		t.Fatal("host update was not ordered")
+	}
+}
+
+func TestHostReconnectReplaysMissedUpdates(t *testing.T) {
+	session := testSession(false)
+	session.config.HostGracePeriod = time.Minute
+	host := newRelayPeer(&mockPeer{}, roleHost)
+	joiner := newRelayPeer(&mockPeer{}, roleJoiner)
+	if !session.register(host) || !session.register(joiner) || !session.completeSync(host, joiner.id) {
+		t.Fatal("failed to register test peers")
+	}
+	if !session.acceptNormal(host, "before") {
+		t.Fatal("host update was rejected")
+	}
+	session.unregister(host)
+
+	session.mu.Lock()
+	_, joinerKept := session.peers[joiner]
+	session.mu.Unlock()
+	if !joinerKept {
+		t.Fatal("joiner was disconnected while the host could still return")
+	}
+	if !session.acceptNormal(joiner, "during") {
+		t.Fatal("joiner update was rejected while the host was away")
+	}
+
+	returning := newRelayPeer(&mockPeer{}, roleHost)
+	returning.resume = 1
+	if !session.register(returning) {
+		t.Fatal("host could not resume")
+	}
+	if returning.id != host.id {
+		t.Fatalf("resumed host got id %q, want %q", returning.id, host.id)
+	}
+	returning.queueMu.Lock()
+	var replayed []string
+	for _, message := range returning.queue {
+		if sequence, _, payload, ok := protocol.ParseOrderedEncrypted(message.data); ok {
+			replayed = append(replayed, fmt.Sprintf("%d:%s", sequence, payload))
+		}
+	}
+	returning.queueMu.Unlock()
+	if len(replayed) != 1 || replayed[0] != "2:during" {
+		t.Fatalf("replayed %v, want the update after sequence 1", replayed)
+	}
+
+	stale := newRelayPeer(&mockPeer{}, roleHost)
+	session.unregister(returning)
+	stale.resume = 0
+	session.mu.Lock()
+	session.backlog = session.backlog[1:]
+	session.mu.Unlock()
+	if session.register(stale) {
+		t.Fatal("host resumed from a sequence the backlog no longer holds")
+	}
+}
+
+func TestProposalDuringGraceReachesReturningHost(t *testing.T) {
+	session := testSession(false)
+	session.config.HostGracePeriod = time.Minute
+	session.config.ApproveJoinerEdits = true
+	host := newRelayPeer(&mockPeer{}, roleHost)
+	joiner := newRelayPeer(&mockPeer{}, roleJoiner)
+	if !session.register(host) || !session.register(joiner) || !session.completeSync(host, joiner.id) {
+		t.Fatal("failed to register test peers")
+	}
+	session.unregister(host)
+
+	if !session.acceptNormal(joiner, "proposal") || !session.acceptHostDirected(joiner, "request") {
+		t.Fatal("joiner message was rejected while the host was away")
+	}
+	if session.sequence != 0 {
+		t.Fatalf("proposal entered the ordered stream at sequence %d", session.sequence)
+	}
+
+	returning := newRelayPeer(&mockPeer{}, roleHost)
+	if !session.register(returning) {
+		t.Fatal("host could not resume")
+	}
+	var delivered []string
+	for _, data := range queuedData(returning) {
+		if peerID, payload, ok := protocol.ParseFromEncrypted([]byte(data)); ok && peerID == joiner.id {
+			delivered = append(delivered, payload)
+		}
+	}
+	if strings.Join(delivered, ",") != "proposal,request" {
+		t.Fatalf("returning host got %v, want the held proposal and request", delivered)
+	}
+	session.mu.Lock()
+	held := len(session.heldForHost)
+	session.mu.Unlock()
+	if held != 0 {
+		t.Fatalf("%d messages still held after the host returned", held)
+	}
+}
+
+func TestStandbyJoinerIsPromotedAfterGrace(t *testing.T) {
+	session := testSession(false)
+	session.config.HostGracePeriod = time.Minute
+	session.config.AllowStandby = true
+	host := newRelayPeer(&mockPeer{}, roleHost)
+	first := newRelayPeer(&mockPeer{}, roleJoiner)
+	standby := newRelayPeer(&mockPeer{}, roleJoiner)
+	standby.standby = true
+	if !session.register(host) || !session.register(first) || !session.register(standby) {
+		t.Fatal("failed to register test peers")
+	}
+	if !session.completeSync(host, first.id) || !session.completeSync(host, standby.id) {
+		t.Fatal("failed to complete joiner sync")
+	}
+	session.unregister(host)
+	clearQueue(first)
+	clearQueue(standby)
+
+	session.mu.Lock()
+	round := session.graceRound
+	session.mu.Unlock()
+	session.endGrace(round)
+
+	session.mu.Lock()
+	promoted := session.host == standby && standby.role == roleHost
+	session.mu.Unlock()
+	if !promoted {
+		t.Fatal("standby joiner was not promoted")
+	}
+	standby.queueMu.Lock()
+	gotPromoted := len(standby.queue) == 2 && string(standby.queue[0].data) == string(protocol.EncodeControlPromoted())
+	standby.queueMu.Unlock()
+	if !gotPromoted {
+		t.Fatal("standby joiner was not told it is the host")
+	}
+	first.queueMu.Lock()
+	gotHostBack := len(first.queue) == 2 && string(first.queue[0].data) == string(protocol.EncodeControlHostPresent(true))
+	gotNewHost := len(first.queue) == 2 && string(first.queue[1].data) == string(protocol.EncodeControlPeerJoined(standby.id, true))
+	first.queueMu.Unlock()
+	if !gotHostBack {
+		t.Fatal("other joiners were not told a host is present")
+	}
+	if !gotNewHost {
+		t.Fatal("other joiners were not told which peer is now the host")
+	}
+	if session.register(newRelayPeer(&mockPeer{}, roleHost)) {
+		t.Fatal("old host token took over from the promoted host")
+	}
+}
+
+func TestStandbyNeedsHostOptIn(t *testing.T) {
+	for _, config := range []SessionConfig{
+		{},
+		{AllowStandby: true, ReadOnlyJoiners: true},
+		{AllowStandby: true, ApproveJoinerEdits: true},
+	} {
+		config.HostToken, config.JoinToken = "host-token", "join-token"
+		relay := NewRelay(config)
+		request := httptest.NewRequest("GET", "http://example.test/ws", nil)
+		request.Header.Set("Authorization", "Bearer join-token")
+		request.Header.Set("Sec-WebSocket-Protocol", protocol.WebSocketSubprotocol)
+		request.Header.Set(protocol.StandbyHeader, "1")
+		response := httptest.NewRecorder()
+		relay.ServeHTTP(response, request)
+		if response.Code != http.StatusForbidden {
+			t.Fatalf("standby joiner status with %+v = %d, want 403", config, response.Code)
+		}
+	}
+
+	session := testSession(false)
+	session.config.HostGracePeriod = time.Minute
+	host := newRelayPeer(&mockPeer{}, roleHost)
+	standby := newRelayPeer(&mockPeer{}, roleJoiner)
+	standby.standby = true
+	if !session.register(host) || !session.register(standby) || !session.completeSync(host, standby.id) {
+		t.Fatal("failed to register test peers")
+	}
+	session.unregister(host)
+	session.mu.Lock()
+	round := session.graceRound
+	session.mu.Unlock()
+	session.endGrace(round)
+	select {
+	case <-standby.done:
+	default:
+		t.Fatal("standby joiner was promoted without the host allowing it")
+	}
+}
+
+func TestSessionEndsWhenGraceExpiresWithoutStandby(t *testing.T) {
+	session := testSession(false)
+	session.config.HostGracePeriod = time.Minute
+	host := newRelayPeer(&mockPeer{}, roleHost)
+	joiner := newRelayPeer(&mockPeer{}, roleJoiner)
+	if !session.register(host) || !session.register(joiner) || !session.completeSync(host, joiner.id) {
+		t.Fatal("failed to register test peers")
+	}
+	session.unregister(host)
+	session.mu.Lock()
+	round := session.graceRound
+	session.mu.Unlock()
+	session.endGrace(round)
+
+	select {
+	case <-joiner.done:
+	default:
+		t.Fatal("joiner was kept after the grace period ended")
+	}
+}
+
+func queuedData(peer *relayPeer) []string {
+	peer.queueMu.Lock()
+	defer peer.queueMu.Unlock()
+	data := make([]string, 0, len(peer.queue))
+	for _, message := range peer.queue {
+		data = append(data, string(message.data))
+	}
+	return data
+}
+
+func TestRelayAnnouncesPeerJoinsAndLeaves(t *testing.T) {
+	session := testSession(false)
+	host := newRelayPeer(&mockPeer{}, roleHost)
+	joiner := newRelayPeer(&mockPeer{}, roleJoiner)
+	if !session.register(host) {
+		t.Fatal("failed to register host")
+	}
+	clearQueue(host)
+	if !session.register(joiner) {
+		t.Fatal("failed to register joiner")
+	}
+
+	if !contains(queuedData(joiner), string(protocol.EncodeControlPeerJoined(host.id, true))) {
+		t.Fatal("new joiner was not told about the host")
+	}
+	if !contains(queuedData(host), string(protocol.EncodeControlPeerJoined(joiner.id, false))) {
+		t.Fatal("host was not told about the new joiner")
+	}
+
+	clearQueue(host)
+	session.unregister(joiner)
+	if !contains(queuedData(host), string(protocol.EncodeControlPeerLeft(joiner.id))) {
+		t.Fatal("host was not told the joiner left")
+	}
+}
+
+func TestBroadcastReachesSyncingPeers(t *testing.T) {
+	session := testSession(true)
+	host := newRelayPeer(&mockPeer{}, roleHost)
+	joiner := newRelayPeer(&mockPeer{}, roleJoiner)
+	if !session.register(host) || !session.register(joiner) {
+		t.Fatal("failed to register test peers")
+	}
+	clearQueue(host)
+	clearQueue(joiner)
+
+	if !handleClientMessage(session, joiner, protocol.EncodeBroadcastEncrypted("profile")) {
+		t.Fatal("read-only syncing joiner could not broadcast its profile")
+	}
+	if !handleClientMessage(session, host, protocol.EncodeBroadcastEncrypted("hello")) {
+		t.Fatal("host could not broadcast")
+	}
+	if got := queuedData(host); len(got) != 1 || got[0] != string(protocol.EncodePeerEncrypted(joiner.id, "profile")) {
+		t.Fatalf("host received %q, want the joiner's profile", got)
+	}
+	if got := queuedData(joiner); len(got) != 1 || got[0] != string(protocol.EncodePeerEncrypted(host.id, "hello")) {
+		t.Fatalf("syncing joiner received %q, want the host's broadcast", got)
+	}
+}
+
+func TestSessionLimitsAreValidatedAndReported(t *testing.T) {
+	for _, config := range []SessionConfig{
+		{MaxPeers: 1},
+		{MaxPeers: 3, MaxSyncingPeers: 3},
+		{MaxMessageBytes: 64 * 1024 * 1024},
+		{MaxQueuedBytes: 1024 * 1024},
+		{SyncTimeout: time.Second},
+		{MaxQueuedMessages: -1},
+	} {
+		if err := config.Validate(); err == nil {
+			t.Fatalf("accepted invalid limits %+v", config)
+		}
+	}
+	config := SessionConfig{HostToken: "host-token", JoinToken: "join-token", MaxPeers: 3, SyncTimeout: 10 * time.Minute}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	session := NewRelay(config).session
+	host := newRelayPeer(&mockPeer{}, roleHost)
+	if !session.register(host) {
+		t.Fatal("failed to register host")
+	}
+	var limits protocol.Limits
+	reported := false
+	for _, data := range queuedData(host) {
+		if payload, ok := strings.CutPrefix(data, protocol.ControlChannel+"|"); ok {
+			limits, reported = protocol.ParseLimitsControl(payload)
+			if reported {
+				break
+			}
+		}
+	}
+	if !reported || limits.MaxPeers != 3 || limits.MaxSyncingPeers != maxSyncingPeers || limits.SyncTimeout != 10*time.Minute || limits.MaxMessageBytes != maxRelayMessageBytes {
+		t.Fatalf("reported limits = %+v, %v", limits, reported)
+	}
+
+	for i := 0; i < 2; i++ {
+		joiner := newRelayPeer(&mockPeer{}, roleJoiner)
+		if !session.register(joiner) || !session.completeSync(host, joiner.id) {
+			t.Fatalf("failed to register joiner %d", i+1)
+		}
+	}
+	if session.register(newRelayPeer(&mockPeer{}, roleJoiner)) {
+		t.Fatal("registered a peer over the session's limit")
+	}
+}
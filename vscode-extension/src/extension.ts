@@ -3,6 +3,7 @@ import * as vscode from "vscode";
 import { ShadowProcess } from "./shadowProcess";
 import { StatusBar } from "./statusBar";
 import { SessionWebviewProvider } from "./sessionWebview";
+import { Presence } from "./presence";
 import { ensureBinary, detectBinary, promptInstall } from "./installer";
 import { SessionState } from "./types";
 
@@ -10,12 +11,14 @@ let shadowProcess: ShadowProcess;
 let statusBar: StatusBar;
 let sessionWebview: SessionWebviewProvider;
 let outputChannel: vscode.OutputChannel;
+let presence: Presence;
 
 export function activate(context: vscode.ExtensionContext): void {
   outputChannel = vscode.window.createOutputChannel("Shadow");
   shadowProcess = new ShadowProcess(outputChannel);
   statusBar = new StatusBar();
   sessionWebview = new SessionWebviewProvider();
+  presence = new Presence(outputChannel);
 
   const webviewDisposable = vscode.window.registerWebviewViewProvider(
     SessionWebviewProvider.viewType,
@@ -31,6 +34,19 @@ export function activate(context: vscode.ExtensionContext): void {
     refreshSessionUI();
   });
 
+  // Share cursors with peers once the CLI's control interface is up.
+  shadowProcess.onEvent((evt) => {
+    presence.handleEvent(evt);
+    if (evt.event === "focus" && evt.rel_path) {
+      offerFocus(evt.message, evt.rel_path, evt.line ?? 0);
+    }
+  });
+  shadowProcess.onStateChange((state) => {
+    if (state === SessionState.Idle || state === SessionState.Error) {
+      presence.disconnect();
+    }
+  });
+
   refreshSessionUI();
 
   // Register commands.
@@ -45,9 +61,11 @@ export function activate(context: vscode.ExtensionContext): void {
     vscode.commands.registerCommand("shadow.retry", cmdRetry),
     vscode.commands.registerCommand("shadow.openOutput", cmdOpenOutput),
     vscode.commands.registerCommand("shadow.quickAction", cmdQuickAction),
+    vscode.commands.registerCommand("shadow.focusPeers", cmdFocusPeers),
     webviewDisposable,
     outputChannel,
     statusBar,
+    presence,
     { dispose: () => shadowProcess.dispose() },
   );
 }
@@ -239,6 +257,12 @@ async function cmdRetry(): Promise<void> {
   shadowProcess.join(binary, session.joinUrl, workspacePath);
 }
 
+function cmdFocusPeers(): void {
+  if (!presence.focusHere()) {
+    vscode.window.showInformationMessage("Open a shared file during an active Shadow session first.");
+  }
+}
+
 function cmdOpenOutput(): void {
   outputChannel.show(true);
 }
@@ -365,6 +389,17 @@ function refreshSessionUI(): void {
   void vscode.commands.executeCommand("setContext", "shadow.isHostSession", session?.mode === "host");
 }
 
+function offerFocus(message: string, relPath: string, line: number): void {
+  const workspacePath = shadowProcess.session?.workspacePath;
+  if (!workspacePath) return;
+  void vscode.window.showInformationMessage(`Shadow: ${message}`, "Go there").then(async (choice) => {
+    if (choice !== "Go there") return;
+    const uri = vscode.Uri.joinPath(vscode.Uri.file(workspacePath), relPath);
+    const position = new vscode.Position(line, 0);
+    await vscode.window.showTextDocument(uri, { selection: new vscode.Range(position, position) });
+  });
+}
+
 function showInviteMessage(message: string): void {
   void vscode.window.showInformationMessage(
     message,
@@ -0,0 +1,208 @@
+import * as net from "net";
+import * as vscode from "vscode";
+import { ShadowEvent } from "./types";
+
+/** A message exchanged with the shadow control interface. */
+interface ControlMessage {
+  type: string;
+  peer_id?: string;
+  peer_name?: string;
+  file?: string;
+  line?: number;
+  column?: number;
+  selection?: { start: { line: number; column: number }; end: { line: number; column: number } };
+  error?: string;
+}
+
+/**
+ * Shares the local cursor with session peers and draws theirs, through the
+ * loopback control interface the shadow process announces with `control_ready`.
+ */
+export class Presence implements vscode.Disposable {
+  private socket: net.Socket | null = null;
+  private lineBuf = "";
+  private readonly cursors = new Map<string, ControlMessage>();
+  private readonly decorations = new Map<string, vscode.TextEditorDecorationType>();
+  private readonly subscriptions: vscode.Disposable[] = [];
+  private sendTimer: NodeJS.Timeout | undefined;
+
+  constructor(private readonly outputChannel: vscode.OutputChannel) {
+    this.subscriptions.push(
+      vscode.window.onDidChangeTextEditorSelection(() => this.scheduleSend()),
+      vscode.window.onDidChangeActiveTextEditor(() => this.scheduleSend()),
+      vscode.window.onDidChangeVisibleTextEditors(() => this.renderAll()),
+    );
+  }
+
+  /** Handle an event from the shadow process. */
+  handleEvent(evt: ShadowEvent): void {
+    if (evt.event === "control_ready" && evt.control_port && evt.control_token) {
+      this.connect(evt.control_port, evt.control_token);
+    } else if (evt.event === "stopped" || evt.event === "error") {
+      this.disconnect();
+    }
+  }
+
+  /** Ask peers to look at the active editor's cursor line. Returns false when not connected. */
+  focusHere(): boolean {
+    const editor = vscode.window.activeTextEditor;
+    if (!this.socket || !editor || editor.document.uri.scheme !== "file") return false;
+    const message: ControlMessage = {
+      type: "focus",
+      file: editor.document.uri.fsPath,
+      line: editor.selection.active.line,
+    };
+    this.socket.write(JSON.stringify(message) + "\n");
+    return true;
+  }
+
+  /** Drop the connection and every remote cursor. */
+  disconnect(): void {
+    if (this.sendTimer) {
+      clearTimeout(this.sendTimer);
+      this.sendTimer = undefined;
+    }
+    this.socket?.destroy();
+    this.socket = null;
+    this.lineBuf = "";
+    this.cursors.clear();
+    for (const decoration of this.decorations.values()) decoration.dispose();
+    this.decorations.clear();
+  }
+
+  dispose(): void {
+    this.disconnect();
+    for (const subscription of this.subscriptions) subscription.dispose();
+  }
+
+  private connect(port: number, token: string): void {
+    this.disconnect();
+    const socket = net.createConnection({ host: "127.0.0.1", port }, () => {
+      socket.write(JSON.stringify({ type: "hello", token }) + "\n");
+      this.sendCursor();
+    });
+    this.socket = socket;
+    socket.setEncoding("utf8");
+    socket.on("data", (chunk: string) => {
+      if (this.socket !== socket) return;
+      this.lineBuf += chunk;
+      const lines = this.lineBuf.split("\n");
+      this.lineBuf = lines.pop() ?? "";
+      for (const line of lines) {
+        if (line.trim()) this.onLine(line);
+      }
+    });
+    socket.on("error", (err) => {
+      this.outputChannel.appendLine(`[presence] ${err.message}`);
+    });
+    socket.on("close", () => {
+      if (this.socket === socket) this.disconnect();
+    });
+  }
+
+  private onLine(line: string): void {
+    let message: ControlMessage;
+    try {
+      message = JSON.parse(line) as ControlMessage;
+    } catch {
+      return;
+    }
+    if (message.type === "error") {
+      this.outputChannel.appendLine(`[presence] ${message.error}`);
+      return;
+    }
+    if (message.type !== "cursor" || !message.peer_id) return;
+    if (message.file) {
+      this.cursors.set(message.peer_id, message);
+    } else {
+      this.cursors.delete(message.peer_id);
+    }
+    this.render(message.peer_id);
+  }
+
+  private scheduleSend(): void {
+    if (!this.socket || this.sendTimer) return;
+    this.sendTimer = setTimeout(() => {
+      this.sendTimer = undefined;
+      this.sendCursor();
+    }, 50);
+  }
+
+  private sendCursor(): void {
+    if (!this.socket) return;
+    const editor = vscode.window.activeTextEditor;
+    const message: ControlMessage = { type: "cursor" };
+    // Non-file editors are reported as "no file" so peers stop showing this cursor.
+    if (editor && editor.document.uri.scheme === "file") {
+      const { active, start, end, isEmpty } = editor.selection;
+      message.file = editor.document.uri.fsPath;
+      message.line = active.line;
+      message.column = active.character;
+      if (!isEmpty) {
+        message.selection = {
+          start: { line: start.line, column: start.character },
+          end: { line: end.line, column: end.character },
+        };
+      }
+    }
+    this.socket.write(JSON.stringify(message) + "\n");
+  }
+
+  private renderAll(): void {
+    for (const peerId of this.decorations.keys()) this.render(peerId);
+  }
+
+  private render(peerId: string): void {
+    const cursor = this.cursors.get(peerId);
+    let decoration = this.decorations.get(peerId);
+    if (!cursor) {
+      decoration?.dispose();
+      this.decorations.delete(peerId);
+      return;
+    }
+    if (!decoration) {
+      decoration = vscode.window.createTextEditorDecorationType({
+        backgroundColor: new vscode.ThemeColor("editor.selectionHighlightBackground"),
+        rangeBehavior: vscode.DecorationRangeBehavior.ClosedClosed,
+      });
+      this.decorations.set(peerId, decoration);
+    }
+    const position = new vscode.Position(cursor.line ?? 0, cursor.column ?? 0);
+    const label = cursor.peer_name || `peer ${peerId}`;
+    for (const editor of vscode.window.visibleTextEditors) {
+      if (editor.document.uri.fsPath !== cursor.file) {
+        editor.setDecorations(decoration, []);
+        continue;
+      }
+      const options: vscode.DecorationOptions[] = [];
+      if (cursor.selection) {
+        options.push({
+          range: new vscode.Range(
+            cursor.selection.start.line,
+            cursor.selection.start.column,
+            cursor.selection.end.line,
+            cursor.selection.end.column,
+          ),
+        });
+      }
+      options.push({
+        range: new vscode.Range(position, position),
+        hoverMessage: label,
+        renderOptions: {
+          before: {
+            contentText: "",
+            border: "1px solid",
+            borderColor: new vscode.ThemeColor("editorCursor.foreground"),
+            margin: "0 -1px 0 0",
+          },
+          after: {
+            contentText: ` ${label}`,
+            color: new vscode.ThemeColor("editorCodeLens.foreground"),
+            fontStyle: "italic",
+          },
+        },
+      });
+      editor.setDecorations(decoration, options);
+    }
+  }
+}
@@ -112,7 +112,7 @@ export class ShadowProcess {
 
     const proc = cp.spawn(binaryPath, args, {
       cwd,
-      env: { ...process.env, NO_COLOR: "1" },
+      env: { ...process.env, NO_COLOR: "1", SHADOW_EDITOR: "vscode" },
       stdio: ["ignore", "pipe", "pipe"],
     });
     this.proc = proc;
@@ -197,6 +197,22 @@ export class ShadowProcess {
         }
         break;
 
+      case "bootstrap_progress":
+        if (this._session) {
+          this._session.bootstrap = evt.done
+            ? undefined
+            : { filesDone: evt.files_done ?? 0, filesTotal: evt.files_total ?? 0, etaSeconds: evt.eta_seconds };
+          this._onSessionUpdate.fire(this._session);
+        }
+        break;
+
+      case "roster":
+        if (this._session) {
+          this._session.peers = evt.peers ?? [];
+          this._onSessionUpdate.fire(this._session);
+        }
+        break;
+
       case "read_only":
         if (this._session) {
           this._session.readOnly = true;
@@ -213,9 +229,21 @@ export class ShadowProcess {
         break;
 
       case "warning":
+      case "policy_violation":
+      case "host_away":
         vscode.window.showWarningMessage(`Shadow: ${evt.message}`);
         break;
 
+      case "chat":
+        if (!evt.self) {
+          vscode.window.showInformationMessage(`${evt.peer_name || `peer ${evt.peer_id}`}: ${evt.message}`);
+        }
+        break;
+
+      case "promoted":
+        vscode.window.showInformationMessage(`Shadow: ${evt.message}`);
+        break;
+
       case "stopped":
         this.sawStoppedEvent = true;
         if (this._state !== SessionState.Stopping) {
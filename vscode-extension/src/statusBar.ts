@@ -1,6 +1,16 @@
 import * as vscode from "vscode";
 import { SessionState } from "./types";
-import { SessionInfo } from "./types";
+import { SessionInfo, ShadowPeer } from "./types";
+
+function rosterLines(peers: ShadowPeer[]): string {
+  return peers
+    .map((peer) => {
+      const details = [peer.host ? "host" : "", peer.editor ?? ""].filter(Boolean).join(", ");
+      const name = peer.name || `peer ${peer.id}`;
+      return details ? `${name} (${details})` : name;
+    })
+    .join("\n");
+}
 
 export class StatusBar {
   private item: vscode.StatusBarItem;
@@ -34,8 +44,14 @@ export class StatusBar {
         this.item.backgroundColor = undefined;
         break;
       case SessionState.RunningJoiner:
-        this.item.text = "◗ Shadow: Joined";
-        this.item.tooltip = "Connected to a Shadow session";
+        if (session?.bootstrap) {
+          const { filesDone, filesTotal, etaSeconds } = session.bootstrap;
+          this.item.text = `$(sync~spin) Shadow: Syncing ${filesDone}/${filesTotal}`;
+          this.item.tooltip = etaSeconds ? `Downloading files, about ${etaSeconds}s left` : "Downloading files";
+        } else {
+          this.item.text = "◗ Shadow: Joined";
+          this.item.tooltip = "Connected to a Shadow session";
+        }
         this.item.backgroundColor = undefined;
         break;
       case SessionState.Stopping:
@@ -49,6 +65,9 @@ export class StatusBar {
         this.item.backgroundColor = new vscode.ThemeColor("statusBarItem.errorBackground");
         break;
     }
+    if ((state === SessionState.RunningHost || state === SessionState.RunningJoiner) && session?.peers?.length) {
+      this.item.tooltip += `\n\n${rosterLines(session.peers)}`;
+    }
   }
 
   dispose(): void {
@@ -16,9 +16,33 @@ export interface ShadowEvent {
   join_command?: string;
   file_count?: number;
   rel_path?: string;
+  /** Zero-based line of a focus event. */
+  line?: number;
+  files_done?: number;
+  files_total?: number;
+  bytes_done?: number;
+  bytes_total?: number;
+  eta_seconds?: number;
+  done?: boolean;
+  peer_id?: string;
+  peer_name?: string;
+  peers?: ShadowPeer[];
+  /** Set on chat events this process sent. */
+  self?: boolean;
+  control_port?: number;
+  control_token?: string;
   timestamp: string;
 }
 
+/** Another participant, as listed in a `roster` event. */
+export interface ShadowPeer {
+  id: string;
+  name?: string;
+  editor?: string;
+  version?: string;
+  host?: boolean;
+}
+
 /** Info tracked for the active session. */
 export interface SessionInfo {
   mode: "host" | "joiner";
@@ -29,4 +53,8 @@ export interface SessionInfo {
   readOnly?: boolean;
   hostReadOnly?: boolean;
   lastError?: string;
+  /** Initial sync progress for joiners; cleared once the download completes. */
+  bootstrap?: { filesDone: number; filesTotal: number; etaSeconds?: number };
+  /** Other connected peers, in join order. */
+  peers?: ShadowPeer[];
 }